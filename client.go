@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/goburrow/quic/transport"
@@ -22,6 +23,12 @@ func NewClient(config *transport.Config) *Client {
 	return c
 }
 
+// SetTokenStore sets storage for tokens received from servers in NEW_TOKEN frames.
+// The tokens are used in the next connections to the same servers to skip address validation.
+func (s *Client) SetTokenStore(v TokenStore) {
+	s.tokenStore = v
+}
+
 // ListenAndServe starts listening on UDP network address addr and
 // serves incoming packets. Unlike Server.ListenAndServe, this function
 // does not block as Serve is invoked in a goroutine.
@@ -40,12 +47,18 @@ func (s *Client) Serve() error {
 		return errors.New("no listening connection")
 	}
 	s.logger.log(levelInfo, "connection_started addr=%v", s.socket.LocalAddr())
+	return s.serveSocket(s.socket)
+}
+
+func (s *Client) serveSocket(socket net.PacketConn) error {
+	setSocketOptions(socket)
 	for {
 		p := newPacket()
-		n, addr, err := s.socket.ReadFrom(p.buf[:])
+		n, addr, err := readPacket(socket, p)
 		if n > 0 {
 			p.data = p.buf[:n]
 			p.addr = addr
+			p.local = socket.LocalAddr()
 			s.logger.log(levelTrace, "datagrams_received addr=%s byte_length=%d raw=%x", addr, n, p.data)
 			s.recv(p)
 		} else {
@@ -110,9 +123,66 @@ func (s *Client) Connect(addr string) error {
 	return nil
 }
 
+// Migrate starts moving the connection to the new socket.
+// The connection keeps using its current socket until the new path is validated
+// with a new connection ID. Handler receives transport.EventPathMigrated when
+// migration has succeeded or transport.EventPathFailed when it has failed.
+// Migrate must be called in Handler.Serve. The socket is closed when it is no longer
+// used by the connection or the client is closed, so it must not be shared.
+func (s *Client) Migrate(conn Conn, socket net.PacketConn) error {
+	c, ok := conn.(*remoteConn)
+	if !ok {
+		return errors.New("invalid connection")
+	}
+	if c.probeSocket != nil {
+		return errors.New("connection is migrating")
+	}
+	path := transport.Path{
+		Local: socket.LocalAddr(),
+		Peer:  c.addr,
+	}
+	if err := c.conn.ProbePath(path); err != nil {
+		return err
+	}
+	if err := s.serveMigrationSocket(socket); err != nil {
+		return err
+	}
+	c.probeSocket = socket
+	s.logger.log(levelDebug, "connection_migration_started addr=%s scid=%x local_addr=%s", c.addr, c.scid, path.Local)
+	return nil
+}
+
+// serveMigrationSocket serves the socket in a goroutine which Close waits for.
+func (s *Client) serveMigrationSocket(socket net.PacketConn) error {
+	s.socketsMu.Lock()
+	if s.socketsClosed {
+		s.socketsMu.Unlock()
+		return errors.New("client is closed")
+	}
+	if s.sockets == nil {
+		s.sockets = make(map[net.PacketConn]struct{})
+	}
+	s.sockets[socket] = struct{}{}
+	s.socketsWg.Add(1)
+	s.socketsMu.Unlock()
+	go func() {
+		defer s.socketsWg.Done()
+		err := s.serveSocket(socket)
+		s.socketsMu.Lock()
+		_, ok := s.sockets[socket]
+		s.socketsMu.Unlock()
+		if ok {
+			// The socket was not closed by the client. It is still closed when no longer used.
+			s.logger.log(levelError, "receive_failed local_addr=%s %v", socket.LocalAddr(), err)
+		}
+	}()
+	return nil
+}
+
 // Close closes all current establised connections and listening socket.
 func (s *Client) Close() error {
 	s.close(10 * time.Second)
+	s.closeSockets()
 	if s.socket != nil {
 		return s.socket.Close()
 	}
@@ -132,7 +202,77 @@ func (s *Client) newConn(addr string) (*remoteConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	c := newRemoteConn(udpAddr, scid, conn)
+	if s.tokenStore != nil {
+		if token := s.tokenStore.Pop(udpAddr.String()); len(token) > 0 {
+			if err = conn.SetToken(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c := newRemoteConn(s.socket, udpAddr, scid, conn)
 	s.logger.attachLogger(c)
 	return c, nil
 }
+
+// TokenStore keeps address validation tokens received from servers.
+// A token should only be used once so that connections can not be linked.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-address-validation-for-futu
+type TokenStore interface {
+	// Put stores a token received from server at addr.
+	Put(addr string, token []byte)
+	// Pop removes and returns a token for server at addr, or nil if there is none.
+	Pop(addr string) []byte
+}
+
+// NewTokenStore returns a simple in-memory TokenStore keeping the latest token
+// of up to capacity servers.
+func NewTokenStore(capacity int) TokenStore {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenStore{
+		capacity: capacity,
+		tokens:   make(map[string][]byte, capacity),
+	}
+}
+
+// tokenStore implements TokenStore.
+type tokenStore struct {
+	mu       sync.Mutex
+	capacity int
+	tokens   map[string][]byte
+	addrs    []string // Servers in the order their tokens were received
+}
+
+func (s *tokenStore) Put(addr string, token []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[addr]; ok {
+		s.remove(addr)
+	} else if len(s.addrs) >= s.capacity {
+		delete(s.tokens, s.addrs[0])
+		s.addrs = s.addrs[1:]
+	}
+	s.tokens[addr] = token
+	s.addrs = append(s.addrs, addr)
+}
+
+func (s *tokenStore) Pop(addr string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[addr]
+	if ok {
+		delete(s.tokens, addr)
+		s.remove(addr)
+	}
+	return token
+}
+
+func (s *tokenStore) remove(addr string) {
+	for i := range s.addrs {
+		if s.addrs[i] == addr {
+			s.addrs = append(s.addrs[:i], s.addrs[i+1:]...)
+			return
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -18,6 +19,10 @@ func clientCommand(args []string) error {
 	insecure := cmd.Bool("insecure", false, "skip verifying server certificate")
 	data := cmd.String("data", "GET /\r\n", "sending data")
 	logLevel := cmd.Int("v", 2, "log verbose: 0=off 1=error 2=info 3=debug 4=trace")
+	resume := cmd.Bool("resume", false, "resume session in a second connection")
+	cc := cmd.String("cc", "reno", "congestion control: reno, cubic, bbr")
+	version := cmd.String("version", "1", "QUIC version: 1, 2, 29 (draft-29)")
+	grease := cmd.Bool("grease", false, "send reserved transport parameters and versions, grease the QUIC bit")
 	cmd.Parse(args)
 
 	addr := cmd.Arg(0)
@@ -27,12 +32,25 @@ func clientCommand(args []string) error {
 		return nil
 	}
 	config := newConfig()
+	if err := setCongestionControl(config, *cc); err != nil {
+		return err
+	}
+	if err := setVersion(config, *version); err != nil {
+		return err
+	}
+	setGrease(config, *grease)
 	config.TLS.ServerName = serverName(addr)
 	config.TLS.InsecureSkipVerify = *insecure
-	handler := clientHandler{data: *data}
+	if *resume {
+		config.TLS.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	handler := clientHandler{data: *data, resume: *resume}
 	client := quic.NewClient(config)
 	client.SetHandler(&handler)
 	client.SetLogger(*logLevel, os.Stdout)
+	if *resume {
+		client.SetTokenStore(quic.NewTokenStore(1))
+	}
 	if err := client.ListenAndServe(*listenAddr); err != nil {
 		return err
 	}
@@ -41,12 +59,20 @@ func clientCommand(args []string) error {
 		return err
 	}
 	handler.wg.Wait()
+	if *resume {
+		handler.wg.Add(1)
+		if err := client.Connect(addr); err != nil {
+			return err
+		}
+		handler.wg.Wait()
+	}
 	return client.Close()
 }
 
 type clientHandler struct {
-	wg   sync.WaitGroup
-	data string
+	wg     sync.WaitGroup
+	data   string
+	resume bool
 }
 
 func (s *clientHandler) Serve(c quic.Conn, events []transport.Event) {
@@ -54,6 +80,8 @@ func (s *clientHandler) Serve(c quic.Conn, events []transport.Event) {
 		log.Printf("%s connection event: %v", c.RemoteAddr(), e.Type)
 		switch e.Type {
 		case quic.EventConnAccept:
+			state := c.ConnectionState()
+			log.Printf("%s connection resumed=%v protocol=%q", c.RemoteAddr(), state.DidResume, state.NegotiatedProtocol)
 			st := c.Stream(4)
 			_, _ = st.Write([]byte(s.data))
 			_ = st.Close()
@@ -64,6 +92,10 @@ func (s *clientHandler) Serve(c quic.Conn, events []transport.Event) {
 				n, _ := st.Read(buf)
 				log.Printf("stream %d received:\n%s", e.StreamID, buf[:n])
 			}
+			if s.resume {
+				// Close the connection so session can be resumed in a new one.
+				_ = c.Close()
+			}
 		case quic.EventConnClose:
 			s.wg.Done()
 		}
@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/goburrow/quic"
 	"github.com/goburrow/quic/transport"
 )
 
@@ -38,7 +39,8 @@ func main() {
 
 func newConfig() *transport.Config {
 	c := transport.NewConfig()
-	c.Params.MaxUDPPayloadSize = transport.MaxIPv6PacketSize
+	c.Versions = []uint32{transport.Version1, transport.Version2, transport.VersionDraft29}
+	c.Params.MaxUDPPayloadSize = quic.MaxDatagramSize
 	c.Params.MaxIdleTimeout = 5 * time.Second
 	c.Params.InitialMaxData = 100000
 	c.Params.InitialMaxStreamDataBidiLocal = 100000
@@ -48,7 +50,8 @@ func newConfig() *transport.Config {
 	c.Params.InitialMaxStreamsUni = 10
 	c.TLS = &tls.Config{
 		NextProtos: []string{
-			fmt.Sprintf("hq-%d", transport.ProtocolVersion&0xff),
+			"hq-interop",
+			fmt.Sprintf("hq-%d", transport.VersionDraft29&0xff),
 			"http/0.9",
 		},
 		KeyLogWriter: newKeyLogWriter(),
@@ -56,6 +59,39 @@ func newConfig() *transport.Config {
 	return c
 }
 
+func setCongestionControl(c *transport.Config, name string) error {
+	switch name {
+	case "reno":
+		c.CongestionController = transport.NewReno
+	case "cubic":
+		c.CongestionController = transport.NewCubic
+	case "bbr":
+		c.CongestionController = transport.NewBBR
+	default:
+		return fmt.Errorf("unsupported congestion control: %s", name)
+	}
+	return nil
+}
+
+func setVersion(c *transport.Config, name string) error {
+	switch name {
+	case "1":
+		c.Version = transport.Version1
+	case "2":
+		c.Version = transport.Version2
+	case "29":
+		c.Version = transport.VersionDraft29
+	default:
+		return fmt.Errorf("unsupported version: %s", name)
+	}
+	return nil
+}
+
+func setGrease(c *transport.Config, enable bool) {
+	c.Grease = enable
+	c.Params.GreaseQUICBit = enable
+}
+
 func newKeyLogWriter() io.Writer {
 	logFile := os.Getenv("SSLKEYLOGFILE")
 	if logFile == "" {
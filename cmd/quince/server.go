@@ -18,9 +18,15 @@ func serverCommand(args []string) error {
 	keyFile := cmd.String("key", "cert.key", "TLS certificate key path")
 	logLevel := cmd.Int("v", 2, "log verbose: 0=off 1=error 2=info 3=debug 4=trace")
 	enableRetry := cmd.Bool("retry", false, "enable address validation using Retry packet")
+	cc := cmd.String("cc", "reno", "congestion control: reno, cubic, bbr")
+	grease := cmd.Bool("grease", false, "send reserved transport parameters and versions, grease the QUIC bit")
 	cmd.Parse(args)
 
 	config := newConfig()
+	setGrease(config, *grease)
+	if err := setCongestionControl(config, *cc); err != nil {
+		return err
+	}
 	if *certFile != "" {
 		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
 		if err != nil {
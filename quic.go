@@ -2,7 +2,9 @@
 package quic
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
@@ -13,11 +15,46 @@ import (
 )
 
 const (
-	maxDatagramSize = transport.MaxIPv6PacketSize
-	bufferSize      = 1536
-	maxTokenLen     = 64 + transport.MaxCIDLength
+	// MaxDatagramSize is the largest datagram which can be received, up to a jumbo frame
+	// without IPv6 and UDP headers. Config.Params.MaxUDPPayloadSize should not exceed it.
+	MaxDatagramSize = 9000 - 48
+
+	bufferSize  = MaxDatagramSize
+	maxTokenLen = 64 + transport.MaxCIDLength
 )
 
+// maxDatagramSize is the largest datagram to be sent, limited by the MTU of local network
+// interfaces. The actual size of a path is discovered by the transport.
+var maxDatagramSize = localMaxDatagramSize()
+
+func localMaxDatagramSize() int {
+	if !dontFragment {
+		// Probes could be fragmented and delivered, so the path MTU can not be discovered.
+		// Limiting datagram size disables the search.
+		return transport.MinInitialPacketSize
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return transport.MaxIPv6PacketSize
+	}
+	mtu := 0
+	for _, ifi := range ifaces {
+		// Loopback MTU is usually much larger than any egress path.
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagLoopback == 0 && ifi.MTU > mtu {
+			mtu = ifi.MTU
+		}
+	}
+	// Assume IPv6 and UDP headers.
+	n := mtu - 48
+	if n < transport.MaxIPv6PacketSize {
+		return transport.MaxIPv6PacketSize
+	}
+	if n > bufferSize {
+		return bufferSize
+	}
+	return n
+}
+
 // Extend transport events
 const (
 	EventConnAccept = "conn_accept"
@@ -31,6 +68,22 @@ type Conn interface {
 	Stream(id uint64) io.ReadWriteCloser
 	// SetStream sets or creates stream for Read and Write.
 	SetStream(id uint64)
+	// SetStreamPriority sets or creates stream and changes its sending priority.
+	// See transport.Stream.SetPriority.
+	SetStreamPriority(id uint64, urgency uint8, incremental bool) error
+	// ResetStream abandons sending data on the stream with the application error code.
+	// See transport.Stream.Reset.
+	ResetStream(id uint64, code uint64) error
+	// StopSending requests peer to stop sending data on the stream with the application error code.
+	// See transport.Stream.StopSending.
+	StopSending(id uint64, code uint64) error
+	// ConnectionState returns details about the TLS connection.
+	ConnectionState() tls.ConnectionState
+	// SendDatagram sends data unreliably in a DATAGRAM frame when peer supports it.
+	SendDatagram(b []byte) error
+	// RecvDatagram returns the next received datagram or nil if there is none.
+	// Handler receives transport.EventDatagram when a datagram arrives.
+	RecvDatagram() []byte
 }
 
 // Handler defines interface to handle QUIC connection states.
@@ -44,9 +97,16 @@ func (s noopHandler) Serve(Conn, []transport.Event) {}
 
 // remoteConn implements Conn.
 type remoteConn struct {
-	scid []byte
-	addr net.Addr
-	conn *transport.Conn
+	scid   []byte
+	addr   net.Addr
+	conn   *transport.Conn
+	socket net.PacketConn
+	// probeSocket is the new socket which the connection is migrating to.
+	probeSocket net.PacketConn
+	// noECN is set when the socket does not accept ECN codepoints.
+	noECN bool
+	// Additional connection IDs issued to peer. Locked by localConn.peersMu.
+	cids [][]byte
 
 	events []transport.Event
 	recvCh chan *packet
@@ -55,11 +115,12 @@ type remoteConn struct {
 	stream *transport.Stream
 }
 
-func newRemoteConn(addr net.Addr, scid []byte, conn *transport.Conn) *remoteConn {
+func newRemoteConn(socket net.PacketConn, addr net.Addr, scid []byte, conn *transport.Conn) *remoteConn {
 	return &remoteConn{
 		addr:   addr,
 		scid:   scid,
 		conn:   conn,
+		socket: socket,
 		recvCh: make(chan *packet, 1),
 	}
 }
@@ -96,8 +157,44 @@ func (s *remoteConn) SetStream(id uint64) {
 	s.stream, _ = s.conn.Stream(id)
 }
 
+func (s *remoteConn) SetStreamPriority(id uint64, urgency uint8, incremental bool) error {
+	st, err := s.conn.Stream(id)
+	if err != nil {
+		return err
+	}
+	return st.SetPriority(urgency, incremental)
+}
+
+func (s *remoteConn) ResetStream(id uint64, code uint64) error {
+	st, err := s.conn.Stream(id)
+	if err != nil {
+		return err
+	}
+	return st.Reset(code)
+}
+
+func (s *remoteConn) StopSending(id uint64, code uint64) error {
+	st, err := s.conn.Stream(id)
+	if err != nil {
+		return err
+	}
+	return st.StopSending(code)
+}
+
+func (s *remoteConn) ConnectionState() tls.ConnectionState {
+	return s.conn.ConnectionState()
+}
+
+func (s *remoteConn) SendDatagram(b []byte) error {
+	return s.conn.SendDatagram(b)
+}
+
+func (s *remoteConn) RecvDatagram() []byte {
+	return s.conn.RecvDatagram()
+}
+
 func (s *remoteConn) LocalAddr() net.Addr {
-	return nil // TODO: get from socket
+	return s.socket.LocalAddr()
 }
 
 func (s *remoteConn) RemoteAddr() net.Addr {
@@ -129,6 +226,13 @@ type localConn struct {
 
 	handler Handler
 	logger  logger
+	// tokenStore keeps tokens from NEW_TOKEN frames. Only used by client.
+	tokenStore TokenStore
+	// sockets are served sockets passed to Client.Migrate. Only used by client.
+	socketsMu     sync.Mutex
+	sockets       map[net.PacketConn]struct{}
+	socketsClosed bool // locked by socketsMu.
+	socketsWg     sync.WaitGroup
 }
 
 func (s *localConn) init(config *transport.Config) {
@@ -169,7 +273,7 @@ func (s *localConn) handleConn(c *remoteConn) {
 		select {
 		case p = <-c.recvCh:
 			// Got packet
-			s.recvConn(c, p.data)
+			s.recvConn(c, p)
 		case <-timer.C:
 			// Read timeout
 			s.logger.log(levelDebug, "read_timed_out addr=%s scid=%x timeout=%s", c.addr, c.scid, timeout)
@@ -198,8 +302,12 @@ func (s *localConn) handleConn(c *remoteConn) {
 	}
 }
 
-func (s *localConn) recvConn(c *remoteConn, data []byte) {
-	n, err := c.conn.Write(data)
+func (s *localConn) recvConn(c *remoteConn, p *packet) {
+	path := transport.Path{
+		Local: p.local,
+		Peer:  p.addr,
+	}
+	n, err := c.conn.WriteFromECN(p.data, path, p.ecn)
 	if err != nil {
 		s.logger.log(levelError, "receive_failed addr=%s scid=%x %v", c.addr, c.scid, err)
 		// Close connection when receive failed
@@ -210,12 +318,12 @@ func (s *localConn) recvConn(c *remoteConn, data []byte) {
 		}
 		return
 	}
-	s.logger.log(levelTrace, "datagrams_processed addr=%s scid=%x byte_length=%d", c.addr, c.scid, n)
+	s.logger.log(levelTrace, "datagrams_processed addr=%s scid=%x byte_length=%d", p.addr, c.scid, n)
 }
 
 func (s *localConn) sendConn(c *remoteConn, buf []byte) error {
 	for {
-		n, err := c.conn.Read(buf)
+		n, path, err := c.conn.ReadTo(buf)
 		if err != nil {
 			s.logger.log(levelError, "send_failed addr=%s scid=%x %v", c.addr, c.scid, err)
 			return err
@@ -224,17 +332,56 @@ func (s *localConn) sendConn(c *remoteConn, buf []byte) error {
 			s.logger.log(levelTrace, "send_done addr=%s scid=%x", c.addr, c.scid)
 			return nil
 		}
-		n, err = s.socket.WriteTo(buf[:n], c.addr)
+		// Path validation may require sending to a different address.
+		socket, addr := c.socket, c.addr
+		if path.Peer != nil {
+			addr = path.Peer
+		}
+		if c.probeSocket != nil && path.Local != nil && path.Local.String() == c.probeSocket.LocalAddr().String() {
+			socket = c.probeSocket
+		}
+		size := n
+		ecn := c.conn.ECN()
+		if c.noECN {
+			ecn = transport.ECNNotECT
+		}
+		n, err = writePacket(socket, buf[:size], addr, ecn)
+		if err != nil && ecn != transport.ECNNotECT && isECNNotSupported(err) {
+			// Stop setting ECN codepoint, the transport will find ECN validation failed.
+			s.logger.log(levelDebug, "ecn_disabled addr=%s scid=%x %v", addr, c.scid, err)
+			c.noECN = true
+			n, err = writePacket(socket, buf[:size], addr, transport.ECNNotECT)
+		}
+		if err != nil && isMessageTooLong(err) {
+			// PMTU probe exceeding local MTU is considered lost.
+			s.logger.log(levelDebug, "datagram_too_long addr=%s scid=%x byte_length=%d", addr, c.scid, size)
+			c.conn.DatagramTooLarge(size)
+			continue
+		}
 		if err != nil {
-			s.logger.log(levelError, "send_failed addr=%s scid=%x %v", c.addr, c.scid, err)
+			s.logger.log(levelError, "send_failed addr=%s scid=%x %v", addr, c.scid, err)
 			return err
 		}
-		s.logger.log(levelTrace, "datagrams_sent addr=%s scid=%x byte_length=%d raw=%x", c.addr, c.scid, n, buf[:n])
+		s.logger.log(levelTrace, "datagrams_sent addr=%s scid=%x byte_length=%d raw=%x", addr, c.scid, n, buf[:n])
 	}
 }
 
 func (s *localConn) serveConn(c *remoteConn) {
 	c.events = c.conn.Events(c.events)
+	for _, e := range c.events {
+		switch e.Type {
+		case transport.EventConnectionIDNew:
+			s.addConnID(c, e.Data)
+		case transport.EventConnectionIDRetire:
+			s.removeConnID(c, e.Data)
+		case transport.EventPathMigrated, transport.EventPathFailed:
+			s.connMigrated(c, e.Type == transport.EventPathMigrated)
+		case transport.EventNewToken:
+			if s.tokenStore != nil {
+				s.tokenStore.Put(c.addr.String(), e.Data)
+			}
+		}
+	}
 	s.handler.Serve(c, c.events)
 	for i := range c.events {
 		c.events[i] = transport.Event{}
@@ -242,12 +389,74 @@ func (s *localConn) serveConn(c *remoteConn) {
 	c.events = c.events[:0]
 }
 
+// addConnID routes packets with the new connection ID to the connection.
+func (s *localConn) addConnID(c *remoteConn, cid []byte) {
+	s.peersMu.Lock()
+	if _, ok := s.peers[string(cid)]; ok {
+		s.peersMu.Unlock()
+		s.logger.log(levelError, "connection_id_conflict addr=%s scid=%x cid=%x", c.addr, c.scid, cid)
+		return
+	}
+	s.peers[string(cid)] = c
+	c.cids = append(c.cids, cid)
+	s.peersMu.Unlock()
+	s.logger.log(levelDebug, "connection_id_issued addr=%s scid=%x cid=%x", c.addr, c.scid, cid)
+}
+
+// removeConnID stops routing packets with the retired connection ID.
+func (s *localConn) removeConnID(c *remoteConn, cid []byte) {
+	s.peersMu.Lock()
+	if s.peers[string(cid)] == c {
+		delete(s.peers, string(cid))
+	}
+	for i := range c.cids {
+		if bytes.Equal(c.cids[i], cid) {
+			c.cids = append(c.cids[:i], c.cids[i+1:]...)
+			break
+		}
+	}
+	s.peersMu.Unlock()
+	s.logger.log(levelDebug, "connection_id_retired addr=%s scid=%x cid=%x", c.addr, c.scid, cid)
+}
+
+// connMigrated updates the address and socket after the connection path has changed.
+func (s *localConn) connMigrated(c *remoteConn, ok bool) {
+	if c.probeSocket != nil {
+		if ok {
+			s.closeSocket(c.socket)
+			c.socket = c.probeSocket
+		} else {
+			// Fall back to the current socket.
+			s.closeSocket(c.probeSocket)
+		}
+		c.probeSocket = nil
+	}
+	if addr := c.conn.Path().Peer; addr != nil {
+		c.addr = addr
+	}
+	if ok {
+		s.logger.log(levelInfo, "connection_migrated addr=%s scid=%x local_addr=%s", c.addr, c.scid, c.socket.LocalAddr())
+	} else {
+		s.logger.log(levelInfo, "connection_migration_failed addr=%s scid=%x local_addr=%s", c.addr, c.scid, c.socket.LocalAddr())
+	}
+}
+
 func (s *localConn) connClosed(c *remoteConn) {
 	s.logger.log(levelDebug, "connection_closed addr=%s scid=%x", c.addr, c.scid)
 	c.events = append(c.events, transport.Event{Type: EventConnClose})
 	s.serveConn(c)
 	s.peersMu.Lock()
-	delete(s.peers, string(c.scid[:]))
+	if s.peers[string(c.scid)] == c {
+		delete(s.peers, string(c.scid))
+	}
+	for _, cid := range c.cids {
+		if s.peers[string(cid)] == c {
+			delete(s.peers, string(cid))
+		}
+	}
+	c.cids = nil
+	s.closeSocket(c.probeSocket)
+	s.closeSocket(c.socket)
 	// If server is closing and this is the last one, tell others
 	if s.closing && len(s.peers) == 0 {
 		s.closeCond.Broadcast()
@@ -282,6 +491,32 @@ func (s *localConn) close(timeout time.Duration) {
 	}
 }
 
+// closeSocket closes the socket if it was passed to Client.Migrate.
+func (s *localConn) closeSocket(socket net.PacketConn) {
+	if socket == nil {
+		return
+	}
+	s.socketsMu.Lock()
+	_, ok := s.sockets[socket]
+	delete(s.sockets, socket)
+	s.socketsMu.Unlock()
+	if ok {
+		socket.Close()
+	}
+}
+
+// closeSockets closes all sockets passed to Client.Migrate and waits for their serving goroutines.
+func (s *localConn) closeSockets() {
+	s.socketsMu.Lock()
+	s.socketsClosed = true
+	for socket := range s.sockets {
+		socket.Close()
+		delete(s.sockets, socket)
+	}
+	s.socketsMu.Unlock()
+	s.socketsWg.Wait()
+}
+
 // rand uses tls.Config.Rand if available.
 func (s *localConn) rand(b []byte) error {
 	var err error
@@ -294,9 +529,12 @@ func (s *localConn) rand(b []byte) error {
 }
 
 type packet struct {
-	buf  [bufferSize]byte
-	data []byte // Always points to buf
-	addr net.Addr
+	buf   [bufferSize]byte
+	data  []byte // Always points to buf
+	addr  net.Addr
+	local net.Addr // Address of the socket received this packet
+	oob   [oobSize]byte
+	ecn   transport.ECN // ECN codepoint of the received datagram
 
 	header transport.Header
 }
@@ -314,6 +552,8 @@ func newPacket() *packet {
 func freePacket(p *packet) {
 	p.data = nil
 	p.addr = nil
+	p.local = nil
+	p.ecn = transport.ECNNotECT
 	p.header = transport.Header{}
 	packetPool.Put(p)
 }
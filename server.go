@@ -12,6 +12,12 @@ import (
 	"github.com/goburrow/quic/transport"
 )
 
+// maxStatelessResetLength is the size of stateless reset packets sent in response to large packets.
+const maxStatelessResetLength = 43
+
+// statelessResetKeyLen is the size of the key generated when transport.Config.StatelessResetKey is not set.
+const statelessResetKeyLen = 32
+
 // Server is a server-side QUIC connection.
 // All setters must only be invoked before calling Serve.
 type Server struct {
@@ -21,9 +27,18 @@ type Server struct {
 }
 
 // NewServer creates a new QUIC server.
+// A random stateless reset key is generated when config.StatelessResetKey is not set.
 func NewServer(config *transport.Config) *Server {
 	s := &Server{}
 	s.localConn.init(config)
+	if len(config.StatelessResetKey) == 0 {
+		key := make([]byte, statelessResetKeyLen)
+		if err := s.rand(key); err == nil {
+			c := *config
+			c.StatelessResetKey = key
+			s.config = &c
+		}
+	}
 	return s
 }
 
@@ -57,13 +72,15 @@ func (s *Server) Serve() error {
 		return errors.New("no listening connection")
 	}
 	s.logger.log(levelInfo, "server_listening addr=%s", s.socket.LocalAddr())
+	setSocketOptions(s.socket)
 	for {
 		p := newPacket()
-		n, addr, err := s.socket.ReadFrom(p.buf[:])
+		n, addr, err := readPacket(s.socket, p)
 		if n > 0 {
 			// Process returned data first before considering error
 			p.data = p.buf[:n]
 			p.addr = addr
+			p.local = s.socket.LocalAddr()
 			s.logger.log(levelTrace, "datagrams_received addr=%s byte_length=%d raw=%x", addr, n, p.data)
 			s.recv(p)
 		} else {
@@ -100,13 +117,19 @@ func (s *Server) recv(p *packet) {
 	if ok {
 		c.recvCh <- p
 	} else {
+		if p.header.Type == "short" {
+			// Connection state may have been lost, e.g. after a restart.
+			s.reset(p.addr, &p.header, len(p.data))
+			freePacket(p)
+			return
+		}
 		// Server must ensure the any datagram packet containing Initial packet being at least 1200 bytes
 		if p.header.Type != "initial" || len(p.data) < transport.MinInitialPacketSize {
 			s.logger.log(levelDebug, "packet_dropped addr=%s %s trigger=unexpected_packet", p.addr, &p.header)
 			freePacket(p)
 			return
 		}
-		if p.header.Version != transport.ProtocolVersion {
+		if !s.versionSupported(p.header.Version) {
 			// Negotiate version
 			s.negotiate(p.addr, &p.header)
 			freePacket(p)
@@ -116,10 +139,27 @@ func (s *Server) recv(p *packet) {
 	}
 }
 
+// versions returns QUIC versions accepted by the server in order of preference.
+func (s *Server) versions() []uint32 {
+	if len(s.config.Versions) > 0 {
+		return s.config.Versions
+	}
+	return []uint32{s.config.Version}
+}
+
+func (s *Server) versionSupported(version uint32) bool {
+	for _, v := range s.versions() {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) negotiate(addr net.Addr, h *transport.Header) {
 	p := newPacket()
 	defer freePacket(p)
-	n, err := transport.NegotiateVersion(p.buf[:], h.SCID, h.DCID)
+	n, err := transport.NegotiateVersion(p.buf[:], h.SCID, h.DCID, s.versions())
 	if err != nil {
 		s.logger.log(levelError, "version_negotiation_failed addr=%s %s %v", addr, h, err)
 		return
@@ -143,7 +183,11 @@ func (s *Server) retry(addr net.Addr, h *transport.Header) {
 		return
 	}
 	token := s.addrValid.Generate(addr, h.DCID)
-	n, err := transport.Retry(p.buf[:], h.SCID, newCID[:], h.DCID, token)
+	if len(token) == 0 {
+		s.logger.log(levelError, "retry_failed addr=%s %s trigger=generate_token", addr, h)
+		return
+	}
+	n, err := transport.Retry(p.buf[:], h.SCID, newCID[:], h.DCID, token, h.Version)
 	if err != nil {
 		s.logger.log(levelError, "retry_failed addr=%s %s %v", addr, h, err)
 		return
@@ -157,6 +201,36 @@ func (s *Server) retry(addr net.Addr, h *transport.Header) {
 	s.logger.log(levelTrace, "datagrams_sent addr=%s byte_length=%d raw=%x", addr, n, p.buf[:n])
 }
 
+// reset sends a stateless reset in response to a short header packet of size n with unknown DCID.
+// The reset is smaller than the received packet to prevent an infinite exchange with
+// the peer which is also sending stateless resets.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-looping
+func (s *Server) reset(addr net.Addr, h *transport.Header, n int) {
+	if len(s.config.StatelessResetKey) == 0 || n <= transport.MinStatelessResetLength {
+		s.logger.log(levelDebug, "packet_dropped addr=%s %s trigger=unknown_connection_id", addr, h)
+		return
+	}
+	p := newPacket()
+	defer freePacket(p)
+	n--
+	if n > maxStatelessResetLength {
+		n = maxStatelessResetLength
+	}
+	token := transport.StatelessResetToken(s.config.StatelessResetKey, h.DCID)
+	n, err := transport.StatelessReset(p.buf[:n], token)
+	if err != nil {
+		s.logger.log(levelError, "stateless_reset_failed addr=%s %s %v", addr, h, err)
+		return
+	}
+	n, err = s.socket.WriteTo(p.buf[:n], addr)
+	if err != nil {
+		s.logger.log(levelError, "stateless_reset_failed addr=%s %s %v", addr, h, err)
+		return
+	}
+	s.logger.log(levelDebug, "packet_sent addr=%s packet_type=stateless_reset dcid=%x token=%x", addr, h.DCID, token)
+	s.logger.log(levelTrace, "datagrams_sent addr=%s byte_length=%d raw=%x", addr, n, p.buf[:n])
+}
+
 func (s *Server) verifyToken(addr net.Addr, token []byte) []byte {
 	return s.addrValid.Validate(addr, token)
 }
@@ -167,6 +241,7 @@ func (s *Server) verifyToken(addr net.Addr, token []byte) []byte {
 // server can continue process other packets.
 func (s *Server) handleNewConn(p *packet) {
 	var odcid []byte
+	validated := false
 	if s.addrValid != nil {
 		// Retry token
 		if len(p.header.Token) == 0 {
@@ -174,11 +249,25 @@ func (s *Server) handleNewConn(p *packet) {
 			freePacket(p)
 			return
 		}
-		odcid = s.verifyToken(p.addr, p.header.Token)
-		if len(odcid) == 0 {
-			s.logger.log(levelInfo, "packet_dropped addr=%s %s trigger=invalid_token", p.addr, &p.header)
-			freePacket(p)
-			return
+		if v, ok := s.addrValid.(NewTokenValidator); ok && v.IsNewToken(p.header.Token) {
+			// Token issued in a NEW_TOKEN frame validates the address without Retry.
+			validated = v.ValidateNewToken(p.addr, p.header.Token)
+			if !validated {
+				// Tokens from NEW_TOKEN frames may be expired or issued by another server.
+				// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-address-validation-for-futu
+				s.logger.log(levelInfo, "packet_dropped addr=%s %s trigger=invalid_new_token", p.addr, &p.header)
+				s.retry(p.addr, &p.header)
+				freePacket(p)
+				return
+			}
+		} else {
+			odcid = s.verifyToken(p.addr, p.header.Token)
+			if len(odcid) == 0 {
+				// Client only accepts one Retry so there is no point sending another.
+				s.logger.log(levelInfo, "packet_dropped addr=%s %s trigger=invalid_token", p.addr, &p.header)
+				freePacket(p)
+				return
+			}
 		}
 	}
 	c, err := s.newConn(p.addr, p.header.DCID, odcid)
@@ -187,6 +276,19 @@ func (s *Server) handleNewConn(p *packet) {
 		freePacket(p)
 		return
 	}
+	if validated {
+		// Address validated by the token is not subject to the anti-amplification limit.
+		if err = c.conn.ValidateAddress(); err != nil {
+			s.logger.log(levelError, "validate_address_failed addr=%s cid=%x %v", p.addr, c.scid, err)
+		}
+	}
+	if v, ok := s.addrValid.(NewTokenValidator); ok {
+		// Client can use this token in future connections to skip Retry.
+		token := v.GenerateNewToken(p.addr)
+		if err = c.conn.IssueToken(token); err != nil {
+			s.logger.log(levelError, "issue_token_failed addr=%s cid=%x %v", p.addr, c.scid, err)
+		}
+	}
 	s.peersMu.Lock()
 	if s.closing {
 		// Do not create a new handler when server is closing
@@ -223,7 +325,7 @@ func (s *Server) newConn(addr net.Addr, oscid, odcid []byte) (*remoteConn, error
 	if err != nil {
 		return nil, err
 	}
-	c := newRemoteConn(addr, scid, conn)
+	c := newRemoteConn(s.socket, addr, scid, conn)
 	s.logger.attachLogger(c)
 	return c, nil
 }
@@ -241,7 +343,6 @@ func (s *Server) Close() error {
 }
 
 // AddressValidator generates and validates server retry token.
-// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#token-integrity
 type AddressValidator interface {
 	// Generate creates a new token from given addr and odcid.
 	Generate(addr net.Addr, odcid []byte) []byte
@@ -250,8 +351,24 @@ type AddressValidator interface {
 	Validate(addr net.Addr, token []byte) []byte
 }
 
-// NewAddressValidator returns a simple implementation of AddressValidator.
-// It encrypts client original CID into token which is valid for 10 seconds.
+// NewTokenValidator can optionally be implemented by AddressValidator to issue tokens
+// in NEW_TOKEN frames, so clients can skip Retry in future connections.
+// Formats of retry tokens and these tokens must be different so that one can not be used as the other.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#token-integrity
+type NewTokenValidator interface {
+	// GenerateNewToken creates a token for client at addr to use in future connections.
+	GenerateNewToken(addr net.Addr) []byte
+	// ValidateNewToken returns true when token was created by GenerateNewToken for
+	// the host of addr and it has not expired.
+	ValidateNewToken(addr net.Addr, token []byte) bool
+	// IsNewToken returns true when token has the format of tokens created by GenerateNewToken
+	// rather than retry tokens, regardless of its validity.
+	IsNewToken(token []byte) bool
+}
+
+// NewAddressValidator returns a simple implementation of AddressValidator and NewTokenValidator.
+// It encrypts client original CID into retry token which is valid for 10 seconds.
+// Tokens sent in NEW_TOKEN frames are bound to client IP address and valid for 24 hours.
 func NewAddressValidator() AddressValidator {
 	s, err := newAddressValidator()
 	if err != nil {
@@ -260,11 +377,21 @@ func NewAddressValidator() AddressValidator {
 	return s
 }
 
-// addressValidator implements AddressValidator.
-// The token include ODCID encrypted using AES-GSM AEAD with a randomly-generated key.
+const (
+	tokenTypeRetry    = 0
+	tokenTypeNewToken = 1
+	tokenHeaderLen    = 5 // Type and issued time
+
+	retryTokenValidity = 10 // Seconds
+	newTokenValidity   = 24 * 60 * 60
+)
+
+// addressValidator implements AddressValidator and NewTokenValidator.
+// The token starts with its type, issued time and a random nonce, followed by ODCID
+// (empty for NEW_TOKEN) encrypted using AES-GSM AEAD with a randomly-generated key.
+// Type and issued time are authenticated as additional data.
 type addressValidator struct {
 	aead   cipher.AEAD
-	nonce  []byte // First 4 bytes is current time
 	timeFn func() time.Time
 }
 
@@ -284,49 +411,87 @@ func newAddressValidator() (*addressValidator, error) {
 	if err != nil {
 		return nil, err
 	}
-	nonce := make([]byte, aead.NonceSize())
-	_, err = rand.Read(nonce)
-	if err != nil {
-		return nil, err
-	}
 	return &addressValidator{
 		aead:   aead,
-		nonce:  nonce,
 		timeFn: time.Now,
 	}, nil
 }
 
-// Generate encrypts odcid using current time as nonce and addr as additional data.
+// Generate encrypts odcid using addr as additional data.
 func (s *addressValidator) Generate(addr net.Addr, odcid []byte) []byte {
-	now := s.timeFn().Unix()
-	nonce := make([]byte, len(s.nonce))
-	binary.BigEndian.PutUint32(nonce, uint32(now))
-	copy(nonce[4:], s.nonce[4:])
-
-	token := make([]byte, 4+len(odcid)+s.aead.Overhead())
-	binary.BigEndian.PutUint32(token, uint32(now))
-	s.aead.Seal(token[4:4], nonce, odcid, []byte(addr.String()))
-	return token
+	return s.seal(tokenTypeRetry, odcid, []byte(addr.String()))
 }
 
 // Validate decrypts token and returns odcid.
 func (s *addressValidator) Validate(addr net.Addr, token []byte) []byte {
-	if len(token) < 4 {
+	odcid, ok := s.open(tokenTypeRetry, token, retryTokenValidity, []byte(addr.String()))
+	if !ok {
+		return nil
+	}
+	return odcid
+}
+
+// GenerateNewToken encrypts an empty payload with the host of addr as additional data,
+// since client port may change in new connections.
+func (s *addressValidator) GenerateNewToken(addr net.Addr) []byte {
+	return s.seal(tokenTypeNewToken, nil, []byte(addrHost(addr)))
+}
+
+// ValidateNewToken verifies the token was generated by GenerateNewToken.
+func (s *addressValidator) ValidateNewToken(addr net.Addr, token []byte) bool {
+	_, ok := s.open(tokenTypeNewToken, token, newTokenValidity, []byte(addrHost(addr)))
+	return ok
+}
+
+// IsNewToken checks the token type.
+func (s *addressValidator) IsNewToken(token []byte) bool {
+	return len(token) > 0 && token[0] == tokenTypeNewToken
+}
+
+func (s *addressValidator) seal(typ byte, data, ad []byte) []byte {
+	now := s.timeFn().Unix()
+	n := tokenHeaderLen + s.aead.NonceSize()
+	token := make([]byte, n+len(data)+s.aead.Overhead())
+	token[0] = typ
+	binary.BigEndian.PutUint32(token[1:], uint32(now))
+	// Each token has its own nonce as tokens can be generated at the same time.
+	nonce := token[tokenHeaderLen:n]
+	if _, err := rand.Read(nonce); err != nil {
 		return nil
 	}
-	const validity = 10 // Second
+	s.aead.Seal(token[n:n], nonce, data, tokenAD(token[:tokenHeaderLen], ad))
+	return token
+}
+
+func (s *addressValidator) open(typ byte, token []byte, validity int64, ad []byte) ([]byte, bool) {
+	n := tokenHeaderLen + s.aead.NonceSize()
+	if len(token) < n || token[0] != typ {
+		return nil, false
+	}
 	now := s.timeFn().Unix()
-	issued := int64(binary.BigEndian.Uint32(token))
+	issued := int64(binary.BigEndian.Uint32(token[1:]))
 	if issued < now-validity || issued > now {
 		// TODO: Fix overflow when time > MAX_U32
-		return nil
+		return nil, false
 	}
-	nonce := make([]byte, len(s.nonce))
-	copy(nonce, token[:4])
-	copy(nonce[4:], s.nonce[4:])
-	odcid, err := s.aead.Open(nil, nonce, token[4:], []byte(addr.String()))
+	data, err := s.aead.Open(nil, token[tokenHeaderLen:n], token[n:], tokenAD(token[:tokenHeaderLen], ad))
 	if err != nil {
-		return nil
+		return nil, false
 	}
-	return odcid
+	return data, true
+}
+
+// tokenAD returns additional data containing token type, issued time and client address.
+func tokenAD(header, ad []byte) []byte {
+	b := make([]byte, 0, len(header)+len(ad))
+	b = append(b, header...)
+	return append(b, ad...)
+}
+
+// addrHost returns IP address of UDP addr.
+func addrHost(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	return addr.String()
 }
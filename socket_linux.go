@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package quic
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/goburrow/quic/transport"
+)
+
+// oobSize is enough for either IP_TOS or IPV6_TCLASS control message.
+const oobSize = 64
+
+// dontFragment is true as Don't Fragment is set on sockets in setSocketOptions.
+const dontFragment = true
+
+// setSocketOptions asks the socket to report the ECN codepoint of received datagrams
+// and sets Don't Fragment so the path MTU can be discovered by the transport.
+// The socket may be either IPv4 or IPv6 (dual stack), so errors are ignored.
+func setSocketOptions(socket net.PacketConn) {
+	conn, ok := socket.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+		// Probe mode sets DF but ignores the path MTU cached by the kernel.
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	})
+}
+
+// isMessageTooLong returns true when a datagram could not be sent because it is larger
+// than the local MTU, which happens to PMTU probes.
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
+
+// readPacket reads a datagram into p.buf along with its ECN codepoint.
+func readPacket(socket net.PacketConn, p *packet) (int, net.Addr, error) {
+	conn, ok := socket.(*net.UDPConn)
+	if !ok {
+		return socket.ReadFrom(p.buf[:])
+	}
+	n, oobn, _, addr, err := conn.ReadMsgUDP(p.buf[:], p.oob[:])
+	if addr == nil {
+		return n, nil, err
+	}
+	p.ecn = parseECN(p.oob[:oobn])
+	return n, addr, err
+}
+
+func parseECN(oob []byte) transport.ECN {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return transport.ECNNotECT
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) > 0:
+			return transport.ECN(m.Data[0] & 0x03)
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 4:
+			tclass := *(*int32)(unsafe.Pointer(&m.Data[0]))
+			return transport.ECN(tclass & 0x03)
+		}
+	}
+	return transport.ECNNotECT
+}
+
+// isECNNotSupported returns true when a datagram could not be sent because the socket
+// does not accept the control message setting the ECN codepoint.
+func isECNNotSupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// writePacket sends b to addr with the ECN codepoint set in IP header.
+func writePacket(socket net.PacketConn, b []byte, addr net.Addr, ecn transport.ECN) (int, error) {
+	conn, ok := socket.(*net.UDPConn)
+	udpAddr, isUDP := addr.(*net.UDPAddr)
+	if !ok || !isUDP || ecn == transport.ECNNotECT {
+		return socket.WriteTo(b, addr)
+	}
+	var oob [oobSize]byte
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	if udpAddr.IP.To4() != nil {
+		h.Level = syscall.IPPROTO_IP
+		h.Type = syscall.IP_TOS
+	} else {
+		h.Level = syscall.IPPROTO_IPV6
+		h.Type = syscall.IPV6_TCLASS
+	}
+	h.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = int32(ecn)
+	n, _, err := conn.WriteMsgUDP(b, oob[:syscall.CmsgSpace(4)], udpAddr)
+	return n, err
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package quic
+
+import (
+	"net"
+
+	"github.com/goburrow/quic/transport"
+)
+
+// oobSize is zero as ECN codepoints and Don't Fragment are only supported on Linux.
+const oobSize = 0
+
+// dontFragment is false as Don't Fragment is not set on sockets.
+const dontFragment = false
+
+func setSocketOptions(socket net.PacketConn) {}
+
+func readPacket(socket net.PacketConn, p *packet) (int, net.Addr, error) {
+	return socket.ReadFrom(p.buf[:])
+}
+
+func writePacket(socket net.PacketConn, b []byte, addr net.Addr, ecn transport.ECN) (int, error) {
+	return socket.WriteTo(b, addr)
+}
+
+func isMessageTooLong(err error) bool {
+	return false
+}
+
+func isECNNotSupported(err error) bool {
+	return false
+}
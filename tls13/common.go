@@ -83,7 +83,9 @@ const (
 	extensionSignatureAlgorithmsCert uint16 = 50
 	extensionKeyShare                uint16 = 51
 	extensionRenegotiationInfo       uint16 = 0xff01
-	extensionQUICTransportParams     uint16 = 0xffa5
+	extensionQUICTransportParams     uint16 = 0x39
+	// extensionQUICTransportParamsDraft is used by QUIC draft versions.
+	extensionQUICTransportParamsDraft uint16 = 0xffa5
 )
 
 // TLS signaling cipher suite values
@@ -195,6 +197,11 @@ type clientSessionState struct {
 	nonce  []byte    // Ticket nonce sent by the server, to derive PSK
 	useBy  time.Time // Expiration of the ticket lifetime as set by the server
 	ageAdd uint32    // Random obfuscation factor for sending the ticket age
+
+	// QUIC 0-RTT fields.
+	maxEarlyData    uint32 // Maximum early data allowed by the server, 0 if not allowed
+	alpn            string // Application protocol negotiated for the session
+	transportParams []byte // QUIC transport parameters of the server
 }
 
 // ticketKeyNameLen is the number of bytes of identifier that is prepended to
@@ -374,6 +381,7 @@ func configGetCertificate(c *tls.Config, clientHello *tls.ClientHelloInfo) (*tls
 
 const (
 	keyLogLabelTLS12           = "CLIENT_RANDOM"
+	keyLogLabelClientEarly     = "CLIENT_EARLY_TRAFFIC_SECRET"
 	keyLogLabelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
 	keyLogLabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
 	keyLogLabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
@@ -12,6 +12,7 @@ type EncryptionLevel int
 
 const (
 	EncryptionLevelInitial EncryptionLevel = iota
+	EncryptionLevelEarly
 	EncryptionLevelHandshake
 	EncryptionLevelApplication
 )
@@ -73,8 +74,21 @@ type Conn struct {
 	clientHs *clientHandshakeStateTLS13
 	serverHs *serverHandshakeStateTLS13
 
-	quicTransportParams []byte
-	peerTransportParams []byte
+	quicTransportParams    []byte
+	quicTransportParamsExt uint16
+	peerTransportParams    []byte
+	// quicTransportParamsHandler is called on server with client transport parameters
+	// before the handshake keys are derived.
+	quicTransportParamsHandler func([]byte) error
+	// sessionTransportParams is the server transport parameters remembered
+	// from the session used for early data.
+	sessionTransportParams []byte
+
+	// earlyData is true when early data is enabled. For servers,
+	// earlyDataContext must match the resumed session to accept early data.
+	earlyData         bool
+	earlyDataContext  []byte
+	earlyDataAccepted bool
 
 	alert alert
 }
@@ -88,6 +102,8 @@ func NewConn(recordLayer RecordLayer, config *tls.Config, isClient bool) *Conn {
 		config:      config,
 		vers:        tls.VersionTLS13,
 		recordLayer: recordLayer,
+
+		quicTransportParamsExt: extensionQUICTransportParams,
 	}
 }
 
@@ -251,6 +267,27 @@ func (c *Conn) Handshake() error {
 	return nil
 }
 
+// HandlePostHandshakeMessage processes a handshake message received after
+// the handshake has completed, i.e. NewSessionTicket.
+// It returns ErrWantRead when no complete message is available.
+func (c *Conn) HandlePostHandshakeMessage() error {
+	if !c.handshakeComplete() {
+		return errors.New("tls: handshake has not completed")
+	}
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	switch msg := msg.(type) {
+	case *newSessionTicketMsgTLS13:
+		return c.handleNewSessionTicket(msg)
+	default:
+		// KeyUpdate is prohibited in QUIC.
+		c.sendAlert(alertUnexpectedMessage)
+		return fmt.Errorf("tls: received unexpected handshake message of type %T", msg)
+	}
+}
+
 // ConnectionState returns basic TLS details about the connection.
 func (c *Conn) ConnectionState() tls.ConnectionState {
 	var state tls.ConnectionState
@@ -286,10 +323,43 @@ func (c *Conn) SetQUICTransportParams(b []byte) {
 	c.quicTransportParams = b
 }
 
+// SetQUICTransportParamsExtension sets the TLS extension codepoint of QUIC transport
+// parameters, which depends on the QUIC version. Peer transport parameters are only
+// accepted with the same codepoint.
+func (c *Conn) SetQUICTransportParamsExtension(ext uint16) {
+	c.quicTransportParamsExt = ext
+}
+
+// SetQUICTransportParamsHandler sets the function which server calls with client transport
+// parameters before sending its own. The handler may update server transport parameters
+// and the QUIC version used for handshake keys. Its error aborts the handshake.
+func (c *Conn) SetQUICTransportParamsHandler(fn func([]byte) error) {
+	c.quicTransportParamsHandler = fn
+}
+
 func (c *Conn) PeerQUICTransportParams() []byte {
 	return c.peerTransportParams
 }
 
+// SetEarlyData enables sending (client) or accepting (server) early data.
+// For servers, context is saved in session tickets and early data is only accepted
+// when it is equal to the context of the resumed session.
+func (c *Conn) SetEarlyData(enable bool, context []byte) {
+	c.earlyData = enable
+	c.earlyDataContext = context
+}
+
+// EarlyDataAccepted returns true when early data has been accepted by the server.
+func (c *Conn) EarlyDataAccepted() bool {
+	return c.earlyDataAccepted
+}
+
+// SessionQUICTransportParams returns QUIC transport parameters of the server
+// remembered from the resumed session when client is sending early data.
+func (c *Conn) SessionQUICTransportParams() []byte {
+	return c.sessionTransportParams
+}
+
 func (c *Conn) handshakeComplete() bool {
 	return c.handshakeStatus == 1
 }
@@ -58,6 +58,7 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 		alpnProtocols:                config.NextProtos,
 		supportedVersions:            supportedVersions,
 		quicTransportParams:          c.quicTransportParams,
+		quicTransportParamsExt:       c.quicTransportParamsExt,
 	}
 
 	// FIXME
@@ -132,6 +133,12 @@ func (c *Conn) clientHandshake() (err error) {
 		if _, err := c.writeRecord(recordTypeHandshake, hello.marshal()); err != nil {
 			return err
 		}
+		if hello.earlyData {
+			if err := c.setEarlyTrafficSecret(hello, session, earlySecret); err != nil {
+				c.sendAlert(alertInternalError)
+				return err
+			}
+		}
 
 		c.clientHs = &clientHandshakeStateTLS13{
 			c:           c,
@@ -174,6 +181,10 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 	if !ok || tlsSession == nil {
 		return cacheKey, nil, nil, nil
 	}
+	session = new(clientSessionState)
+	if !session.fromTLS(tlsSession) {
+		return cacheKey, nil, nil, nil
+	}
 
 	// Check that version used for the previous session is still valid.
 	versOk := false
@@ -238,6 +249,7 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 	}
 	hello.pskIdentities = []pskIdentity{identity}
 	hello.pskBinders = [][]byte{make([]byte, cipherSuite.hash.Size())}
+	hello.earlyData = c.shouldSendEarlyData(session)
 
 	// Compute the PSK binders. See RFC 8446, Section 4.2.11.2.
 	psk := cipherSuite.expandLabel(session.masterSecret, "resumption",
@@ -252,6 +264,44 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 	return
 }
 
+// shouldSendEarlyData returns true when the session allows early data and
+// the client offers the application protocol negotiated in the session.
+// See RFC 8446, Section 4.2.10.
+func (c *Conn) shouldSendEarlyData(session *clientSessionState) bool {
+	if !c.earlyData || session.maxEarlyData == 0 {
+		return false
+	}
+	if session.alpn == "" {
+		return true
+	}
+	for _, proto := range c.config.NextProtos {
+		if proto == session.alpn {
+			return true
+		}
+	}
+	return false
+}
+
+// setEarlyTrafficSecret derives client_early_traffic_secret from the ClientHello
+// and sets it to the record layer. The record layer's write level is unchanged
+// as handshake messages are never sent in early data.
+func (c *Conn) setEarlyTrafficSecret(hello *clientHelloMsg, session *clientSessionState, earlySecret []byte) error {
+	suite := cipherSuiteTLS13ByID(session.cipherSuite)
+	if suite == nil {
+		return errors.New("tls: unsupported cipher suite")
+	}
+	transcript := suite.hash.New()
+	transcript.Write(hello.marshal())
+	earlyTrafficSecret := suite.deriveSecret(earlySecret, clientEarlyTrafficLabel, transcript)
+	// Early data is protected with the cipher suite of the session.
+	c.cipherSuite = suite.id
+	if err := c.recordLayer.SetWriteSecret(EncryptionLevelEarly, earlyTrafficSecret); err != nil {
+		return err
+	}
+	c.sessionTransportParams = session.transportParams
+	return configWriteKeyLog(c.config, keyLogLabelClientEarly, hello.random, earlyTrafficSecret)
+}
+
 func (c *Conn) pickTLSVersion(serverHello *serverHelloMsg) error {
 	peerVersion := serverHello.vers
 	if serverHello.supportedVersion != 0 {
@@ -260,6 +260,8 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 	hs.hello.keyShares = []keyShare{{group: curveID, data: params.PublicKey()}}
 
 	hs.hello.cookie = hs.serverHello.cookie
+	// Early data is not allowed after a HelloRetryRequest. See RFC 8446, Section 4.2.10.
+	hs.hello.earlyData = false
 
 	hs.hello.raw = nil
 	if len(hs.hello.pskIdentities) > 0 {
@@ -420,7 +422,25 @@ func (hs *clientHandshakeStateTLS13) readServerParameters() error {
 	}
 	c.clientProtocol = encryptedExtensions.alpnProtocol
 
-	c.peerTransportParams = encryptedExtensions.quicTransportParams
+	if encryptedExtensions.earlyData {
+		if !hs.hello.earlyData {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server accepted unrequested early data")
+		}
+		if !hs.usingPSK || hs.serverHello.selectedIdentity != 0 {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server accepted early data without the first PSK")
+		}
+		if c.clientProtocol != hs.session.alpn {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server accepted early data with different ALPN")
+		}
+		c.earlyDataAccepted = true
+	}
+
+	if encryptedExtensions.quicTransportParamsExt == c.quicTransportParamsExt {
+		c.peerTransportParams = encryptedExtensions.quicTransportParams
+	}
 	hs.state = clientStateReadServerCert
 	return nil
 }
@@ -702,6 +722,9 @@ func (c *Conn) handleNewSessionTicket(msg *newSessionTicketMsgTLS13) error {
 		nonce:              msg.nonce,
 		useBy:              configTime(c.config).Add(lifetime),
 		ageAdd:             msg.ageAdd,
+		maxEarlyData:       msg.maxEarlyData,
+		alpn:               c.clientProtocol,
+		transportParams:    c.peerTransportParams,
 	}
 
 	cacheKey := clientSessionCacheKey(c.config)
@@ -95,6 +95,8 @@ type clientHelloMsg struct {
 	pskBinders                       [][]byte
 
 	quicTransportParams []byte
+	// quicTransportParamsExt is the extension codepoint of quicTransportParams.
+	quicTransportParamsExt uint16
 }
 
 func (m *clientHelloMsg) marshal() []byte {
@@ -269,6 +271,12 @@ func (m *clientHelloMsg) marshal() []byte {
 					})
 				})
 			}
+			if len(m.quicTransportParams) > 0 {
+				b.AddUint16(m.quicTransportParamsExt)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.quicTransportParams)
+				})
+			}
 			if len(m.pskIdentities) > 0 { // pre_shared_key must be the last extension
 				// RFC 8446, Section 4.2.11
 				b.AddUint16(extensionPreSharedKey)
@@ -290,12 +298,6 @@ func (m *clientHelloMsg) marshal() []byte {
 					})
 				})
 			}
-			if len(m.quicTransportParams) > 0 {
-				b.AddUint16(extensionQUICTransportParams)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddBytes(m.quicTransportParams)
-				})
-			}
 			extensionsPresent = len(b.BytesOrPanic()) > 2
 		})
 
@@ -584,8 +586,9 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				}
 				m.pskBinders = append(m.pskBinders, binder)
 			}
-		case extensionQUICTransportParams:
+		case extensionQUICTransportParams, extensionQUICTransportParamsDraft:
 			m.quicTransportParams = extData
+			m.quicTransportParamsExt = extension
 			continue
 		default:
 			// Ignore unknown extensions.
@@ -838,8 +841,11 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 type encryptedExtensionsMsg struct {
 	raw          []byte
 	alpnProtocol string
+	earlyData    bool
 
 	quicTransportParams []byte
+	// quicTransportParamsExt is the extension codepoint of quicTransportParams.
+	quicTransportParamsExt uint16
 }
 
 func (m *encryptedExtensionsMsg) marshal() []byte {
@@ -861,8 +867,13 @@ func (m *encryptedExtensionsMsg) marshal() []byte {
 					})
 				})
 			}
+			if m.earlyData {
+				// RFC 8446, Section 4.2.10
+				b.AddUint16(extensionEarlyData)
+				b.AddUint16(0) // empty extension_data
+			}
 			if len(m.quicTransportParams) > 0 {
-				b.AddUint16(extensionQUICTransportParams)
+				b.AddUint16(m.quicTransportParamsExt)
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 					b.AddBytes(m.quicTransportParams)
 				})
@@ -904,8 +915,12 @@ func (m *encryptedExtensionsMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.alpnProtocol = string(proto)
-		case extensionQUICTransportParams:
+		case extensionEarlyData:
+			// RFC 8446, Section 4.2.10
+			m.earlyData = true
+		case extensionQUICTransportParams, extensionQUICTransportParamsDraft:
 			m.quicTransportParams = extData
+			m.quicTransportParamsExt = extension
 			continue
 		default:
 			// Ignore unknown extensions.
@@ -12,6 +12,9 @@ import (
 type testRecordLayer struct {
 	read  [EncryptionLevelApplication + 1]bytes.Buffer
 	write [EncryptionLevelApplication + 1]bytes.Buffer
+
+	readSecrets  [EncryptionLevelApplication + 1][]byte
+	writeSecrets [EncryptionLevelApplication + 1][]byte
 }
 
 func (t *testRecordLayer) ReadRecord(level EncryptionLevel, b []byte) (int, error) {
@@ -31,13 +34,23 @@ func (t *testRecordLayer) WriteRecord(level EncryptionLevel, b []byte) (int, err
 }
 
 func (t *testRecordLayer) SetReadSecret(level EncryptionLevel, readSecret []byte) error {
+	t.readSecrets[level] = readSecret
 	return nil
 }
 
 func (t *testRecordLayer) SetWriteSecret(level EncryptionLevel, writeSecret []byte) error {
+	t.writeSecrets[level] = writeSecret
 	return nil
 }
 
+// transfer moves data written by t to the read buffers of peer.
+func (t *testRecordLayer) transfer(peer *testRecordLayer) {
+	for i := range t.write {
+		peer.read[i].Write(t.write[i].Bytes())
+		t.write[i].Reset()
+	}
+}
+
 func TestReadClientHello(t *testing.T) {
 	cert, err := tls.LoadX509KeyPair("../testdata/cert.pem", "../testdata/key.pem")
 	if err != nil {
@@ -71,3 +84,100 @@ func TestReadClientHello(t *testing.T) {
 
 	t.Logf("\nhandshake output buffer: %d\n", records.write[EncryptionLevelHandshake].Len())
 }
+
+func testHandshake(t *testing.T, client, server *Conn, clientRecords, serverRecords *testRecordLayer) {
+	for i := 0; i < 5; i++ {
+		err := client.Handshake()
+		if err != nil && err != ErrWantRead {
+			t.Fatalf("client handshake: %v", err)
+		}
+		clientRecords.transfer(serverRecords)
+		err = server.Handshake()
+		if err != nil && err != ErrWantRead {
+			t.Fatalf("server handshake: %v", err)
+		}
+		serverRecords.transfer(clientRecords)
+		if client.handshakeComplete() && server.handshakeComplete() {
+			return
+		}
+	}
+	t.Fatalf("handshake not completed")
+}
+
+func TestEarlyData(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../testdata/cert.pem", "../testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"hq"},
+	}
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		NextProtos:         []string{"hq"},
+	}
+	params := []byte("params")
+	// Full handshake to receive session ticket
+	clientRecords := &testRecordLayer{}
+	serverRecords := &testRecordLayer{}
+	client := NewConn(clientRecords, clientConfig, true)
+	server := NewConn(serverRecords, serverConfig, false)
+	server.SetQUICTransportParams(params)
+	server.SetEarlyData(true, []byte("context"))
+	testHandshake(t, client, server, clientRecords, serverRecords)
+	msg, err := client.readHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket, ok := msg.(*newSessionTicketMsgTLS13)
+	if !ok || ticket.maxEarlyData != 0xffffffff {
+		t.Fatalf("expect session ticket allowing early data: %#v", msg)
+	}
+	if err = client.handleNewSessionTicket(ticket); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.HandlePostHandshakeMessage(); err != ErrWantRead {
+		t.Fatalf("expect error %v, actual %v", ErrWantRead, err)
+	}
+	// Resume with early data
+	clientRecords = &testRecordLayer{}
+	serverRecords = &testRecordLayer{}
+	client = NewConn(clientRecords, clientConfig, true)
+	client.SetEarlyData(true, nil)
+	server = NewConn(serverRecords, serverConfig, false)
+	server.SetEarlyData(true, []byte("context"))
+	testHandshake(t, client, server, clientRecords, serverRecords)
+	if !client.didResume || !server.didResume {
+		t.Fatalf("expect resumed: client=%v server=%v", client.didResume, server.didResume)
+	}
+	if !client.EarlyDataAccepted() || !server.EarlyDataAccepted() {
+		t.Fatalf("expect early data accepted: client=%v server=%v", client.EarlyDataAccepted(), server.EarlyDataAccepted())
+	}
+	earlySecret := clientRecords.writeSecrets[EncryptionLevelEarly]
+	if len(earlySecret) == 0 || !bytes.Equal(earlySecret, serverRecords.readSecrets[EncryptionLevelEarly]) {
+		t.Fatalf("expect same early secret: client=%x server=%x", earlySecret, serverRecords.readSecrets[EncryptionLevelEarly])
+	}
+	if !bytes.Equal(params, client.SessionQUICTransportParams()) {
+		t.Fatalf("expect session transport params: %x, actual: %x", params, client.SessionQUICTransportParams())
+	}
+	// Reject early data with different context
+	clientRecords = &testRecordLayer{}
+	serverRecords = &testRecordLayer{}
+	client = NewConn(clientRecords, clientConfig, true)
+	client.SetEarlyData(true, nil)
+	server = NewConn(serverRecords, serverConfig, false)
+	server.SetEarlyData(true, []byte("changed"))
+	testHandshake(t, client, server, clientRecords, serverRecords)
+	if !client.didResume || !server.didResume {
+		t.Fatalf("expect resumed: client=%v server=%v", client.didResume, server.didResume)
+	}
+	if client.EarlyDataAccepted() || server.EarlyDataAccepted() {
+		t.Fatalf("expect early data rejected: client=%v server=%v", client.EarlyDataAccepted(), server.EarlyDataAccepted())
+	}
+	if len(clientRecords.writeSecrets[EncryptionLevelEarly]) == 0 || serverRecords.readSecrets[EncryptionLevelEarly] != nil {
+		t.Fatalf("unexpected early secrets: client=%x server=%x",
+			clientRecords.writeSecrets[EncryptionLevelEarly], serverRecords.readSecrets[EncryptionLevelEarly])
+	}
+}
@@ -41,6 +41,7 @@ type serverHandshakeStateTLS13 struct {
 	cert            *tls.Certificate
 	sigAlg          tls.SignatureScheme
 	earlySecret     []byte
+	sessionState    *sessionStateTLS13 // resumed session
 	sharedKey       []byte
 	handshakeSecret []byte
 	masterSecret    []byte
@@ -192,16 +193,9 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 		return errors.New("tls: initial handshake had non-empty renegotiation extension")
 	}
 
-	if hs.clientHello.earlyData {
-		// See RFC 8446, Section 4.2.10 for the complicated behavior required
-		// here. The scenario is that a different server at our address offered
-		// to accept early data in the past, which we can't handle. For now, all
-		// 0-RTT enabled session tickets need to expire before a Go server can
-		// replace a server or join a pool. That's the same requirement that
-		// applies to mixing or replacing with any TLS 1.2 server.
-		c.sendAlert(alertUnsupportedExtension)
-		return errors.New("tls: client sent unexpected early data")
-	}
+	// Early data is only accepted when resuming a session which allows it.
+	// Otherwise, it is rejected and QUIC discards 0-RTT packets.
+	// See RFC 8446, Section 4.2.10.
 
 	hs.hello.sessionId = hs.clientHello.sessionId
 	hs.hello.compressionMethod = compressionNone
@@ -286,7 +280,9 @@ func (hs *serverHandshakeStateTLS13) processClientKeyShare(clientKeyShare *keySh
 	}
 
 	c.serverName = hs.clientHello.serverName
-	c.peerTransportParams = hs.clientHello.quicTransportParams
+	if hs.clientHello.quicTransportParamsExt == c.quicTransportParamsExt {
+		c.peerTransportParams = hs.clientHello.quicTransportParams
+	}
 	return nil
 }
 
@@ -337,7 +333,8 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 
 		// We don't check the obfuscated ticket age because it's affected by
 		// clock skew and it's only a freshness signal useful for shrinking the
-		// window for replay attacks, which don't affect us as we don't do 0-RTT.
+		// window for replay attacks. Applications accepting early data must
+		// tolerate replays.
 
 		pskSuite := cipherSuiteTLS13ByID(sessionState.cipherSuite)
 		if pskSuite == nil || pskSuite.hash != hs.suite.hash {
@@ -379,6 +376,7 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 
 		hs.hello.selectedIdentityPresent = true
 		hs.hello.selectedIdentity = uint16(i)
+		hs.sessionState = sessionState
 		hs.usingPSK = true
 		c.didResume = true
 		return nil
@@ -565,6 +563,26 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 	c := hs.c
 
 	hs.transcript.Write(hs.clientHello.marshal())
+	if hs.shouldAcceptEarlyData() {
+		earlyTrafficSecret := hs.suite.deriveSecret(hs.earlySecret,
+			clientEarlyTrafficLabel, hs.transcript)
+		// Handshake messages are never sent in early data so c.in is unchanged.
+		if err := c.recordLayer.SetReadSecret(EncryptionLevelEarly, earlyTrafficSecret); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		err := configWriteKeyLog(c.config, keyLogLabelClientEarly, hs.clientHello.random, earlyTrafficSecret)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		c.earlyDataAccepted = true
+	}
+	if c.quicTransportParamsHandler != nil {
+		if err := c.quicTransportParamsHandler(c.peerTransportParams); err != nil {
+			return err
+		}
+	}
 	hs.transcript.Write(hs.hello.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
 		return err
@@ -609,8 +627,10 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 			c.clientProtocol = selectedProto
 		}
 	}
+	encryptedExtensions.earlyData = c.earlyDataAccepted
 	if len(c.quicTransportParams) > 0 {
 		encryptedExtensions.quicTransportParams = c.quicTransportParams
+		encryptedExtensions.quicTransportParamsExt = c.quicTransportParamsExt
 	}
 
 	hs.transcript.Write(encryptedExtensions.marshal())
@@ -621,6 +641,28 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 	return nil
 }
 
+// shouldAcceptEarlyData returns true when early data is enabled and the client
+// resumes the first offered session with the same cipher suite, ALPN and context.
+// See RFC 8446, Section 4.2.10.
+func (hs *serverHandshakeStateTLS13) shouldAcceptEarlyData() bool {
+	c := hs.c
+	if !c.earlyData || !hs.clientHello.earlyData || hs.sessionState == nil ||
+		hs.hello.selectedIdentity != 0 {
+		return false
+	}
+	if !hs.sessionState.earlyData || hs.sessionState.cipherSuite != hs.suite.id ||
+		!bytes.Equal(hs.sessionState.context, c.earlyDataContext) {
+		return false
+	}
+	var alpn string
+	if len(hs.clientHello.alpnProtocols) > 0 {
+		if selectedProto, fallback := mutualProtocol(hs.clientHello.alpnProtocols, c.config.NextProtos); !fallback {
+			alpn = selectedProto
+		}
+	}
+	return alpn == hs.sessionState.alpn
+}
+
 func (hs *serverHandshakeStateTLS13) requestClientCert() bool {
 	return hs.c.config.ClientAuth >= tls.RequestClientCert && !hs.usingPSK
 }
@@ -795,6 +837,9 @@ func (hs *serverHandshakeStateTLS13) sendSessionTickets() error {
 			OCSPStaple:                  c.ocspResponse,
 			SignedCertificateTimestamps: c.scts,
 		},
+		earlyData: c.earlyData,
+		alpn:      c.clientProtocol,
+		context:   c.earlyDataContext,
 	}
 	var err error
 	m.label, err = c.encryptTicket(state.marshal())
@@ -802,6 +847,11 @@ func (hs *serverHandshakeStateTLS13) sendSessionTickets() error {
 		return err
 	}
 	m.lifetime = uint32(maxSessionTicketLifetime / time.Second)
+	if c.earlyData {
+		// QUIC requires max_early_data_size to be 0xffffffff.
+		// See https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-enabling-0-rtt
+		m.maxEarlyData = 0xffffffff
+	}
 
 	if _, err := c.writeRecord(recordTypeHandshake, m.marshal()); err != nil {
 		return err
@@ -0,0 +1,131 @@
+//go:build go1.21
+// +build go1.21
+
+package tls13
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Since Go 1.21, tls.ClientSessionState only holds a tls.SessionState, so
+// clientSessionState is serialized into its Extra field.
+func (s *clientSessionState) toTLS() *tls.ClientSessionState {
+	state := &tls.SessionState{
+		Extra: [][]byte{s.marshal()},
+	}
+	ts, err := tls.NewResumptionState(s.sessionTicket, state)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
+
+func (s *clientSessionState) fromTLS(ts *tls.ClientSessionState) bool {
+	ticket, state, err := ts.ResumptionState()
+	if err != nil || state == nil || len(state.Extra) != 1 {
+		return false
+	}
+	if !s.unmarshal(state.Extra[0]) {
+		return false
+	}
+	s.sessionTicket = ticket
+	return true
+}
+
+func (s *clientSessionState) marshal() []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(s.vers)
+	b.AddUint16(s.cipherSuite)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.masterSecret)
+	})
+	addUint64(&b, uint64(s.receivedAt.UnixNano()))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.nonce)
+	})
+	addUint64(&b, uint64(s.useBy.UnixNano()))
+	b.AddUint32(s.ageAdd)
+	marshalCertificateList(&b, s.serverCertificates)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, chain := range s.verifiedChains {
+			marshalCertificateList(b, chain)
+		}
+	})
+	b.AddUint32(s.maxEarlyData)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(s.alpn))
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.transportParams)
+	})
+	return b.BytesOrPanic()
+}
+
+func (s *clientSessionState) unmarshal(data []byte) bool {
+	*s = clientSessionState{}
+	str := cryptobyte.String(data)
+	var receivedAt, useBy uint64
+	var chains cryptobyte.String
+	var alpn []byte
+	if !str.ReadUint16(&s.vers) ||
+		!str.ReadUint16(&s.cipherSuite) ||
+		!readUint8LengthPrefixed(&str, &s.masterSecret) ||
+		!readUint64(&str, &receivedAt) ||
+		!readUint8LengthPrefixed(&str, &s.nonce) ||
+		!readUint64(&str, &useBy) ||
+		!str.ReadUint32(&s.ageAdd) ||
+		!unmarshalCertificateList(&str, &s.serverCertificates) ||
+		!str.ReadUint24LengthPrefixed(&chains) {
+		return false
+	}
+	for !chains.Empty() {
+		var chain []*x509.Certificate
+		if !unmarshalCertificateList(&chains, &chain) {
+			return false
+		}
+		s.verifiedChains = append(s.verifiedChains, chain)
+	}
+	if !str.ReadUint32(&s.maxEarlyData) ||
+		!readUint8LengthPrefixed(&str, &alpn) ||
+		!readUint16LengthPrefixed(&str, &s.transportParams) ||
+		!str.Empty() {
+		return false
+	}
+	s.receivedAt = time.Unix(0, int64(receivedAt))
+	s.useBy = time.Unix(0, int64(useBy))
+	s.alpn = string(alpn)
+	return true
+}
+
+func marshalCertificateList(b *cryptobyte.Builder, certs []*x509.Certificate) {
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, cert := range certs {
+			b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(cert.Raw)
+			})
+		}
+	})
+}
+
+func unmarshalCertificateList(s *cryptobyte.String, certs *[]*x509.Certificate) bool {
+	var list cryptobyte.String
+	if !s.ReadUint24LengthPrefixed(&list) {
+		return false
+	}
+	for !list.Empty() {
+		var raw []byte
+		if !readUint24LengthPrefixed(&list, &raw) {
+			return false
+		}
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return false
+		}
+		*certs = append(*certs, cert)
+	}
+	return true
+}
@@ -21,26 +21,40 @@ import (
 
 // sessionStateTLS13 is the content of a TLS 1.3 session ticket. Its first
 // version (revision = 0) doesn't carry any of the information needed for 0-RTT
-// validation and the nonce is always empty.
+// validation and the nonce is always empty. Revision 1 adds early data fields.
 type sessionStateTLS13 struct {
 	// uint8 version  = 0x0304;
-	// uint8 revision = 0;
+	// uint8 revision = 1;
 	cipherSuite      uint16
 	createdAt        uint64
 	resumptionSecret []byte          // opaque resumption_master_secret<1..2^8-1>;
 	certificate      tls.Certificate // CertificateEntry certificate_list<0..2^24-1>;
+	earlyData        bool            // uint8 early_data;
+	alpn             string          // opaque alpn<0..2^8-1>;
+	context          []byte          // opaque early_data_context<0..2^16-1>;
 }
 
 func (m *sessionStateTLS13) marshal() []byte {
 	var b cryptobyte.Builder
 	b.AddUint16(tls.VersionTLS13)
-	b.AddUint8(0) // revision
+	b.AddUint8(1) // revision
 	b.AddUint16(m.cipherSuite)
 	addUint64(&b, m.createdAt)
 	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes(m.resumptionSecret)
 	})
 	marshalCertificate(&b, m.certificate)
+	if m.earlyData {
+		b.AddUint8(1)
+	} else {
+		b.AddUint8(0)
+	}
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(m.alpn))
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(m.context)
+	})
 	return b.BytesOrPanic()
 }
 
@@ -49,16 +63,24 @@ func (m *sessionStateTLS13) unmarshal(data []byte) bool {
 	s := cryptobyte.String(data)
 	var version uint16
 	var revision uint8
-	return s.ReadUint16(&version) &&
+	var earlyData uint8
+	var alpn []byte
+	ok := s.ReadUint16(&version) &&
 		version == tls.VersionTLS13 &&
 		s.ReadUint8(&revision) &&
-		revision == 0 &&
+		revision == 1 &&
 		s.ReadUint16(&m.cipherSuite) &&
 		readUint64(&s, &m.createdAt) &&
 		readUint8LengthPrefixed(&s, &m.resumptionSecret) &&
 		len(m.resumptionSecret) != 0 &&
 		unmarshalCertificate(&s, &m.certificate) &&
+		s.ReadUint8(&earlyData) &&
+		readUint8LengthPrefixed(&s, &alpn) &&
+		readUint16LengthPrefixed(&s, &m.context) &&
 		s.Empty()
+	m.earlyData = earlyData == 1
+	m.alpn = string(alpn)
+	return ok
 }
 
 func (c *Conn) encryptTicket(state []byte) ([]byte, error) {
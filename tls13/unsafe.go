@@ -1,3 +1,6 @@
+//go:build !go1.21
+// +build !go1.21
+
 package tls13
 
 import (
@@ -7,6 +10,7 @@ import (
 
 // Work around for using tls.ClientSessionState in ClientSessionCache.
 // https://github.com/golang/go/issues/25351
+// QUIC 0-RTT fields are not kept as they are not in tls.ClientSessionState.
 func (s *clientSessionState) toTLS() *tls.ClientSessionState {
 	ts := &tls.ClientSessionState{}
 	sBytes := (*[unsafe.Sizeof(*s)]byte)(unsafe.Pointer(s))[:]
@@ -15,9 +19,9 @@ func (s *clientSessionState) toTLS() *tls.ClientSessionState {
 	return ts
 }
 
-func (s *clientSessionState) fromTLS(ts *tls.ClientSessionState) {
+func (s *clientSessionState) fromTLS(ts *tls.ClientSessionState) bool {
 	sBytes := (*[unsafe.Sizeof(*s)]byte)(unsafe.Pointer(s))[:]
 	tsBytes := (*[unsafe.Sizeof(*ts)]byte)(unsafe.Pointer(ts))[:]
 	copy(sBytes, tsBytes)
-	return
+	return true
 }
@@ -1,3 +1,6 @@
+//go:build !go1.21
+// +build !go1.21
+
 package tls13
 
 import (
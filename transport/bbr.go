@@ -0,0 +1,408 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// bbrStartupGain is 2/ln(2), the minimum gain to double sending rate every round.
+	bbrStartupGain = 2.885
+	bbrDrainGain   = 1 / bbrStartupGain
+	bbrCwndGain    = 2.0
+
+	// bbrBtlBwFilterLen is the number of rounds of the max bandwidth filter window.
+	bbrBtlBwFilterLen = 10
+	// bbrMinRTTFilterLen is the time window of the min RTT filter.
+	bbrMinRTTFilterLen  = 10 * time.Second
+	bbrProbeRTTDuration = 200 * time.Millisecond
+	// bbrMinPipeCwndPackets is the minimal congestion window in packets to keep the pipe full.
+	bbrMinPipeCwndPackets = 4
+
+	// Startup is exited when bandwidth has not grown by 25% for 3 rounds.
+	bbrFullBwThreshold = 1.25
+	bbrFullBwCount     = 3
+
+	// bbrLossThreshold is the maximum tolerated loss rate in a round.
+	bbrLossThreshold = 0.02
+	// bbrBeta is the multiplicative decrease of inflight upper bound on excessive loss.
+	bbrBeta = 0.7
+)
+
+// bbrPacingGainCycle is the pacing gains of ProbeBW phases: probe up, drain down and cruise.
+var bbrPacingGainCycle = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrMode uint8
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+func (s bbrMode) String() string {
+	switch s {
+	case bbrStartup:
+		return "startup"
+	case bbrDrain:
+		return "drain"
+	case bbrProbeBW:
+		return "probe_bw"
+	case bbrProbeRTT:
+		return "probe_rtt"
+	default:
+		return "unknown"
+	}
+}
+
+// bbr is a model-based congestion controller which estimates bottleneck bandwidth
+// and round-trip propagation time from delivery rate samples instead of reacting to
+// every loss. Inflight is bounded when loss rate of a round exceeds a threshold
+// or, at most once per round, when ECN-CE marks are reported as in BBRv2.
+// https://datatracker.ietf.org/doc/html/draft-cardwell-iccrg-bbr-congestion-control
+type bbr struct {
+	mode bbrMode
+
+	congestionWindow uint64
+	priorCwnd        uint64
+	maxDatagramSize  uint64
+	// pacingRate is the sending rate in bytes per second.
+	pacingRate uint64
+	pacingGain float64
+	cwndGain   float64
+
+	// btlBw is the windowed max delivery rate of the last bbrBtlBwFilterLen rounds.
+	btlBw     uint64
+	bwSamples [bbrBtlBwFilterLen]uint64
+	// minRTT is the windowed min RTT of the last bbrMinRTTFilterLen.
+	minRTT      time.Duration
+	minRTTStamp time.Time
+	// minRTTExpired is true when min RTT has not been refreshed within the filter window.
+	minRTTExpired bool
+
+	// Round trip counting.
+	roundCount         uint64
+	nextRoundDelivered uint64
+	roundStart         bool
+
+	// Full pipe detection in startup.
+	filledPipe  bool
+	fullBw      uint64
+	fullBwCount int
+
+	cycleIndex int
+	cycleStamp time.Time
+
+	probeRTTDoneStamp time.Time
+	probeRTTRoundDone bool
+
+	// inflightHi is the upper bound of data in flight set on excessive loss, zero if unbounded.
+	inflightHi     uint64
+	roundLost      uint64
+	roundDelivered uint64
+	// ceRound is roundCount+1 when inflight was last bounded on ECN-CE, zero if never.
+	ceRound uint64
+}
+
+// NewBBR creates a BBR congestion controller.
+func NewBBR() CongestionController {
+	s := &bbr{}
+	s.Reset()
+	return s
+}
+
+func (s *bbr) OnPacketSent(sentBytes uint64, now time.Time) {}
+
+// OnAck does nothing as BBR relies on delivery rate samples.
+func (s *bbr) OnAck(ackedBytes uint64, sentTime time.Time, rtt time.Duration, now time.Time) {}
+
+// OnCongestionEvent does nothing as loss is accounted per round in rate samples.
+// ECN-CE marks are handled in onCongestionExperienced.
+func (s *bbr) OnCongestionEvent(sentTime time.Time, now time.Time) {}
+
+// onCongestionExperienced bounds inflight when peer reports ECN-CE marks.
+func (s *bbr) onCongestionExperienced(sentTime time.Time, now time.Time) {
+	if s.ceRound == s.roundCount+1 {
+		return
+	}
+	s.ceRound = s.roundCount + 1
+	s.boundInflight()
+	if s.congestionWindow > s.inflightHi {
+		s.congestionWindow = s.inflightHi
+	}
+}
+
+func (s *bbr) OnPersistentCongestion(now time.Time) {
+	s.saveCwnd()
+	s.congestionWindow = 2 * s.maxDatagramSize
+}
+
+// https://datatracker.ietf.org/doc/html/draft-cardwell-iccrg-bbr-congestion-control#section-4.2
+func (s *bbr) OnRateSample(rs *RateSample, now time.Time) {
+	s.updateRound(rs)
+	s.updateBtlBw(rs)
+	s.updateMinRTT(rs, now)
+	s.checkLoss(rs)
+	s.checkFullPipe(rs)
+	s.checkDrain(rs, now)
+	s.updateCyclePhase(rs, now)
+	s.checkProbeRTT(rs, now)
+	s.setPacingRate()
+	s.setCwnd(rs)
+}
+
+func (s *bbr) CanSend(bytesInFlight uint64) bool {
+	return bytesInFlight < s.congestionWindow
+}
+
+func (s *bbr) CongestionWindow() uint64 {
+	return s.congestionWindow
+}
+
+// PacingRate returns the current pacing rate in bytes per second.
+func (s *bbr) PacingRate() uint64 {
+	return s.pacingRate
+}
+
+func (s *bbr) SetMaxDatagramSize(size uint64) {
+	s.maxDatagramSize = size
+	if s.congestionWindow < s.minPipeCwnd() {
+		s.congestionWindow = s.minPipeCwnd()
+	}
+}
+
+func (s *bbr) Reset() {
+	*s = bbr{}
+	s.maxDatagramSize = initialMaxDatagramSize
+	s.congestionWindow = initialWindow
+	s.enterStartup()
+	// Initial pacing rate assumes 1ms RTT until there is a sample.
+	s.pacingRate = uint64(bbrStartupGain * initialWindow / time.Millisecond.Seconds())
+}
+
+func (s *bbr) enterStartup() {
+	s.mode = bbrStartup
+	s.pacingGain = bbrStartupGain
+	s.cwndGain = bbrStartupGain
+}
+
+func (s *bbr) enterProbeBW(now time.Time) {
+	s.mode = bbrProbeBW
+	s.cwndGain = bbrCwndGain
+	// Start at a random phase except the drain one.
+	s.cycleIndex = int(uint64(now.UnixNano()) % uint64(len(bbrPacingGainCycle)-1))
+	if s.cycleIndex > 0 {
+		s.cycleIndex++
+	}
+	s.cycleStamp = now
+	s.pacingGain = bbrPacingGainCycle[s.cycleIndex]
+}
+
+func (s *bbr) updateRound(rs *RateSample) {
+	if rs.PriorDelivered >= s.nextRoundDelivered {
+		s.nextRoundDelivered = rs.TotalDelivered
+		s.roundCount++
+		s.roundStart = true
+	} else {
+		s.roundStart = false
+	}
+}
+
+func (s *bbr) updateBtlBw(rs *RateSample) {
+	if rs.DeliveryRate == 0 {
+		return
+	}
+	i := s.roundCount % bbrBtlBwFilterLen
+	if s.roundStart {
+		s.bwSamples[i] = 0
+	}
+	// Application-limited samples are only used when they increase the estimate.
+	if rs.DeliveryRate >= s.btlBw || !rs.AppLimited {
+		if rs.DeliveryRate > s.bwSamples[i] {
+			s.bwSamples[i] = rs.DeliveryRate
+		}
+		s.btlBw = 0
+		for _, bw := range s.bwSamples {
+			if bw > s.btlBw {
+				s.btlBw = bw
+			}
+		}
+	}
+}
+
+func (s *bbr) updateMinRTT(rs *RateSample, now time.Time) {
+	s.minRTTExpired = !s.minRTTStamp.IsZero() && now.Sub(s.minRTTStamp) > bbrMinRTTFilterLen
+	if rs.RTT > 0 && (s.minRTT == 0 || rs.RTT <= s.minRTT || s.minRTTExpired) {
+		s.minRTT = rs.RTT
+		s.minRTTStamp = now
+	}
+}
+
+// checkLoss bounds inflight when loss rate of the last round is too high.
+func (s *bbr) checkLoss(rs *RateSample) {
+	s.roundLost += rs.Lost
+	s.roundDelivered += rs.Delivered
+	if !s.roundStart {
+		return
+	}
+	total := s.roundLost + s.roundDelivered
+	if total > 0 && float64(s.roundLost) > bbrLossThreshold*float64(total) {
+		s.boundInflight()
+	} else if s.inflightHi > 0 && s.mode == bbrProbeBW && s.pacingGain > 1 {
+		// Probe for more inflight when there was no excessive loss.
+		s.inflightHi += s.inflightHi / 4
+	}
+	s.roundLost = 0
+	s.roundDelivered = 0
+}
+
+// boundInflight decreases the upper bound of inflight in response to congestion.
+func (s *bbr) boundInflight() {
+	hi := uint64(float64(s.congestionWindow) * bbrBeta)
+	if hi < s.minPipeCwnd() {
+		hi = s.minPipeCwnd()
+	}
+	s.inflightHi = hi
+	if s.mode == bbrStartup {
+		// Pipe is considered full on congestion.
+		s.filledPipe = true
+	}
+}
+
+func (s *bbr) checkFullPipe(rs *RateSample) {
+	if s.filledPipe || !s.roundStart || rs.AppLimited {
+		return
+	}
+	if float64(s.btlBw) >= float64(s.fullBw)*bbrFullBwThreshold {
+		s.fullBw = s.btlBw
+		s.fullBwCount = 0
+		return
+	}
+	s.fullBwCount++
+	if s.fullBwCount >= bbrFullBwCount {
+		s.filledPipe = true
+	}
+}
+
+func (s *bbr) checkDrain(rs *RateSample, now time.Time) {
+	if s.mode == bbrStartup && s.filledPipe {
+		s.mode = bbrDrain
+		s.pacingGain = bbrDrainGain
+		s.cwndGain = bbrStartupGain
+	}
+	if s.mode == bbrDrain && rs.BytesInFlight <= s.inflight(1) {
+		s.enterProbeBW(now)
+	}
+}
+
+func (s *bbr) updateCyclePhase(rs *RateSample, now time.Time) {
+	if s.mode != bbrProbeBW || !s.isNextCyclePhase(rs, now) {
+		return
+	}
+	s.cycleIndex = (s.cycleIndex + 1) % len(bbrPacingGainCycle)
+	s.cycleStamp = now
+	s.pacingGain = bbrPacingGainCycle[s.cycleIndex]
+}
+
+func (s *bbr) isNextCyclePhase(rs *RateSample, now time.Time) bool {
+	isFullLength := now.Sub(s.cycleStamp) > s.minRTT
+	if s.pacingGain > 1 {
+		return isFullLength && (rs.Lost > 0 || rs.BytesInFlight >= s.inflight(s.pacingGain))
+	}
+	if s.pacingGain < 1 {
+		return isFullLength || rs.BytesInFlight <= s.inflight(1)
+	}
+	return isFullLength
+}
+
+func (s *bbr) checkProbeRTT(rs *RateSample, now time.Time) {
+	if s.mode != bbrProbeRTT && s.minRTTExpired {
+		s.saveCwnd()
+		s.mode = bbrProbeRTT
+		s.pacingGain = 1
+		s.cwndGain = 1
+		s.probeRTTDoneStamp = time.Time{}
+	}
+	if s.mode != bbrProbeRTT {
+		return
+	}
+	if s.probeRTTDoneStamp.IsZero() {
+		if rs.BytesInFlight <= s.minPipeCwnd() {
+			s.probeRTTDoneStamp = now.Add(bbrProbeRTTDuration)
+			s.probeRTTRoundDone = false
+			s.nextRoundDelivered = rs.TotalDelivered
+		}
+		return
+	}
+	if s.roundStart {
+		s.probeRTTRoundDone = true
+	}
+	if s.probeRTTRoundDone && !now.Before(s.probeRTTDoneStamp) {
+		s.minRTTStamp = now
+		if s.congestionWindow < s.priorCwnd {
+			s.congestionWindow = s.priorCwnd
+		}
+		if s.filledPipe {
+			s.enterProbeBW(now)
+		} else {
+			s.enterStartup()
+		}
+	}
+}
+
+func (s *bbr) setPacingRate() {
+	if s.btlBw == 0 {
+		return
+	}
+	rate := uint64(s.pacingGain * float64(s.btlBw))
+	if s.filledPipe || rate > s.pacingRate {
+		s.pacingRate = rate
+	}
+}
+
+func (s *bbr) setCwnd(rs *RateSample) {
+	target := s.inflight(s.cwndGain)
+	if s.filledPipe {
+		s.congestionWindow += rs.Delivered
+		if s.congestionWindow > target {
+			s.congestionWindow = target
+		}
+	} else if s.congestionWindow < target || rs.TotalDelivered < initialWindow {
+		s.congestionWindow += rs.Delivered
+	}
+	if s.inflightHi > 0 && s.congestionWindow > s.inflightHi {
+		s.congestionWindow = s.inflightHi
+	}
+	if s.congestionWindow < s.minPipeCwnd() {
+		s.congestionWindow = s.minPipeCwnd()
+	}
+	if s.mode == bbrProbeRTT && s.congestionWindow > s.minPipeCwnd() {
+		s.congestionWindow = s.minPipeCwnd()
+	}
+}
+
+func (s *bbr) minPipeCwnd() uint64 {
+	return bbrMinPipeCwndPackets * s.maxDatagramSize
+}
+
+// inflight returns the estimated bandwidth-delay product multiplied by gain
+// plus some allowance for delayed and aggregated ACKs.
+func (s *bbr) inflight(gain float64) uint64 {
+	if s.minRTT == 0 || s.btlBw == 0 {
+		return initialWindow
+	}
+	bdp := float64(s.btlBw) * s.minRTT.Seconds()
+	return uint64(gain*bdp) + 3*s.maxDatagramSize
+}
+
+// saveCwnd remembers the last good congestion window to restore after ProbeRTT.
+func (s *bbr) saveCwnd() {
+	if s.mode != bbrProbeRTT || s.congestionWindow > s.priorCwnd {
+		s.priorCwnd = s.congestionWindow
+	}
+}
+
+func (s *bbr) String() string {
+	return fmt.Sprintf("bbr mode=%v cwnd=%d btlbw=%d minrtt=%v pacing=%d", s.mode, s.congestionWindow, s.btlBw, s.minRTT, s.pacingRate)
+}
@@ -0,0 +1,248 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// defaultActiveConnectionIDLimit is used when active_connection_id_limit is absent.
+	defaultActiveConnectionIDLimit = 2
+	// maxActiveConnectionIDs limits the number of connection IDs issued to peer.
+	maxActiveConnectionIDs = 8
+	// statelessResetTokenLen is the length of a stateless reset token.
+	statelessResetTokenLen = 16
+)
+
+// connectionID is an issued connection ID associated with a sequence number
+// and a stateless reset token.
+type connectionID struct {
+	seq        uint64
+	cid        []byte
+	resetToken []byte
+}
+
+func (s connectionID) String() string {
+	return fmt.Sprintf("seq=%d cid=%x", s.seq, s.cid)
+}
+
+// connectionIDManager keeps track of connection IDs issued by each endpoint.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-issuing-connection-ids
+type connectionIDManager struct {
+	// local contains connection IDs issued to peer, which peer uses as destination CID.
+	local        []connectionID
+	nextLocalSeq uint64
+	// peerLimit is the maximum number of active connection IDs peer is willing to store.
+	peerLimit uint64
+
+	// peer contains connection IDs issued by peer, which are used as destination CID.
+	peer []connectionID
+	// peerSeq is the sequence number of the destination CID currently in use.
+	peerSeq uint64
+	// localLimit is the maximum number of peer connection IDs we are willing to store.
+	localLimit uint64
+	// peerRetirePriorTo is the largest Retire Prior To value received.
+	peerRetirePriorTo uint64
+
+	// Sequence numbers of local CIDs that need to send NEW_CONNECTION_ID.
+	sendNew []uint64
+	// Sequence numbers of peer CIDs that need to send RETIRE_CONNECTION_ID.
+	sendRetire []uint64
+}
+
+// init sets the initial local connection ID with sequence number 0.
+func (s *connectionIDManager) init(scid, resetToken []byte, localLimit uint64) {
+	if localLimit == 0 {
+		localLimit = defaultActiveConnectionIDLimit
+	}
+	s.localLimit = localLimit
+	s.peerLimit = defaultActiveConnectionIDLimit
+	s.local = append(s.local[:0], connectionID{
+		seq:        0,
+		cid:        scid,
+		resetToken: resetToken,
+	})
+	s.nextLocalSeq = 1
+}
+
+// setPeerInitial sets destination connection ID used during the handshake
+// as peer connection ID with sequence number 0.
+func (s *connectionIDManager) setPeerInitial(dcid, resetToken []byte, peerLimit uint64) {
+	if peerLimit == 0 {
+		peerLimit = defaultActiveConnectionIDLimit
+	}
+	s.peerLimit = peerLimit
+	s.peer = append(s.peer[:0], connectionID{
+		seq:        0,
+		cid:        append([]byte(nil), dcid...),
+		resetToken: append([]byte(nil), resetToken...),
+	})
+	s.peerSeq = 0
+}
+
+// needIssue returns true when more connection IDs can be issued to peer.
+func (s *connectionIDManager) needIssue() bool {
+	limit := s.peerLimit
+	if limit > maxActiveConnectionIDs {
+		limit = maxActiveConnectionIDs
+	}
+	return uint64(len(s.local)) < limit
+}
+
+// issue adds a new local connection ID which will be sent to peer.
+func (s *connectionIDManager) issue(cid, resetToken []byte) {
+	seq := s.nextLocalSeq
+	s.nextLocalSeq++
+	s.local = append(s.local, connectionID{
+		seq:        seq,
+		cid:        cid,
+		resetToken: resetToken,
+	})
+	s.sendNew = append(s.sendNew, seq)
+}
+
+// hasLocal returns true if cid is an active local connection ID.
+func (s *connectionIDManager) hasLocal(cid []byte) bool {
+	for i := range s.local {
+		if bytes.Equal(s.local[i].cid, cid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *connectionIDManager) getLocal(seq uint64) *connectionID {
+	for i := range s.local {
+		if s.local[i].seq == seq {
+			return &s.local[i]
+		}
+	}
+	return nil
+}
+
+// retireLocal removes local connection ID when peer sends RETIRE_CONNECTION_ID.
+// It returns the retired connection ID or nil if it has been retired.
+func (s *connectionIDManager) retireLocal(seq uint64) ([]byte, error) {
+	if seq >= s.nextLocalSeq {
+		return nil, newError(ProtocolViolation, sprint("retire connection id ", seq))
+	}
+	for i := range s.local {
+		if s.local[i].seq == seq {
+			cid := s.local[i].cid
+			s.local = append(s.local[:i], s.local[i+1:]...)
+			// Do not send the CID if it has not been sent
+			s.sendNew = removeSequence(s.sendNew, seq)
+			return cid, nil
+		}
+	}
+	return nil, nil
+}
+
+// addPeer stores a new connection ID received in NEW_CONNECTION_ID frame.
+func (s *connectionIDManager) addPeer(f *newConnectionIDFrame) error {
+	if f.retirePriorTo > f.sequenceNumber {
+		return newError(FrameEncodingError, "new_connection_id retire_prior_to")
+	}
+	for i := range s.peer {
+		c := &s.peer[i]
+		if c.seq == f.sequenceNumber {
+			if !bytes.Equal(c.cid, f.connectionID) || !bytes.Equal(c.resetToken, f.statelessResetToken) {
+				return newError(ProtocolViolation, sprint("new connection id ", f.sequenceNumber))
+			}
+			// Retransmitted frame
+			return nil
+		}
+	}
+	if f.sequenceNumber < s.peerRetirePriorTo {
+		// Already retired, just tell peer.
+		s.sendRetire = append(s.sendRetire, f.sequenceNumber)
+		return nil
+	}
+	s.peer = append(s.peer, connectionID{
+		seq:        f.sequenceNumber,
+		cid:        append([]byte(nil), f.connectionID...),
+		resetToken: append([]byte(nil), f.statelessResetToken...),
+	})
+	if f.retirePriorTo > s.peerRetirePriorTo {
+		s.peerRetirePriorTo = f.retirePriorTo
+		s.retirePeerPriorTo(f.retirePriorTo)
+	}
+	if uint64(len(s.peer)) > s.localLimit {
+		return newError(ConnectionIDLimitError, sprint("active connection ids exceeded ", s.localLimit))
+	}
+	return nil
+}
+
+// retirePeerPriorTo retires all peer connection IDs with sequence number less than seq.
+func (s *connectionIDManager) retirePeerPriorTo(seq uint64) {
+	n := 0
+	for _, c := range s.peer {
+		if c.seq < seq {
+			s.sendRetire = append(s.sendRetire, c.seq)
+		} else {
+			s.peer[n] = c
+			n++
+		}
+	}
+	for i := n; i < len(s.peer); i++ {
+		s.peer[i] = connectionID{}
+	}
+	s.peer = s.peer[:n]
+}
+
+// activePeer returns the destination connection ID currently in use.
+func (s *connectionIDManager) activePeer() *connectionID {
+	for i := range s.peer {
+		if s.peer[i].seq == s.peerSeq {
+			return &s.peer[i]
+		}
+	}
+	return nil
+}
+
+// nextPeer returns the unused peer connection ID with smallest sequence number
+// or nil if there is none.
+func (s *connectionIDManager) nextPeer() *connectionID {
+	var next *connectionID
+	for i := range s.peer {
+		c := &s.peer[i]
+		if c.seq > s.peerSeq && (next == nil || c.seq < next.seq) {
+			next = c
+		}
+	}
+	return next
+}
+
+// usePeer switches the destination connection ID to the one with given sequence
+// number and retires the current one.
+func (s *connectionIDManager) usePeer(seq uint64) {
+	if seq == s.peerSeq {
+		return
+	}
+	for i := range s.peer {
+		if s.peer[i].seq == s.peerSeq {
+			s.sendRetire = append(s.sendRetire, s.peerSeq)
+			s.peer = append(s.peer[:i], s.peer[i+1:]...)
+			break
+		}
+	}
+	s.peerSeq = seq
+}
+
+// hasUpdate returns true when there are connection ID frames to send.
+func (s *connectionIDManager) hasUpdate() bool {
+	return len(s.sendNew) > 0 || len(s.sendRetire) > 0
+}
+
+func removeSequence(seqs []uint64, seq uint64) []uint64 {
+	for i, v := range seqs {
+		if v == seq {
+			return append(seqs[:i], seqs[i+1:]...)
+		}
+	}
+	return seqs
+}
+
+func (s *connectionIDManager) String() string {
+	return fmt.Sprintf("local=%v peer=%v active=%d", s.local, s.peer, s.peerSeq)
+}
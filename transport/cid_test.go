@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConnectionIDManagerIssue(t *testing.T) {
+	var m connectionIDManager
+	m.init([]byte{1}, nil, 4)
+	if !m.hasLocal([]byte{1}) {
+		t.Fatalf("expect local cid %x, actual %v", []byte{1}, &m)
+	}
+	m.setPeerInitial([]byte{2}, nil, 3)
+	for i := byte(2); m.needIssue(); i++ {
+		m.issue([]byte{i}, make([]byte, statelessResetTokenLen))
+	}
+	if len(m.local) != 3 || len(m.sendNew) != 2 {
+		t.Fatalf("expect 3 local cids, actual %v %v", &m, m.sendNew)
+	}
+	cid, err := m.retireLocal(1)
+	if err != nil || !bytes.Equal(cid, []byte{2}) {
+		t.Fatalf("expect retired cid %x, actual %x %v", []byte{2}, cid, err)
+	}
+	if len(m.sendNew) != 1 || m.sendNew[0] != 2 || !m.needIssue() {
+		t.Fatalf("expect sending new cid 2, actual %v %v", &m, m.sendNew)
+	}
+	cid, err = m.retireLocal(1)
+	if err != nil || cid != nil {
+		t.Fatalf("expect no retired cid, actual %x %v", cid, err)
+	}
+	_, err = m.retireLocal(5)
+	if err == nil || err.(*Error).Code != ProtocolViolation {
+		t.Fatalf("expect error %v, actual %v", ProtocolViolation, err)
+	}
+}
+
+func TestConnectionIDManagerPeer(t *testing.T) {
+	var m connectionIDManager
+	m.init([]byte{1}, nil, 3)
+	m.setPeerInitial([]byte{2}, nil, 0)
+	token := make([]byte, statelessResetTokenLen)
+	err := m.addPeer(newNewConnectionIDFrame(1, 0, []byte{3}, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Retransmission
+	err = m.addPeer(newNewConnectionIDFrame(1, 0, []byte{3}, token))
+	if err != nil || len(m.peer) != 2 {
+		t.Fatalf("expect 2 peer cids, actual %v %v", &m, err)
+	}
+	err = m.addPeer(newNewConnectionIDFrame(1, 0, []byte{4}, token))
+	if err == nil || err.(*Error).Code != ProtocolViolation {
+		t.Fatalf("expect error %v, actual %v", ProtocolViolation, err)
+	}
+	// Retire sequence 0 which is in use
+	err = m.addPeer(newNewConnectionIDFrame(2, 1, []byte{5}, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.activePeer() != nil || len(m.sendRetire) != 1 || m.sendRetire[0] != 0 {
+		t.Fatalf("expect cid 0 retired, actual %v %v", &m, m.sendRetire)
+	}
+	next := m.nextPeer()
+	if next == nil || next.seq != 1 {
+		t.Fatalf("expect next peer cid 1, actual %v", next)
+	}
+	m.usePeer(next.seq)
+	if c := m.activePeer(); c == nil || !bytes.Equal(c.cid, []byte{3}) {
+		t.Fatalf("expect active peer cid %x, actual %v", []byte{3}, c)
+	}
+	// Retired sequence
+	err = m.addPeer(newNewConnectionIDFrame(0, 0, []byte{2}, token))
+	if err != nil || len(m.sendRetire) != 2 {
+		t.Fatalf("expect retiring cid 0, actual %v %v", m.sendRetire, err)
+	}
+	err = m.addPeer(newNewConnectionIDFrame(3, 1, []byte{6}, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.addPeer(newNewConnectionIDFrame(4, 1, []byte{7}, token))
+	if err == nil || err.(*Error).Code != ConnectionIDLimitError {
+		t.Fatalf("expect error %v, actual %v", ConnectionIDLimitError, err)
+	}
+}
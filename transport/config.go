@@ -7,8 +7,8 @@ import (
 )
 
 const (
-	// ProtocolVersion is the supported QUIC version
-	ProtocolVersion = 0xff000000 + 29
+	// ProtocolVersion is the default QUIC version.
+	ProtocolVersion = Version1
 
 	// MaxCIDLength is the maximum length of a Connection ID
 	MaxCIDLength = 20
@@ -23,25 +23,71 @@ const (
 	MaxPacketSize = 65527
 	// MinInitialPacketSize is the QUIC minimum packet size when it contains Initial packet.
 	MinInitialPacketSize = 1200
+	// MinStatelessResetLength is the minimum size of a stateless reset packet.
+	// Packets not larger than this size must not trigger a stateless reset to avoid looping.
+	MinStatelessResetLength = 5 + statelessResetTokenLen
 
 	minPayloadLength = 4
 
 	// Crypto is not under flow control, but we still enforce a hard limit.
 	cryptoMaxData = 1 << 20
+
+	// Default maximum receive windows for flow control auto-tuning.
+	defaultMaxConnectionWindow = 24 << 20
+	defaultMaxStreamWindow     = 16 << 20
 )
 
 // Config is a QUIC connection configuration.
 // This implementaton utilizes tls.Config.Rand and tls.Config.Time if available.
 type Config struct {
+	// Version is the QUIC version client uses in its first Initial packet.
 	Version uint32
-	TLS     *tls.Config
-	Params  Parameters
+	// Versions is the list of supported versions in order of preference.
+	// Client chooses from it when receiving a Version Negotiation packet and server
+	// only accepts these versions. Only Version is supported when it is empty.
+	Versions []uint32
+	TLS      *tls.Config
+	Params   Parameters
+
+	// StatelessResetKey is the secret used to derive stateless reset tokens from connection IDs.
+	// It must be kept across restarts so that the server can reset connections it has lost state of.
+	// Tokens are randomly generated when it is not set. quic.Server generates a random key
+	// when it is not set, so its stateless resets only work until the server is restarted.
+	StatelessResetKey []byte
+
+	// EarlyData enables sending (client) or accepting (server) 0-RTT data.
+	// Client also needs TLS.ClientSessionCache to resume sessions.
+	// Server only accepts early data when its transport parameters have not changed
+	// since the session ticket was issued. Application must tolerate replayed early data.
+	EarlyData bool
+
+	// Grease enables sending a reserved transport parameter and offering a reserved
+	// version in version information, so peers and middleboxes intolerant of unknown
+	// values are found early. The QUIC Bit is advertised separately in Params.GreaseQUICBit.
+	// https://www.rfc-editor.org/rfc/rfc9000.html#name-reserved-transport-paramete
+	Grease bool
+
+	// CongestionController creates a congestion controller for each connection.
+	// NewReno is used when it is nil, NewCubic and NewBBR are alternatives.
+	CongestionController func() CongestionController
+
+	// MaxStreamsPolicy decides when peer is allowed to open more streams after its
+	// streams have been closed. Default is MaxStreamsWindow.
+	MaxStreamsPolicy MaxStreamsPolicy
+
+	// MaxConnectionWindow and MaxStreamWindow are the maximum receive windows of connection and
+	// stream flow control. Windows start at Params.InitialMaxData and Params.InitialMaxStreamData*,
+	// and are doubled when peer consumes a window within two RTTs.
+	// Auto-tuning is disabled when they are not larger than the initial values.
+	MaxConnectionWindow uint64
+	MaxStreamWindow     uint64
 }
 
 // NewConfig creates a default configuration.
 func NewConfig() *Config {
 	return &Config{
-		Version: ProtocolVersion,
+		Version:  ProtocolVersion,
+		Versions: []uint32{Version1, VersionDraft29},
 		Params: Parameters{
 			MaxIdleTimeout:   30 * time.Second,
 			AckDelayExponent: 3,
@@ -53,10 +99,10 @@ func NewConfig() *Config {
 			InitialMaxStreamDataUni:        1024,
 			InitialMaxStreamsBidi:          1,
 			InitialMaxStreamsUni:           1,
+
+			ActiveConnectionIDLimit: defaultActiveConnectionIDLimit,
 		},
+		MaxConnectionWindow: defaultMaxConnectionWindow,
+		MaxStreamWindow:     defaultMaxStreamWindow,
 	}
 }
-
-func versionSupported(ver uint32) bool {
-	return ver == ProtocolVersion
-}
@@ -0,0 +1,138 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+)
+
+// CongestionController controls the amount of data in flight of a connection.
+// All sizes are in bytes and only include in-flight packets.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-congestion-control
+type CongestionController interface {
+	// OnPacketSent is called when an in-flight packet is sent.
+	OnPacketSent(sentBytes uint64, now time.Time)
+	// OnAck is called when an in-flight packet sent at sentTime is acknowledged.
+	// rtt is the current smoothed round-trip time.
+	OnAck(ackedBytes uint64, sentTime time.Time, rtt time.Duration, now time.Time)
+	// OnCongestionEvent is called when a packet sent at sentTime is detected lost.
+	OnCongestionEvent(sentTime time.Time, now time.Time)
+	// OnPersistentCongestion is called when persistent congestion is established.
+	OnPersistentCongestion(now time.Time)
+	// OnRateSample is called with the delivery rate sample after an ACK frame is processed.
+	OnRateSample(rs *RateSample, now time.Time)
+	// CanSend returns true when more data can be sent with bytesInFlight.
+	CanSend(bytesInFlight uint64) bool
+	// CongestionWindow returns the current congestion window.
+	CongestionWindow() uint64
+	// SetMaxDatagramSize is called when the maximum datagram size of the path has changed.
+	SetMaxDatagramSize(size uint64)
+	// Reset resets the controller to its initial state when the path has changed.
+	Reset()
+}
+
+// RateSample is a delivery rate sample generated when in-flight packets are acknowledged.
+// https://datatracker.ietf.org/doc/html/draft-cheng-iccrg-delivery-rate-estimation
+type RateSample struct {
+	// DeliveryRate is the estimated delivery rate in bytes per second,
+	// zero when the sample is invalid.
+	DeliveryRate uint64
+	// Delivered is the amount of data delivered during the sample interval.
+	Delivered uint64
+	// Interval is the length of the sample interval.
+	Interval time.Duration
+	// PriorDelivered is the total data delivered when the most recently sent
+	// acknowledged packet was sent.
+	PriorDelivered uint64
+	// TotalDelivered is the total data delivered by the connection so far.
+	TotalDelivered uint64
+	// RTT is the round-trip time of the most recently sent acknowledged packet.
+	RTT time.Duration
+	// Lost is the amount of data detected lost while processing the ACK frame.
+	Lost uint64
+	// BytesInFlight is the amount of data in flight after the ACK frame is processed.
+	BytesInFlight uint64
+	// AppLimited is true when the sample was taken while the sender was application-limited.
+	AppLimited bool
+}
+
+// newReno is the congestion controller described in RFC 9002.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-congestion-control
+type newReno struct {
+	congestionWindow   uint64
+	slowStartThreshold uint64
+	recoveryStartTime  time.Time
+	maxDatagramSize    uint64
+}
+
+// NewReno creates a NewReno congestion controller, which is used by default.
+func NewReno() CongestionController {
+	s := &newReno{}
+	s.Reset()
+	return s
+}
+
+func (s *newReno) OnPacketSent(sentBytes uint64, now time.Time) {}
+
+func (s *newReno) OnAck(ackedBytes uint64, sentTime time.Time, rtt time.Duration, now time.Time) {
+	if s.inRecovery(sentTime) {
+		// Do not increase congestion window in recovery period.
+		return
+	}
+	if s.congestionWindow < s.slowStartThreshold {
+		// Slow start.
+		s.congestionWindow += ackedBytes
+	} else {
+		// Congestion avoidance.
+		s.congestionWindow += (s.maxDatagramSize * ackedBytes) / s.congestionWindow
+	}
+}
+
+func (s *newReno) OnCongestionEvent(sentTime time.Time, now time.Time) {
+	// Start a new congestion event if packet was sent after the start of the previous one.
+	if s.inRecovery(sentTime) {
+		return
+	}
+	s.recoveryStartTime = now
+	s.congestionWindow /= 2
+	if s.congestionWindow < 2*s.maxDatagramSize {
+		s.congestionWindow = 2 * s.maxDatagramSize
+	}
+	s.slowStartThreshold = s.congestionWindow
+}
+
+func (s *newReno) OnPersistentCongestion(now time.Time) {
+	s.congestionWindow = 2 * s.maxDatagramSize
+	s.recoveryStartTime = time.Time{}
+}
+
+func (s *newReno) OnRateSample(rs *RateSample, now time.Time) {}
+
+func (s *newReno) CanSend(bytesInFlight uint64) bool {
+	return bytesInFlight < s.congestionWindow
+}
+
+func (s *newReno) CongestionWindow() uint64 {
+	return s.congestionWindow
+}
+
+func (s *newReno) SetMaxDatagramSize(size uint64) {
+	s.maxDatagramSize = size
+	if s.congestionWindow < 2*size {
+		s.congestionWindow = 2 * size
+	}
+}
+
+func (s *newReno) Reset() {
+	s.maxDatagramSize = initialMaxDatagramSize
+	s.congestionWindow = initialWindow
+	s.slowStartThreshold = maxUint64
+	s.recoveryStartTime = time.Time{}
+}
+
+func (s *newReno) inRecovery(sentTime time.Time) bool {
+	return !s.recoveryStartTime.IsZero() && !sentTime.After(s.recoveryStartTime)
+}
+
+func (s *newReno) String() string {
+	return fmt.Sprintf("reno cwnd=%d ssthresh=%d", s.congestionWindow, s.slowStartThreshold)
+}
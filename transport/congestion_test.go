@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewReno(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtt := 100 * time.Millisecond
+	cc := NewReno()
+	if cc.CongestionWindow() != initialWindow || !cc.CanSend(initialWindow-1) || cc.CanSend(initialWindow) {
+		t.Fatalf("expect initial window: %v", cc)
+	}
+	// Slow start
+	cc.OnAck(1000, now, rtt, now.Add(rtt))
+	if cc.CongestionWindow() != initialWindow+1000 {
+		t.Fatalf("expect congestion window: %v, actual: %v", initialWindow+1000, cc.CongestionWindow())
+	}
+	now = now.Add(rtt)
+	cc.OnCongestionEvent(now.Add(-rtt), now)
+	cwnd := uint64((initialWindow + 1000) / 2)
+	if cc.CongestionWindow() != cwnd {
+		t.Fatalf("expect congestion window: %v, actual: %v", cwnd, cc.CongestionWindow())
+	}
+	// No change for packets sent before recovery
+	cc.OnCongestionEvent(now.Add(-rtt), now.Add(time.Millisecond))
+	cc.OnAck(1000, now.Add(-rtt), rtt, now.Add(time.Millisecond))
+	if cc.CongestionWindow() != cwnd {
+		t.Fatalf("expect congestion window: %v, actual: %v", cwnd, cc.CongestionWindow())
+	}
+	// Congestion avoidance
+	cc.OnAck(cwnd, now.Add(time.Millisecond), rtt, now.Add(rtt))
+	if cc.CongestionWindow() != cwnd+initialMaxDatagramSize {
+		t.Fatalf("expect congestion window: %v, actual: %v", cwnd+initialMaxDatagramSize, cc.CongestionWindow())
+	}
+	cc.OnPersistentCongestion(now)
+	if cc.CongestionWindow() != minimumWindow {
+		t.Fatalf("expect congestion window: %v, actual: %v", minimumWindow, cc.CongestionWindow())
+	}
+	cc.Reset()
+	if cc.CongestionWindow() != initialWindow {
+		t.Fatalf("expect congestion window: %v, actual: %v", initialWindow, cc.CongestionWindow())
+	}
+}
+
+func TestCubic(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtt := 100 * time.Millisecond
+	cc := NewCubic()
+	if cc.CongestionWindow() != initialWindow {
+		t.Fatalf("expect initial window: %v", cc)
+	}
+	wMax := uint64(100 * initialMaxDatagramSize)
+	cc.OnAck(wMax-initialWindow, now, rtt, now.Add(rtt))
+	now = now.Add(rtt)
+	// Multiplicative decrease
+	cc.OnCongestionEvent(now.Add(-rtt), now)
+	cwnd := uint64(float64(wMax) * cubicBeta)
+	if cc.CongestionWindow() != cwnd {
+		t.Fatalf("expect congestion window: %v, actual: %v", cwnd, cc.CongestionWindow())
+	}
+	// Window grows back to wMax in K seconds and stays concave before that.
+	k := time.Duration(float64(time.Second) * math.Cbrt(float64(wMax-cwnd)/initialMaxDatagramSize/cubicC))
+	sent := now.Add(time.Millisecond)
+	for elapsed := time.Duration(0); elapsed < k-rtt; elapsed += rtt {
+		before := cc.CongestionWindow()
+		cc.OnAck(before, sent, rtt, sent.Add(elapsed))
+		if cc.CongestionWindow() < before || cc.CongestionWindow() > wMax {
+			t.Fatalf("expect congestion window in [%v, %v], actual: %v", before, wMax, cc.CongestionWindow())
+		}
+	}
+	for elapsed := k - rtt; elapsed < k+2*rtt; elapsed += rtt {
+		cc.OnAck(cc.CongestionWindow(), sent, rtt, sent.Add(elapsed))
+	}
+	if cc.CongestionWindow() < wMax*99/100 {
+		t.Fatalf("expect congestion window reaches %v, actual: %v", wMax, cc.CongestionWindow())
+	}
+	// Fast convergence when window has not reached previous maximum.
+	cc.OnCongestionEvent(sent.Add(k), sent.Add(k+rtt))
+	cwnd = cc.CongestionWindow()
+	cc.OnCongestionEvent(sent.Add(k+2*rtt), sent.Add(k+3*rtt))
+	if cc.CongestionWindow() != uint64(float64(cwnd)*cubicBeta) {
+		t.Fatalf("expect congestion window: %v, actual: %v", uint64(float64(cwnd)*cubicBeta), cc.CongestionWindow())
+	}
+	if c := cc.(*cubic); c.wMax >= float64(cwnd) {
+		t.Fatalf("expect fast convergence: wMax=%v cwnd=%v", c.wMax, cwnd)
+	}
+	cc.OnPersistentCongestion(now)
+	if cc.CongestionWindow() != minimumWindow {
+		t.Fatalf("expect congestion window: %v, actual: %v", minimumWindow, cc.CongestionWindow())
+	}
+}
+
+func TestBBR(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	const bw = 1000000 // bytes per second
+	rtt := 100 * time.Millisecond
+	bdp := uint64(bw * rtt.Seconds())
+	cc := NewBBR().(*bbr)
+	var delivered uint64
+	// Each sample is a round trip delivering a congestion window, limited by the bottleneck bandwidth.
+	round := func(lossRate float64) {
+		inflight := cc.CongestionWindow()
+		if inflight > bdp {
+			inflight = bdp
+		}
+		rs := RateSample{
+			DeliveryRate:   uint64(float64(inflight) / rtt.Seconds()),
+			Delivered:      inflight,
+			Interval:       rtt,
+			PriorDelivered: delivered,
+			TotalDelivered: delivered + inflight,
+			RTT:            rtt,
+			Lost:           uint64(float64(inflight) * lossRate),
+			BytesInFlight:  inflight / 2,
+		}
+		delivered += inflight
+		now = now.Add(rtt)
+		cc.OnRateSample(&rs, now)
+	}
+	for i := 0; i < 20; i++ {
+		round(0)
+	}
+	if cc.mode != bbrProbeBW || !cc.filledPipe {
+		t.Fatalf("expect probe bw mode: %v", cc)
+	}
+	if cc.btlBw != bw || cc.minRTT != rtt {
+		t.Fatalf("expect bottleneck bandwidth %v and min rtt %v: %v", bw, rtt, cc)
+	}
+	if cc.CongestionWindow() != cc.inflight(bbrCwndGain) {
+		t.Fatalf("expect congestion window: %v, actual: %v", cc.inflight(bbrCwndGain), cc.CongestionWindow())
+	}
+	// Random loss below threshold is ignored.
+	cwnd := cc.CongestionWindow()
+	round(0.01)
+	round(0.01)
+	if cc.CongestionWindow() != cwnd || cc.inflightHi != 0 {
+		t.Fatalf("expect congestion window unchanged: %v", cc)
+	}
+	// Excessive loss bounds inflight.
+	round(0.1)
+	round(0)
+	if cc.inflightHi == 0 || cc.CongestionWindow() > cc.inflightHi {
+		t.Fatalf("expect inflight bounded: %v", cc)
+	}
+	// ECN-CE bounds inflight once per round.
+	cc.inflightHi = 0
+	cwnd = cc.CongestionWindow()
+	cc.onCongestionExperienced(now, now)
+	cc.onCongestionExperienced(now, now)
+	if expect := uint64(float64(cwnd) * bbrBeta); cc.inflightHi != expect || cc.CongestionWindow() != expect {
+		t.Fatalf("expect inflight bounded to %v: %v", expect, cc)
+	}
+	round(0)
+	cwnd = cc.CongestionWindow()
+	cc.onCongestionExperienced(now, now)
+	if expect := uint64(float64(cwnd) * bbrBeta); cc.inflightHi != expect {
+		t.Fatalf("expect inflight bounded to %v: %v", expect, cc)
+	}
+	// ECN-CE in startup exits startup.
+	startup := NewBBR().(*bbr)
+	startup.onCongestionExperienced(now, now)
+	if !startup.filledPipe || startup.CongestionWindow() >= initialWindow {
+		t.Fatalf("expect pipe filled: %v", startup)
+	}
+	// ProbeRTT when min RTT has not been updated for a while.
+	now = now.Add(bbrMinRTTFilterLen + rtt)
+	rs := RateSample{
+		Delivered:      bdp,
+		PriorDelivered: delivered,
+		TotalDelivered: delivered + bdp,
+		RTT:            2 * rtt,
+		BytesInFlight:  cc.minPipeCwnd(),
+	}
+	delivered += bdp
+	cc.OnRateSample(&rs, now)
+	if cc.mode != bbrProbeRTT || cc.CongestionWindow() != cc.minPipeCwnd() {
+		t.Fatalf("expect probe rtt mode: %v", cc)
+	}
+}
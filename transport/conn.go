@@ -3,6 +3,8 @@ package transport
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
 	"io"
 	"time"
 )
@@ -21,34 +23,51 @@ const (
 type Conn struct {
 	isClient bool
 	version  uint32
+	versions []uint32 // Supported versions in order of preference.
 
 	scid  []byte // Source CID
 	dcid  []byte // Destination CID. DCID can be replaced in recvPacketInitial.
 	odcid []byte // Original destination CID. Used to validate transport parameters.
 	rscid []byte // Retry source CID. Set in recvPacketRetry.
+	icid  []byte // DCID of client Initial packets which initial keys are derived from.
 	token []byte // Stateless retry token
+	// newToken is the address validation token to be sent in NEW_TOKEN frame.
+	newToken []byte
 
 	packetNumberSpaces [packetSpaceCount]packetNumberSpace
 	streams            streamMap
+	connIDs            connectionIDManager
+	paths              pathManager
+	datagrams          datagramQueue
 
 	localParams Parameters
 	peerParams  Parameters
+	resetKey    []byte // Secret to derive stateless reset tokens.
 
 	handshake tlsHandshake
 	recovery  lossRecovery
 	flow      flowControl
+	// Maximum receive window of streams flow control can grow to.
+	maxStreamWindow uint64
 
 	state                 connectionState
 	gotPeerCID            bool
 	didRetry              bool
 	didVersionNegotiation bool
+	// originalVersion is the version of the client first Initial packet, after a Version
+	// Negotiation packet if any, which may differ from the negotiated compatible version.
+	originalVersion       uint32
 	ackElicitingSent      bool // Whether an ACK-eliciting packet has been sent since last receiving a packet.
 	handshakeConfirmed    bool // On server, it's handshakeDone frame sent. On client, it's the frame received
 	derivedInitialSecrets bool
 	updateMaxData         bool // Whether a MAX_DATA needs to be sent
+	zeroRTT               bool // Client is sending 0-RTT packets with remembered transport parameters
 
 	closeFrame *connectionCloseFrame // Error to be send to peer
 
+	recvECN ECN // ECN codepoint of the datagram being processed.
+	sendECN ECN // ECN codepoint of the datagram last produced by ReadTo.
+
 	idleTimer     time.Time // Idle timeout expiration time.
 	drainingTimer time.Time // Draining timeout expiration time.
 
@@ -75,23 +94,55 @@ func newConn(config *Config, scid, odcid []byte, isClient bool) (*Conn, error) {
 		return nil, newError(ProtocolViolation, "cid too long")
 	}
 	s := &Conn{
-		version:     config.Version,
-		isClient:    isClient,
-		localParams: config.Params,
-		state:       stateAttempted,
+		version:         config.Version,
+		versions:        config.Versions,
+		isClient:        isClient,
+		localParams:     config.Params,
+		resetKey:        config.StatelessResetKey,
+		state:           stateAttempted,
+		originalVersion: config.Version,
+	}
+	if len(s.versions) == 0 {
+		s.versions = []uint32{s.version}
 	}
 	s.handshake.init(s, config.TLS)
 	now := s.time() // Depends on handshake TLS config
+	if config.Grease {
+		s.localParams.grease = make([]byte, reservedParamRandLen)
+		if err := s.rand(s.localParams.grease); err != nil {
+			return nil, err
+		}
+	}
 	for i := range s.packetNumberSpaces {
 		s.packetNumberSpaces[i].init()
 	}
 	s.streams.init(s.localParams.InitialMaxStreamsBidi, s.localParams.InitialMaxStreamsUni)
+	s.streams.policy = config.MaxStreamsPolicy
+	s.paths.init()
+	if config.CongestionController != nil {
+		s.recovery.cc = config.CongestionController()
+	}
 	s.recovery.init(now)
+	if !isClient && len(odcid) == 0 {
+		// Client address has not been validated with a Retry token so anti-amplification
+		// limit applies until a Handshake packet is received.
+		// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-address-validation
+		s.paths.active.validated = false
+		s.paths.active.limited = true
+	}
+	// Server always knows that client has validated server address.
+	s.recovery.peerCompletedAddressValidation = !isClient
 	s.flow.init(s.localParams.InitialMaxData, 0)
+	s.flow.setMaxWindow(config.MaxConnectionWindow)
+	s.maxStreamWindow = config.MaxStreamWindow
 	if len(scid) > 0 {
 		s.scid = append(s.scid[:0], scid...)
 	}
 	s.localParams.InitialSourceCID = s.scid // SCID is fixed so can use its reference
+	if len(s.resetKey) > 0 && len(s.scid) > 0 {
+		s.localParams.StatelessResetToken = StatelessResetToken(s.resetKey, s.scid)
+	}
+	s.connIDs.init(s.scid, s.localParams.StatelessResetToken, s.localParams.ActiveConnectionIDLimit)
 	if len(odcid) > 0 {
 		s.odcid = append(s.odcid[:0], odcid...)
 		s.localParams.OriginalDestinationCID = s.odcid
@@ -112,13 +163,70 @@ func newConn(config *Config, scid, odcid []byte, isClient bool) (*Conn, error) {
 		}
 		s.deriveInitialKeyMaterial(s.dcid)
 	}
-	s.handshake.setTransportParams(&s.localParams)
+	s.setTransportParams()
+	if config.EarlyData {
+		s.handshake.setEarlyData(true, s.earlyDataContext())
+	}
 	return s, nil
 }
 
+// earlyDataContext returns local transport parameters which are not specific to
+// this connection. Server rejects early data when they are different from
+// the parameters remembered in the session ticket.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-values-of-transport-paramet
+func (s *Conn) earlyDataContext() []byte {
+	params := s.localParams
+	params.OriginalDestinationCID = nil
+	params.InitialSourceCID = nil
+	params.RetrySourceCID = nil
+	params.StatelessResetToken = nil
+	params.ChosenVersion = 0
+	params.AvailableVersions = nil
+	params.grease = nil
+	return params.marshal()
+}
+
+// setTransportParams sets local transport parameters with current version information to TLS.
+func (s *Conn) setTransportParams() {
+	s.localParams.ChosenVersion = s.version
+	s.localParams.AvailableVersions = s.versions
+	if len(s.localParams.grease) > 0 {
+		var b [4]byte
+		if err := s.rand(b[:]); err == nil {
+			// Reserved versions follow the pattern 0x?a?a?a?a.
+			// https://www.rfc-editor.org/rfc/rfc9000.html#name-versions
+			reserved := binary.BigEndian.Uint32(b[:])&0xf0f0f0f0 | 0x0a0a0a0a
+			s.localParams.AvailableVersions = append(s.versions[:len(s.versions):len(s.versions)], reserved)
+		}
+	}
+	s.handshake.setTransportParams(&s.localParams)
+}
+
 // Write consumes received data.
 func (s *Conn) Write(b []byte) (int, error) {
+	return s.WriteFrom(b, Path{})
+}
+
+// WriteFrom consumes data received on the network path addr.
+// The path is used to detect peer address changes and to validate new paths.
+func (s *Conn) WriteFrom(b []byte, addr Path) (int, error) {
+	return s.WriteFromECN(b, addr, ECNNotECT)
+}
+
+// WriteFromECN is like WriteFrom but also takes the ECN codepoint in the IP header
+// of the received datagram, which is reported back to peer in ACK frames.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-explicit-congestion-notific
+func (s *Conn) WriteFromECN(b []byte, addr Path, ecn ECN) (int, error) {
 	now := s.time()
+	s.recvECN = ecn
+	path := s.paths.get(addr)
+	if path == nil {
+		// New path is only kept when its packets are successfully processed.
+		path = newNetworkPath(addr, false)
+		path.limited = true
+	}
+	path.recvBytes += uint64(len(b))
+	s.paths.recv = path
 	n := 0
 	for n < len(b) {
 		if !s.drainingTimer.IsZero() || s.closeFrame != nil {
@@ -131,13 +239,18 @@ func (s *Conn) Write(b []byte) (int, error) {
 		}
 		n += i
 	}
+	if len(b) > 0 {
+		// Received data may have lifted anti-amplification limit.
+		s.recovery.setAmplificationLimited(s.paths.active.isAmplificationLimited(), now)
+	}
 	s.checkTimeout(now)
 	return n, nil
 }
 
 func (s *Conn) deriveInitialKeyMaterial(cid []byte) {
 	aead := initialAEAD{}
-	aead.init(cid)
+	aead.init(s.version, cid)
+	s.icid = append(s.icid[:0], cid...)
 	space := &s.packetNumberSpaces[packetSpaceInitial]
 	if s.isClient {
 		space.opener, space.sealer = aead.server, aead.client
@@ -147,6 +260,21 @@ func (s *Conn) deriveInitialKeyMaterial(cid []byte) {
 	s.derivedInitialSecrets = true
 }
 
+// switchVersion changes to a compatible version during the handshake.
+// Initial keys are derived again for the new version.
+// https://www.rfc-editor.org/rfc/rfc9368.html#name-compatible-versions
+func (s *Conn) switchVersion(version uint32) {
+	debug("switch version from 0x%x to 0x%x", s.version, version)
+	if !s.isClient {
+		// Client may still send Initial packets in the original version until it
+		// receives the server first Initial packet.
+		space := &s.packetNumberSpaces[packetSpaceInitial]
+		space.originalOpener = space.opener
+	}
+	s.version = version
+	s.deriveInitialKeyMaterial(s.icid)
+}
+
 func (s *Conn) recv(b []byte, now time.Time) (int, error) {
 	p := packet{
 		header: packetHeader{
@@ -165,7 +293,7 @@ func (s *Conn) recv(b []byte, now time.Time) (int, error) {
 	case packetTypeInitial:
 		return s.recvPacketInitial(b, &p, now)
 	case packetTypeZeroRTT:
-		return 0, newError(InternalError, "zerortt packet not supported")
+		return s.recvPacketZeroRTT(b, &p, now)
 	case packetTypeHandshake:
 		return s.recvPacketHandshake(b, &p, now)
 	case packetTypeShort:
@@ -189,9 +317,16 @@ func (s *Conn) recvPacketVersionNegotiation(b []byte, p *packet, now time.Time)
 		return 0, err
 	}
 	debug("received packet %v", p)
+	// Client must ignore a Version Negotiation packet listing the version it has selected.
+	if versionSupported(p.supportedVersions, s.version) {
+		debug("dropped packet %v", p)
+		s.logPacketDropped(p, now)
+		return len(b), nil
+	}
+	// Choose the most preferred version which is also supported by server.
 	var newVersion uint32
-	for _, v := range p.supportedVersions {
-		if versionSupported(v) {
+	for _, v := range s.versions {
+		if isVersionKnown(v) && versionSupported(p.supportedVersions, v) {
 			newVersion = v
 			break
 		}
@@ -200,13 +335,15 @@ func (s *Conn) recvPacketVersionNegotiation(b []byte, p *packet, now time.Time)
 		return 0, newError(InternalError, sprint("unsupported version ", p.supportedVersions))
 	}
 	s.version = newVersion
+	s.originalVersion = newVersion
 	s.didVersionNegotiation = true
+	s.deriveInitialKeyMaterial(s.dcid)
 	// Reset connection state to send another initial packet
 	s.gotPeerCID = false
-	s.recovery.dropUnackedData(packetSpaceInitial)
+	s.recovery.onSpaceDiscarded(packetSpaceInitial, now)
 	s.packetNumberSpaces[packetSpaceInitial].reset()
 	s.handshake.reset()
-	s.handshake.setTransportParams(&s.localParams)
+	s.setTransportParams()
 	s.logPacketReceived(p, now)
 	return p.headerLen + n, nil
 }
@@ -226,7 +363,7 @@ func (s *Conn) recvPacketRetry(b []byte, p *packet, now time.Time) (int, error)
 		return 0, err
 	}
 	// Verify token and integrity tag
-	if len(p.token) == 0 || !verifyRetryIntegrity(b, s.dcid) {
+	if len(p.token) == 0 || !verifyRetryIntegrity(s.version, b, s.dcid) {
 		return 0, errInvalidToken
 	}
 	debug("received packet %v", p)
@@ -239,21 +376,43 @@ func (s *Conn) recvPacketRetry(b []byte, p *packet, now time.Time) (int, error)
 	s.deriveInitialKeyMaterial(s.dcid)
 	// Reset connection state to send another initial packet
 	s.gotPeerCID = false
-	s.recovery.dropUnackedData(packetSpaceInitial)
+	s.recovery.onSpaceDiscarded(packetSpaceInitial, now)
 	s.packetNumberSpaces[packetSpaceInitial].reset()
 	s.handshake.reset()
-	s.handshake.setTransportParams(&s.localParams)
+	s.setTransportParams()
 	s.logPacketReceived(p, now)
 	return len(b), nil // p.headerLen + bodyLen + retryIntegrityTagLen
 }
 
 func (s *Conn) recvPacketInitial(b []byte, p *packet, now time.Time) (int, error) {
-	if s.gotPeerCID && (!bytes.Equal(p.header.dcid, s.scid) || !bytes.Equal(p.header.scid, s.dcid)) {
+	// Client uses the original destination CID until it receives the server first Initial packet.
+	dcidValid := bytes.Equal(p.header.dcid, s.scid) || (!s.isClient && bytes.Equal(p.header.dcid, s.odcid))
+	if s.gotPeerCID && (!dcidValid || !bytes.Equal(p.header.scid, s.dcid)) {
 		debug("dropped packet %v", p)
 		s.logPacketDropped(p, now)
 		return len(b), nil
 	}
+	if s.derivedInitialSecrets && p.header.version != s.version && (s.isClient || p.header.version != s.originalVersion) {
+		// Server can only choose a compatible version in its first Initial packet.
+		// Server still accepts client packets sent in the original version after switching.
+		if !s.isClient || s.gotPeerCID || !versionCompatible(s.version, p.header.version) ||
+			!versionSupported(s.versions, p.header.version) {
+			debug("dropped packet %v: unexpected version", p)
+			s.logPacketDropped(p, now)
+			return len(b), nil
+		}
+		s.switchVersion(p.header.version)
+	}
 	if !s.derivedInitialSecrets { // Server side
+		// Server uses the version chosen by client.
+		if !versionSupported(s.versions, p.header.version) || !isVersionKnown(p.header.version) {
+			debug("dropped packet %v: unsupported version", p)
+			s.logPacketDropped(p, now)
+			return len(b), nil
+		}
+		s.version = p.header.version
+		s.originalVersion = p.header.version
+		s.setTransportParams()
 		s.deriveInitialKeyMaterial(p.header.dcid)
 	}
 	if !s.gotPeerCID {
@@ -265,7 +424,7 @@ func (s *Conn) recvPacketInitial(b []byte, p *packet, now time.Time) (int, error
 			if !s.didRetry {
 				s.odcid = append(s.odcid[:0], p.header.dcid...)
 				s.localParams.OriginalDestinationCID = s.odcid
-				s.handshake.setTransportParams(&s.localParams)
+				s.setTransportParams()
 			}
 		}
 		// Replace the randomly generated destination connection ID with
@@ -276,6 +435,18 @@ func (s *Conn) recvPacketInitial(b []byte, p *packet, now time.Time) (int, error
 	return s.recvPacket(b, p, packetSpaceInitial, now)
 }
 
+// recvPacketZeroRTT processes 0-RTT packets sent by client. They are dropped
+// when 0-RTT keys are not available, e.g. early data has been rejected.
+// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-accepting-and-rejecting-0-r
+func (s *Conn) recvPacketZeroRTT(b []byte, p *packet, now time.Time) (int, error) {
+	if s.isClient || (!bytes.Equal(p.header.dcid, s.scid) && !bytes.Equal(p.header.dcid, s.odcid)) {
+		debug("dropped packet %v", p)
+		s.logPacketDropped(p, now)
+		return len(b), nil
+	}
+	return s.recvPacket(b, p, packetSpaceApplication, now)
+}
+
 func (s *Conn) recvPacketHandshake(b []byte, p *packet, now time.Time) (int, error) {
 	if !bytes.Equal(p.header.dcid, s.scid) || !bytes.Equal(p.header.scid, s.dcid) {
 		debug("dropped packet %v", p)
@@ -286,7 +457,10 @@ func (s *Conn) recvPacketHandshake(b []byte, p *packet, now time.Time) (int, err
 }
 
 func (s *Conn) recvPacketShort(b []byte, p *packet, now time.Time) (int, error) {
-	if !bytes.Equal(p.header.dcid, s.scid) {
+	if !s.connIDs.hasLocal(p.header.dcid) {
+		if s.recvStatelessReset(b, now) {
+			return len(b), nil
+		}
 		debug("dropped packet %v", p)
 		s.logPacketDropped(p, now)
 		return len(b), nil
@@ -296,15 +470,36 @@ func (s *Conn) recvPacketShort(b []byte, p *packet, now time.Time) (int, error)
 
 func (s *Conn) recvPacket(b []byte, p *packet, space packetSpace, now time.Time) (int, error) {
 	pnSpace := &s.packetNumberSpaces[space]
-	if !pnSpace.canDecrypt() {
+	if !pnSpace.canDecrypt(p.typ) {
 		debug("dropped undecryptable packet %v space=%v", p, space)
 		s.logPacketDropped(p, now)
 		return len(b), nil
 	}
 	payload, length, err := pnSpace.decryptPacket(b, p)
 	if err != nil {
+		if space == packetSpaceApplication {
+			if s.recvStatelessReset(b, now) {
+				return len(b), nil
+			}
+			// Packet may be protected with keys which have been discarded.
+			debug("dropped undecryptable packet %v space=%v: %v", p, space, err)
+			s.logPacketDropped(p, now)
+			return len(b), nil
+		}
 		return 0, err
 	}
+	if space == packetSpaceApplication && pnSpace.prevOpener.aead != nil &&
+		pnSpace.prevOpenerTimer.IsZero() && p.keyPhase == pnSpace.keyPhase {
+		// Retain old keys for a while after receiving a packet protected with the new keys.
+		// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-key-update
+		debug("key phase updated %v", pnSpace.keyPhase)
+		pnSpace.prevOpenerTimer = now.Add(3 * s.recovery.probeTimeout())
+	}
+	if p.typ == packetTypeShort && pnSpace.zeroRTTOpener.aead != nil && pnSpace.zeroRTTOpenerTimer.IsZero() {
+		// Server retains 0-RTT keys for a while to process reordered packets.
+		// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-discarding-0-rtt-keys
+		pnSpace.zeroRTTOpenerTimer = now.Add(3 * s.recovery.probeTimeout())
+	}
 	debug("decrypted packet %v payload=%d", p, len(payload))
 	if pnSpace.isPacketReceived(p.packetNumber) {
 		// Ignore duplicate packet
@@ -312,50 +507,79 @@ func (s *Conn) recvPacket(b []byte, p *packet, space packetSpace, now time.Time)
 		return length, nil
 	}
 	s.logPacketReceived(p, now)
-	if err = s.recvFrames(payload, space, now); err != nil {
+	probing, err := s.recvFrames(payload, p.typ, space, now)
+	if err != nil {
 		return 0, err
 	}
+	if space == packetSpaceApplication {
+		largest := p.packetNumber >= pnSpace.largestRecvPacketNumber
+		if err = s.updatePath(s.paths.recv, probing, largest, now); err != nil {
+			return 0, err
+		}
+	}
 
 	// Process acked frames
 	s.processAckedPackets(space)
 
 	// Mark this packet received
 	pnSpace.onPacketReceived(p.packetNumber, now)
+	pnSpace.recvECN.add(s.recvECN)
 
 	if s.localParams.MaxIdleTimeout > 0 {
 		s.idleTimer = now.Add(s.localParams.MaxIdleTimeout)
 	}
 	// An Handshake packet has been received from the client and has been successfully processed,
 	// so we can drop the initial state and consider the client's address to be verified.
-	if !s.isClient && space == packetSpaceHandshake && s.state == stateAttempted {
-		s.state = stateHandshake
-		s.dropPacketSpace(packetSpaceInitial)
+	if !s.isClient && space == packetSpaceHandshake {
+		if s.state == stateAttempted {
+			s.state = stateHandshake
+			s.dropPacketSpace(packetSpaceInitial, now)
+		}
+		s.paths.active.validated = true
 	}
 	s.ackElicitingSent = false
 	return length, nil
 }
 
+// recvStatelessReset checks if the datagram b which cannot be processed is a stateless reset
+// from peer. The connection enters draining state immediately if it is.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-detecting-a-stateless-reset
+func (s *Conn) recvStatelessReset(b []byte, now time.Time) bool {
+	if !isStatelessReset(b, s.connIDs.peer) {
+		return false
+	}
+	debug("received stateless reset")
+	s.state = stateDraining
+	s.setDraining(now)
+	return true
+}
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#frames
 // recvFrames sets ackElicited if a received frame is an ack eliciting.
-func (s *Conn) recvFrames(b []byte, space packetSpace, now time.Time) error {
+// It returns true if the packet contains only probing frames.
+func (s *Conn) recvFrames(b []byte, pktType packetType, space packetSpace, now time.Time) (bool, error) {
 	// To avoid sending an ACK in response to an ACK-only packet, we need
 	// to keep track of whether this packet contains any frame other than
 	// ACK, PADDING and CONNECTION_CLOSE.
 	var ackElicited = false
+	var probing = true
 	for len(b) > 0 {
 		var typ uint64
 		n := getVarint(b, &typ)
 		if n == 0 {
-			return newError(FrameEncodingError, "")
+			return false, newError(FrameEncodingError, "")
+		}
+		if pktType == packetTypeZeroRTT && !isFrameAllowedInZeroRTT(typ) {
+			return false, newError(ProtocolViolation, sprint("unexpected frame in 0-RTT ", typ))
 		}
 		var err error
-		// TODO: Check allowed frames for current packet type
+		// TODO: Check allowed frames for Initial and Handshake packets
 		switch {
 		case typ == frameTypePadding:
 			n, err = s.recvFramePadding(b, now)
 		case typ == frameTypePing:
 			s.recvFramePing(now)
-		case typ == frameTypeAck:
+		case typ == frameTypeAck || typ == frameTypeAckECN:
 			n, err = s.recvFrameAck(b, space, now)
 		case typ == frameTypeResetStream:
 			n, err = s.recvFrameResetStream(b, now)
@@ -379,26 +603,39 @@ func (s *Conn) recvFrames(b []byte, space packetSpace, now time.Time) error {
 			n, err = s.recvFrameStreamDataBlocked(b, now)
 		case typ == frameTypeStreamsBlockedBidi || typ == frameTypeStreamsBlockedUni:
 			n, err = s.recvFrameStreamsBlocked(b, now)
+		case typ == frameTypeNewConnectionID:
+			n, err = s.recvFrameNewConnectionID(b, space, now)
+		case typ == frameTypeRetireConnectionID:
+			n, err = s.recvFrameRetireConnectionID(b, space, now)
+		case typ == frameTypePathChallenge:
+			n, err = s.recvFramePathChallenge(b, space, now)
+		case typ == frameTypePathResponse:
+			n, err = s.recvFramePathResponse(b, space, now)
 		case typ == frameTypeConnectionClose || typ == frameTypeApplicationClose:
 			n, err = s.recvFrameConnectionClose(b, space, now)
 		case typ == frameTypeHanshakeDone:
 			n, err = s.recvFrameHandshakeDone(b, now)
+		case typ == frameTypeDatagram || typ == frameTypeDatagramLength:
+			n, err = s.recvFrameDatagram(b, now)
 		default:
-			return newError(FrameEncodingError, sprint("unsupported frame ", typ))
+			return false, newError(FrameEncodingError, sprint("unsupported frame ", typ))
 		}
 		if err != nil {
 			debug("error processing frame 0x%x: %v", typ, err)
-			return err
+			return false, err
 		}
 		if !ackElicited {
 			ackElicited = isFrameAckEliciting(typ)
 		}
+		if probing {
+			probing = isFrameProbing(typ)
+		}
 		b = b[n:]
 	}
 	if ackElicited {
 		s.packetNumberSpaces[space].ackElicited = true
 	}
-	return nil
+	return probing, nil
 }
 
 func (s *Conn) recvFramePadding(b []byte, now time.Time) (int, error) {
@@ -426,7 +663,12 @@ func (s *Conn) recvFrameAck(b []byte, space packetSpace, now time.Time) (int, er
 		return 0, newError(FrameEncodingError, sprint("invalid ack ranges ", f.String()))
 	}
 	ackDelay := time.Duration((1<<s.peerParams.AckDelayExponent)*f.ackDelay) * time.Microsecond
-	s.recovery.onAckReceived(ranges, ackDelay, space, now)
+	if s.isClient && space != packetSpaceInitial {
+		// Server has validated client address when it acknowledges a Handshake packet.
+		s.recovery.peerCompletedAddressValidation = true
+	}
+	s.recovery.onAckReceived(ranges, ackDelay, f.ecnCounts, space, now)
+	s.packetNumberSpaces[space].onPacketAcked(ranges.largest())
 
 	if !s.packetNumberSpaces[space].firstPacketAcked {
 		s.packetNumberSpaces[space].firstPacketAcked = true
@@ -434,9 +676,10 @@ func (s *Conn) recvFrameAck(b []byte, space packetSpace, now time.Time) (int, er
 		// When we receive an ACK for a 1-RTT packet after handshake completion,
 		// it means the handshake has been confirmed.
 		if space == packetSpaceApplication && s.state == stateActive {
-			s.dropPacketSpace(packetSpaceHandshake)
+			s.dropPacketSpace(packetSpaceHandshake, now)
 			if s.isClient && !s.handshakeConfirmed {
 				s.handshakeConfirmed = true
+				s.recovery.handshakeConfirmed = true
 			}
 		}
 	}
@@ -464,6 +707,11 @@ func (s *Conn) recvFrameResetStream(b []byte, now time.Time) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if st == nil {
+		debug("stream %d closed", f.streamID)
+		s.logFrameProcessed(&f, now)
+		return n, nil
+	}
 	mayRecv, err := st.recv.reset(f.finalSize)
 	if err != nil {
 		return 0, err
@@ -472,6 +720,8 @@ func (s *Conn) recvFrameResetStream(b []byte, now time.Time) (int, error) {
 		return 0, errFlowControl
 	}
 	s.flow.addRecv(mayRecv)
+	// Data not yet read will not be delivered to application.
+	st.discardRecv()
 	s.addEvent(newStreamResetEvent(f.streamID, f.errorCode))
 	s.logFrameProcessed(&f, now)
 	return n, nil
@@ -488,7 +738,7 @@ func (s *Conn) recvFrameStopSending(b []byte, now time.Time) (int, error) {
 	debug("received frame 0x%x: %v", b[0], &f)
 	// Not for a locally-initiated stream that has not yet been created.
 	local := isStreamLocal(f.streamID, s.isClient)
-	if local && s.streams.get(f.streamID) == nil {
+	if local && s.streams.get(f.streamID) == nil && !s.streams.isClosed(f.streamID) {
 		return 0, newError(StreamStateError, sprint("stop sending stream ", f.streamID))
 	}
 	// Not for a receive-only stream.
@@ -497,7 +747,18 @@ func (s *Conn) recvFrameStopSending(b []byte, now time.Time) (int, error) {
 		debug("peer attempted to stop sending their receive-only stream: id=%d local=%v bidi=%v", f.streamID, local, bidi)
 		return 0, newError(StreamStateError, sprint("stop sending stream ", f.streamID))
 	}
-	// TODO: block writing data to the stream?
+	st, err := s.getOrCreateStream(f.streamID, false)
+	if err != nil {
+		return 0, err
+	}
+	if st == nil {
+		debug("stream %d closed", f.streamID)
+		s.logFrameProcessed(&f, now)
+		return n, nil
+	}
+	// An endpoint that receives a STOP_SENDING frame MUST send a RESET_STREAM frame
+	// if the stream is in the "Ready" or "Send" state.
+	st.resetSend(f.errorCode)
 	s.addEvent(newStreamStopEvent(f.streamID, f.errorCode))
 	s.logFrameProcessed(&f, now)
 	return n, nil
@@ -523,14 +784,23 @@ func (s *Conn) recvFrameCrypto(b []byte, space packetSpace, now time.Time) (int,
 	return n, nil
 }
 
+// recvFrameNewToken passes the token to application, which can use it
+// in Initial packets of future connections to the same server.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-address-validation-for-futu
 func (s *Conn) recvFrameNewToken(b []byte, now time.Time) (int, error) {
-	// TODO
+	if !s.isClient {
+		return 0, newError(ProtocolViolation, "unexpected new_token")
+	}
 	var f newTokenFrame
 	n, err := f.decode(b)
 	if err != nil {
 		return 0, err
 	}
 	debug("received frame 0x%x: %v", b[0], &f)
+	if len(f.token) == 0 {
+		return 0, newError(FrameEncodingError, "new_token")
+	}
+	s.addEvent(newNewTokenEvent(append([]byte(nil), f.token...)))
 	s.logFrameProcessed(&f, now)
 	return n, nil
 }
@@ -549,13 +819,19 @@ func (s *Conn) recvFrameStream(b []byte, now time.Time) (int, error) {
 		debug("peer attempted to sent to our stream: id=%d local=%v bidi=%v", f.streamID, local, bidi)
 		return 0, newError(StreamStateError, "writing not permitted")
 	}
-	if s.flow.canRecv() < uint64(len(f.data)) {
-		return 0, errFlowControl
-	}
 	st, err := s.getOrCreateStream(f.streamID, false)
 	if err != nil {
 		return 0, err
 	}
+	if st == nil {
+		// Retransmitted data of a closed stream.
+		debug("stream %d closed", f.streamID)
+		s.logFrameProcessed(&f, now)
+		return n, nil
+	}
+	if s.flow.canRecv() < uint64(len(f.data)) {
+		return 0, errFlowControl
+	}
 	err = st.pushRecv(f.data, f.offset, f.fin)
 	if err != nil {
 		return 0, err
@@ -592,7 +868,9 @@ func (s *Conn) recvFrameMaxStreamData(b []byte, now time.Time) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	st.flow.setMaxSend(f.maximumData)
+	if st != nil {
+		st.flow.setMaxSend(f.maximumData)
+	}
 	s.logFrameProcessed(&f, now)
 	return n, nil
 }
@@ -612,24 +890,44 @@ func (s *Conn) recvFrameMaxStreams(b []byte, now time.Time) (int, error) {
 	return n, nil
 }
 
-// TODO
+// recvFrameDataBlocked sends MAX_DATA again when the limit has been raised
+// but peer is still blocked at the old limit.
 func (s *Conn) recvFrameDataBlocked(b []byte, now time.Time) (int, error) {
 	var f dataBlockedFrame
 	n, err := f.decode(b)
 	if err != nil {
 		return 0, err
 	}
+	debug("received frame 0x%x: %v", b[0], &f)
+	if f.dataLimit < s.flow.maxRecvNext {
+		s.updateMaxData = true
+	}
 	s.logFrameProcessed(&f, now)
 	return n, nil
 }
 
-// TODO
+// recvFrameStreamDataBlocked sends MAX_STREAM_DATA again when the limit has been raised
+// but peer is still blocked at the old limit.
 func (s *Conn) recvFrameStreamDataBlocked(b []byte, now time.Time) (int, error) {
 	var f streamDataBlockedFrame
 	n, err := f.decode(b)
 	if err != nil {
 		return 0, err
 	}
+	debug("received frame 0x%x: %v", b[0], &f)
+	// Peer can't send on our unidirectional streams.
+	local := isStreamLocal(f.streamID, s.isClient)
+	bidi := isStreamBidi(f.streamID)
+	if local && !bidi {
+		return 0, newError(StreamStateError, sprint("stream data blocked ", f.streamID))
+	}
+	st, err := s.getOrCreateStream(f.streamID, false)
+	if err != nil {
+		return 0, err
+	}
+	if st != nil && !st.recv.fin && f.dataLimit < st.flow.maxRecvNext {
+		st.updateMaxData = true
+	}
 	s.logFrameProcessed(&f, now)
 	return n, nil
 }
@@ -645,6 +943,109 @@ func (s *Conn) recvFrameStreamsBlocked(b []byte, now time.Time) (int, error) {
 	return n, nil
 }
 
+func (s *Conn) recvFrameNewConnectionID(b []byte, space packetSpace, now time.Time) (int, error) {
+	var f newConnectionIDFrame
+	n, err := f.decode(b)
+	if err != nil {
+		return 0, err
+	}
+	debug("received frame 0x%x: %v", b[0], &f)
+	if space != packetSpaceApplication {
+		return 0, newError(ProtocolViolation, "unexpected new connection id frame")
+	}
+	// An endpoint that is sending packets with a zero-length Destination Connection ID
+	// MUST treat receipt of a NEW_CONNECTION_ID frame as a connection error.
+	if len(s.dcid) == 0 {
+		return 0, newError(ProtocolViolation, "new connection id for zero-length cid")
+	}
+	err = s.connIDs.addPeer(&f)
+	if err != nil {
+		return 0, err
+	}
+	// Current destination CID has been retired by Retire Prior To.
+	if s.connIDs.activePeer() == nil {
+		next := s.connIDs.nextPeer()
+		if next == nil {
+			return 0, newError(ProtocolViolation, "no connection id available")
+		}
+		s.connIDs.usePeer(next.seq)
+		s.dcid = append([]byte(nil), next.cid...) // DCID may be referenced by rscid
+	}
+	s.logFrameProcessed(&f, now)
+	return n, nil
+}
+
+func (s *Conn) recvFrameRetireConnectionID(b []byte, space packetSpace, now time.Time) (int, error) {
+	var f retireConnectionIDFrame
+	n, err := f.decode(b)
+	if err != nil {
+		return 0, err
+	}
+	debug("received frame 0x%x: %v", b[0], &f)
+	if space != packetSpaceApplication {
+		return 0, newError(ProtocolViolation, "unexpected retire connection id frame")
+	}
+	if len(s.scid) == 0 {
+		return 0, newError(ProtocolViolation, "retire connection id for zero-length cid")
+	}
+	cid, err := s.connIDs.retireLocal(f.sequenceNumber)
+	if err != nil {
+		return 0, err
+	}
+	if cid != nil {
+		s.addEvent(newConnectionIDRetireEvent(cid))
+		// Replace the retired one.
+		if err = s.issueConnectionIDs(); err != nil {
+			return 0, err
+		}
+	}
+	s.logFrameProcessed(&f, now)
+	return n, nil
+}
+
+func (s *Conn) recvFramePathChallenge(b []byte, space packetSpace, now time.Time) (int, error) {
+	var f pathChallengeFrame
+	n, err := f.decode(b)
+	if err != nil {
+		return 0, err
+	}
+	debug("received frame 0x%x: %v", b[0], &f)
+	if space != packetSpaceApplication {
+		return 0, newError(ProtocolViolation, "unexpected path challenge frame")
+	}
+	// Respond on the path the challenge was received.
+	s.paths.recv.response = append(s.paths.recv.response[:0], f.data...)
+	s.logFrameProcessed(&f, now)
+	return n, nil
+}
+
+func (s *Conn) recvFramePathResponse(b []byte, space packetSpace, now time.Time) (int, error) {
+	var f pathResponseFrame
+	n, err := f.decode(b)
+	if err != nil {
+		return 0, err
+	}
+	debug("received frame 0x%x: %v", b[0], &f)
+	if space != packetSpaceApplication {
+		return 0, newError(ProtocolViolation, "unexpected path response frame")
+	}
+	// Path validation succeeds on any path the response is received.
+	path := s.paths.findChallenge(f.data)
+	if path != nil && path.validating {
+		debug("path validated %v", path)
+		path.onValidated()
+		switch path {
+		case s.paths.active:
+			s.paths.previous = nil
+		case s.paths.probe:
+			// Probing was initiated locally to migrate the connection.
+			s.switchPath(path)
+		}
+	}
+	s.logFrameProcessed(&f, now)
+	return n, nil
+}
+
 func (s *Conn) recvFrameConnectionClose(b []byte, space packetSpace, now time.Time) (int, error) {
 	var f connectionCloseFrame
 	n, err := f.decode(b)
@@ -670,8 +1071,32 @@ func (s *Conn) recvFrameHandshakeDone(b []byte, now time.Time) (int, error) {
 	debug("received frame 0x%x: %v", b[0], &f)
 	if s.state == stateActive && !s.handshakeConfirmed {
 		// Drop client's handshake state when it received done from server
-		s.dropPacketSpace(packetSpaceHandshake)
+		s.dropPacketSpace(packetSpaceHandshake, now)
 		s.handshakeConfirmed = true
+		s.recovery.handshakeConfirmed = true
+		s.recovery.peerCompletedAddressValidation = true
+	}
+	s.logFrameProcessed(&f, now)
+	return n, nil
+}
+
+// recvFrameDatagram queues the data for application. Peer must not send DATAGRAM frames
+// larger than the local max_datagram_frame_size.
+// https://www.rfc-editor.org/rfc/rfc9221.html#name-behavior-and-usage
+func (s *Conn) recvFrameDatagram(b []byte, now time.Time) (int, error) {
+	var f datagramFrame
+	n, err := f.decode(b)
+	if err != nil {
+		return 0, err
+	}
+	debug("received frame 0x%x: %v", b[0], &f)
+	if uint64(n) > s.localParams.MaxDatagramFrameSize {
+		return 0, newError(ProtocolViolation, sprint("datagram frame size ", n))
+	}
+	if s.datagrams.pushRecv(f.data) {
+		s.addEvent(newDatagramEvent())
+	} else {
+		debug("datagram dropped: receiving queue full")
 	}
 	s.logFrameProcessed(&f, now)
 	return n, nil
@@ -693,7 +1118,6 @@ func (s *Conn) processAckedPackets(space packetSpace) {
 				st.send.ack(f.offset, uint64(len(f.data)))
 				if st.send.complete() {
 					s.addEvent(newStreamCompleteEvent(f.streamID))
-					// TODO: Garbage collect the stream
 				}
 			}
 		case *maxDataFrame:
@@ -703,35 +1127,112 @@ func (s *Conn) processAckedPackets(space packetSpace) {
 			if st != nil {
 				st.ackMaxData()
 			}
+		case *resetStreamFrame:
+			st := s.streams.get(f.streamID)
+			if st != nil {
+				st.send.resetAcked = true
+			}
 		}
 	})
 }
 
 func (s *Conn) doHandshake() error {
 	if s.state >= stateActive {
+		if s.state == stateActive {
+			// Session tickets are sent after the handshake.
+			return s.handshake.doPostHandshake()
+		}
 		return nil
 	}
 	err := s.handshake.doHandshake()
 	if err != nil {
 		return err
 	}
+	if s.isClient && !s.zeroRTT && s.packetNumberSpaces[packetSpaceApplication].canEncrypt(packetTypeZeroRTT) {
+		s.startZeroRTT()
+	}
+	s.recovery.hasHandshakeKeys = s.packetNumberSpaces[packetSpaceHandshake].canEncrypt(packetTypeHandshake)
 	if s.handshake.HandshakeComplete() {
 		params := s.handshake.peerTransportParams()
 		debug("peer transport params: %+v", params)
 		if err := s.validatePeerTransportParams(params); err != nil {
 			return err
 		}
+		s.peerParams = *params
+		if s.zeroRTT {
+			s.finishZeroRTT()
+		}
 		s.flow.setMaxSend(params.InitialMaxData)
 		s.streams.setPeerMaxStreamsBidi(params.InitialMaxStreamsBidi)
 		s.streams.setPeerMaxStreamsUni(params.InitialMaxStreamsUni)
 		s.recovery.maxAckDelay = params.MaxAckDelay
-		s.peerParams = *params
-		// TODO: early app frames
+		// Streams may have been opened in 0-RTT before peer limits are known.
+		for id, st := range s.streams.streams {
+			st.flow.setMaxSend(s.peerInitialMaxStreamData(id))
+		}
+		s.connIDs.setPeerInitial(s.dcid, params.StatelessResetToken, params.ActiveConnectionIDLimit)
+		if err := s.issueConnectionIDs(); err != nil {
+			return err
+		}
 		s.state = stateActive
+		// Handshake is confirmed on server when it completes.
+		s.recovery.handshakeConfirmed = !s.isClient
+		return s.handshake.doPostHandshake()
 	}
 	return nil
 }
 
+// startZeroRTT applies server transport parameters remembered from the resumed session,
+// so client can open streams and send data in 0-RTT packets.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-values-of-transport-paramet
+func (s *Conn) startZeroRTT() {
+	params := s.handshake.sessionTransportParams()
+	if params == nil {
+		debug("no transport parameters for early data")
+		s.packetNumberSpaces[packetSpaceApplication].dropZeroRTTKeys()
+		return
+	}
+	// These parameters must not be remembered.
+	params.OriginalDestinationCID = nil
+	params.InitialSourceCID = nil
+	params.RetrySourceCID = nil
+	params.StatelessResetToken = nil
+	params.AckDelayExponent = 0
+	params.MaxAckDelay = 0
+	debug("early transport params: %+v", params)
+	s.flow.setMaxSend(params.InitialMaxData)
+	s.streams.setPeerMaxStreamsBidi(params.InitialMaxStreamsBidi)
+	s.streams.setPeerMaxStreamsUni(params.InitialMaxStreamsUni)
+	s.peerParams = *params
+	s.zeroRTT = true
+}
+
+// finishZeroRTT discards 0-RTT keys when the handshake completes on client.
+// If server has rejected early data, all 0-RTT packets are considered lost and
+// their frames are retransmitted in 1-RTT packets under new flow control limits,
+// which are given in s.peerParams and may be lower than the remembered ones.
+// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-accepting-and-rejecting-0-r
+func (s *Conn) finishZeroRTT() {
+	s.zeroRTT = false
+	pnSpace := &s.packetNumberSpaces[packetSpaceApplication]
+	pnSpace.dropZeroRTTKeys()
+	// Only acknowledgements of 1-RTT packets allow key update.
+	pnSpace.keyPhaseSendStart = pnSpace.nextPacketNumber
+	if s.handshake.earlyDataAccepted() {
+		debug("early data accepted")
+		return
+	}
+	debug("early data rejected")
+	s.recovery.requeueUnackedData(packetSpaceApplication)
+	s.flow.setSend(0)
+	s.flow.maxSend = s.peerParams.InitialMaxData
+	s.flow.blocked = false
+	for id, st := range s.streams.streams {
+		st.flow.maxSend = s.peerInitialMaxStreamData(id)
+		st.flow.blocked = false
+	}
+}
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-authenticating-connection-i
 //
 // Client                                                  Server
@@ -764,6 +1265,9 @@ func (s *Conn) validatePeerTransportParams(p *Parameters) error {
 		if !bytes.Equal(p.OriginalDestinationCID, s.odcid) {
 			return newError(TransportParameterError, "original destination cid")
 		}
+		if err := s.validateVersionInformation(p); err != nil {
+			return err
+		}
 	} else {
 		// Original CID and Stateless reset token must not be sent by client
 		if len(p.OriginalDestinationCID) > 0 {
@@ -777,72 +1281,320 @@ func (s *Conn) validatePeerTransportParams(p *Parameters) error {
 	if len(s.rscid) > 0 && !bytes.Equal(p.RetrySourceCID, s.rscid) {
 		return newError(TransportParameterError, "retry source cid")
 	}
+	// The value of the active_connection_id_limit parameter MUST be at least 2.
+	if p.ActiveConnectionIDLimit > 0 && p.ActiveConnectionIDLimit < defaultActiveConnectionIDLimit {
+		return newError(TransportParameterError, "active connection id limit")
+	}
+	return nil
+}
+
+// validateVersionInformation checks server version information for downgrade attacks.
+// https://www.rfc-editor.org/rfc/rfc9368.html#name-version-downgrade-preventio
+func (s *Conn) validateVersionInformation(p *Parameters) error {
+	if p.ChosenVersion == 0 {
+		// Server does not support compatible version negotiation, which is only
+		// allowed when client has not acted on a Version Negotiation packet.
+		if s.didVersionNegotiation {
+			return newError(VersionNegotiationError, "missing version information")
+		}
+		return nil
+	}
+	if p.ChosenVersion != s.version {
+		return newError(VersionNegotiationError, "chosen version")
+	}
+	if s.didVersionNegotiation {
+		// Client would have chosen the same original version if the Version Negotiation
+		// packet had listed server available versions.
+		for _, v := range s.versions {
+			if isVersionKnown(v) && versionSupported(p.AvailableVersions, v) {
+				if v != s.originalVersion {
+					return newError(VersionNegotiationError, "version downgrade")
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// negotiateCompatibleVersion is called on server when client transport parameters are
+// received and before the handshake keys are derived. Server switches to a compatible
+// version it prefers if client also supports it.
+// https://www.rfc-editor.org/rfc/rfc9368.html#name-compatible-versions
+func (s *Conn) negotiateCompatibleVersion(p *Parameters) error {
+	if p.ChosenVersion == 0 {
+		// Client does not support compatible version negotiation.
+		return nil
+	}
+	if p.ChosenVersion != s.version {
+		return newError(VersionNegotiationError, "chosen version")
+	}
+	for _, v := range s.versions {
+		if v == s.version {
+			break
+		}
+		if versionCompatible(s.version, v) && versionSupported(p.AvailableVersions, v) {
+			s.switchVersion(v)
+			s.setTransportParams()
+			break
+		}
+	}
+	return nil
+}
+
+// updatePath checks whether peer has moved to a new address.
+// Only the highest-numbered non-probing packet can trigger migration.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-responding-to-connection-mi
+func (s *Conn) updatePath(path *networkPath, probing, largest bool, now time.Time) error {
+	if path == s.paths.active {
+		return nil
+	}
+	if !s.isClient && s.handshakeConfirmed && !probing && largest {
+		return s.migratePath(path, now)
+	}
+	// Keep track of the probing path so PATH_RESPONSE can be sent on it.
+	if path != s.paths.previous {
+		s.paths.probe = path
+	}
+	return nil
+}
+
+// migratePath starts sending to the new path and validates it if needed.
+func (s *Conn) migratePath(path *networkPath, now time.Time) error {
+	debug("peer migrated from %v to %v", s.paths.active, path)
+	prev := s.paths.active
+	if prev.validated {
+		s.paths.previous = prev
+	}
+	if s.paths.probe == path {
+		s.paths.probe = nil
+	}
+	s.paths.active = path
+	// Avoid linking the paths by using a new connection ID when available.
+	if len(s.dcid) > 0 {
+		if next := s.connIDs.nextPeer(); next != nil {
+			s.connIDs.usePeer(next.seq)
+			s.dcid = append([]byte(nil), next.cid...)
+		}
+	}
+	// Congestion controller and round-trip time estimator are reset
+	// unless the only change in the peer's address is its port number.
+	if !addrSameHost(prev.addr.Peer, path.addr.Peer) {
+		s.recovery.resetCongestion()
+	}
+	s.addEvent(newPathMigratedEvent())
+	if !path.validated {
+		return s.validatePath(path, now)
+	}
+	return nil
+}
+
+// switchPath makes the validated probing path active with its reserved connection ID.
+func (s *Conn) switchPath(path *networkPath) {
+	debug("migrated from %v to %v", s.paths.active, path)
+	s.paths.probe = nil
+	s.paths.previous = nil
+	s.paths.active = path
+	if path.dcid != nil {
+		s.connIDs.usePeer(path.dcidSeq)
+		s.dcid = path.dcid
+		path.dcid = nil
+	}
+	s.recovery.resetCongestion()
+	s.addEvent(newPathMigratedEvent())
+}
+
+// validatePath initiates path validation by sending PATH_CHALLENGE on the path.
+func (s *Conn) validatePath(path *networkPath, now time.Time) error {
+	data := make([]byte, pathChallengeLen)
+	if err := s.rand(data); err != nil {
+		return err
+	}
+	path.startValidation(data, now.Add(3*s.recovery.probeTimeout()))
+	return nil
+}
+
+// issueConnectionIDs generates new connection IDs up to the limit peer would accept.
+// Connection IDs are not issued when a zero-length connection ID is in use.
+func (s *Conn) issueConnectionIDs() error {
+	if len(s.scid) == 0 {
+		return nil
+	}
+	for s.connIDs.needIssue() {
+		cid := make([]byte, len(s.scid))
+		if err := s.rand(cid); err != nil {
+			return err
+		}
+		var token []byte
+		if len(s.resetKey) > 0 {
+			token = StatelessResetToken(s.resetKey, cid)
+		} else {
+			token = make([]byte, statelessResetTokenLen)
+			if err := s.rand(token); err != nil {
+				return err
+			}
+		}
+		s.connIDs.issue(cid, token)
+		s.addEvent(newConnectionIDNewEvent(cid))
+	}
 	return nil
 }
 
 // Read produces data for sending to the client.
 func (s *Conn) Read(b []byte) (int, error) {
+	n, _, err := s.ReadTo(b)
+	return n, err
+}
+
+// ReadTo produces data for sending and returns the network path it must be sent on.
+// Zero path is returned when no path has been given in WriteFrom.
+func (s *Conn) ReadTo(b []byte) (int, Path, error) {
 	now := s.time()
+	s.sendECN = ECNNotECT
 	if !s.drainingTimer.IsZero() {
-		return 0, nil
+		return 0, Path{}, nil
 	}
 	if err := s.doHandshake(); err != nil {
-		return 0, err
+		return 0, Path{}, err
+	}
+	if s.state == stateActive {
+		s.collectStreams()
+	}
+	// Path validation frames on a non-active path are sent in a separate datagram.
+	// They are not marked as ECN is only validated on the active path.
+	if probe := s.paths.probe; probe != nil && probe.needSend() && s.state == stateActive && s.closeFrame == nil {
+		n, err := s.send(b, packetSpaceApplication, probe, now)
+		if err != nil {
+			return 0, Path{}, err
+		}
+		if n > 0 {
+			return n, probe.addr, nil
+		}
 	}
-	space := s.writeSpace()
+	path := s.paths.active
+	if s.recovery.ecn.canMark() {
+		s.sendECN = ECNECT0
+	}
+	// Pacing timer is recalculated when checking for data to send.
+	s.recovery.pacer.nextSendTime = time.Time{}
+	space := s.writeSpace(now)
 	if space == packetSpaceCount {
-		return 0, nil
+		// PMTU probe is sent in a separate datagram when there is no other data.
+		n, err := s.sendPMTUProbe(b, path, now)
+		if err != nil {
+			return 0, Path{}, err
+		}
+		if n > 0 {
+			return n, path.addr, nil
+		}
+		if s.state == stateActive && !s.streams.hasFlushable() && !s.datagrams.hasSend() {
+			// Nothing to send so delivery rate is limited by the application,
+			// not by congestion control or pacing.
+			s.recovery.onAppLimited()
+		}
+		return 0, Path{}, nil
 	}
-	n, err := s.send(b, space, now)
+	n, err := s.send(b, space, path, now)
 	if err != nil {
-		return 0, err
+		return 0, Path{}, err
 	}
 	// Coalesce packets when possible.
 	// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#packet-coalesce
 	if space < packetSpaceApplication {
 		avail := minInt(s.maxPacketSize(), len(b))
 		if avail-n >= 96 { // Enough for a handshake packet
-			nextSpace := s.writeSpace()
+			nextSpace := s.writeSpace(now)
 			if nextSpace < packetSpaceCount && nextSpace > space {
-				m, err := s.send(b[n:avail], nextSpace, now)
+				m, err := s.send(b[n:avail], nextSpace, path, now)
 				if err != nil {
-					return 0, err
+					return 0, Path{}, err
 				}
-				return n + m, nil
+				return n + m, path.addr, nil
 			}
 		}
 	}
-	return n, nil
+	return n, path.addr, nil
+}
+
+func (s *Conn) send(b []byte, space packetSpace, path *networkPath, now time.Time) (int, error) {
+	return s.sendPacket(b, space, path, false, now)
 }
 
-func (s *Conn) send(b []byte, space packetSpace, now time.Time) (int, error) {
+// sendPacket encodes a packet in b. When probe is true, the packet is a PMTU probe
+// containing only PING and PADDING frames to fill b.
+func (s *Conn) sendPacket(b []byte, space packetSpace, path *networkPath, probe bool, now time.Time) (int, error) {
 	pnSpace := &s.packetNumberSpaces[space]
-	if !pnSpace.canEncrypt() {
+	typ := packetTypeFromSpace(space)
+	if space == packetSpaceApplication && s.canSendEarlyData() {
+		typ = packetTypeZeroRTT
+	}
+	if !pnSpace.canEncrypt(typ) {
 		return 0, newError(InternalError, sprint("cannot encrypt space ", space.String()))
 	}
+	if space == packetSpaceApplication && s.handshakeConfirmed &&
+		pnSpace.needUpdateKey() && pnSpace.canUpdateKey() {
+		debug("update key before confidentiality limit")
+		pnSpace.updateKey()
+	}
 	avail := minInt(s.maxPacketSize(), len(b))
+	if probe {
+		avail = len(b)
+	}
+	// Anti-amplification limit on unvalidated path
+	limit := path.sendLimit(avail)
+	dcid := s.dcid
+	if path.dcid != nil {
+		dcid = path.dcid
+	}
+	version := s.version
+	if typ == packetTypeZeroRTT {
+		// 0-RTT packets are sent in the original version when server switches version.
+		version = pnSpace.zeroRTTSealer.version
+	}
 	p := packet{
-		typ: packetTypeFromSpace(space),
+		typ: typ,
 		header: packetHeader{
-			version: s.version,
-			dcid:    s.dcid,
+			version: version,
+			dcid:    dcid,
 			scid:    s.scid,
 		},
 		token:        s.token,
 		packetNumber: pnSpace.nextPacketNumber,
-		payloadLen:   avail,
+		payloadLen:   limit,
+		keyPhase:     pnSpace.keyPhase,
+	}
+	if s.peerParams.GreaseQUICBit && typ != packetTypeInitial {
+		var r [1]byte
+		if err := s.rand(r[:]); err == nil {
+			p.clearFixedBit = r[0]&1 == 0
+		}
 	}
 	// Calculate what is left for payload
-	overhead := pnSpace.sealer.aead.Overhead()
+	overhead := pnSpace.sealerFor(typ).aead.Overhead()
 	pktOverhead := p.encodedLen() + overhead - p.payloadLen // Packet length without payload
-	left := avail - pktOverhead
+	left := limit - pktOverhead
 	if left <= minPayloadLength {
+		if limit < avail {
+			debug("amplification limit reached %v", path)
+			if path == s.paths.active {
+				s.recovery.setAmplificationLimited(true, now)
+			}
+			return 0, nil
+		}
 		return 0, errShortBuffer
 	}
 	s.processLostPackets(space)
 	// Add frames
 	op := newOutgoingPacket(p.packetNumber, now)
-	p.payloadLen = s.sendFrames(op, space, left, now)
+	op.ecn = s.sendECN == ECNECT0
+	if probe {
+		op.pmtuProbe = true
+		f := &pingFrame{}
+		op.addFrame(f)
+		p.payloadLen = f.encodedLen()
+	} else {
+		p.payloadLen = s.sendFrames(op, space, path, left, now)
+	}
 	if len(op.frames) == 0 {
 		return 0, nil
 	}
@@ -860,6 +1612,17 @@ func (s *Conn) send(b []byte, space packetSpace, now time.Time) (int, error) {
 			left -= n
 		}
 	}
+	// Expand datagrams containing path validation frames to at least the smallest
+	// allowed maximum datagram size, unless the anti-amplification limit does not permit.
+	// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-initiating-path-validation
+	if space == packetSpaceApplication && hasPathValidationFrame(op.frames) {
+		n := minInt(MinInitialPacketSize-pktOverhead-p.payloadLen, left)
+		if n > 0 {
+			op.addFrame(newPaddingFrame(n))
+			p.payloadLen += n
+			left -= n
+		}
+	}
 	if p.payloadLen < minPayloadLength {
 		n := minPayloadLength - p.payloadLen
 		if n > left {
@@ -869,6 +1632,11 @@ func (s *Conn) send(b []byte, space packetSpace, now time.Time) (int, error) {
 		p.payloadLen += n
 		left -= n
 	}
+	if probe && left > 0 {
+		op.addFrame(newPaddingFrame(left))
+		p.payloadLen += left
+		left = 0
+	}
 	// Include crypto overhead to encode packet header with correct length
 	p.payloadLen += overhead
 	payloadOffset, err := p.encode(b)
@@ -886,6 +1654,10 @@ func (s *Conn) send(b []byte, space packetSpace, now time.Time) (int, error) {
 	}
 	pnSpace.encryptPacket(b[:n], &p)
 	op.size = uint64(n)
+	path.sentBytes += op.size
+	if path == s.paths.active {
+		s.recovery.amplificationLimited = path.isAmplificationLimited()
+	}
 	// Finish preparing sending packet
 	debug("sending packet %s %s", &p, op)
 	s.onPacketSent(op, space)
@@ -894,19 +1666,28 @@ func (s *Conn) send(b []byte, space packetSpace, now time.Time) (int, error) {
 	// On the client, drop initial state after sending an Handshake packet.
 	if s.isClient && p.typ == packetTypeHandshake && s.state == stateAttempted {
 		s.state = stateHandshake
-		s.dropPacketSpace(packetSpaceInitial)
+		s.dropPacketSpace(packetSpaceInitial, now)
 	}
 	return n, nil
 }
 
-func (s *Conn) writeSpace() packetSpace {
-	// On error or probe, send packet in the latest space available.
-	if s.closeFrame != nil || s.recovery.probes > 0 {
+func (s *Conn) writeSpace(now time.Time) packetSpace {
+	// On error, send packet in the latest space available.
+	if s.closeFrame != nil {
+		return s.handshake.writeSpace()
+	}
+	// Probe packets are sent in the space which PTO expired.
+	if s.recovery.probes > 0 {
+		space := s.recovery.probeSpace
+		if s.packetNumberSpaces[space].canEncrypt(packetTypeFromSpace(space)) {
+			return space
+		}
 		return s.handshake.writeSpace()
 	}
 	for i := packetSpaceInitial; i < packetSpaceCount; i++ {
-		// Only use application packet number space when handshake is complete.
-		if i == packetSpaceApplication && s.state < stateActive {
+		// Only use application packet number space when handshake is complete
+		// or client is sending early data.
+		if i == packetSpaceApplication && s.state < stateActive && !s.canSendEarlyData() {
 			continue
 		}
 		if s.packetNumberSpaces[i].ready() {
@@ -916,24 +1697,65 @@ func (s *Conn) writeSpace() packetSpace {
 			return i
 		}
 	}
-	// If there are flushable streams, use Application.
-	if s.state >= stateActive && s.streams.hasFlushable() {
+	// If there are flushable streams and congestion window allows, use Application.
+	flushable := s.streams.hasFlushable() && s.recovery.canSend(now)
+	if s.state >= stateActive && (flushable || s.connIDs.hasUpdate() || s.paths.active.needSend() || s.newToken != nil || s.streams.hasUpdate() || s.flow.blocked ||
+		s.streams.localMaxStreamsNext(true) > 0 || s.streams.localMaxStreamsNext(false) > 0) {
+		return packetSpaceApplication
+	}
+	if s.state == stateActive && s.datagrams.hasSend() && s.recovery.canSend(now) {
+		return packetSpaceApplication
+	}
+	if s.canSendEarlyData() && flushable {
 		return packetSpaceApplication
 	}
 	// Nothing to send
 	return packetSpaceCount
 }
 
+// canSendEarlyData returns true when client has 0-RTT keys before the handshake is complete.
+func (s *Conn) canSendEarlyData() bool {
+	return s.zeroRTT && s.state < stateActive &&
+		s.packetNumberSpaces[packetSpaceApplication].canEncrypt(packetTypeZeroRTT)
+}
+
+// maxPacketSize returns the maximum datagram size discovered by DPLPMTUD.
 func (s *Conn) maxPacketSize() int {
-	if s.state >= stateActive && s.peerParams.MaxUDPPayloadSize > 0 {
-		n := int(s.peerParams.MaxUDPPayloadSize)
-		if n >= MinInitialPacketSize && n <= MaxPacketSize {
-			return n
-		}
+	if s.state >= stateActive {
+		return s.recovery.pmtud.current
 	}
 	return MinInitialPacketSize
 }
 
+// peerMaxPacketSize returns the maximum datagram size peer is willing to receive.
+func (s *Conn) peerMaxPacketSize() int {
+	n := int(s.peerParams.MaxUDPPayloadSize)
+	if n >= MinInitialPacketSize && n <= MaxPacketSize {
+		return n
+	}
+	return MaxPacketSize
+}
+
+// sendPMTUProbe sends a PMTU probe packet when the search for a larger datagram size
+// is in progress. b is limited by the local MTU.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-sending-quic-pmtu-probes
+func (s *Conn) sendPMTUProbe(b []byte, path *networkPath, now time.Time) (int, error) {
+	if s.state != stateActive || !s.recovery.handshakeConfirmed || s.closeFrame != nil {
+		return 0, nil
+	}
+	pmtud := &s.recovery.pmtud
+	if pmtud.maxSize == 0 {
+		// Search starts once the handshake is confirmed.
+		pmtud.start(s.peerMaxPacketSize())
+	}
+	size := pmtud.nextProbe(len(b), now)
+	if size == 0 || path.sendLimit(size) < size || !s.recovery.canSend(now) {
+		return 0, nil
+	}
+	debug("sending pmtu probe size=%d %v", size, pmtud)
+	return s.sendPacket(b[:size], packetSpaceApplication, path, true, now)
+}
+
 func (s *Conn) processLostPackets(space packetSpace) {
 	pnSpace := &s.packetNumberSpaces[space]
 	s.recovery.drainLost(space, func(f frame) {
@@ -949,20 +1771,74 @@ func (s *Conn) processLostPackets(space packetSpace) {
 			}
 		case *streamFrame:
 			st := s.streams.get(f.streamID)
-			if st != nil {
+			if st != nil && !st.send.reset {
 				// Push data back to send again
 				err := st.send.push(f.data, f.offset, f.fin)
 				if err != nil {
 					debug("process lost stream frame %s: %v", f, err)
 				}
 			}
+		case *resetStreamFrame:
+			st := s.streams.get(f.streamID)
+			if st != nil && !st.send.resetAcked {
+				st.updateReset = true
+			}
+		case *dataBlockedFrame:
+			// Only resend when still blocked at the same limit.
+			if f.dataLimit == s.flow.maxSend && s.flow.canSend() == 0 {
+				s.flow.blocked = true
+			}
+		case *streamDataBlockedFrame:
+			st := s.streams.get(f.streamID)
+			if st != nil && !st.send.reset && f.dataLimit == st.flow.maxSend {
+				st.flow.blocked = true
+			}
+		case *stopSendingFrame:
+			// Not needed when peer has finished or reset the stream.
+			st := s.streams.get(f.streamID)
+			if st != nil && !st.recv.fin {
+				st.updateStopSending = true
+			}
 		case *handshakeDoneFrame:
 			s.handshakeConfirmed = false
+		case *maxStreamsFrame:
+			// Resend when the limit has not been raised again.
+			if f.maximumStreams == s.streams.localMaxStreams(f.bidi) {
+				s.streams.setUpdateMaxStreams(f.bidi)
+			}
+		case *newTokenFrame:
+			if s.newToken == nil {
+				s.newToken = f.token
+			}
+		case *datagramFrame:
+			// DATAGRAM frames are not retransmitted.
+		case *newConnectionIDFrame:
+			// Only resend when the connection ID has not been retired.
+			if s.connIDs.getLocal(f.sequenceNumber) != nil {
+				s.connIDs.sendNew = append(s.connIDs.sendNew, f.sequenceNumber)
+			}
+		case *retireConnectionIDFrame:
+			s.connIDs.sendRetire = append(s.connIDs.sendRetire, f.sequenceNumber)
+		case *pathChallengeFrame:
+			// Send a new challenge when the path is still being validated.
+			path := s.paths.findChallenge(f.data)
+			if path != nil && path.validating && path.challenge == nil {
+				data := make([]byte, pathChallengeLen)
+				if err := s.rand(data); err != nil {
+					debug("process lost path challenge frame %s: %v", f, err)
+				} else {
+					path.challenge = data
+				}
+			}
 		}
 	})
 }
 
-func (s *Conn) sendFrames(op *outgoingPacket, space packetSpace, left int, now time.Time) int {
+func (s *Conn) sendFrames(op *outgoingPacket, space packetSpace, path *networkPath, left int, now time.Time) int {
+	if path != s.paths.active {
+		// Only path validation frames are sent on probing path.
+		return s.sendFramesPath(op, path, left)
+	}
 	pnSpace := &s.packetNumberSpaces[space]
 	payloadLen := 0
 	// CONNECTION_CLOSE
@@ -975,24 +1851,29 @@ func (s *Conn) sendFrames(op *outgoingPacket, space packetSpace, left int, now t
 			s.setDraining(now)
 		}
 	}
+	// 0-RTT packets must not contain ACK and CRYPTO frames.
+	// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-frames-and-frame-types
+	zeroRTT := space == packetSpaceApplication && s.state < stateActive
 	if s.state < stateDraining {
-		// ACK
-		if f := s.sendFrameAck(pnSpace, now); f != nil {
-			n := f.encodedLen()
-			if left >= n {
+		if !zeroRTT {
+			// ACK
+			if f := s.sendFrameAck(pnSpace, now); f != nil {
+				n := f.encodedLen()
+				if left >= n {
+					op.addFrame(f)
+					payloadLen += n
+					left -= n
+					pnSpace.ackElicited = false
+				}
+			}
+			// CRYPTO
+			if f := s.sendFrameCrypto(pnSpace, left); f != nil {
+				n := f.encodedLen()
 				op.addFrame(f)
 				payloadLen += n
 				left -= n
-				pnSpace.ackElicited = false
 			}
 		}
-		// CRYPTO
-		if f := s.sendFrameCrypto(pnSpace, left); f != nil {
-			n := f.encodedLen()
-			op.addFrame(f)
-			payloadLen += n
-			left -= n
-		}
 		if space == packetSpaceApplication {
 			// HANDSHAKE_DONE
 			if f := s.sendFrameHandshakeDone(); f != nil {
@@ -1004,6 +1885,47 @@ func (s *Conn) sendFrames(op *outgoingPacket, space packetSpace, left int, now t
 					s.handshakeConfirmed = true
 				}
 			}
+			// NEW_TOKEN
+			if f := s.sendFrameNewToken(); f != nil {
+				n := f.encodedLen()
+				if left >= n {
+					op.addFrame(f)
+					payloadLen += n
+					left -= n
+					s.newToken = nil
+				}
+			}
+			// PATH_RESPONSE and PATH_CHALLENGE
+			if n := s.sendFramesPath(op, path, left); n > 0 {
+				payloadLen += n
+				left -= n
+			}
+			// NEW_CONNECTION_ID
+			for len(s.connIDs.sendNew) > 0 {
+				f := s.sendFrameNewConnectionID(s.connIDs.sendNew[0])
+				if f != nil {
+					n := f.encodedLen()
+					if left < n {
+						break
+					}
+					op.addFrame(f)
+					payloadLen += n
+					left -= n
+				}
+				s.connIDs.sendNew = s.connIDs.sendNew[1:]
+			}
+			// RETIRE_CONNECTION_ID
+			for len(s.connIDs.sendRetire) > 0 {
+				f := newRetireConnectionIDFrame(s.connIDs.sendRetire[0])
+				n := f.encodedLen()
+				if left < n {
+					break
+				}
+				op.addFrame(f)
+				payloadLen += n
+				left -= n
+				s.connIDs.sendRetire = s.connIDs.sendRetire[1:]
+			}
 			// MAX_DATA
 			if f := s.sendFrameMaxData(); f != nil {
 				n := f.encodedLen()
@@ -1012,7 +1934,19 @@ func (s *Conn) sendFrames(op *outgoingPacket, space packetSpace, left int, now t
 					payloadLen += n
 					left -= n
 					s.updateMaxData = true
-					s.flow.commitMaxRecv()
+					s.commitMaxData(now)
+				}
+			}
+			// MAX_STREAMS
+			for _, bidi := range [...]bool{true, false} {
+				if f := s.sendFrameMaxStreams(bidi); f != nil {
+					n := f.encodedLen()
+					if left >= n {
+						op.addFrame(f)
+						payloadLen += n
+						left -= n
+						s.streams.commitMaxStreams(f.maximumStreams, bidi)
+					}
 				}
 			}
 			// MAX_STREAM_DATA
@@ -1023,19 +1957,69 @@ func (s *Conn) sendFrames(op *outgoingPacket, space packetSpace, left int, now t
 						op.addFrame(f)
 						payloadLen += n
 						left -= n
-						st.flow.commitMaxRecv()
+						s.commitMaxStreamData(st, now)
 					}
 				}
 			}
-			// STREAM
-			// TODO: support stream priority
+			// RESET_STREAM, STOP_SENDING and STREAM_DATA_BLOCKED
 			for id, st := range s.streams.streams {
-				if f := s.sendFrameStream(id, st, left); f != nil {
+				if f := s.sendFrameResetStream(id, st); f != nil {
 					n := f.encodedLen()
-					op.addFrame(f)
+					if left >= n {
+						op.addFrame(f)
+						payloadLen += n
+						left -= n
+						st.updateReset = false
+					}
+				}
+				if f := s.sendFrameStopSending(id, st); f != nil {
+					n := f.encodedLen()
+					if left >= n {
+						op.addFrame(f)
+						payloadLen += n
+						left -= n
+						st.updateStopSending = false
+					}
+				}
+				if f := s.sendFrameStreamDataBlocked(id, st); f != nil {
+					n := f.encodedLen()
+					if left >= n {
+						op.addFrame(f)
+						payloadLen += n
+						left -= n
+						st.flow.commitBlocked()
+					}
+				}
+			}
+			// DATAGRAM
+			if s.state == stateActive && s.recovery.canSend(now) {
+				if n := s.sendFramesDatagram(op, payloadLen+left, left); n > 0 {
 					payloadLen += n
 					left -= n
-					s.flow.addSend(len(f.data))
+				}
+			}
+			// STREAM
+			if s.recovery.canSend(now) {
+				for _, id := range s.streams.flushable() {
+					st := s.streams.get(id)
+					if f := s.sendFrameStream(id, st, left); f != nil {
+						n := f.encodedLen()
+						op.addFrame(f)
+						payloadLen += n
+						left -= n
+						s.flow.addSend(len(f.data))
+						s.streams.onSent(st)
+					}
+				}
+				// DATA_BLOCKED
+				if f := s.sendFrameDataBlocked(); f != nil {
+					n := f.encodedLen()
+					if left >= n {
+						op.addFrame(f)
+						payloadLen += n
+						left -= n
+						s.flow.commitBlocked()
+					}
 				}
 			}
 		}
@@ -1052,6 +2036,59 @@ func (s *Conn) sendFrames(op *outgoingPacket, space packetSpace, left int, now t
 	return payloadLen
 }
 
+// sendFramesPath adds PATH_RESPONSE and PATH_CHALLENGE frames for the path.
+func (s *Conn) sendFramesPath(op *outgoingPacket, path *networkPath, left int) int {
+	payloadLen := 0
+	if path.response != nil {
+		f := newPathResponseFrame(path.response)
+		n := f.encodedLen()
+		if left >= n {
+			op.addFrame(f)
+			payloadLen += n
+			left -= n
+			path.response = nil
+		}
+	}
+	if path.challenge != nil {
+		f := newPathChallengeFrame(path.challenge)
+		n := f.encodedLen()
+		if left >= n {
+			op.addFrame(f)
+			payloadLen += n
+			left -= n
+			path.onChallengeSent()
+		}
+	}
+	return payloadLen
+}
+
+// sendFramesDatagram adds queued DATAGRAM frames which fit in the packet.
+// Datagrams larger than the packet capacity or the peer limit are dropped.
+func (s *Conn) sendFramesDatagram(op *outgoingPacket, capacity, left int) int {
+	payloadLen := 0
+	for {
+		data := s.datagrams.peek()
+		if data == nil {
+			break
+		}
+		f := newDatagramFrame(data)
+		n := f.encodedLen()
+		if n > capacity || uint64(n) > s.peerParams.MaxDatagramFrameSize {
+			debug("datagram dropped: frame size %d", n)
+			s.datagrams.pop()
+			continue
+		}
+		if n > left {
+			break
+		}
+		op.addFrame(f)
+		payloadLen += n
+		left -= n
+		s.datagrams.pop()
+	}
+	return payloadLen
+}
+
 func (s *Conn) onPacketSent(op *outgoingPacket, space packetSpace) {
 	s.recovery.onPacketSent(op, space)
 	s.packetNumberSpaces[space].nextPacketNumber++
@@ -1065,6 +2102,12 @@ func (s *Conn) onPacketSent(op *outgoingPacket, space packetSpace) {
 	}
 }
 
+// ECN returns the ECN codepoint to be set in the IP header of the datagram
+// last produced by ReadTo.
+func (s *Conn) ECN() ECN {
+	return s.sendECN
+}
+
 // Timeout returns the amount of time until the next timeout event.
 // A negative timeout means that the timer should be disarmed.
 func (s *Conn) Timeout() time.Duration {
@@ -1076,9 +2119,13 @@ func (s *Conn) Timeout() time.Duration {
 		deadline = s.recovery.lossDetectionTimer
 		if deadline.IsZero() {
 			deadline = s.idleTimer
-			if deadline.IsZero() {
-				return -1
-			}
+		}
+		// Wake up when pacer allows sending more data.
+		if t := s.recovery.pacer.nextSendTime; !t.IsZero() && (deadline.IsZero() || t.Before(deadline)) {
+			deadline = t
+		}
+		if deadline.IsZero() {
+			return -1
 		}
 	}
 	timeout := time.Until(deadline)
@@ -1099,9 +2146,46 @@ func (s *Conn) checkTimeout(now time.Time) {
 		s.state = stateClosed
 		return
 	}
+	s.checkPathTimeout(now)
+	if s.state == stateClosed {
+		return
+	}
+	pnSpace := &s.packetNumberSpaces[packetSpaceApplication]
+	if !pnSpace.prevOpenerTimer.IsZero() && !now.Before(pnSpace.prevOpenerTimer) {
+		debug("discard keys of previous key phase")
+		pnSpace.dropPrevKeys()
+	}
+	if !pnSpace.zeroRTTOpenerTimer.IsZero() && !now.Before(pnSpace.zeroRTTOpenerTimer) {
+		debug("discard 0-RTT keys")
+		pnSpace.dropZeroRTTKeys()
+	}
 	s.recovery.onLossDetectionTimeout(now)
 }
 
+// checkPathTimeout abandons paths which could not be validated in time.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-loss-detection-on-the-new-path
+func (s *Conn) checkPathTimeout(now time.Time) {
+	if path := s.paths.probe; path != nil && path.isValidationExpired(now) {
+		debug("path validation failed %v", path)
+		// Keep using the current path.
+		s.paths.probe = nil
+		s.addEvent(newPathFailedEvent())
+	}
+	if path := s.paths.active; path.isValidationExpired(now) {
+		debug("path validation failed %v", path)
+		if s.paths.previous == nil {
+			// No validated path to fall back, close the connection silently.
+			s.state = stateClosed
+			return
+		}
+		// Revert to the last validated path.
+		s.paths.active = s.paths.previous
+		s.paths.previous = nil
+		s.recovery.resetCongestion()
+		s.addEvent(newPathFailedEvent())
+	}
+}
+
 // Close sets the connection to closing state.
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#draining
 func (s *Conn) Close(app bool, errCode uint64, reason string) {
@@ -1117,6 +2201,130 @@ func (s *Conn) Close(app bool, errCode uint64, reason string) {
 	s.state = stateDraining
 }
 
+// Path returns the network path currently in use.
+func (s *Conn) Path() Path {
+	return s.paths.active.addr
+}
+
+// ProbePath validates a new network path and migrates the connection to it when succeeded.
+// A new connection ID is used on the new path. Only client can initiate migration after
+// the handshake is confirmed and when the peer does not disable active migration.
+// EventPathMigrated or EventPathFailed is emitted when path validation completes.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-connection-migration
+func (s *Conn) ProbePath(addr Path) error {
+	if !s.isClient {
+		return newError(InternalError, "only client can migrate")
+	}
+	if s.state != stateActive || !s.handshakeConfirmed {
+		return newError(InternalError, "handshake not confirmed")
+	}
+	if s.peerParams.DisableActiveMigration {
+		return newError(InternalError, "active migration disabled")
+	}
+	if addr.isZero() || s.paths.active.addr.equal(addr) {
+		return newError(InternalError, sprint("invalid path ", addr))
+	}
+	if s.paths.probe != nil && s.paths.probe.validating {
+		return newError(InternalError, "path validation in progress")
+	}
+	path := newNetworkPath(addr, false)
+	if len(s.dcid) > 0 {
+		next := s.connIDs.nextPeer()
+		if next == nil {
+			return newError(InternalError, "no connection id available")
+		}
+		path.dcid = append([]byte(nil), next.cid...)
+		path.dcidSeq = next.seq
+	}
+	if err := s.validatePath(path, s.time()); err != nil {
+		return err
+	}
+	s.paths.probe = path
+	return nil
+}
+
+// UpdateKey initiates a key update. Packets are protected with the new keys after this call.
+// A key update can only be started after the handshake is confirmed and the previous
+// key update has been acknowledged.
+// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-initiating-a-key-update
+func (s *Conn) UpdateKey() error {
+	if s.state != stateActive || !s.handshakeConfirmed {
+		return newError(InternalError, "handshake not confirmed")
+	}
+	pnSpace := &s.packetNumberSpaces[packetSpaceApplication]
+	if !pnSpace.canUpdateKey() {
+		return newError(InternalError, "key update in progress")
+	}
+	pnSpace.updateKey()
+	return nil
+}
+
+// SetToken sets the token received in a NEW_TOKEN frame of a previous connection
+// to be included in Initial packets. It is only valid for client and must be
+// called before the first packet is sent.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-address-validation-for-futu
+func (s *Conn) SetToken(token []byte) error {
+	if !s.isClient || s.state != stateAttempted || s.packetNumberSpaces[packetSpaceInitial].nextPacketNumber > 0 {
+		return newError(InternalError, "token not allowed")
+	}
+	s.token = append(s.token[:0], token...)
+	return nil
+}
+
+// IssueToken sends an address validation token to client in a NEW_TOKEN frame
+// after the handshake is complete. It is only valid for server.
+func (s *Conn) IssueToken(token []byte) error {
+	if s.isClient || len(token) == 0 {
+		return newError(InternalError, "token not allowed")
+	}
+	s.newToken = append([]byte(nil), token...)
+	return nil
+}
+
+// DatagramTooLarge tells the datagram of size returned by ReadTo could not be sent because
+// it is larger than the local MTU. If it is a PMTU probe, the probe is considered lost immediately.
+func (s *Conn) DatagramTooLarge(size int) {
+	if s.recovery.onPMTUProbeFailed(size, s.time()) {
+		debug("pmtu probe too large size=%d %v", size, &s.recovery.pmtud)
+	}
+}
+
+// ValidateAddress marks client address as validated, e.g. by a token previously sent
+// in a NEW_TOKEN frame, so the anti-amplification limit does not apply.
+// It is only valid for server before the handshake starts.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-address-validation-for-futu
+func (s *Conn) ValidateAddress() error {
+	if s.isClient || s.state != stateAttempted {
+		return newError(InternalError, "address validation not allowed")
+	}
+	s.paths.active.validated = true
+	s.paths.active.limited = false
+	return nil
+}
+
+// SendDatagram queues data to be sent unreliably in a DATAGRAM frame.
+// The data is not retransmitted when lost.
+// https://www.rfc-editor.org/rfc/rfc9221.html
+func (s *Conn) SendDatagram(b []byte) error {
+	max := s.peerParams.MaxDatagramFrameSize
+	if max == 0 {
+		return newError(InternalError, "datagram not supported by peer")
+	}
+	if n := newDatagramFrame(b).encodedLen(); uint64(n) > max || n > s.maxPacketSize()-maxDatagramPacketOverhead {
+		return newError(InternalError, sprint("datagram too large ", len(b)))
+	}
+	if !s.datagrams.push(b) {
+		return newError(InternalError, "datagram queue full")
+	}
+	return nil
+}
+
+// RecvDatagram returns the data of next received DATAGRAM frame or nil
+// if there is none. EventDatagram is emitted when a DATAGRAM frame is received.
+func (s *Conn) RecvDatagram() []byte {
+	return s.datagrams.popRecv()
+}
+
 // IsEstablished returns true of handshake is complete and the connection is not closing.
 func (s *Conn) IsEstablished() bool {
 	return s.state == stateActive
@@ -1127,6 +2335,12 @@ func (s *Conn) IsClosed() bool {
 	return s.state == stateClosed
 }
 
+// ConnectionState returns details about the TLS connection, such as whether
+// the session was resumed, the negotiated application protocol and peer certificates.
+func (s *Conn) ConnectionState() tls.ConnectionState {
+	return s.handshake.connectionState()
+}
+
 // Events consumes received events. It appends to provided events slice
 // and clear received events.
 func (s *Conn) Events(events []Event) []Event {
@@ -1142,14 +2356,35 @@ func (s *Conn) Events(events []Event) []Event {
 // Client-initiated streams have even-numbered stream IDs and
 // server-initiated streams have odd-numbered stream IDs.
 func (s *Conn) Stream(id uint64) (*Stream, error) {
-	return s.getOrCreateStream(id, true)
+	st, err := s.getOrCreateStream(id, true)
+	if err == nil && st == nil {
+		err = newError(StreamStateError, sprint("stream closed ", id))
+	}
+	return st, err
+}
+
+// collectStreams removes streams which have been closed in both directions.
+// Peer is given credit to open new streams as its streams are removed.
+func (s *Conn) collectStreams() {
+	for id, st := range s.streams.streams {
+		if st.isClosed() {
+			debug("stream %d closed", id)
+			s.streams.remove(id)
+			s.addEvent(newStreamClosedEvent(id))
+		}
+	}
 }
 
 func (s *Conn) sendFrameAck(pnSpace *packetNumberSpace, now time.Time) *ackFrame {
 	if pnSpace.ackElicited {
 		ackDelay := uint64(now.Sub(pnSpace.largestRecvPacketTime).Microseconds())
 		ackDelay /= 1 << s.peerParams.AckDelayExponent
-		return newAckFrame(ackDelay, pnSpace.recvPacketNeedAck)
+		f := newAckFrame(ackDelay, pnSpace.recvPacketNeedAck)
+		if !pnSpace.recvECN.isZero() {
+			counts := pnSpace.recvECN
+			f.ecnCounts = &counts
+		}
+		return f
 	}
 	return nil
 }
@@ -1188,6 +2423,13 @@ func (s *Conn) sendFrameMaxData() *maxDataFrame {
 	return nil
 }
 
+func (s *Conn) sendFrameMaxStreams(bidi bool) *maxStreamsFrame {
+	if v := s.streams.localMaxStreamsNext(bidi); v > 0 {
+		return newMaxStreamsFrame(v, bidi)
+	}
+	return nil
+}
+
 func (s *Conn) sendFrameMaxStreamData(id uint64, st *Stream) *maxStreamDataFrame {
 	if st.updateMaxData {
 		return newMaxStreamDataFrame(id, st.flow.maxRecvNext)
@@ -1195,6 +2437,71 @@ func (s *Conn) sendFrameMaxStreamData(id uint64, st *Stream) *maxStreamDataFrame
 	return nil
 }
 
+// commitMaxData sets the receiving limit after MAX_DATA has been sent.
+// The window is only auto-tuned when it is a new limit rather than a retransmission.
+func (s *Conn) commitMaxData(now time.Time) {
+	// Window is only tuned for a new limit, not a retransmission.
+	tune := s.flow.maxRecvNext != s.flow.maxRecv
+	s.flow.commitMaxRecv()
+	if tune {
+		s.flow.autoTune(now, s.recovery.smoothedRTT)
+	}
+}
+
+// commitMaxStreamData sets the receiving limit of the stream after MAX_STREAM_DATA has been sent.
+func (s *Conn) commitMaxStreamData(st *Stream, now time.Time) {
+	tune := st.flow.maxRecvNext != st.flow.maxRecv
+	st.flow.commitMaxRecv()
+	if tune {
+		st.flow.autoTune(now, s.recovery.smoothedRTT)
+		// Connection window should be larger than stream window so a single stream
+		// does not block the others.
+		s.flow.setWindow(st.flow.window * 3 / 2)
+	}
+}
+
+// sendFrameDataBlocked returns DATA_BLOCKED when streams have data to send but are
+// blocked by connection-level flow control.
+func (s *Conn) sendFrameDataBlocked() *dataBlockedFrame {
+	if s.flow.canSend() == 0 && s.streams.hasFlushable() {
+		s.flow.setBlocked()
+	}
+	if s.flow.blocked {
+		return newDataBlockedFrame(s.flow.maxSend)
+	}
+	return nil
+}
+
+func (s *Conn) sendFrameStreamDataBlocked(id uint64, st *Stream) *streamDataBlockedFrame {
+	if st.flow.blocked {
+		return newStreamDataBlockedFrame(id, st.flow.maxSend)
+	}
+	return nil
+}
+
+func (s *Conn) sendFrameResetStream(id uint64, st *Stream) *resetStreamFrame {
+	if st.updateReset {
+		return newResetStreamFrame(id, st.send.resetCode, st.send.length)
+	}
+	return nil
+}
+
+func (s *Conn) sendFrameStopSending(id uint64, st *Stream) *stopSendingFrame {
+	if st.updateStopSending {
+		return newStopSendingFrame(id, st.recv.stopCode)
+	}
+	return nil
+}
+
+func (s *Conn) sendFrameNewConnectionID(seq uint64) *newConnectionIDFrame {
+	c := s.connIDs.getLocal(seq)
+	if c == nil {
+		// Retired before being sent
+		return nil
+	}
+	return newNewConnectionIDFrame(c.seq, 0, c.cid, c.resetToken)
+}
+
 func (s *Conn) sendFrameHandshakeDone() *handshakeDoneFrame {
 	// HandshakeDone is sent only by server.
 	if s.isClient || s.state != stateActive || s.handshakeConfirmed {
@@ -1203,17 +2510,29 @@ func (s *Conn) sendFrameHandshakeDone() *handshakeDoneFrame {
 	return &handshakeDoneFrame{}
 }
 
+func (s *Conn) sendFrameNewToken() *newTokenFrame {
+	// NewToken is sent only by server after the handshake.
+	if s.isClient || s.state != stateActive || s.newToken == nil {
+		return nil
+	}
+	return newNewTokenFrame(s.newToken)
+}
+
 func (s *Conn) setDraining(now time.Time) {
 	if s.drainingTimer.IsZero() {
 		s.drainingTimer = now.Add(s.recovery.probeTimeout() * 3)
 	}
 }
 
+// getOrCreateStream returns nil stream without error when the stream has been closed.
 func (s *Conn) getOrCreateStream(id uint64, local bool) (*Stream, error) {
 	st := s.streams.get(id)
 	if st != nil {
 		return st, nil
 	}
+	if s.streams.isClosed(id) {
+		return nil, nil
+	}
 	// Initialize new stream
 	if local != isStreamLocal(id, s.isClient) {
 		return nil, newError(StreamStateError, sprint("invalid type of stream ", id))
@@ -1223,33 +2542,42 @@ func (s *Conn) getOrCreateStream(id uint64, local bool) (*Stream, error) {
 	if err != nil {
 		return nil, err
 	}
-	var maxRecv, maxSend uint64
+	var maxRecv uint64
 	if local {
 		if bidi {
 			maxRecv = s.localParams.InitialMaxStreamDataBidiLocal
-			maxSend = s.peerParams.InitialMaxStreamDataBidiRemote
-		} else {
-			maxRecv = 0
-			maxSend = s.peerParams.InitialMaxStreamDataUni
 		}
 	} else {
 		if bidi {
 			maxRecv = s.localParams.InitialMaxStreamDataBidiRemote
-			maxSend = s.peerParams.InitialMaxStreamDataBidiLocal
 		} else {
 			maxRecv = s.localParams.InitialMaxStreamDataUni
-			maxSend = 0
 		}
 	}
-	st.flow.init(maxRecv, maxSend)
+	st.flow.init(maxRecv, s.peerInitialMaxStreamData(id))
+	st.flow.setMaxWindow(s.maxStreamWindow)
 	// Manually set connection flow control to get updated read bytes
 	st.connFlow = &s.flow
 	return st, nil
 }
 
-func (s *Conn) dropPacketSpace(space packetSpace) {
+// peerInitialMaxStreamData returns the initial send limit of stream id given by peer.
+func (s *Conn) peerInitialMaxStreamData(id uint64) uint64 {
+	if isStreamLocal(id, s.isClient) {
+		if isStreamBidi(id) {
+			return s.peerParams.InitialMaxStreamDataBidiRemote
+		}
+		return s.peerParams.InitialMaxStreamDataUni
+	}
+	if isStreamBidi(id) {
+		return s.peerParams.InitialMaxStreamDataBidiLocal
+	}
+	return 0
+}
+
+func (s *Conn) dropPacketSpace(space packetSpace, now time.Time) {
 	s.packetNumberSpaces[space].drop()
-	s.recovery.dropUnackedData(space)
+	s.recovery.onSpaceDiscarded(space, now)
 	debug("dropped space=%v", space)
 }
 
@@ -1276,6 +2604,17 @@ func (s *Conn) time() time.Time {
 	return time.Now()
 }
 
+// hasPathValidationFrame returns true if frames contain PATH_CHALLENGE or PATH_RESPONSE.
+func hasPathValidationFrame(frames []frame) bool {
+	for _, f := range frames {
+		switch f.(type) {
+		case *pathChallengeFrame, *pathResponseFrame:
+			return true
+		}
+	}
+	return false
+}
+
 func minInt(a, b int) int {
 	if a < b {
 		return a
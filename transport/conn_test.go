@@ -6,8 +6,11 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/goburrow/quic/tls13"
 )
 
 func TestClientConnInitialState(t *testing.T) {
@@ -18,179 +21,1806 @@ func TestClientConnInitialState(t *testing.T) {
 	config.Params.StatelessResetToken = []byte{0}
 	scid := []byte{1, 2, 3}
 
-	c, err := Connect(scid, config)
+	c, err := Connect(scid, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(scid, c.scid) {
+		t.Fatalf("expect scid %x, actual %x", scid, c.scid)
+	}
+	if !bytes.Equal(scid, c.localParams.InitialSourceCID) {
+		t.Fatalf("expect initial source cid %x, actual %#v", scid, c.localParams)
+	}
+	if len(c.dcid) != MaxCIDLength {
+		t.Fatalf("expect dcid generated, actual %x", c.dcid)
+	}
+	if c.localParams.OriginalDestinationCID != nil || c.localParams.RetrySourceCID != nil ||
+		c.localParams.StatelessResetToken != nil {
+		t.Fatalf("expect empty cid, actual %#v", c.localParams)
+	}
+}
+
+func TestServerConnInitialState(t *testing.T) {
+	config := NewConfig()
+	config.Params.OriginalDestinationCID = []byte{0}
+	config.Params.InitialSourceCID = []byte{0}
+	config.Params.RetrySourceCID = []byte{0}
+	config.Params.StatelessResetToken = []byte{8, 9}
+	scid := []byte{1, 2, 3}
+	odcid := []byte{4, 5}
+
+	c, err := Accept(scid, odcid, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(scid, c.scid) {
+		t.Fatalf("expect scid %x, actual %x", scid, c.scid)
+	}
+	if !bytes.Equal(scid, c.localParams.InitialSourceCID) {
+		t.Fatalf("expect initial source cid %x, actual %#v", scid, c.localParams)
+	}
+	if !bytes.Equal(odcid, c.localParams.OriginalDestinationCID) {
+		t.Fatalf("expect original destination cid %x, actual %#v", odcid, c.localParams)
+	}
+	if !bytes.Equal(scid, c.localParams.RetrySourceCID) {
+		t.Fatalf("expect retry source cid %x, actual %#v", scid, c.localParams)
+	}
+	if !bytes.Equal(config.Params.StatelessResetToken, c.localParams.StatelessResetToken) {
+		t.Fatalf("expect reset token %x, actual %#v", config.Params.StatelessResetToken, c.localParams)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	// Not use stub random and time
+	clientConfig := NewConfig()
+	clientConfig.Version = 0xffffffff
+	clientConfig.TLS = &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = negotiateClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.version != ProtocolVersion {
+		t.Fatalf("expect negotiated version %v, actual %v", ProtocolVersion, client.version)
+	}
+	err = retryClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("client retried scid=%x dcid=%x odcid=%x", client.scid, client.dcid, client.odcid)
+	serverConfig := NewConfig()
+	serverConfig.TLS = &tls.Config{
+		Certificates: testCerts,
+	}
+	server, err := Accept([]byte("server-cid"), client.odcid, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handshake(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("server handshaked scid=%x dcid=%x odcid=%x", server.scid, server.dcid, server.odcid)
+}
+
+func TestConnStream(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	ct, err := client.Stream(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ct.Write([]byte("hello"))
+	if n != 5 || err != nil {
+		t.Fatalf("stream write: %v %v", n, err)
+	}
+	err = ct.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(b)
+	if err != nil {
+		t.Fatalf("client read: %v %v", n, err)
+	}
+	n, err = server.Write(b[:n])
+	if err != nil {
+		t.Fatalf("server write: %v %v", n, err)
+	}
+	events := server.Events(nil)
+	if len(events) != 1 || events[0].Type != EventStream || events[0].StreamID != 4 {
+		t.Fatalf("events %+v", events)
+	}
+	st, err := server.Stream(events[0].StreamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = st.Read(b)
+	if n != 5 || err != nil {
+		t.Fatalf("server stream read %v %v", n, err)
+	}
+	if string(b[:n]) != "hello" {
+		t.Fatalf("server received %v", b[:n])
+	}
+	n, err = st.Read(b)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("server stream read %v %v, expect %v", n, err, io.EOF)
+	}
+}
+
+func TestSendMaxData(t *testing.T) {
+	config := newTestConfig()
+	config.Params.InitialMaxData = 200
+	config.Params.InitialMaxStreamDataBidiRemote = 150
+	s, err := Accept([]byte("server-cid"), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 201)
+	stream := &streamFrame{
+		streamID: 4,
+		offset:   0,
+		data:     b,
+	}
+	_, err = s.recvFrameStream(encodeFrame(stream), testTime())
+	if err != errFlowControl {
+		t.Fatalf("expect error %v, actual %v", errFlowControl, err)
+	}
+	stream.data = b[:100]
+	_, err = s.recvFrameStream(encodeFrame(stream), testTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxData := s.sendFrameMaxData()
+	if maxData != nil {
+		t.Fatalf("expect no max data frame, actual %v", maxData)
+	}
+	// max 1024, read 1000
+	st, _ := s.Stream(4)
+	st.Read(b)
+	t.Logf("flow: %+v", s.flow)
+	maxData = s.sendFrameMaxData()
+	if maxData == nil || maxData.maximumData != 300 {
+		t.Fatalf("expect max data frame, actual %v", maxData)
+	}
+	t.Logf("stream flow: %+v", st.flow)
+	maxStreamData := s.sendFrameMaxStreamData(4, st)
+	if maxStreamData == nil || maxStreamData.streamID != 4 || maxStreamData.maximumData != 250 {
+		t.Fatalf("expect max stream data frame, actual %v", maxStreamData)
+	}
+}
+
+func TestConnDataBlocked(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1024)
+	st, err := client.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.Write(b[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	// Not blocked while there is still credit.
+	if _, err = st.Write(b[:100]); err != errFlowControl || st.flow.blocked {
+		t.Fatalf("expect error %v and not blocked, actual %v %+v", errFlowControl, err, st.flow)
+	}
+	if _, err = st.Write(b[:24]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.Write(b[:1]); err != errFlowControl {
+		t.Fatalf("expect error %v, actual %v", errFlowControl, err)
+	}
+	uni, err := client.Stream(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = uni.Write(b[:10]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = transfer(client, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st.flow.blocked || !st.flow.blockedSent || st.flow.blockedAt != 1024 {
+		t.Fatalf("expect stream data blocked sent: %+v", st.flow)
+	}
+	if client.flow.blocked || !client.flow.blockedSent || client.flow.blockedAt != 1024 {
+		t.Fatalf("expect data blocked sent: %+v", client.flow)
+	}
+	// Peer is still blocked after receiving limits are raised.
+	sst, err := server.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := sst.Read(b); n != 1024 {
+		t.Fatalf("expect read %d, actual %d", 1024, n)
+	}
+	server.updateMaxData = false
+	sst.updateMaxData = false
+	_, err = server.recvFrameDataBlocked(encodeFrame(newDataBlockedFrame(1024)), testTime())
+	if err != nil || !server.updateMaxData {
+		t.Fatalf("expect max data to be sent: %v %+v", err, server.flow)
+	}
+	_, err = server.recvFrameStreamDataBlocked(encodeFrame(newStreamDataBlockedFrame(0, 1024)), testTime())
+	if err != nil || !sst.updateMaxData {
+		t.Fatalf("expect max stream data to be sent: %v %+v", err, sst.flow)
+	}
+	_, err = server.recvFrameStreamDataBlocked(encodeFrame(newStreamDataBlockedFrame(3, 0)), testTime())
+	if err == nil || err.Error() != "stream_state_error stream data blocked 3" {
+		t.Fatalf("expect error %v, actual %v", errorText[StreamStateError], err)
+	}
+}
+
+func TestConnAutoTuneWindowBlocked(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := client.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1024)
+	if _, err = st.Write(b[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err = transfer(client, server); err != nil {
+		t.Fatal(err)
+	}
+	sst, err := server.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := testTime()
+	server.recovery.smoothedRTT = 100 * time.Millisecond
+	sst.flow.lastUpdate = now
+	window := sst.flow.window
+	if n, _ := sst.Read(b); n != 10 {
+		t.Fatalf("expect read %d, actual %d", 10, n)
+	}
+	if sst.updateMaxData {
+		t.Fatalf("expect max stream data not needed: %+v", sst.flow)
+	}
+	// Peer is blocked so the new limit is sent before reaching the update threshold.
+	sst.updateMaxData = true
+	op := outgoingPacket{}
+	server.sendFrames(&op, packetSpaceApplication, server.paths.active, 1000, now)
+	if sst.flow.maxRecv != 1034 || sst.flow.window != 2*window {
+		t.Fatalf("expect window %d, actual %+v", 2*window, sst.flow)
+	}
+}
+
+func TestConnAutoTuneWindow(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := client.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1024)
+	if _, err = st.Write(b[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	if err = transfer(client, server); err != nil {
+		t.Fatal(err)
+	}
+	sst, err := server.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := testTime()
+	server.recovery.smoothedRTT = 100 * time.Millisecond
+	// Last update was recent so the next new limit grows the window.
+	sst.flow.lastUpdate = now
+	server.flow.lastUpdate = now
+	window := sst.flow.window
+	if n, _ := sst.Read(b); n != 1000 {
+		t.Fatalf("expect read %d, actual %d", 1000, n)
+	}
+	var maxData []uint64
+	for i := 0; i < 3; i++ {
+		op := outgoingPacket{}
+		// No room for MAX_STREAM_DATA in the first packet.
+		left := 1000
+		if i == 0 {
+			left = 2
+		}
+		server.sendFrames(&op, packetSpaceApplication, server.paths.active, left, now)
+		for _, f := range op.frames {
+			if f, ok := f.(*maxStreamDataFrame); ok {
+				maxData = append(maxData, f.maximumData)
+			}
+		}
+	}
+	// MAX_STREAM_DATA is resent until acknowledged but the window is only tuned once.
+	if len(maxData) != 2 || maxData[0] != 2024 || maxData[1] != 2024 {
+		t.Fatalf("expect max stream data sent twice, actual %v", maxData)
+	}
+	if sst.flow.window != 2*window || sst.flow.pendingWindow != window {
+		t.Fatalf("expect window %d, actual %+v", 2*window, sst.flow)
+	}
+	if server.flow.window != 3*window {
+		t.Fatalf("expect connection window %d, actual %+v", 3*window, server.flow)
+	}
+}
+
+func TestConnConnectionID(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.connIDs.local) != defaultActiveConnectionIDLimit {
+		t.Fatalf("expect %d local cids, actual %v", defaultActiveConnectionIDLimit, &server.connIDs)
+	}
+	b := make([]byte, 1400)
+	for i := 0; i < 3; i++ {
+		n, err := server.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Write(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.connIDs.peer) != 2 {
+		t.Fatalf("expect 2 peer cids, actual %v", &client.connIDs)
+	}
+	// Switch to the new destination CID
+	next := client.connIDs.nextPeer()
+	client.connIDs.usePeer(next.seq)
+	client.dcid = next.cid
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := server.Events(nil)
+	if len(events) != 2 || events[0].Type != EventConnectionIDRetire || string(events[0].Data) != "server-cid" ||
+		events[1].Type != EventConnectionIDNew {
+		t.Fatalf("expect retired and issued cid events, actual %+v", events)
+	}
+	if server.connIDs.hasLocal([]byte("server-cid")) {
+		t.Fatalf("expect cid retired, actual %v", &server.connIDs)
+	}
+}
+
+func TestConnPeerMigration(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path1 := Path{Peer: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}}
+	path2 := Path{Peer: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2000}}
+	b := make([]byte, 1400)
+	st, err := client.Stream(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("hello"))
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.WriteFrom(b[:n], path1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Path().equal(path1) || !server.paths.active.validated {
+		t.Fatalf("expect validated path %v, actual %v", path1, &server.paths)
+	}
+	// Client address changed
+	st.Write([]byte("world"))
+	n, err = client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvLen := n
+	_, err = server.WriteFrom(b[:n], path2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Path().equal(path2) || server.paths.active.validated || !server.paths.active.needSend() {
+		t.Fatalf("expect validating path %v, actual %v", path2, &server.paths)
+	}
+	n, addr, err := server.ReadTo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.equal(path2) || n == 0 || n > amplificationFactor*recvLen {
+		t.Fatalf("expect sending to %v, actual %v %d", path2, addr, n)
+	}
+	_, err = client.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < MinInitialPacketSize {
+		t.Fatalf("expect path response padded to %d, actual %d", MinInitialPacketSize, n)
+	}
+	_, err = server.WriteFrom(b[:n], path2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.paths.active.validated || server.paths.previous != nil {
+		t.Fatalf("expect path validated, actual %v", &server.paths)
+	}
+}
+
+func TestConnClientMigration(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4433}
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000}
+	client.paths.active.addr = Path{Local: clientAddr, Peer: serverAddr}
+	server.paths.active.addr = Path{Local: serverAddr, Peer: clientAddr}
+	clientPath := Path{Local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2000}, Peer: serverAddr}
+	b := make([]byte, 1400)
+	// Receive new connection IDs
+	for i := 0; i < 3; i++ {
+		n, err := server.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Write(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := client.connIDs.nextPeer()
+	if next == nil {
+		t.Fatalf("expect new connection id, actual %v", &client.connIDs)
+	}
+	err = client.ProbePath(clientPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, addr, err := client.ReadTo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.equal(clientPath) || n < MinInitialPacketSize {
+		t.Fatalf("expect probing packet to %v, actual %v %d", clientPath, addr, n)
+	}
+	serverPath := Path{Local: serverAddr, Peer: clientPath.Local}
+	_, err = server.WriteFrom(b[:n], serverPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.paths.probe == nil || server.Path().equal(serverPath) {
+		t.Fatalf("expect server probing path, actual %v", &server.paths)
+	}
+	n, addr, err = server.ReadTo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.equal(serverPath) {
+		t.Fatalf("expect path response to %v, actual %v", serverPath, addr)
+	}
+	_, err = client.WriteFrom(b[:n], clientPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := client.Events(nil)
+	if len(events) != 1 || events[0].Type != EventPathMigrated {
+		t.Fatalf("expect path migrated event, actual %+v", events)
+	}
+	if !client.Path().equal(clientPath) || !bytes.Equal(client.dcid, next.cid) {
+		t.Fatalf("expect client migrated to %v with dcid %x, actual %v %x", clientPath, next.cid, &client.paths, client.dcid)
+	}
+}
+
+func TestConnClientMigrationDisabled(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = server
+	client.peerParams.DisableActiveMigration = true
+	err = client.ProbePath(Path{Local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2000}})
+	if err == nil {
+		t.Fatal("expect error when active migration is disabled")
+	}
+}
+
+func TestConnStatelessReset(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.StatelessResetKey = []byte("reset-key")
+	serverCID := []byte("server-cid")
+	server, err := Accept(serverCID, nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := StatelessResetToken(serverConfig.StatelessResetKey, serverCID)
+	if !bytes.Equal(token, server.localParams.StatelessResetToken) {
+		t.Fatalf("expect reset token %x, actual %x", token, server.localParams.StatelessResetToken)
+	}
+	err = handshake(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range server.connIDs.local {
+		expect := StatelessResetToken(serverConfig.StatelessResetKey, c.cid)
+		if !bytes.Equal(expect, c.resetToken) {
+			t.Fatalf("expect reset token %x for %v, actual %x", expect, c, c.resetToken)
+		}
+	}
+	// Packet with unknown token is dropped
+	b := make([]byte, 40)
+	_, err = StatelessReset(b, make([]byte, statelessResetTokenLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.state != stateActive {
+		t.Fatalf("expect state %v, actual %v", stateActive, client.state)
+	}
+	_, err = StatelessReset(b, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.state != stateDraining || client.drainingTimer.IsZero() {
+		t.Fatalf("expect state %v, actual %v", stateDraining, client.state)
+	}
+	n, err := client.Read(b)
+	if n != 0 || err != nil {
+		t.Fatalf("expect no data sent, actual %d %v", n, err)
+	}
+}
+
+func TestConnKeyUpdate(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	// Exchange packets until the handshake is confirmed and acknowledged.
+	for i := 0; i < 3; i++ {
+		n, err := server.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			if _, err = client.Write(b[:n]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n, err = client.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			if _, err = server.Write(b[:n]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = client.UpdateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.UpdateKey()
+	if err == nil {
+		t.Fatal("expect error updating key again before acknowledged")
+	}
+	clientSpace := &client.packetNumberSpaces[packetSpaceApplication]
+	serverSpace := &server.packetNumberSpaces[packetSpaceApplication]
+	if !clientSpace.keyPhase || clientSpace.prevOpener.aead == nil {
+		t.Fatalf("expect client key phase updated")
+	}
+	st, err := client.Stream(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serverSpace.keyPhase || serverSpace.prevOpener.aead == nil || serverSpace.prevOpenerTimer.IsZero() {
+		t.Fatalf("expect server key phase updated")
+	}
+	events := server.Events(nil)
+	if len(events) != 1 || events[0].Type != EventStream || events[0].StreamID != 4 {
+		t.Fatalf("expect stream event, actual %+v", events)
+	}
+	n, err = server.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clientSpace.keyPhaseAcked || clientSpace.prevOpenerTimer.IsZero() {
+		t.Fatalf("expect client received packet in new key phase")
+	}
+	// Old keys are discarded after timeout.
+	client.checkTimeout(clientSpace.prevOpenerTimer)
+	if clientSpace.prevOpener.aead != nil {
+		t.Fatalf("expect client previous keys discarded")
+	}
+	if client.state != stateActive {
+		t.Fatalf("expect client state %v, actual %v", stateActive, client.state)
+	}
+	err = client.UpdateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnEarlyData(t *testing.T) {
+	b := make([]byte, 1400)
+	for _, accepted := range []bool{true, false} {
+		client, server, err := newTestEarlyDataConn(accepted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := client.Stream(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = st.Write([]byte("early"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Initial packet fills the first datagram, 0-RTT packet is sent in the next one.
+		for i := 0; i < 2; i++ {
+			n, err := client.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = server.Write(b[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if client.packetNumberSpaces[packetSpaceApplication].nextPacketNumber != 1 {
+			t.Fatalf("expect client sent 0-RTT packet")
+		}
+		events := server.Events(nil)
+		if accepted {
+			if len(events) != 1 || events[0].Type != EventStream || events[0].StreamID != 0 {
+				t.Fatalf("expect stream event, actual %+v", events)
+			}
+		} else if len(events) != 0 {
+			t.Fatalf("expect no events, actual %+v", events)
+		}
+		err = handshake(client, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.packetNumberSpaces[packetSpaceApplication].canEncrypt(packetTypeZeroRTT) {
+			t.Fatalf("expect client 0-RTT keys discarded")
+		}
+		// Rejected data is retransmitted in 1-RTT packets.
+		n, err := client.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = server.Write(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, err := server.Stream(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err = ss.Read(b)
+		if err != nil || string(b[:n]) != "early" {
+			t.Fatalf("expect server received %q, actual %q %v", "early", b[:n], err)
+		}
+		serverSpace := &server.packetNumberSpaces[packetSpaceApplication]
+		if accepted {
+			if serverSpace.zeroRTTOpenerTimer.IsZero() {
+				t.Fatalf("expect server 0-RTT keys discarding scheduled")
+			}
+			server.checkTimeout(serverSpace.zeroRTTOpenerTimer)
+			if serverSpace.canDecrypt(packetTypeZeroRTT) {
+				t.Fatalf("expect server 0-RTT keys discarded")
+			}
+		}
+	}
+}
+
+func TestConnEarlyDataRejectedLowerLimits(t *testing.T) {
+	client, server, err := newTestEarlyDataConn(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remembered limits are higher than the server ones.
+	client.flow.setMaxSend(10000)
+	client.peerParams.InitialMaxStreamDataBidiRemote = 10000
+	st, err := client.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2000)
+	if _, err = st.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = handshake(client, server); err != nil {
+		t.Fatal(err)
+	}
+	limit := server.localParams.InitialMaxStreamDataBidiRemote
+	if client.flow.maxSend != server.localParams.InitialMaxData || st.flow.maxSend != limit {
+		t.Fatalf("expect send limits %v %v, actual %v %v", server.localParams.InitialMaxData, limit,
+			client.flow.maxSend, st.flow.maxSend)
+	}
+	for i := 0; i < 4; i++ {
+		if err = transfer(client, server); err != nil {
+			t.Fatal(err)
+		}
+		if err = transfer(server, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ss, err := server.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ss.Read(data)
+	if err != nil || uint64(n) != limit {
+		t.Fatalf("expect server received %v bytes, actual %v %v", limit, n, err)
+	}
+}
+
+func TestConnSessionResumption(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	clientConfig.TLS.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	clientConfig.EarlyData = true
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.EarlyData = true
+	b := make([]byte, 1400)
+	for i := 0; i < 2; i++ {
+		resumed := i > 0
+		client, err := Connect([]byte("client-cid"), clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := Accept([]byte("server-cid"), nil, serverConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := client.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = server.Write(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resumed {
+			if !client.zeroRTT {
+				t.Fatalf("expect client sending early data")
+			}
+			st, err := client.Stream(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = st.Write([]byte("early"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = handshake(client, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Deliver session ticket.
+		n, err = server.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Write(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := client.ConnectionState()
+		if state.DidResume != resumed || state.NegotiatedProtocol != "" || len(state.PeerCertificates) == 0 {
+			t.Fatalf("unexpected client connection state: %+v", state)
+		}
+		if state = server.ConnectionState(); state.DidResume != resumed {
+			t.Fatalf("expect server resumed %v, actual %v", resumed, state.DidResume)
+		}
+		if _, ok := clientConfig.TLS.ClientSessionCache.Get("localhost"); !ok {
+			t.Fatalf("expect session ticket stored")
+		}
+		if resumed {
+			if !client.handshake.earlyDataAccepted() || !server.handshake.earlyDataAccepted() {
+				t.Fatalf("expect early data accepted")
+			}
+			events := server.Events(nil)
+			if len(events) == 0 || events[0].Type != EventStream || events[0].StreamID != 0 {
+				t.Fatalf("expect stream event, actual %+v", events)
+			}
+		}
+	}
+}
+
+func TestConnNewToken(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.IssueToken([]byte("token")); err == nil {
+		t.Fatal("expect error issuing token by client")
+	}
+	if err = server.IssueToken([]byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	err = handshake(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	n, err := server.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token []byte
+	for _, e := range client.Events(nil) {
+		if e.Type == EventNewToken {
+			token = e.Data
+		}
+	}
+	if string(token) != "token" {
+		t.Fatalf("expect new token event, actual %q", token)
+	}
+	// Server must not receive NEW_TOKEN.
+	_, err = server.recvFrameNewToken(encodeFrame(newNewTokenFrame(token)), testTime())
+	if err == nil || err.(*Error).Code != ProtocolViolation {
+		t.Fatalf("expect error %v, actual %v", ProtocolViolation, err)
+	}
+	// Token is used in a new connection.
+	client, err = Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.SetToken(token); err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Header{}
+	_, err = h.Decode(b[:n], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(h.Token) != "token" {
+		t.Fatalf("expect token in initial packet, actual %q", h.Token)
+	}
+	if err = client.SetToken(token); err == nil {
+		t.Fatal("expect error setting token after sending initial packet")
+	}
+}
+
+func TestConnValidateAddress(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.ValidateAddress(); err == nil {
+		t.Fatal("expect error validating address on client")
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Client presented a valid token from NEW_TOKEN frame.
+	if err = server.ValidateAddress(); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := server.paths.active
+	// Client does not respond but server is not limited in probing.
+	for i := 0; i < 10; i++ {
+		for {
+			n, err = server.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		if server.recovery.amplificationLimited || server.recovery.lossDetectionTimer.IsZero() {
+			t.Fatalf("expect not amplification limited: %v", path)
+		}
+		server.checkTimeout(server.recovery.lossDetectionTimer)
+	}
+	if path.sentBytes <= 3*path.recvBytes {
+		t.Fatalf("expect sending more than amplification limit: %v", path)
+	}
+}
+
+func TestConnAmplificationLimit(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := server.paths.active
+	// Client does not respond so server keeps probing until reaching the limit.
+	for i := 0; i < 100; i++ {
+		for {
+			n, err = server.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		if server.recovery.lossDetectionTimer.IsZero() {
+			break
+		}
+		server.checkTimeout(server.recovery.lossDetectionTimer)
+	}
+	if path.validated || path.sentBytes > 3*path.recvBytes || !server.recovery.amplificationLimited {
+		t.Fatalf("expect amplification limited: %v", path)
+	}
+	if !server.recovery.lossDetectionTimer.IsZero() {
+		t.Fatalf("expect loss detection timer disarmed: %v", server.recovery.lossDetectionTimer)
+	}
+	// Receiving more data lifts the limit.
+	n, err = client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		client.checkTimeout(client.recovery.lossDetectionTimer)
+		n, err = client.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = server.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.recovery.amplificationLimited || server.recovery.lossDetectionTimer.IsZero() {
+		t.Fatalf("expect amplification limit lifted: %v", path)
+	}
+}
+
+func TestConnClientAntiDeadlock(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.recovery.peerCompletedAddressValidation || !server.recovery.peerCompletedAddressValidation {
+		t.Fatalf("expect peer address validation completed")
+	}
+	config := newTestConfig()
+	client, err = Connect([]byte("client-cid"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.recovery.peerCompletedAddressValidation {
+		t.Fatalf("expect client does not know peer address validation")
+	}
+	// Loss detection timer is armed even when nothing is in flight.
+	client.recovery.bytesInFlight = 0
+	client.recovery.setLossDetectionTimer(client.time())
+	if client.recovery.lossDetectionTimer.IsZero() {
+		t.Fatalf("expect client loss detection timer armed")
+	}
+}
+
+func TestConnECN(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	// Datagrams are delivered with the codepoint requested by sender.
+	transfer := func(from, to *Conn) {
+		for {
+			n, _, err := from.ReadTo(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				return
+			}
+			if _, err = to.WriteFromECN(b[:n], Path{}, from.ECN()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 5; i++ {
+		transfer(client, server)
+		transfer(server, client)
+	}
+	if !client.IsEstablished() || !server.IsEstablished() {
+		t.Fatalf("expect connections established")
+	}
+	if client.recovery.ecn.state != ecnCapable || server.recovery.ecn.state != ecnCapable {
+		t.Fatalf("expect ecn capable: client=%v server=%v", client.recovery.ecn.state, server.recovery.ecn.state)
+	}
+	counts := server.packetNumberSpaces[packetSpaceInitial].recvECN
+	if counts.ect0 == 0 || counts.ect1 != 0 || counts.ce != 0 {
+		t.Fatalf("expect ect0 counted: %+v", counts)
+	}
+	// Peer not reporting ECN counts fails validation.
+	client, server, err = newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.recovery.ecn.state != ecnFailed || client.ECN() != ECNNotECT {
+		t.Fatalf("expect ecn failed: %v", client.recovery.ecn.state)
+	}
+}
+
+func TestConnPacingNotAppLimited(t *testing.T) {
+	client, _, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.recovery.pmtud.state = pmtuDisabled
+	b := make([]byte, 1400)
+	for {
+		n, err := client.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	client.recovery.appLimited = 0
+	st, err := client.Stream(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	// Pacer has no tokens left.
+	client.recovery.smoothedRTT = 100 * time.Millisecond
+	client.recovery.pacer.tokens = -1
+	client.recovery.pacer.lastUpdate = client.time()
+	n, err := client.Read(b)
+	if n != 0 || err != nil {
+		t.Fatalf("expect sending limited by pacer: %v %v", n, err)
+	}
+	if client.recovery.pacer.nextSendTime.IsZero() {
+		t.Fatalf("expect pacing timer set")
+	}
+	if client.recovery.appLimited != 0 {
+		t.Fatalf("expect not app limited: %v", client.recovery.appLimited)
+	}
+	// Nothing to send after all data is sent.
+	client.recovery.pacer.tokens = pacingBurst
+	if n, err = client.Read(b); n == 0 || err != nil {
+		t.Fatalf("expect stream data sent: %v %v", n, err)
+	}
+	if n, err = client.Read(b); n != 0 || err != nil {
+		t.Fatalf("expect nothing to send: %v %v", n, err)
+	}
+	if client.recovery.appLimited == 0 {
+		t.Fatalf("expect app limited")
+	}
+}
+
+func TestConnPMTUProbe(t *testing.T) {
+	client, server, err := newTestConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.maxPacketSize() != MinInitialPacketSize {
+		t.Fatalf("expect max packet size: %v, actual %v", MinInitialPacketSize, client.maxPacketSize())
+	}
+	b := make([]byte, 1400)
+	for i := 0; i < 3; i++ {
+		for _, c := range [][2]*Conn{{client, server}, {server, client}} {
+			n, err := c[0].Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 0 {
+				if _, err = c[1].Write(b[:n]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	// Probe is limited by buffer size.
+	if client.maxPacketSize() != len(b) || server.maxPacketSize() != len(b) {
+		t.Fatalf("expect max packet size: %v, actual client=%v server=%v", len(b), client.maxPacketSize(), server.maxPacketSize())
+	}
+	if client.recovery.pmtud.state != pmtuSearchComplete {
+		t.Fatalf("expect pmtu search complete: %v", &client.recovery.pmtud)
+	}
+	// Lost probe is not a congestion signal.
+	cwnd := client.recovery.cc.CongestionWindow()
+	client.recovery.pmtud.search(MaxPacketSize)
+	b = make([]byte, 2000)
+	n, err := client.Read(b)
+	if n != len(b) || err != nil {
+		t.Fatalf("expect probe sent: %v %v", n, err)
+	}
+	var ranges rangeSet
+	pn := client.packetNumberSpaces[packetSpaceApplication].nextPacketNumber
+	client.recovery.onPacketSent(&outgoingPacket{
+		packetNumber: pn,
+		frames:       []frame{&pingFrame{}},
+		timeSent:     client.time().Add(time.Minute),
+		size:         100,
+		ackEliciting: true,
+		inFlight:     true,
+	}, packetSpaceApplication)
+	ranges.push(pn, pn)
+	client.recovery.onAckReceived(ranges, 0, nil, packetSpaceApplication, client.time().Add(2*time.Minute))
+	if client.recovery.pmtud.probing || client.recovery.pmtud.current != 1400 {
+		t.Fatalf("expect probe lost: %v", &client.recovery.pmtud)
+	}
+	if client.recovery.cc.CongestionWindow() < cwnd {
+		t.Fatalf("expect congestion window not reduced: %v, actual %v", cwnd, client.recovery.cc.CongestionWindow())
+	}
+	// Probe which cannot be sent locally is lost immediately.
+	inFlight := client.recovery.bytesInFlight
+	n, err = client.Read(b)
+	if n != len(b) || err != nil || !client.recovery.pmtud.probing {
+		t.Fatalf("expect probe sent: %v %v", n, err)
+	}
+	client.DatagramTooLarge(n - 1)
+	if !client.recovery.pmtud.probing {
+		t.Fatalf("expect probe in flight: %v", &client.recovery.pmtud)
+	}
+	client.DatagramTooLarge(n)
+	if client.recovery.pmtud.probing || client.recovery.bytesInFlight != inFlight {
+		t.Fatalf("expect probe lost: %v inflight=%d", &client.recovery.pmtud, client.recovery.bytesInFlight)
+	}
+	if client.recovery.cc.CongestionWindow() < cwnd {
+		t.Fatalf("expect congestion window not reduced: %v, actual %v", cwnd, client.recovery.cc.CongestionWindow())
+	}
+}
+
+func TestConnDatagram(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.Params.MaxDatagramFrameSize = 100
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handshake(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Events(nil)
+	server.Events(nil)
+	// Client does not support DATAGRAM frames.
+	if err = server.SendDatagram([]byte("hello")); err == nil {
+		t.Fatal("expect error sending datagram to client")
+	}
+	if err = client.SendDatagram(make([]byte, 100)); err == nil {
+		t.Fatal("expect error sending datagram larger than peer limit")
+	}
+	for _, data := range []string{"hello", "world"} {
+		if err = client.SendDatagram([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := make([]byte, 1400)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Write(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := server.Events(nil)
+	if len(events) != 2 || events[0].Type != EventDatagram || events[1].Type != EventDatagram {
+		t.Fatalf("expect datagram events, actual %+v", events)
+	}
+	for _, data := range []string{"hello", "world"} {
+		if b := server.RecvDatagram(); string(b) != data {
+			t.Fatalf("expect datagram %q, actual %q", data, b)
+		}
+	}
+	if b := server.RecvDatagram(); b != nil {
+		t.Fatalf("expect no datagram, actual %q", b)
+	}
+	// Lost datagrams are not retransmitted.
+	if err = client.SendDatagram([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(b)
+	if err != nil || n == 0 {
+		t.Fatalf("expect datagram sent: %v %v", n, err)
+	}
+	client.recovery.lost[packetSpaceApplication] = append(client.recovery.lost[packetSpaceApplication],
+		newDatagramFrame([]byte("lost")))
+	n, err = client.Read(b)
+	if err != nil || n != 0 {
+		t.Fatalf("expect lost datagram not retransmitted: %v %v", n, err)
+	}
+	// Frames larger than the local limit or unsupported are not allowed.
+	_, err = server.recvFrameDatagram(encodeFrame(newDatagramFrame(make([]byte, 100))), testTime())
+	if err == nil || err.(*Error).Code != ProtocolViolation {
+		t.Fatalf("expect error %v, actual %v", ProtocolViolation, err)
+	}
+	_, err = client.recvFrameDatagram(encodeFrame(newDatagramFrame([]byte("hello"))), testTime())
+	if err == nil || err.(*Error).Code != ProtocolViolation {
+		t.Fatalf("expect error %v, actual %v", ProtocolViolation, err)
+	}
+}
+
+func TestConnVersionNegotiation(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	clientConfig.Version = 0x1a2a3a4a
+	clientConfig.Versions = []uint32{VersionDraft29, Version1}
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Header{}
+	if _, err = h.Decode(b[:n], 0); err != nil {
+		t.Fatal(err)
+	}
+	// Version Negotiation listing the version client has selected is ignored.
+	vn := make([]byte, 200)
+	m, err := NegotiateVersion(vn, h.SCID, h.DCID, []uint32{Version1, 0x1a2a3a4a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write(vn[:m]); err != nil {
+		t.Fatal(err)
+	}
+	if client.version != 0x1a2a3a4a {
+		t.Fatalf("expect version unchanged, actual %x", client.version)
+	}
+	// Client chooses the version it prefers.
+	m, err = NegotiateVersion(vn, h.SCID, h.DCID, []uint32{Version1, VersionDraft29})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write(vn[:m]); err != nil {
+		t.Fatal(err)
+	}
+	if client.version != VersionDraft29 {
+		t.Fatalf("expect version %x, actual %x", VersionDraft29, client.version)
+	}
+	// Server only supporting version 1 drops the Initial packet.
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.Versions = []uint32{Version1}
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := append([]byte(nil), b[:n]...)
+	if _, err = server.Write(initial); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = server.Read(b); m != 0 || err != nil {
+		t.Fatalf("expect no response, actual %v %v", m, err)
+	}
+	// Server uses the version chosen by client.
+	serverConfig.Versions = []uint32{Version1, VersionDraft29}
+	server, err = Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Write(initial); err != nil {
+		t.Fatal(err)
+	}
+	if err = handshake(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if server.version != VersionDraft29 {
+		t.Fatalf("expect version %x, actual %x", VersionDraft29, server.version)
+	}
+}
+
+func TestConnVersion2(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	clientConfig.Version = Version2
+	client, err := Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.Versions = []uint32{Version2, Version1}
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = handshake(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if server.version != Version2 {
+		t.Fatalf("expect version %x, actual %x", Version2, server.version)
+	}
+	client.Events(nil)
+	server.Events(nil)
+	st, err := client.Stream(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1400)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Write(b[:n]); err != nil {
+		t.Fatal(err)
+	}
+	events := server.Events(nil)
+	if len(events) != 1 || events[0].Type != EventStream || events[0].StreamID != 4 {
+		t.Fatalf("expect stream event, actual %+v", events)
+	}
+}
+
+func TestConnCompatibleVersion(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	clientConfig.Version = Version1
+	clientConfig.Versions = []uint32{Version1, Version2}
+	client, err := Connect([]byte("client-cid"), clientConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(scid, c.scid) {
-		t.Fatalf("expect scid %x, actual %x", scid, c.scid)
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.Versions = []uint32{Version2, Version1}
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !bytes.Equal(scid, c.localParams.InitialSourceCID) {
-		t.Fatalf("expect initial source cid %x, actual %#v", scid, c.localParams)
+	if err = handshake(client, server); err != nil {
+		t.Fatal(err)
 	}
-	if len(c.dcid) != MaxCIDLength {
-		t.Fatalf("expect dcid generated, actual %x", c.dcid)
+	if client.version != Version2 || server.version != Version2 {
+		t.Fatalf("expect version %x, actual client=%x server=%x", Version2, client.version, server.version)
 	}
-	if c.localParams.OriginalDestinationCID != nil || c.localParams.RetrySourceCID != nil ||
-		c.localParams.StatelessResetToken != nil {
-		t.Fatalf("expect empty cid, actual %#v", c.localParams)
+	if client.peerParams.ChosenVersion != Version2 || server.peerParams.ChosenVersion != Version1 {
+		t.Fatalf("expect chosen versions, actual client=%x server=%x",
+			client.peerParams.ChosenVersion, server.peerParams.ChosenVersion)
 	}
 }
 
-func TestServerConnInitialState(t *testing.T) {
-	config := NewConfig()
-	config.Params.OriginalDestinationCID = []byte{0}
-	config.Params.InitialSourceCID = []byte{0}
-	config.Params.RetrySourceCID = []byte{0}
-	config.Params.StatelessResetToken = []byte{8, 9}
-	scid := []byte{1, 2, 3}
-	odcid := []byte{4, 5}
-
-	c, err := Accept(scid, odcid, config)
+func TestConnCompatibleVersionOriginalInitial(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	clientConfig.Version = Version1
+	clientConfig.Versions = []uint32{Version1, Version2}
+	client, err := Connect([]byte("client-cid"), clientConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(scid, c.scid) {
-		t.Fatalf("expect scid %x, actual %x", scid, c.scid)
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.Versions = []uint32{Version2, Version1}
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !bytes.Equal(scid, c.localParams.InitialSourceCID) {
-		t.Fatalf("expect initial source cid %x, actual %#v", scid, c.localParams)
+	if err = transfer(client, server); err != nil {
+		t.Fatal(err)
 	}
-	if !bytes.Equal(odcid, c.localParams.OriginalDestinationCID) {
-		t.Fatalf("expect original destination cid %x, actual %#v", odcid, c.localParams)
+	b := make([]byte, 1400)
+	n, err := server.Read(b)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !bytes.Equal(scid, c.localParams.RetrySourceCID) {
-		t.Fatalf("expect retry source cid %x, actual %#v", scid, c.localParams)
+	serverInitial := append([]byte(nil), b[:n]...)
+	if server.version != Version2 || server.originalVersion != Version1 {
+		t.Fatalf("expect server switched version, actual: %x %x", server.version, server.originalVersion)
 	}
-	if !bytes.Equal(config.Params.StatelessResetToken, c.localParams.StatelessResetToken) {
-		t.Fatalf("expect reset token %x, actual %#v", config.Params.StatelessResetToken, c.localParams)
+	// Client retransmits its Initial packet in the original version.
+	client.recovery.onLossDetectionTimeout(client.recovery.lossDetectionTimer)
+	n, err = client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Header{}
+	if _, err = h.Decode(b[:n], 0); err != nil || h.Version != Version1 {
+		t.Fatalf("expect client initial in version %x, actual: %v %v", Version1, &h, err)
+	}
+	if _, err = server.Write(b[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if !server.packetNumberSpaces[packetSpaceInitial].recvPacketNumbers.contains(1) {
+		t.Fatalf("expect client initial accepted: %v", &server.packetNumberSpaces[packetSpaceInitial].recvPacketNumbers)
+	}
+	if _, err = client.Write(serverInitial); err != nil {
+		t.Fatal(err)
+	}
+	if err = handshake(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if client.version != Version2 || server.version != Version2 {
+		t.Fatalf("expect version %x, actual client=%x server=%x", Version2, client.version, server.version)
 	}
 }
 
-func TestHandshake(t *testing.T) {
-	// Not use stub random and time
-	clientConfig := NewConfig()
-	clientConfig.Version = 0xffffffff
-	clientConfig.TLS = &tls.Config{
-		InsecureSkipVerify: true,
-	}
+func TestConnVersionDowngrade(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	clientConfig.Version = 0x1a2a3a4a
+	clientConfig.Versions = []uint32{Version2, Version1}
 	client, err := Connect([]byte("client-cid"), clientConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = negotiateClient(client)
+	b := make([]byte, 1400)
+	n, err := client.Read(b)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if client.version != ProtocolVersion {
-		t.Fatalf("expect negotiated version %v, actual %v", ProtocolVersion, client.version)
+	h := Header{}
+	if _, err = h.Decode(b[:n], 0); err != nil {
+		t.Fatal(err)
 	}
-	err = retryClient(client)
+	// Attacker removes version 2 from Version Negotiation packet.
+	vn := make([]byte, 200)
+	m, err := NegotiateVersion(vn, h.SCID, h.DCID, []uint32{Version1})
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("client retried scid=%x dcid=%x odcid=%x", client.scid, client.dcid, client.odcid)
-	serverConfig := NewConfig()
-	serverConfig.TLS = &tls.Config{
-		Certificates: testCerts,
+	if _, err = client.Write(vn[:m]); err != nil {
+		t.Fatal(err)
 	}
-	server, err := Accept([]byte("server-cid"), client.odcid, serverConfig)
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.Versions = []uint32{Version1, Version2}
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
 	err = handshake(client, server)
-	if err != nil {
-		t.Fatal(err)
+	if err == nil || err.(*Error).Code != VersionNegotiationError {
+		t.Fatalf("expect error %v, actual %v", VersionNegotiationError, err)
 	}
-	t.Logf("server handshaked scid=%x dcid=%x odcid=%x", server.scid, server.dcid, server.odcid)
 }
 
-func TestConnStream(t *testing.T) {
-	client, server, err := newTestConn()
+func TestConnGrease(t *testing.T) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	clientConfig.Grease = true
+	client, err := Connect([]byte("client-cid"), clientConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
-	b := make([]byte, 1400)
-	ct, err := client.Stream(4)
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	serverConfig.Params.GreaseQUICBit = true
+	serverConfig.Params.InitialMaxData = 1 << 20
+	serverConfig.Params.InitialMaxStreamDataBidiRemote = 1 << 20
+	server, err := Accept([]byte("server-cid"), nil, serverConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
-	n, err := ct.Write([]byte("hello"))
-	if n != 5 || err != nil {
-		t.Fatalf("stream write: %v %v", n, err)
+	if err = handshake(client, server); err != nil {
+		t.Fatal(err)
 	}
-	err = ct.Close()
+	if len(server.peerParams.AvailableVersions) != len(clientConfig.Versions)+1 {
+		t.Fatalf("expect reserved version offered, actual %x", server.peerParams.AvailableVersions)
+	}
+	if !client.peerParams.GreaseQUICBit || server.peerParams.GreaseQUICBit {
+		t.Fatalf("expect only server sending grease_quic_bit")
+	}
+	client.Events(nil)
+	server.Events(nil)
+	st, err := client.Stream(4)
 	if err != nil {
 		t.Fatal(err)
 	}
-	n, err = client.Read(b)
+	b := make([]byte, 1400)
+	cleared := 0
+	for i := 0; i < 16; i++ {
+		if _, err = st.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		n, err := client.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0]&fixedBit == 0 {
+			cleared++
+		}
+		if _, err = server.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Test random source always returns zeros.
+	if cleared != 16 {
+		t.Fatalf("expect QUIC bit cleared, actual %d cleared", cleared)
+	}
+	data := make([]byte, 100)
+	sst, err := server.Stream(4)
 	if err != nil {
-		t.Fatalf("client read: %v %v", n, err)
+		t.Fatal(err)
 	}
-	n, err = server.Write(b[:n])
+	if n, _ := sst.Read(data); n != 16*len("hello") {
+		t.Fatalf("expect all data received, actual %d", n)
+	}
+	// Server does not clear the QUIC bit.
+	n, err := server.Read(b)
 	if err != nil {
-		t.Fatalf("server write: %v %v", n, err)
+		t.Fatal(err)
 	}
-	events := server.Events(nil)
-	if len(events) != 1 || events[0].Type != EventStream || events[0].StreamID != 4 {
-		t.Fatalf("events %+v", events)
+	if n > 0 && b[0]&fixedBit == 0 {
+		t.Fatalf("expect fixed bit, actual 0x%x", b[0])
 	}
-	st, err := server.Stream(events[0].StreamID)
+}
+
+func TestConnStreamClose(t *testing.T) {
+	client, server, err := newTestConn()
 	if err != nil {
 		t.Fatal(err)
 	}
-	n, err = st.Read(b)
-	if n != 5 || err != nil {
-		t.Fatalf("server stream read %v %v", n, err)
+	if server.localParams.InitialMaxStreamsBidi != 1 {
+		t.Fatalf("expect initial max streams 1, actual %d", server.localParams.InitialMaxStreamsBidi)
 	}
-	if string(b[:n]) != "hello" {
-		t.Fatalf("server received %v", b[:n])
+	b := make([]byte, 100)
+	for _, id := range []uint64{0, 4, 8} {
+		st, err := client.Stream(id)
+		if err != nil {
+			t.Fatalf("open stream %d: %v", id, err)
+		}
+		if _, err = st.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		st.Close()
+		if err = transfer(client, server); err != nil {
+			t.Fatal(err)
+		}
+		sst, err := server.Stream(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := sst.Read(b); string(b[:n]) != "ping" {
+			t.Fatalf("expect data received, actual %q", b[:n])
+		}
+		if _, err = sst.Write([]byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		sst.Close()
+		// Server response carries MAX_STREAMS after the stream is closed on client.
+		for i := 0; i < 3; i++ {
+			if err = transfer(server, client); err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := st.Read(b); n > 0 && string(b[:n]) != "pong" {
+				t.Fatalf("expect data received, actual %q", b[:n])
+			}
+			if err = transfer(client, server); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if client.streams.get(id) != nil || !client.streams.isClosed(id) {
+			t.Fatalf("expect client stream %d removed: %v", id, client.streams.get(id))
+		}
+		if server.streams.get(id) != nil || !server.streams.isClosed(id) {
+			t.Fatalf("expect server stream %d removed: %v", id, server.streams.get(id))
+		}
 	}
-	n, err = st.Read(b)
-	if n != 0 || err != io.EOF {
-		t.Fatalf("server stream read %v %v, expect %v", n, err, io.EOF)
+	events := server.Events(nil)
+	closed := 0
+	for _, e := range events {
+		if e.Type == EventStreamClosed {
+			closed++
+		}
+	}
+	if closed != 3 {
+		t.Fatalf("expect 3 stream closed events, actual %+v", events)
+	}
+	if _, err = client.Stream(4); err == nil {
+		t.Fatal("expect error opening closed stream")
+	}
+	// Late frames of closed streams are ignored.
+	_, err = server.recvFrameStream(encodeFrame(newStreamFrame(4, []byte("ping"), 0, true)), testTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.streams.get(4) != nil || len(server.Events(nil)) != 0 {
+		t.Fatalf("expect closed stream not created again")
 	}
 }
 
-func TestSendMaxData(t *testing.T) {
-	config := newTestConfig()
-	config.Params.InitialMaxData = 200
-	config.Params.InitialMaxStreamDataBidiRemote = 150
-	s, err := Accept([]byte("server-cid"), nil, config)
+func TestConnStreamReset(t *testing.T) {
+	client, server, err := newTestConn()
 	if err != nil {
 		t.Fatal(err)
 	}
-	b := make([]byte, 201)
-	stream := &streamFrame{
-		streamID: 4,
-		offset:   0,
-		data:     b,
+	st, err := client.Stream(0)
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, err = s.recvFrameStream(encodeFrame(stream), testTime())
-	if err != errFlowControl {
-		t.Fatalf("expect error %v, actual %v", errFlowControl, err)
+	if _, err = st.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
 	}
-	stream.data = b[:100]
-	_, err = s.recvFrameStream(encodeFrame(stream), testTime())
+	if err = transfer(client, server); err != nil {
+		t.Fatal(err)
+	}
+	sst, err := server.Stream(0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	maxData := s.sendFrameMaxData()
-	if maxData != nil {
-		t.Fatalf("expect no max data frame, actual %v", maxData)
+	server.Events(nil)
+	// Server asks client to stop sending and client resets the stream.
+	if err = sst.StopSending(9); err != nil {
+		t.Fatal(err)
 	}
-	// max 1024, read 1000
-	st, _ := s.Stream(4)
-	st.Read(b)
-	t.Logf("flow: %+v", s.flow)
-	maxData = s.sendFrameMaxData()
-	if maxData == nil || maxData.maximumData != 300 {
-		t.Fatalf("expect max data frame, actual %v", maxData)
+	if err = transfer(server, client); err != nil {
+		t.Fatal(err)
 	}
-	t.Logf("stream flow: %+v", st.flow)
-	maxStreamData := s.sendFrameMaxStreamData(4, st)
-	if maxStreamData == nil || maxStreamData.streamID != 4 || maxStreamData.maximumData != 250 {
-		t.Fatalf("expect max stream data frame, actual %v", maxStreamData)
+	events := client.Events(nil)
+	if len(events) != 1 || events[0].Type != EventStopSending || events[0].StreamID != 0 || events[0].ErrorCode != 9 {
+		t.Fatalf("expect stop sending event, actual %+v", events)
+	}
+	if !st.send.reset || st.send.resetCode != 9 {
+		t.Fatalf("expect stream reset: %+v", st.send)
+	}
+	if err = transfer(client, server); err != nil {
+		t.Fatal(err)
+	}
+	events = server.Events(nil)
+	if len(events) != 1 || events[0].Type != EventResetStream || events[0].StreamID != 0 || events[0].ErrorCode != 9 {
+		t.Fatalf("expect reset stream event, actual %+v", events)
+	}
+	if !sst.recv.isFin() || sst.recv.length != 4 || sst.updateStopSending {
+		t.Fatalf("expect stream finished: %+v", sst.recv)
+	}
+	// Server resets its sending part.
+	if _, err = sst.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if err = sst.Reset(3); err != nil {
+		t.Fatal(err)
+	}
+	if err = transfer(server, client); err != nil {
+		t.Fatal(err)
+	}
+	events = client.Events(nil)
+	if len(events) != 1 || events[0].Type != EventResetStream || events[0].StreamID != 0 || events[0].ErrorCode != 3 {
+		t.Fatalf("expect reset stream event, actual %+v", events)
+	}
+	// Acknowledgements make both streams closed.
+	for i := 0; i < 2; i++ {
+		if err = transfer(client, server); err != nil {
+			t.Fatal(err)
+		}
+		if err = transfer(server, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !client.streams.isClosed(0) || !server.streams.isClosed(0) {
+		t.Fatalf("expect stream closed: client=%v server=%v", client.streams.get(0), server.streams.get(0))
 	}
 }
 
@@ -213,6 +1843,36 @@ func TestInvalidConn(t *testing.T) {
 	}
 }
 
+func TestRecvFramesZeroRTT(t *testing.T) {
+	conn, err := Accept([]byte("server"), nil, NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges rangeSet
+	ranges.push(0, 0)
+	frames := []frame{
+		newAckFrame(0, ranges),
+		newCryptoFrame([]byte("crypto"), 0),
+		newNewTokenFrame([]byte("token")),
+		&handshakeDoneFrame{},
+		newPathResponseFrame(make([]byte, pathChallengeLen)),
+	}
+	for _, f := range frames {
+		_, err = conn.recvFrames(encodeFrame(f), packetTypeZeroRTT, packetSpaceApplication, testTime())
+		if err, ok := err.(*Error); !ok || err.Code != ProtocolViolation {
+			t.Fatalf("expect error %v for %v, actual %v", errorText[ProtocolViolation], f, err)
+		}
+	}
+	if conn.recovery.smoothedRTT != 0 || conn.packetNumberSpaces[packetSpaceApplication].firstPacketAcked {
+		t.Fatalf("expect ack in 0-RTT not processed")
+	}
+	_, err = conn.recvFrames(encodeFrame(newStreamFrame(0, []byte("data"), 0, true)), packetTypeZeroRTT,
+		packetSpaceApplication, testTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestRecvResetStream(t *testing.T) {
 	conn, err := Connect([]byte("client"), NewConfig())
 	if err != nil {
@@ -289,6 +1949,10 @@ func TestRecvStopSending(t *testing.T) {
 	if len(events) != 1 || events[0].Type != EventStopSending || events[0].StreamID != 4 || events[0].ErrorCode != 9 {
 		t.Fatalf("event %+v", events)
 	}
+	st := conn.streams.get(4)
+	if st == nil || !st.send.reset || !st.updateReset || st.send.resetCode != 9 {
+		t.Fatalf("expect stream reset %v", st)
+	}
 }
 
 func newTestConn() (client, server *Conn, err error) {
@@ -314,6 +1978,39 @@ func newTestConn() (client, server *Conn, err error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	// Discard events generated during handshake.
+	client.Events(nil)
+	server.Events(nil)
+	return client, server, nil
+}
+
+// newTestEarlyDataConn creates client sending 0-RTT packets with preset keys
+// and transport parameters as if resuming a session.
+func newTestEarlyDataConn(accepted bool) (client, server *Conn, err error) {
+	clientConfig := newTestConfig()
+	clientConfig.TLS.ServerName = "localhost"
+	clientConfig.TLS.RootCAs = testCA
+	client, err = Connect([]byte("client-cid"), clientConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverConfig := newTestConfig()
+	serverConfig.TLS.Certificates = testCerts
+	server, err = Accept([]byte("server-cid"), nil, serverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	suite := tls13.CipherSuiteByID(tls.TLS_AES_128_GCM_SHA256)
+	secret := make([]byte, suite.Hash().Size())
+	client.packetNumberSpaces[packetSpaceApplication].zeroRTTSealer.init(ProtocolVersion, suite, secret)
+	if accepted {
+		server.packetNumberSpaces[packetSpaceApplication].zeroRTTOpener.init(ProtocolVersion, suite, secret)
+	}
+	params := serverConfig.Params
+	client.zeroRTT = true
+	client.flow.setMaxSend(params.InitialMaxData)
+	client.streams.setPeerMaxStreamsBidi(params.InitialMaxStreamsBidi)
+	client.peerParams.InitialMaxStreamDataBidiRemote = params.InitialMaxStreamDataBidiRemote
 	return client, server, nil
 }
 
@@ -329,7 +2026,7 @@ func negotiateClient(client *Conn) error {
 		return err
 	}
 	b = make([]byte, 200)
-	n, err = NegotiateVersion(b, h.SCID, h.DCID)
+	n, err = NegotiateVersion(b, h.SCID, h.DCID, []uint32{ProtocolVersion})
 	if err != nil {
 		return err
 	}
@@ -352,7 +2049,7 @@ func retryClient(client *Conn) error {
 		return err
 	}
 	b = make([]byte, 200)
-	n, err = Retry(b, h.SCID, []byte("server-cid"), h.DCID, []byte("retry-token"))
+	n, err = Retry(b, h.SCID, []byte("server-cid"), h.DCID, []byte("retry-token"), h.Version)
 	if err != nil {
 		return err
 	}
@@ -395,6 +2092,17 @@ func handshake(client, server *Conn) error {
 	return nil
 }
 
+// transfer sends a datagram from one connection to the other.
+func transfer(from, to *Conn) error {
+	b := make([]byte, 1400)
+	n, err := from.Read(b)
+	if err != nil || n == 0 {
+		return err
+	}
+	_, err = to.Write(b[:n])
+	return err
+}
+
 func BenchmarkCreateConn(b *testing.B) {
 	config := newTestConfig()
 	cid := make([]byte, MaxCIDLength)
@@ -20,39 +20,33 @@ const (
 	cryptoLevelOneRTT
 )
 
-// version ff00001d
-var initialSalt = []byte{
-	0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97,
-	0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99,
-}
-
 type initialAEAD struct {
 	client packetProtection
 	server packetProtection
 }
 
 // https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#initial-secrets
-func (s *initialAEAD) init(cid []byte) {
+func (s *initialAEAD) init(version uint32, cid []byte) {
 	suite := tls13.CipherSuiteByID(tls.TLS_AES_128_GCM_SHA256)
-	initialSecret := suite.Extract(cid, initialSalt)
+	initialSecret := suite.Extract(cid, getVersionParams(version).initialSalt)
 	// client
 	clientSecret := deriveSecret(suite, initialSecret, "client in")
-	s.client.init(suite, clientSecret)
+	s.client.init(version, suite, clientSecret)
 
 	// server
 	serverSecret := deriveSecret(suite, initialSecret, "server in")
-	s.server.init(suite, serverSecret)
+	s.server.init(version, suite, serverSecret)
 }
 
 func deriveSecret(suite tls13.CipherSuite, secret []byte, label string) []byte {
 	return suite.ExpandLabel(secret, label, suite.Hash().Size())
 }
 
-func quicTrafficKey(suite tls13.CipherSuite, secret []byte) (key, iv, hp []byte) {
+func quicTrafficKey(suite tls13.CipherSuite, secret []byte, params *versionParams) (key, iv, hp []byte) {
 	const aeadNonceLength = 12
-	key = suite.ExpandLabel(secret, "quic key", suite.KeyLen())
-	iv = suite.ExpandLabel(secret, "quic iv", aeadNonceLength)
-	hp = suite.ExpandLabel(secret, "quic hp", suite.KeyLen())
+	key = suite.ExpandLabel(secret, params.keyLabel, suite.KeyLen())
+	iv = suite.ExpandLabel(secret, params.ivLabel, aeadNonceLength)
+	hp = suite.ExpandLabel(secret, params.hpLabel, suite.KeyLen())
 	return
 }
 
@@ -61,11 +55,20 @@ type packetProtection struct {
 	aead  cipher.AEAD
 	hp    headerProtection
 	nonce [8]byte // packet number
+
+	// Cipher suite and secret to derive keys for next key phase.
+	suite  tls13.CipherSuite
+	secret []byte
+	// version determines labels to derive keys.
+	version uint32
 }
 
-func (s *packetProtection) init(suite tls13.CipherSuite, secret []byte) {
-	key, iv, hpKey := quicTrafficKey(suite, secret)
+func (s *packetProtection) init(version uint32, suite tls13.CipherSuite, secret []byte) {
+	key, iv, hpKey := quicTrafficKey(suite, secret, getVersionParams(version))
 	s.aead = suite.AEAD(key, iv)
+	s.suite = suite
+	s.secret = secret
+	s.version = version
 
 	if suite.ID() == tls.TLS_CHACHA20_POLY1305_SHA256 {
 		s.hp.chaCha20Init(hpKey)
@@ -74,6 +77,34 @@ func (s *packetProtection) init(suite tls13.CipherSuite, secret []byte) {
 	}
 }
 
+// next returns packet protection of the next key phase.
+// Header protection keys are not updated.
+// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-key-update
+func (s *packetProtection) next() packetProtection {
+	const aeadNonceLength = 12
+	params := getVersionParams(s.version)
+	secret := deriveSecret(s.suite, s.secret, params.kuLabel)
+	key := s.suite.ExpandLabel(secret, params.keyLabel, s.suite.KeyLen())
+	iv := s.suite.ExpandLabel(secret, params.ivLabel, aeadNonceLength)
+	return packetProtection{
+		aead:    s.suite.AEAD(key, iv),
+		hp:      s.hp,
+		suite:   s.suite,
+		secret:  secret,
+		version: s.version,
+	}
+}
+
+// confidentialityLimit returns the number of packets can be encrypted with the same key.
+// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-limits-on-aead-usage
+func (s *packetProtection) confidentialityLimit() uint64 {
+	if s.suite != nil && s.suite.ID() == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		// Greater than the number of possible packet numbers.
+		return 1 << 62
+	}
+	return 1 << 23
+}
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#aead
 // Length of b and payload must include crypto overhead.
 func (s *packetProtection) encryptPayload(b []byte, packetNumber uint64, payloadLen int) []byte {
@@ -238,48 +269,21 @@ func (s *headerProtection) chacha20Mask(sample, mask []byte) {
 
 const retryIntegrityTagLen = 16
 
-var retryIntegrityKey = []byte{
-	0xcc, 0xce, 0x18, 0x7e, 0xd0, 0x9a, 0x09, 0xd0,
-	0x57, 0x28, 0x15, 0x5a, 0x6c, 0xb9, 0x6b, 0xe1,
-}
-
-var retryIntegrityNonce = []byte{
-	0xe5, 0x49, 0x30, 0xf9, 0x7f, 0x21, 0x36, 0xf0,
-	0x53, 0x0a, 0x8c, 0x1c,
-}
-
-var retryIntegrityAEAD cipher.AEAD
-
-func newRetryIntegrityAEAD() cipher.AEAD {
-	if retryIntegrityAEAD == nil {
-		// XXX: Need sync.Once?
-		aes, err := aes.NewCipher(retryIntegrityKey)
-		if err != nil {
-			panic(err)
-		}
-		gcm, err := cipher.NewGCM(aes)
-		if err != nil {
-			panic(err)
-		}
-		retryIntegrityAEAD = gcm
-	}
-	return retryIntegrityAEAD
-}
-
 // computeRetryIntegrity append retry integrity tag to given pseudo retry packet.
 // https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-retry-packet-integrity
-func computeRetryIntegrity(pseudo []byte) ([]byte, error) {
-	aead := newRetryIntegrityAEAD()
+func computeRetryIntegrity(version uint32, pseudo []byte) ([]byte, error) {
+	params := getVersionParams(version)
+	aead := params.retryAEAD
 	if cap(pseudo)-len(pseudo) < aead.Overhead() {
 		// Avoid allocating
 		return nil, errShortBuffer
 	}
-	b := aead.Seal(pseudo, retryIntegrityNonce, nil, pseudo)
+	b := aead.Seal(pseudo, params.retryNonce, nil, pseudo)
 	return b, nil
 }
 
 // verifyRetryIntegrity verifies integrity tag in retry packet b given the original destination CID odcid.
-func verifyRetryIntegrity(b, odcid []byte) bool {
+func verifyRetryIntegrity(version uint32, b, odcid []byte) bool {
 	if len(b) < retryIntegrityTagLen {
 		return false
 	}
@@ -288,7 +292,7 @@ func verifyRetryIntegrity(b, odcid []byte) bool {
 	copy(pseudo[1:], odcid)
 	copy(pseudo[1+len(odcid):], b[:len(b)-retryIntegrityTagLen])
 
-	out, err := computeRetryIntegrity(pseudo[:len(pseudo)-retryIntegrityTagLen])
+	out, err := computeRetryIntegrity(version, pseudo[:len(pseudo)-retryIntegrityTagLen])
 	if err != nil || len(out) < retryIntegrityTagLen {
 		return false
 	}
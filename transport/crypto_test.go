@@ -9,6 +9,39 @@ import (
 	"github.com/goburrow/quic/tls13"
 )
 
+// https://www.rfc-editor.org/rfc/rfc9001.html#name-keys
+// https://www.rfc-editor.org/rfc/rfc9369.html#name-keys
+func TestInitialSecrets(t *testing.T) {
+	tests := []struct {
+		version uint32
+		client  string
+		server  string
+	}{
+		{
+			version: Version1,
+			client:  "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea",
+			server:  "3c199828fd139efd216c155ad844cc81fb82fa8d7446fa7d78be803acdda951b",
+		},
+		{
+			version: Version2,
+			client:  "14ec9d6eb9fd7af83bf5a668bc17a7e283766aade7ecd0891f70f9ff7f4bf47b",
+			server:  "0263db1782731bf4588e7e4d93b7463907cb8cd8200b5da55a8bd488eafc37c1",
+		},
+	}
+	for _, tt := range tests {
+		aead := initialAEAD{}
+		aead.init(tt.version, testdata.DecodeHex("8394c8f03e515708"))
+		expect := testdata.DecodeHex(tt.client)
+		if !bytes.Equal(expect, aead.client.secret) {
+			t.Fatalf("client initial secret version %x\nexpect: %x\nactual: %x", tt.version, expect, aead.client.secret)
+		}
+		expect = testdata.DecodeHex(tt.server)
+		if !bytes.Equal(expect, aead.server.secret) {
+			t.Fatalf("server initial secret version %x\nexpect: %x\nactual: %x", tt.version, expect, aead.server.secret)
+		}
+	}
+}
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-client-initial
 func TestDecryptClientInitial(t *testing.T) {
 	const clientInitial = `
@@ -70,7 +103,7 @@ func TestDecryptClientInitial(t *testing.T) {
 		t.Fatal(err)
 	}
 	aead := initialAEAD{}
-	aead.init(testdata.DecodeHex("8394c8f03e515708"))
+	aead.init(VersionDraft29, testdata.DecodeHex("8394c8f03e515708"))
 	err = aead.client.decryptHeader(b, pnOffset)
 	if err != nil {
 		t.Fatal(err)
@@ -112,7 +145,7 @@ func TestDecryptServerInitial(t *testing.T) {
 		t.Fatal(err)
 	}
 	aead := initialAEAD{}
-	aead.init(testdata.DecodeHex("8394c8f03e515708"))
+	aead.init(VersionDraft29, testdata.DecodeHex("8394c8f03e515708"))
 	err = aead.server.decryptHeader(b, pnOffset)
 	if err != nil {
 		t.Fatal(err)
@@ -129,28 +162,56 @@ func TestDecryptServerInitial(t *testing.T) {
 	}
 }
 
-// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-retry
+// https://tools.ietf.org/html/draft-ietf-quic-tls-29#appendix-A.4
+// https://www.rfc-editor.org/rfc/rfc9001.html#name-retry
+// https://www.rfc-editor.org/rfc/rfc9369.html#name-retry
 func TestComputeRetryIntegrity(t *testing.T) {
 	odcid := testdata.DecodeHex(`8394c8f03e515708`)
-	retry := testdata.DecodeHex(`ffff00001d0008f067a5502a4262b5746f6b656e`)
-	b := make([]byte, 0, 128)
-	b = append(b, byte(len(odcid)))
-	b = append(b, odcid...)
-	b = append(b, retry...)
-
-	actual, err := computeRetryIntegrity(b)
-	if err != nil {
-		t.Fatal(err)
+	tests := []struct {
+		version uint32
+		retry   string
+		expect  string
+	}{
+		{
+			version: VersionDraft29,
+			retry:   `ffff00001d0008f067a5502a4262b5746f6b656e`,
+			expect: `
+			ffff00001d0008f067a5502a4262b574 6f6b656ed16926d81f6f9ca2953a8aa4
+			575e1e49`,
+		},
+		{
+			version: Version1,
+			retry:   `ff000000010008f067a5502a4262b5746f6b656e`,
+			expect: `
+			ff000000010008f067a5502a4262b574 6f6b656e04a265ba2eff4d829058fb3f
+			0f2496ba`,
+		},
+		{
+			version: Version2,
+			retry:   `cf6b3343cf0008f067a5502a4262b5746f6b656e`,
+			expect: `
+			cf6b3343cf0008f067a5502a4262b574 6f6b656ec8646ce8bfe33952d9555436
+			65dcc7b6`,
+		},
 	}
-	actual = actual[len(odcid)+1:]
-	expect := testdata.DecodeHex(`
-	ffff00001d0008f067a5502a4262b574 6f6b656ed16926d81f6f9ca2953a8aa4
-	575e1e49`)
-	if !bytes.Equal(expect, actual) {
-		t.Fatalf("integrity tag\nexpect: %x\nactual: %x", expect, actual)
-	}
-	if !verifyRetryIntegrity(expect, odcid) {
-		t.Fatalf("verify retry integrity failed: %x", expect)
+	for _, tt := range tests {
+		b := make([]byte, 0, 128)
+		b = append(b, byte(len(odcid)))
+		b = append(b, odcid...)
+		b = append(b, testdata.DecodeHex(tt.retry)...)
+
+		actual, err := computeRetryIntegrity(tt.version, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = actual[len(odcid)+1:]
+		expect := testdata.DecodeHex(tt.expect)
+		if !bytes.Equal(expect, actual) {
+			t.Fatalf("integrity tag version %x\nexpect: %x\nactual: %x", tt.version, expect, actual)
+		}
+		if !verifyRetryIntegrity(tt.version, expect, odcid) {
+			t.Fatalf("verify retry integrity failed: %x", expect)
+		}
 	}
 }
 
@@ -163,11 +224,11 @@ func BenchmarkRetryIntegrity(b *testing.B) {
 	575e1e49`)
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		_, err := computeRetryIntegrity(pseudoPacket)
+		_, err := computeRetryIntegrity(VersionDraft29, pseudoPacket)
 		if err != nil {
 			b.Fatal(err)
 		}
-		if !verifyRetryIntegrity(retryPacket, odcid) {
+		if !verifyRetryIntegrity(VersionDraft29, retryPacket, odcid) {
 			b.Fatal("verify retry integrity failed")
 		}
 	}
@@ -197,7 +258,7 @@ func TestDecryptChaChaPoly(t *testing.T) {
 		t.Fatalf("expect pnOffset %d, actual %d", 1, pnOffset)
 	}
 	pp := packetProtection{}
-	pp.init(tls13.CipherSuiteByID(tls.TLS_CHACHA20_POLY1305_SHA256), secret)
+	pp.init(Version1, tls13.CipherSuiteByID(tls.TLS_CHACHA20_POLY1305_SHA256), secret)
 	err = pp.decryptHeader(b, pnOffset)
 	if err != nil {
 		t.Fatal(err)
@@ -223,3 +284,29 @@ func TestDecryptChaChaPoly(t *testing.T) {
 		t.Errorf("expect payload: 01, actual %x", payload)
 	}
 }
+
+// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-chacha20-poly1305-short-hea
+func TestPacketProtectionKeyUpdate(t *testing.T) {
+	secret := testdata.DecodeHex(`
+	9ac312a7f877468ebe69422748ad00a1
+	5443f18203a07d6060f688f30f21632b`)
+	pp := packetProtection{}
+	pp.init(Version1, tls13.CipherSuiteByID(tls.TLS_CHACHA20_POLY1305_SHA256), secret)
+	next := pp.next()
+	expect := testdata.DecodeHex(`
+	1223504755036d556342ee9361d25342
+	1a826c9ecdf3c7148684b36b714881f9`)
+	if !bytes.Equal(expect, next.secret) {
+		t.Fatalf("expect next secret %x, actual %x", expect, next.secret)
+	}
+	if next.hp != pp.hp {
+		t.Fatalf("expect same header protection")
+	}
+	// Packet encrypted with the next keys cannot be decrypted with the current keys.
+	b := make([]byte, 32)
+	b[0] = 0x40
+	payload := next.encryptPayload(b, 1, len(b)-1)
+	if _, err := pp.decryptPayload(b, 1, len(payload)); err == nil {
+		t.Fatalf("expect decryption error")
+	}
+}
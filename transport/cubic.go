@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+	// cubicAlpha makes the Reno-friendly window grow as fast as Reno on average.
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// cubic is the CUBIC congestion controller which grows the window as a cubic
+// function of time since the last congestion event, independently of RTT.
+// https://www.rfc-editor.org/rfc/rfc9438.html
+type cubic struct {
+	congestionWindow   uint64
+	slowStartThreshold uint64
+	recoveryStartTime  time.Time
+	maxDatagramSize    uint64
+
+	// wMax is the window size just before the window was reduced in the last congestion event.
+	wMax float64
+	// epochStart is the time the current congestion avoidance stage started.
+	epochStart time.Time
+	// k is the time period in seconds the window takes to increase to origin.
+	k float64
+	// origin is the window at the plateau of the cubic function.
+	origin float64
+	// wEst is the estimated window of Reno for the Reno-friendly region.
+	wEst float64
+}
+
+// NewCubic creates a CUBIC congestion controller.
+func NewCubic() CongestionController {
+	s := &cubic{}
+	s.Reset()
+	return s
+}
+
+func (s *cubic) OnPacketSent(sentBytes uint64, now time.Time) {}
+
+// https://www.rfc-editor.org/rfc/rfc9438.html#name-window-increase-function
+func (s *cubic) OnAck(ackedBytes uint64, sentTime time.Time, rtt time.Duration, now time.Time) {
+	if s.inRecovery(sentTime) {
+		return
+	}
+	if s.congestionWindow < s.slowStartThreshold {
+		// Slow start.
+		s.congestionWindow += ackedBytes
+		return
+	}
+	cwnd := float64(s.congestionWindow)
+	if s.epochStart.IsZero() {
+		s.epochStart = now
+		s.wEst = cwnd
+		if cwnd < s.wMax {
+			s.k = math.Cbrt((s.wMax - cwnd) / float64(s.maxDatagramSize) / cubicC)
+			s.origin = s.wMax
+		} else {
+			s.k = 0
+			s.origin = cwnd
+		}
+	}
+	s.wEst += cubicAlpha * float64(s.maxDatagramSize) * float64(ackedBytes) / cwnd
+	if s.window(now.Sub(s.epochStart)) < s.wEst {
+		// Reno-friendly region.
+		s.congestionWindow = uint64(s.wEst)
+		return
+	}
+	// Target window is the cubic function one RTT in the future, limited to 1.5 times cwnd.
+	target := s.window(now.Sub(s.epochStart) + rtt)
+	if target < cwnd {
+		target = cwnd
+	} else if target > cwnd*1.5 {
+		target = cwnd * 1.5
+	}
+	s.congestionWindow += uint64((target - cwnd) * float64(ackedBytes) / cwnd)
+}
+
+// window returns W_cubic(t) in bytes, where t is the time elapsed since epochStart.
+func (s *cubic) window(elapsed time.Duration) float64 {
+	t := elapsed.Seconds() - s.k
+	return s.origin + cubicC*t*t*t*float64(s.maxDatagramSize)
+}
+
+// https://www.rfc-editor.org/rfc/rfc9438.html#name-multiplicative-decrease
+func (s *cubic) OnCongestionEvent(sentTime time.Time, now time.Time) {
+	if s.inRecovery(sentTime) {
+		return
+	}
+	s.recoveryStartTime = now
+	cwnd := float64(s.congestionWindow)
+	if cwnd < s.wMax {
+		// Fast convergence: release bandwidth for new flows.
+		s.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		s.wMax = cwnd
+	}
+	s.congestionWindow = uint64(cwnd * cubicBeta)
+	if s.congestionWindow < 2*s.maxDatagramSize {
+		s.congestionWindow = 2 * s.maxDatagramSize
+	}
+	s.slowStartThreshold = s.congestionWindow
+	s.epochStart = time.Time{}
+}
+
+func (s *cubic) OnPersistentCongestion(now time.Time) {
+	s.congestionWindow = 2 * s.maxDatagramSize
+	s.recoveryStartTime = time.Time{}
+	s.epochStart = time.Time{}
+}
+
+func (s *cubic) OnRateSample(rs *RateSample, now time.Time) {}
+
+func (s *cubic) CanSend(bytesInFlight uint64) bool {
+	return bytesInFlight < s.congestionWindow
+}
+
+func (s *cubic) CongestionWindow() uint64 {
+	return s.congestionWindow
+}
+
+func (s *cubic) SetMaxDatagramSize(size uint64) {
+	s.maxDatagramSize = size
+	if s.congestionWindow < 2*size {
+		s.congestionWindow = 2 * size
+	}
+}
+
+func (s *cubic) Reset() {
+	s.maxDatagramSize = initialMaxDatagramSize
+	s.congestionWindow = initialWindow
+	s.slowStartThreshold = maxUint64
+	s.recoveryStartTime = time.Time{}
+	s.wMax = 0
+	s.epochStart = time.Time{}
+	s.k = 0
+	s.origin = 0
+	s.wEst = 0
+}
+
+func (s *cubic) inRecovery(sentTime time.Time) bool {
+	return !s.recoveryStartTime.IsZero() && !sentTime.After(s.recoveryStartTime)
+}
+
+func (s *cubic) String() string {
+	return fmt.Sprintf("cubic cwnd=%d ssthresh=%d wmax=%.0f", s.congestionWindow, s.slowStartThreshold, s.wMax)
+}
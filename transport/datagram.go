@@ -0,0 +1,63 @@
+package transport
+
+const (
+	// maxDatagramQueueLen is the maximum number of datagrams buffered in each direction.
+	maxDatagramQueueLen = 128
+	// maxDatagramPacketOverhead is the largest size of a short header packet without payload:
+	// the header with the longest connection ID and packet number, and the AEAD tag.
+	maxDatagramPacketOverhead = 1 + MaxCIDLength + 4 + 16
+)
+
+// datagramQueue buffers payloads of DATAGRAM frames. Data is not retransmitted
+// when packets are lost.
+// https://www.rfc-editor.org/rfc/rfc9221.html
+type datagramQueue struct {
+	send [][]byte
+	recv [][]byte
+}
+
+// push adds data to be sent. It returns false when the queue is full.
+func (s *datagramQueue) push(data []byte) bool {
+	if len(s.send) >= maxDatagramQueueLen {
+		return false
+	}
+	s.send = append(s.send, append([]byte(nil), data...))
+	return true
+}
+
+// peek returns next data to be sent or nil if there is none.
+func (s *datagramQueue) peek() []byte {
+	if len(s.send) == 0 {
+		return nil
+	}
+	return s.send[0]
+}
+
+func (s *datagramQueue) pop() {
+	s.send[0] = nil
+	s.send = s.send[1:]
+}
+
+// pushRecv adds received data. It returns false when data is dropped as the queue is full.
+func (s *datagramQueue) pushRecv(data []byte) bool {
+	if len(s.recv) >= maxDatagramQueueLen {
+		return false
+	}
+	s.recv = append(s.recv, append([]byte{}, data...))
+	return true
+}
+
+// popRecv returns next received data or nil if there is none.
+func (s *datagramQueue) popRecv() []byte {
+	if len(s.recv) == 0 {
+		return nil
+	}
+	data := s.recv[0]
+	s.recv[0] = nil
+	s.recv = s.recv[1:]
+	return data
+}
+
+func (s *datagramQueue) hasSend() bool {
+	return len(s.send) > 0
+}
@@ -0,0 +1,161 @@
+package transport
+
+import "fmt"
+
+// ECN is the Explicit Congestion Notification codepoint in the IP header of a datagram.
+// https://www.rfc-editor.org/rfc/rfc3168.html
+type ECN uint8
+
+// ECN codepoints.
+const (
+	ECNNotECT ECN = 0x00
+	ECNECT1   ECN = 0x01
+	ECNECT0   ECN = 0x02
+	ECNCE     ECN = 0x03
+)
+
+func (s ECN) String() string {
+	switch s {
+	case ECNNotECT:
+		return "not-ect"
+	case ECNECT1:
+		return "ect1"
+	case ECNECT0:
+		return "ect0"
+	case ECNCE:
+		return "ce"
+	default:
+		return fmt.Sprintf("ecn_%d", uint8(s))
+	}
+}
+
+// ecnCounts is the number of packets received with each ECN codepoint.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-ecn-counts
+type ecnCounts struct {
+	ect0 uint64
+	ect1 uint64
+	ce   uint64
+}
+
+func (s *ecnCounts) add(ecn ECN) {
+	switch ecn {
+	case ECNECT0:
+		s.ect0++
+	case ECNECT1:
+		s.ect1++
+	case ECNCE:
+		s.ce++
+	}
+}
+
+func (s *ecnCounts) isZero() bool {
+	return s.ect0 == 0 && s.ect1 == 0 && s.ce == 0
+}
+
+// ecnTestingPackets is the number of packets marked with ECT(0) to test ECN support of the path.
+const ecnTestingPackets = 10
+
+type ecnState uint8
+
+const (
+	ecnTesting ecnState = iota
+	ecnUnknown
+	ecnCapable
+	ecnFailed
+)
+
+func (s ecnState) String() string {
+	switch s {
+	case ecnTesting:
+		return "testing"
+	case ecnUnknown:
+		return "unknown"
+	case ecnCapable:
+		return "capable"
+	case ecnFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("ecn_state_%d", uint8(s))
+	}
+}
+
+// ecnValidator checks whether the path and peer support ECN, so outgoing packets
+// are only marked with ECT(0) when ECN counts in ACK frames are correct.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-ecn-validation
+type ecnValidator struct {
+	state ecnState
+	// testingSent and testingLost are the number of marked packets sent and lost while testing.
+	testingSent int
+	testingLost int
+	// newlyAcked is the number of marked packets newly acknowledged by the ACK frame being processed.
+	newlyAcked uint64
+	// peerCounts is the largest ECN counts reported by peer in each packet number space.
+	peerCounts [packetSpaceCount]ecnCounts
+}
+
+// canMark returns true when packets should be sent with ECT(0) codepoint.
+func (s *ecnValidator) canMark() bool {
+	return s.state == ecnTesting || s.state == ecnCapable
+}
+
+func (s *ecnValidator) onPacketSent(p *outgoingPacket) {
+	if p.ecn && s.state == ecnTesting {
+		s.testingSent++
+		if s.testingSent >= ecnTestingPackets {
+			s.state = ecnUnknown
+		}
+	}
+}
+
+func (s *ecnValidator) onPacketLost(p *outgoingPacket) {
+	if p.ecn && (s.state == ecnTesting || s.state == ecnUnknown) {
+		s.testingLost++
+		if s.state == ecnUnknown && s.testingLost >= s.testingSent {
+			// All packets sent for testing were lost.
+			s.state = ecnFailed
+		}
+	}
+}
+
+// onAckReceived validates ECN counts in an ACK frame which advances the largest
+// acknowledged packet number and returns the increase of ECN-CE count.
+// counts is nil when the frame does not contain ECN counts.
+func (s *ecnValidator) onAckReceived(counts *ecnCounts, space packetSpace) uint64 {
+	newlyAcked := s.newlyAcked
+	s.newlyAcked = 0
+	if s.state == ecnFailed {
+		return 0
+	}
+	if counts == nil {
+		if newlyAcked > 0 {
+			// Peer does not report ECN counts for marked packets.
+			s.state = ecnFailed
+		}
+		return 0
+	}
+	prev := &s.peerCounts[space]
+	if counts.ect0 < prev.ect0 || counts.ect1 < prev.ect1 || counts.ce < prev.ce {
+		s.state = ecnFailed
+		return 0
+	}
+	// Only ECT(0) is sent so ECT(1) must not be reported.
+	if counts.ect1 > prev.ect1 || (counts.ect0-prev.ect0)+(counts.ce-prev.ce) < newlyAcked {
+		s.state = ecnFailed
+		return 0
+	}
+	ce := counts.ce - prev.ce
+	*prev = *counts
+	if newlyAcked > 0 && s.state != ecnCapable {
+		s.state = ecnCapable
+	}
+	return ce
+}
+
+// reset restarts ECN validation on a new path.
+// Counts reported by peer are kept as they are cumulative for the connection.
+func (s *ecnValidator) reset() {
+	s.state = ecnTesting
+	s.testingSent = 0
+	s.testingLost = 0
+	s.newlyAcked = 0
+}
@@ -22,6 +22,7 @@ const (
 	InvalidToken            uint64 = 0xb
 	ApplicationError        uint64 = 0xc
 	CryptoBufferExceeded    uint64 = 0xd
+	VersionNegotiationError uint64 = 0x11 // https://www.rfc-editor.org/rfc/rfc9368.html#name-version-negotiation-error
 	CryptoError             uint64 = 0x100
 )
 
@@ -40,6 +41,7 @@ var errorText = map[uint64]string{
 	InvalidToken:            "invalid_token",
 	ApplicationError:        "application_error",
 	CryptoBufferExceeded:    "crypto_buffer_exceeded",
+	VersionNegotiationError: "version_negotiation_error",
 	CryptoError:             "crypto_error",
 }
 
@@ -6,6 +6,17 @@ const (
 	EventStopSending    = "stop_sending"
 	EventResetStream    = "reset_stream"
 	EventStreamComplete = "stream_complete"
+	EventStreamClosed   = "stream_closed"
+
+	EventConnectionIDNew    = "connection_id_new"
+	EventConnectionIDRetire = "connection_id_retire"
+
+	EventPathMigrated = "path_migrated"
+	EventPathFailed   = "path_failed"
+
+	EventNewToken = "new_token"
+
+	EventDatagram = "datagram"
 )
 
 // Event is a union structure of all events.
@@ -13,6 +24,8 @@ type Event struct {
 	Type      string
 	StreamID  uint64
 	ErrorCode uint64
+	// Data is the connection ID for connection ID events or the token for new token events.
+	Data []byte
 }
 
 // newStreamRecvEvent creates an event where a STREAM frame was received and data is readable.
@@ -48,3 +61,57 @@ func newStreamCompleteEvent(id uint64) Event {
 		StreamID: id,
 	}
 }
+
+// newStreamClosedEvent creates an event where the stream has been closed in both directions
+// and removed from the connection.
+func newStreamClosedEvent(id uint64) Event {
+	return Event{
+		Type:     EventStreamClosed,
+		StreamID: id,
+	}
+}
+
+// newConnectionIDNewEvent creates an event where a new connection ID has been issued to peer.
+func newConnectionIDNewEvent(cid []byte) Event {
+	return Event{
+		Type: EventConnectionIDNew,
+		Data: cid,
+	}
+}
+
+// newConnectionIDRetireEvent creates an event where peer has retired a connection ID.
+func newConnectionIDRetireEvent(cid []byte) Event {
+	return Event{
+		Type: EventConnectionIDRetire,
+		Data: cid,
+	}
+}
+
+// newPathMigratedEvent creates an event where the connection has switched to a new path.
+func newPathMigratedEvent() Event {
+	return Event{
+		Type: EventPathMigrated,
+	}
+}
+
+// newPathFailedEvent creates an event where a path could not be validated.
+func newPathFailedEvent() Event {
+	return Event{
+		Type: EventPathFailed,
+	}
+}
+
+// newNewTokenEvent creates an event where a NEW_TOKEN frame was received.
+func newNewTokenEvent(token []byte) Event {
+	return Event{
+		Type: EventNewToken,
+		Data: token,
+	}
+}
+
+// newDatagramEvent creates an event where a DATAGRAM frame was received.
+func newDatagramEvent() Event {
+	return Event{
+		Type: EventDatagram,
+	}
+}
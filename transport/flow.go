@@ -1,5 +1,7 @@
 package transport
 
+import "time"
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#flow-control
 type flowControl struct {
 	totalRecv   uint64 // Total bytes received from peer - updated when data is received.
@@ -8,12 +10,56 @@ type flowControl struct {
 
 	totalSend uint64 // Total bytes sent to peer - updated when data is sent successfully.
 	maxSend   uint64 // Sending limits - updated when got MAX_DATA.
+
+	// Receive window is the amount of data peer can send beyond what has been consumed.
+	// It is auto-tuned up to maxWindow.
+	window        uint64
+	maxWindow     uint64
+	pendingWindow uint64    // Window growth to be added to the limit when data is consumed.
+	lastUpdate    time.Time // When the receiving limit was last auto-tuned.
+
+	// Sending is blocked by the limit and DATA_BLOCKED or STREAM_DATA_BLOCKED needs to be sent.
+	blocked     bool
+	blockedSent bool
+	blockedAt   uint64 // Limit reported in the last blocked frame.
 }
 
 func (s *flowControl) init(maxRecv, maxSend uint64) {
 	s.maxRecv = maxRecv
 	s.maxRecvNext = maxRecv
 	s.maxSend = maxSend
+	s.window = maxRecv
+	s.maxWindow = maxRecv
+}
+
+// setMaxWindow sets the maximum receive window which auto-tuning can grow to.
+func (s *flowControl) setMaxWindow(n uint64) {
+	if n > s.window {
+		s.maxWindow = n
+	}
+}
+
+// setWindow grows the receive window to n bytes, up to maxWindow.
+// The growth is advertised in the next update when more data is consumed,
+// so it does not trigger an update itself.
+func (s *flowControl) setWindow(n uint64) {
+	if n > s.maxWindow {
+		n = s.maxWindow
+	}
+	if n > s.window {
+		s.pendingWindow += n - s.window
+		s.window = n
+	}
+}
+
+// autoTune doubles the receive window when the receiving limit is updated
+// within two RTTs since the last update, i.e. the window is limiting throughput.
+// It is called after a new limit is sent in MAX_DATA or MAX_STREAM_DATA.
+func (s *flowControl) autoTune(now time.Time, rtt time.Duration) {
+	if !s.lastUpdate.IsZero() && now.Sub(s.lastUpdate) < 2*rtt {
+		s.setWindow(s.window * 2)
+	}
+	s.lastUpdate = now
 }
 
 // canRecv returns true if number of bytes received does not exceed limits.
@@ -36,7 +82,8 @@ func (s *flowControl) setRecv(n uint64) {
 
 // addMaxRecvNext adds to maximum data will be received in next commit.
 func (s *flowControl) addMaxRecvNext(n uint64) {
-	s.maxRecvNext += n
+	s.maxRecvNext += n + s.pendingWindow
+	s.pendingWindow = 0
 }
 
 // commitMaxRecv sets maxRecv to current maxRecvNext.
@@ -71,5 +118,20 @@ func (s *flowControl) setSend(n uint64) {
 func (s *flowControl) setMaxSend(n uint64) {
 	if n > s.maxSend {
 		s.maxSend = n
+		s.blocked = false
 	}
 }
+
+// setBlocked marks sending is blocked so peer is notified once for each limit.
+func (s *flowControl) setBlocked() {
+	if !s.blockedSent || s.blockedAt != s.maxSend {
+		s.blocked = true
+	}
+}
+
+// commitBlocked records the limit which has been sent in a blocked frame.
+func (s *flowControl) commitBlocked() {
+	s.blocked = false
+	s.blockedSent = true
+	s.blockedAt = s.maxSend
+}
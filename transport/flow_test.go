@@ -1,6 +1,9 @@
 package transport
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestFlowControlSend(t *testing.T) {
 	s := flowControl{}
@@ -55,3 +58,72 @@ func TestFlowControlRecv(t *testing.T) {
 		t.Fatalf("expect updateMaxRecv %v, actual %v", true, update)
 	}
 }
+
+func TestFlowControlAutoTune(t *testing.T) {
+	s := flowControl{}
+	s.init(10, 0)
+	s.setMaxWindow(30)
+	now := testTime()
+	rtt := 100 * time.Millisecond
+	// First update only records the time.
+	s.autoTune(now, rtt)
+	if s.window != 10 || s.maxRecvNext != 10 {
+		t.Fatalf("expect window %v, actual %+v", 10, s)
+	}
+	s.autoTune(now.Add(2*rtt), rtt)
+	if s.window != 10 || s.maxRecvNext != 10 {
+		t.Fatalf("expect window %v, actual %+v", 10, s)
+	}
+	s.autoTune(now.Add(3*rtt), rtt)
+	if s.window != 20 || s.maxRecvNext != 10 || s.shouldUpdateMaxRecv() {
+		t.Fatalf("expect window %v not advertised, actual %+v", 20, s)
+	}
+	// Growth is added when data is consumed.
+	s.addRecv(5)
+	s.addMaxRecvNext(5)
+	if s.maxRecvNext != 25 || s.pendingWindow != 0 {
+		t.Fatalf("expect max recv next %v, actual %+v", 25, s)
+	}
+	s.commitMaxRecv()
+	s.autoTune(now.Add(4*rtt), rtt)
+	s.addMaxRecvNext(0)
+	if s.window != 30 || s.maxRecvNext != 35 {
+		t.Fatalf("expect window %v, actual %+v", 30, s)
+	}
+	// Window is not shrunk.
+	s.setWindow(5)
+	if s.window != 30 || s.pendingWindow != 0 {
+		t.Fatalf("expect window %v, actual %+v", 30, s)
+	}
+	// Disabled
+	s = flowControl{}
+	s.init(10, 0)
+	s.setMaxWindow(5)
+	s.setWindow(20)
+	if s.window != 10 || s.pendingWindow != 0 {
+		t.Fatalf("expect window %v, actual %+v", 10, s)
+	}
+}
+
+func TestFlowControlBlocked(t *testing.T) {
+	s := flowControl{}
+	s.init(0, 10)
+	s.setBlocked()
+	if !s.blocked {
+		t.Fatalf("expect blocked %v, actual %+v", true, s)
+	}
+	s.commitBlocked()
+	s.setBlocked()
+	if s.blocked || s.blockedAt != 10 {
+		t.Fatalf("expect blocked sent once at %v, actual %+v", 10, s)
+	}
+	s.setMaxSend(20)
+	s.setBlocked()
+	if !s.blocked {
+		t.Fatalf("expect blocked %v, actual %+v", true, s)
+	}
+	s.setMaxSend(30)
+	if s.blocked {
+		t.Fatalf("expect blocked %v, actual %+v", false, s)
+	}
+}
@@ -6,6 +6,7 @@ const (
 	frameTypePadding     = 0x00
 	frameTypePing        = 0x01
 	frameTypeAck         = 0x02
+	frameTypeAckECN      = 0x03
 	frameTypeResetStream = 0x04
 	frameTypeStopSending = 0x05
 	frameTypeCrypto      = 0x06
@@ -21,10 +22,17 @@ const (
 	frameTypeStreamDataBlocked  = 0x15
 	frameTypeStreamsBlockedBidi = 0x16
 	frameTypeStreamsBlockedUni  = 0x17
+	frameTypeNewConnectionID    = 0x18
+	frameTypeRetireConnectionID = 0x19
+	frameTypePathChallenge      = 0x1a
+	frameTypePathResponse       = 0x1b
 
 	frameTypeConnectionClose  = 0x1c
 	frameTypeApplicationClose = 0x1d
 	frameTypeHanshakeDone     = 0x1e
+
+	frameTypeDatagram       = 0x30
+	frameTypeDatagramLength = 0x31
 )
 
 const (
@@ -173,7 +181,8 @@ type ackFrame struct {
 	ackDelay      uint64 // Time in microseconds since when the largest acknowledged packet
 	firstAckRange uint64 // Number of contiguous packets preceding the largest acknowledged
 	ackRanges     []ackRange
-	// TODO: ECN
+	// ecnCounts is only present in ACK_ECN frame (type=0x03).
+	ecnCounts *ecnCounts
 }
 
 func newAckFrame(ackDelay uint64, r rangeSet) *ackFrame {
@@ -193,12 +202,19 @@ func (s *ackFrame) encodedLen() int {
 	for _, r := range s.ackRanges {
 		n += varintLen(r.gap) + varintLen(r.ackRange)
 	}
+	if s.ecnCounts != nil {
+		n += varintLen(s.ecnCounts.ect0) + varintLen(s.ecnCounts.ect1) + varintLen(s.ecnCounts.ce)
+	}
 	return n
 }
 
 func (s *ackFrame) encode(b []byte) (int, error) {
 	enc := newCodec(b)
-	if !enc.writeByte(frameTypeAck) ||
+	typ := byte(frameTypeAck)
+	if s.ecnCounts != nil {
+		typ = frameTypeAckECN
+	}
+	if !enc.writeByte(typ) ||
 		!enc.writeVarint(s.largestAck) ||
 		!enc.writeVarint(s.ackDelay) ||
 		!enc.writeVarint(uint64(len(s.ackRanges))) ||
@@ -210,13 +226,21 @@ func (s *ackFrame) encode(b []byte) (int, error) {
 			return 0, errShortBuffer
 		}
 	}
+	if s.ecnCounts != nil {
+		if !enc.writeVarint(s.ecnCounts.ect0) ||
+			!enc.writeVarint(s.ecnCounts.ect1) ||
+			!enc.writeVarint(s.ecnCounts.ce) {
+			return 0, errShortBuffer
+		}
+	}
 	return enc.offset(), nil
 }
 
 func (s *ackFrame) decode(b []byte) (int, error) {
 	dec := newCodec(b)
+	var typ byte
 	var rangeCount uint64
-	if !dec.skip(1) || // skip frame type
+	if !dec.readByte(&typ) ||
 		!dec.readVarint(&s.largestAck) ||
 		!dec.readVarint(&s.ackDelay) ||
 		!dec.readVarint(&rangeCount) ||
@@ -235,6 +259,16 @@ func (s *ackFrame) decode(b []byte) (int, error) {
 	} else {
 		s.ackRanges = nil
 	}
+	if typ == frameTypeAckECN {
+		s.ecnCounts = &ecnCounts{}
+		if !dec.readVarint(&s.ecnCounts.ect0) ||
+			!dec.readVarint(&s.ecnCounts.ect1) ||
+			!dec.readVarint(&s.ecnCounts.ce) {
+			return 0, newError(FrameEncodingError, "ack")
+		}
+	} else {
+		s.ecnCounts = nil
+	}
 	return dec.offset(), nil
 }
 
@@ -298,6 +332,10 @@ func (s *ackFrame) fromRangeSet(ranges rangeSet) {
 }
 
 func (s *ackFrame) String() string {
+	if s.ecnCounts != nil {
+		return fmt.Sprintf("ack{delay=%d largest=%d first=%d ranges=%d ect0=%d ect1=%d ce=%d}", s.ackDelay, s.largestAck, s.firstAckRange, len(s.ackRanges),
+			s.ecnCounts.ect0, s.ecnCounts.ect1, s.ecnCounts.ce)
+	}
 	return fmt.Sprintf("ack{delay=%d largest=%d first=%d ranges=%d}", s.ackDelay, s.largestAck, s.firstAckRange, len(s.ackRanges))
 }
 
@@ -758,6 +796,221 @@ func (s *streamsBlockedFrame) String() string {
 	return fmt.Sprintf("streamsBlocked{limit=%d}", s.streamLimit)
 }
 
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#frame-new-connection-id
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                      Sequence Number (i)                    ...
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                      Retire Prior To (i)                    ...
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// | Length (8)  |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                 Connection ID (8..160)                      ...
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                                                               |
+// +                                                               +
+// |                                                               |
+// +                 Stateless Reset Token (128)                   +
+// |                                                               |
+// +                                                               +
+// |                                                               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+type newConnectionIDFrame struct {
+	sequenceNumber      uint64
+	retirePriorTo       uint64
+	connectionID        []byte
+	statelessResetToken []byte
+}
+
+func newNewConnectionIDFrame(seq, retirePriorTo uint64, cid, resetToken []byte) *newConnectionIDFrame {
+	return &newConnectionIDFrame{
+		sequenceNumber:      seq,
+		retirePriorTo:       retirePriorTo,
+		connectionID:        cid,
+		statelessResetToken: resetToken,
+	}
+}
+
+func (s *newConnectionIDFrame) encodedLen() int {
+	return 1 + varintLen(s.sequenceNumber) +
+		varintLen(s.retirePriorTo) +
+		1 + len(s.connectionID) +
+		statelessResetTokenLen
+}
+
+func (s *newConnectionIDFrame) encode(b []byte) (int, error) {
+	if len(s.connectionID) == 0 || len(s.connectionID) > MaxCIDLength ||
+		len(s.statelessResetToken) != statelessResetTokenLen {
+		return 0, newError(InternalError, "new_connection_id")
+	}
+	enc := newCodec(b)
+	if !enc.writeByte(frameTypeNewConnectionID) ||
+		!enc.writeVarint(s.sequenceNumber) ||
+		!enc.writeVarint(s.retirePriorTo) ||
+		!enc.writeByte(uint8(len(s.connectionID))) ||
+		!enc.write(s.connectionID) ||
+		!enc.write(s.statelessResetToken) {
+		return 0, errShortBuffer
+	}
+	return enc.offset(), nil
+}
+
+func (s *newConnectionIDFrame) decode(b []byte) (int, error) {
+	dec := newCodec(b)
+	var length uint8
+	if !dec.skip(1) || // Skip type
+		!dec.readVarint(&s.sequenceNumber) ||
+		!dec.readVarint(&s.retirePriorTo) ||
+		!dec.readByte(&length) ||
+		length == 0 || length > MaxCIDLength {
+		return 0, newError(FrameEncodingError, "new_connection_id")
+	}
+	if s.connectionID = dec.read(int(length)); s.connectionID == nil {
+		return 0, newError(FrameEncodingError, "new_connection_id")
+	}
+	if s.statelessResetToken = dec.read(statelessResetTokenLen); s.statelessResetToken == nil {
+		return 0, newError(FrameEncodingError, "new_connection_id")
+	}
+	return dec.offset(), nil
+}
+
+func (s *newConnectionIDFrame) String() string {
+	return fmt.Sprintf("newConnectionID{sequence=%d retire=%d cid=%x}", s.sequenceNumber, s.retirePriorTo, s.connectionID)
+}
+
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#frame-retire-connection-id
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                      Sequence Number (i)                    ...
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+type retireConnectionIDFrame struct {
+	sequenceNumber uint64
+}
+
+func newRetireConnectionIDFrame(seq uint64) *retireConnectionIDFrame {
+	return &retireConnectionIDFrame{
+		sequenceNumber: seq,
+	}
+}
+
+func (s *retireConnectionIDFrame) encodedLen() int {
+	return 1 + varintLen(s.sequenceNumber)
+}
+
+func (s *retireConnectionIDFrame) encode(b []byte) (int, error) {
+	enc := newCodec(b)
+	if !enc.writeByte(frameTypeRetireConnectionID) ||
+		!enc.writeVarint(s.sequenceNumber) {
+		return 0, errShortBuffer
+	}
+	return enc.offset(), nil
+}
+
+func (s *retireConnectionIDFrame) decode(b []byte) (int, error) {
+	dec := newCodec(b)
+	if !dec.skip(1) || // Skip type
+		!dec.readVarint(&s.sequenceNumber) {
+		return 0, newError(FrameEncodingError, "retire_connection_id")
+	}
+	return dec.offset(), nil
+}
+
+func (s *retireConnectionIDFrame) String() string {
+	return fmt.Sprintf("retireConnectionID{sequence=%d}", s.sequenceNumber)
+}
+
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#frame-path-challenge
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                                                               |
+// +                            Data (64)                          +
+// |                                                               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+type pathChallengeFrame struct {
+	data []byte
+}
+
+func newPathChallengeFrame(data []byte) *pathChallengeFrame {
+	return &pathChallengeFrame{
+		data: data,
+	}
+}
+
+func (s *pathChallengeFrame) encodedLen() int {
+	return 1 + pathChallengeLen
+}
+
+func (s *pathChallengeFrame) encode(b []byte) (int, error) {
+	if len(s.data) != pathChallengeLen {
+		return 0, newError(InternalError, "path_challenge")
+	}
+	enc := newCodec(b)
+	if !enc.writeByte(frameTypePathChallenge) ||
+		!enc.write(s.data) {
+		return 0, errShortBuffer
+	}
+	return enc.offset(), nil
+}
+
+func (s *pathChallengeFrame) decode(b []byte) (int, error) {
+	dec := newCodec(b)
+	if !dec.skip(1) { // Skip type
+		return 0, newError(FrameEncodingError, "path_challenge")
+	}
+	if s.data = dec.read(pathChallengeLen); s.data == nil {
+		return 0, newError(FrameEncodingError, "path_challenge")
+	}
+	return dec.offset(), nil
+}
+
+func (s *pathChallengeFrame) String() string {
+	return fmt.Sprintf("pathChallenge{data=%x}", s.data)
+}
+
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#frame-path-response
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                                                               |
+// +                            Data (64)                          +
+// |                                                               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+type pathResponseFrame struct {
+	data []byte
+}
+
+func newPathResponseFrame(data []byte) *pathResponseFrame {
+	return &pathResponseFrame{
+		data: data,
+	}
+}
+
+func (s *pathResponseFrame) encodedLen() int {
+	return 1 + pathChallengeLen
+}
+
+func (s *pathResponseFrame) encode(b []byte) (int, error) {
+	if len(s.data) != pathChallengeLen {
+		return 0, newError(InternalError, "path_response")
+	}
+	enc := newCodec(b)
+	if !enc.writeByte(frameTypePathResponse) ||
+		!enc.write(s.data) {
+		return 0, errShortBuffer
+	}
+	return enc.offset(), nil
+}
+
+func (s *pathResponseFrame) decode(b []byte) (int, error) {
+	dec := newCodec(b)
+	if !dec.skip(1) { // Skip type
+		return 0, newError(FrameEncodingError, "path_response")
+	}
+	if s.data = dec.read(pathChallengeLen); s.data == nil {
+		return 0, newError(FrameEncodingError, "path_response")
+	}
+	return dec.offset(), nil
+}
+
+func (s *pathResponseFrame) String() string {
+	return fmt.Sprintf("pathResponse{data=%x}", s.data)
+}
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#frame-connection-close
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 // |                         Error Code (i)                      ...
@@ -915,6 +1168,62 @@ func (s *handshakeDoneFrame) String() string {
 	return "handshakeDone{}"
 }
 
+// https://www.rfc-editor.org/rfc/rfc9221.html#name-datagram-frame-types
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                          [Length (i)]                       ...
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                         Datagram Data (*)                   ...
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+type datagramFrame struct {
+	data []byte
+}
+
+func newDatagramFrame(data []byte) *datagramFrame {
+	return &datagramFrame{
+		data: data,
+	}
+}
+
+func (s *datagramFrame) encodedLen() int {
+	return 1 + varintLen(uint64(len(s.data))) + len(s.data)
+}
+
+func (s *datagramFrame) encode(b []byte) (int, error) {
+	enc := newCodec(b)
+	// Always include length
+	if !enc.writeByte(frameTypeDatagramLength) ||
+		!enc.writeVarint(uint64(len(s.data))) ||
+		!enc.write(s.data) {
+		return 0, errShortBuffer
+	}
+	return enc.offset(), nil
+}
+
+func (s *datagramFrame) decode(b []byte) (int, error) {
+	dec := newCodec(b)
+	var typ uint8
+	if !dec.readByte(&typ) {
+		return 0, newError(FrameEncodingError, "datagram")
+	}
+	if typ == frameTypeDatagramLength {
+		var length uint64
+		if !dec.readVarint(&length) {
+			return 0, newError(FrameEncodingError, "datagram")
+		}
+		if s.data = dec.read(int(length)); s.data == nil {
+			return 0, newError(FrameEncodingError, "datagram")
+		}
+		return dec.offset(), nil
+	}
+	// Without length, data extends to the end of the packet.
+	s.data = b[dec.offset():]
+	return len(b), nil
+}
+
+func (s *datagramFrame) String() string {
+	return fmt.Sprintf("datagram{length=%d}", len(s.data))
+}
+
 func encodeFrames(b []byte, frames []frame) (int, error) {
 	n := 0
 	for _, f := range frames {
@@ -927,9 +1236,31 @@ func encodeFrames(b []byte, frames []frame) (int, error) {
 	return n, nil
 }
 
+// Probing frames are PATH_CHALLENGE, PATH_RESPONSE, NEW_CONNECTION_ID, and PADDING.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-probing-a-new-path
+func isFrameProbing(typ uint64) bool {
+	switch typ {
+	case frameTypePathChallenge, frameTypePathResponse, frameTypeNewConnectionID, frameTypePadding:
+		return true
+	default:
+		return false
+	}
+}
+
+// isFrameAllowedInZeroRTT returns false for frames which must not be sent in 0-RTT packets.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-frames-and-frame-types
+func isFrameAllowedInZeroRTT(typ uint64) bool {
+	switch typ {
+	case frameTypeAck, frameTypeAckECN, frameTypeCrypto, frameTypeNewToken, frameTypeHanshakeDone, frameTypePathResponse:
+		return false
+	default:
+		return true
+	}
+}
+
 func isFrameAckEliciting(typ uint64) bool {
 	switch typ {
-	case frameTypeAck, frameTypePadding, frameTypeConnectionClose, frameTypeApplicationClose:
+	case frameTypeAck, frameTypeAckECN, frameTypePadding, frameTypeConnectionClose, frameTypeApplicationClose:
 		return false
 	default:
 		return true
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	mrand "math/rand"
@@ -73,6 +74,23 @@ func TestFrameAck(t *testing.T) {
 	}
 }
 
+func TestFrameAckECN(t *testing.T) {
+	f := &ackFrame{
+		largestAck:    0x12,
+		ackDelay:      0x34,
+		firstAckRange: 0x1,
+		ecnCounts: &ecnCounts{
+			ect0: 5,
+			ect1: 0,
+			ce:   0x40,
+		},
+	}
+	testFrame(t, f, "031234000105004040")
+	if isFrameAckEliciting(frameTypeAckECN) {
+		t.Fatalf("expect ack_ecn frame not ack eliciting")
+	}
+}
+
 func TestFrameAckRangeSet(t *testing.T) {
 	var f ackFrame
 	var ranges rangeSet
@@ -208,11 +226,56 @@ func TestFrameStreamsBlocked(t *testing.T) {
 	testFrame(t, f, "165234")
 }
 
+func TestFrameNewConnectionID(t *testing.T) {
+	f := &newConnectionIDFrame{
+		sequenceNumber:      2,
+		retirePriorTo:       1,
+		connectionID:        []byte{0x01, 0x02, 0x03, 0x04},
+		statelessResetToken: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	}
+	testFrame(t, f, "1802010401020304000102030405060708090a0b0c0d0e0f")
+}
+
+func TestFrameRetireConnectionID(t *testing.T) {
+	f := &retireConnectionIDFrame{
+		sequenceNumber: 0x1234,
+	}
+	testFrame(t, f, "195234")
+}
+
+func TestFramePathChallenge(t *testing.T) {
+	f := &pathChallengeFrame{
+		data: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	testFrame(t, f, "1a0102030405060708")
+}
+
+func TestFramePathResponse(t *testing.T) {
+	f := &pathResponseFrame{
+		data: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	testFrame(t, f, "1b0102030405060708")
+}
+
 func TestFrameHandshakeDone(t *testing.T) {
 	f := &handshakeDoneFrame{}
 	testFrame(t, f, "1e")
 }
 
+func TestFrameDatagram(t *testing.T) {
+	f := &datagramFrame{
+		data: []byte{1, 2, 3},
+	}
+	testFrame(t, f, "3103010203")
+	// Without length
+	b := testdata.DecodeHex("30010203")
+	var d datagramFrame
+	n, err := d.decode(b)
+	if err != nil || n != len(b) || !bytes.Equal(d.data, f.data) {
+		t.Fatalf("decode datagram frame: %v %v %v", n, err, &d)
+	}
+}
+
 func TestFuzzFrame(t *testing.T) {
 	b := make([]byte, 1024)
 	out := make([]byte, len(b))
@@ -237,8 +300,13 @@ func TestFuzzFrame(t *testing.T) {
 		&dataBlockedFrame{},
 		&streamDataBlockedFrame{},
 		&streamsBlockedFrame{},
+		&newConnectionIDFrame{},
+		&retireConnectionIDFrame{},
+		&pathChallengeFrame{},
+		&pathResponseFrame{},
 		&connectionCloseFrame{},
 		&handshakeDoneFrame{},
+		&datagramFrame{},
 	}
 	for i := 0; i < 10000; i++ {
 		_, err := rand.Read(b)
@@ -250,9 +318,13 @@ func TestFuzzFrame(t *testing.T) {
 			if err == nil {
 				n, err = f.encode(out[:n])
 				if err != nil {
-					if _, ok := f.(*streamFrame); ok && err == errShortBuffer {
-						// Stream frame always include length, so encoded length may be greater than decoded length.
-						continue
+					switch f.(type) {
+					case *streamFrame, *datagramFrame:
+						if err == errShortBuffer {
+							// Stream and datagram frames always include length, so encoded length
+							// may be greater than decoded length.
+							continue
+						}
 					}
 					t.Fatalf("could not encode decoded frame: %v: %v\n%x", f, err, b)
 				}
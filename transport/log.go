@@ -180,10 +180,20 @@ func newLogEventFrame(tm time.Time, tp string, f frame) LogEvent {
 		logFrameStreamDataBlocked(&e, f)
 	case *streamsBlockedFrame:
 		logFrameStreamsBlocked(&e, f)
+	case *newConnectionIDFrame:
+		logFrameNewConnectionID(&e, f)
+	case *retireConnectionIDFrame:
+		logFrameRetireConnectionID(&e, f)
+	case *pathChallengeFrame:
+		logFramePathChallenge(&e, f)
+	case *pathResponseFrame:
+		logFramePathResponse(&e, f)
 	case *connectionCloseFrame:
 		logFrameConnectionClose(&e, f)
 	case *handshakeDoneFrame:
 		logFrameHandshakeDone(&e, f)
+	case *datagramFrame:
+		logFrameDatagram(&e, f)
 	}
 	return e
 }
@@ -199,6 +209,11 @@ func logFramePing(e *LogEvent, s *pingFrame) {
 func logFrameAck(e *LogEvent, s *ackFrame) {
 	e.addField("frame_type", "ack")
 	e.addField("ack_delay", s.ackDelay)
+	if s.ecnCounts != nil {
+		e.addField("ect0", s.ecnCounts.ect0)
+		e.addField("ect1", s.ecnCounts.ect1)
+		e.addField("ce", s.ecnCounts.ce)
+	}
 }
 
 func logFrameResetStream(e *LogEvent, s *resetStreamFrame) {
@@ -275,6 +290,29 @@ func logFrameStreamsBlocked(e *LogEvent, s *streamsBlockedFrame) {
 	e.addField("limit", s.streamLimit)
 }
 
+func logFrameNewConnectionID(e *LogEvent, s *newConnectionIDFrame) {
+	e.addField("frame_type", "new_connection_id")
+	e.addField("sequence_number", s.sequenceNumber)
+	e.addField("retire_prior_to", s.retirePriorTo)
+	e.addField("connection_id", s.connectionID)
+	e.addField("stateless_reset_token", s.statelessResetToken)
+}
+
+func logFrameRetireConnectionID(e *LogEvent, s *retireConnectionIDFrame) {
+	e.addField("frame_type", "retire_connection_id")
+	e.addField("sequence_number", s.sequenceNumber)
+}
+
+func logFramePathChallenge(e *LogEvent, s *pathChallengeFrame) {
+	e.addField("frame_type", "path_challenge")
+	e.addField("data", s.data)
+}
+
+func logFramePathResponse(e *LogEvent, s *pathResponseFrame) {
+	e.addField("frame_type", "path_response")
+	e.addField("data", s.data)
+}
+
 func logFrameConnectionClose(e *LogEvent, s *connectionCloseFrame) {
 	e.addField("frame_type", "connection_close")
 	if s.application {
@@ -294,6 +332,11 @@ func logFrameHandshakeDone(e *LogEvent, s *handshakeDoneFrame) {
 	e.addField("frame_type", "handshake_done")
 }
 
+func logFrameDatagram(e *LogEvent, s *datagramFrame) {
+	e.addField("frame_type", "datagram")
+	e.addField("length", len(s.data))
+}
+
 func logUnknownFrame(e *LogEvent, frameType uint64, b []byte) {
 	e.addField("frame_type", "unknown")
 	e.addField("raw_frame_type", frameType)
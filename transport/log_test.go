@@ -82,6 +82,26 @@ func TestLogFrameStreamsBlocked(t *testing.T) {
 	testLogFrame(t, f, "frame_type=streams_blocked stream_type=bidirectional limit=2")
 }
 
+func TestLogFrameNewConnectionID(t *testing.T) {
+	f := newNewConnectionIDFrame(2, 1, []byte{1, 2}, make([]byte, 16))
+	testLogFrame(t, f, "frame_type=new_connection_id sequence_number=2 retire_prior_to=1 connection_id=0102 stateless_reset_token=00000000000000000000000000000000")
+}
+
+func TestLogFrameRetireConnectionID(t *testing.T) {
+	f := newRetireConnectionIDFrame(3)
+	testLogFrame(t, f, "frame_type=retire_connection_id sequence_number=3")
+}
+
+func TestLogFramePathChallenge(t *testing.T) {
+	f := newPathChallengeFrame([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	testLogFrame(t, f, "frame_type=path_challenge data=0102030405060708")
+}
+
+func TestLogFramePathResponse(t *testing.T) {
+	f := newPathResponseFrame([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	testLogFrame(t, f, "frame_type=path_response data=0102030405060708")
+}
+
 func TestLogFrameConnectionClose(t *testing.T) {
 	f := newConnectionCloseFrame(0x122, 99, []byte("reason"), false)
 	testLogFrame(t, f, "frame_type=connection_close error_space=transport error_code=crypto_error_34 raw_error_code=290 reason=reason trigger_frame_type=99")
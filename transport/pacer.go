@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"time"
+)
+
+const (
+	// pacingGain is the multiplier of cwnd/smoothed_rtt so pacing does not
+	// prevent the congestion window from being fully utilized.
+	pacingGain = 1.25
+	// pacingBurst is the amount of data which can be sent at once.
+	pacingBurst = initialWindow
+)
+
+// pacer spreads packets over time with a token bucket refilled at the pacing rate.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-pacing
+type pacer struct {
+	// tokens is the amount of data can be sent now. It can be negative
+	// as a packet is allowed to be sent whenever there are tokens.
+	tokens     int64
+	lastUpdate time.Time
+	// nextSendTime is the time packets can be sent again when pacing is limiting.
+	nextSendTime time.Time
+}
+
+// refill adds tokens accumulated since the last update.
+func (s *pacer) refill(rate uint64, now time.Time) {
+	if s.lastUpdate.IsZero() {
+		s.tokens = pacingBurst
+	} else if now.After(s.lastUpdate) {
+		s.tokens += int64(float64(rate) * now.Sub(s.lastUpdate).Seconds())
+		if s.tokens > pacingBurst {
+			s.tokens = pacingBurst
+		}
+	}
+	s.lastUpdate = now
+}
+
+// canSend returns true when a packet can be sent with given pacing rate in bytes per second.
+// Pacing is disabled when rate is zero.
+func (s *pacer) canSend(rate uint64, now time.Time) bool {
+	if rate == 0 {
+		s.nextSendTime = time.Time{}
+		return true
+	}
+	s.refill(rate, now)
+	if s.tokens > 0 {
+		s.nextSendTime = time.Time{}
+		return true
+	}
+	wait := time.Duration(float64(1-s.tokens) / float64(rate) * float64(time.Second))
+	s.nextSendTime = now.Add(wait)
+	return false
+}
+
+func (s *pacer) onPacketSent(size uint64, rate uint64, now time.Time) {
+	if rate == 0 {
+		return
+	}
+	s.refill(rate, now)
+	s.tokens -= int64(size)
+}
+
+func (s *pacer) reset() {
+	*s = pacer{}
+}
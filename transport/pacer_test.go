@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	const rate = 1000000 // 1 byte per microsecond
+	var p pacer
+	if !p.canSend(0, now) {
+		t.Fatalf("expect pacing disabled without rate")
+	}
+	// Burst is allowed.
+	n := 0
+	for p.canSend(rate, now) {
+		p.onPacketSent(1000, rate, now)
+		n++
+	}
+	if n != (pacingBurst+999)/1000 {
+		t.Fatalf("expect burst packets: %v, actual: %v", (pacingBurst+999)/1000, n)
+	}
+	next := p.nextSendTime
+	if !next.After(now) || next.Sub(now) > 2*time.Millisecond {
+		t.Fatalf("expect next send time after %v: %v", now, next)
+	}
+	if p.canSend(rate, next.Add(-time.Microsecond)) {
+		t.Fatalf("expect pacing limited before %v", next)
+	}
+	if !p.canSend(rate, next) || !p.nextSendTime.IsZero() {
+		t.Fatalf("expect pacing not limited at %v: %+v", next, p)
+	}
+	// Packets are spread at the pacing rate.
+	p.onPacketSent(1000, rate, next)
+	if p.canSend(rate, next.Add(500*time.Microsecond)) {
+		t.Fatalf("expect pacing limited")
+	}
+	if !p.canSend(rate, next.Add(time.Millisecond)) {
+		t.Fatalf("expect pacing not limited")
+	}
+	// Tokens do not exceed burst after idle.
+	p.canSend(rate, next.Add(time.Hour))
+	if p.tokens != pacingBurst {
+		t.Fatalf("expect tokens: %v, actual: %v", pacingBurst, p.tokens)
+	}
+}
@@ -1,6 +1,10 @@
 package transport
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"fmt"
 	"time"
 )
@@ -51,25 +55,36 @@ func (s packetType) String() string {
 
 const (
 	maxPacketNumberLength = 4
+	maxPacketNumber       = 1<<62 - 1
+	// fixedBit is the QUIC Bit which is set unless peer supports greasing it.
+	fixedBit = 0x40
+	// keyPhaseBit is the Key Phase bit in short header.
+	keyPhaseBit = 0x04
+	// keyUpdateMargin is the number of packets before reaching confidentiality limit
+	// when a key update is initiated.
+	keyUpdateMargin = 1 << 16
 )
 
 func isLongHeader(b byte) bool {
 	return b&0x80 != 0
 }
 
-func packetTypeFromLongHeader(b uint8) packetType {
-	switch (b >> 4) & 0x3 {
-	case 0:
-		return packetTypeInitial
-	case 1:
-		return packetTypeZeroRTT
-	case 2:
-		return packetTypeHandshake
-	case 3:
-		return packetTypeRetry
-	default:
-		panic("unreachable")
+// packetTypeFromLongHeader returns packet type from the Long Packet Type bits,
+// which are different in QUIC version 2.
+// https://www.rfc-editor.org/rfc/rfc9369.html#name-long-header-packet-types
+func packetTypeFromLongHeader(version uint32, b uint8) packetType {
+	bits := (b >> 4) & 0x3
+	for i, v := range getVersionParams(version).longHeaderTypes {
+		if v == bits {
+			return packetType(i)
+		}
 	}
+	panic("unreachable")
+}
+
+// longHeaderFlags returns the first byte of a long header packet without packet number length.
+func longHeaderFlags(version uint32, typ packetType) uint8 {
+	return 0xc0 | getVersionParams(version).longHeaderTypes[typ]<<4
 }
 
 func packetTypeFromSpace(space packetSpace) packetType {
@@ -210,7 +225,7 @@ func (s *packetHeader) packetType() packetType {
 		if s.version == 0 {
 			return packetTypeVersionNegotiation
 		}
-		return packetTypeFromLongHeader(s.flags)
+		return packetTypeFromLongHeader(s.version, s.flags)
 	}
 	return packetTypeShort
 }
@@ -226,6 +241,10 @@ type packet struct {
 
 	packetNumber uint64
 	payloadLen   int
+	keyPhase     bool // Only in Short
+	// clearFixedBit clears the QUIC Bit when peer has sent grease_quic_bit.
+	// https://www.rfc-editor.org/rfc/rfc9287.html#name-clearing-the-quic-bit
+	clearFixedBit bool
 }
 
 var packetEncodedLenFuncs = [...]func(*packet) int{
@@ -261,19 +280,21 @@ func (s *packet) encodedLen() int {
 
 func (s *packet) encode(b []byte) (int, error) {
 	switch s.typ {
-	case packetTypeInitial:
-		s.header.flags = 0xc0 | packetNumberLenHeaderFlag(packetNumberLen(s.packetNumber))
-	case packetTypeZeroRTT:
-		s.header.flags = 0xd0 | packetNumberLenHeaderFlag(packetNumberLen(s.packetNumber))
-	case packetTypeHandshake:
-		s.header.flags = 0xe0 | packetNumberLenHeaderFlag(packetNumberLen(s.packetNumber))
+	case packetTypeInitial, packetTypeZeroRTT, packetTypeHandshake:
+		s.header.flags = longHeaderFlags(s.header.version, s.typ) | packetNumberLenHeaderFlag(packetNumberLen(s.packetNumber))
 	case packetTypeRetry:
 		// XXX: Unused bits are suggested being random
-		s.header.flags = 0xf0
+		s.header.flags = longHeaderFlags(s.header.version, s.typ)
 	case packetTypeVersionNegotiation:
 		s.header.flags = 0xc0
 	case packetTypeShort:
-		s.header.flags = 0x00 | packetNumberLenHeaderFlag(packetNumberLen(s.packetNumber))
+		s.header.flags = fixedBit | packetNumberLenHeaderFlag(packetNumberLen(s.packetNumber))
+		if s.keyPhase {
+			s.header.flags |= keyPhaseBit
+		}
+	}
+	if s.clearFixedBit {
+		s.header.flags &^= fixedBit
 	}
 	n, err := s.header.encode(b)
 	if err != nil {
@@ -451,8 +472,8 @@ func packetVersionDecode(s *packet, b []byte) (int, error) {
 	return dec.offset(), nil
 }
 
-// NegotiateVersion writes version negotiation packet to b.
-func NegotiateVersion(b, dcid, scid []byte) (int, error) {
+// NegotiateVersion writes version negotiation packet advertising the supported versions to b.
+func NegotiateVersion(b, dcid, scid []byte, versions []uint32) (int, error) {
 	if len(dcid) > MaxCIDLength || len(scid) > MaxCIDLength {
 		return 0, newError(ProtocolViolation, "cid too long")
 	}
@@ -462,7 +483,7 @@ func NegotiateVersion(b, dcid, scid []byte) (int, error) {
 			dcid: dcid,
 			scid: scid,
 		},
-		supportedVersions: []uint32{ProtocolVersion},
+		supportedVersions: versions,
 	}
 	return p.encode(b)
 }
@@ -686,8 +707,8 @@ func packetRetryDecode(s *packet, b []byte) (int, error) {
 // |                        Retry Token (*)                      ...
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
-// Retry writes retry packet to b.
-func Retry(b, dcid, scid, odcid, token []byte) (int, error) {
+// Retry writes retry packet of the given version to b.
+func Retry(b, dcid, scid, odcid, token []byte, version uint32) (int, error) {
 	if len(dcid) > MaxCIDLength || len(scid) > MaxCIDLength || len(odcid) > MaxCIDLength {
 		return 0, newError(ProtocolViolation, "cid too long")
 	}
@@ -701,7 +722,7 @@ func Retry(b, dcid, scid, odcid, token []byte) (int, error) {
 	p := packet{
 		typ: packetTypeRetry,
 		header: packetHeader{
-			version: ProtocolVersion,
+			version: version,
 			dcid:    dcid,
 			scid:    scid,
 		},
@@ -711,7 +732,7 @@ func Retry(b, dcid, scid, odcid, token []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	out, err := computeRetryIntegrity(b[:offset+n])
+	out, err := computeRetryIntegrity(version, b[:offset+n])
 	if err != nil {
 		return 0, err
 	}
@@ -722,6 +743,59 @@ func Retry(b, dcid, scid, odcid, token []byte) (int, error) {
 	return n, nil
 }
 
+// Stateless Reset: https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-stateless-reset
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |0|1|               Unpredictable Bits (38 ..)                ...
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                                                               |
+// +                                                               +
+// |                   Stateless Reset Token (128)                 |
+// +                                                               +
+// |                                                               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+// StatelessReset fills b with a stateless reset packet ending with token.
+// The whole buffer is used so caller decides the packet size, which must be at least
+// MinStatelessResetLength and should be smaller than the packet it responds to.
+func StatelessReset(b, token []byte) (int, error) {
+	if len(token) != statelessResetTokenLen {
+		return 0, newError(InternalError, "invalid stateless reset token")
+	}
+	if len(b) < MinStatelessResetLength {
+		return 0, errShortBuffer
+	}
+	n := len(b) - statelessResetTokenLen
+	if _, err := rand.Read(b[:n]); err != nil {
+		return 0, err
+	}
+	b[0] = (b[0] &^ 0xc0) | fixedBit // Short header with fixed bit
+	copy(b[n:], token)
+	return len(b), nil
+}
+
+// StatelessResetToken derives stateless reset token for connection ID cid from a secret key.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-calculating-a-stateless-res
+func StatelessResetToken(key, cid []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(cid)
+	return h.Sum(nil)[:statelessResetTokenLen]
+}
+
+// isStatelessReset returns true if the last bytes of datagram b match one of the tokens.
+func isStatelessReset(b []byte, tokens []connectionID) bool {
+	if len(b) < MinStatelessResetLength {
+		return false
+	}
+	tail := b[len(b)-statelessResetTokenLen:]
+	for i := range tokens {
+		t := tokens[i].resetToken
+		if len(t) == statelessResetTokenLen && subtle.ConstantTimeCompare(t, tail) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#short-header
 // +-+-+-+-+-+-+-+-+
 // |0|1|S|R|R|K|P P|
@@ -808,10 +882,41 @@ type packetNumberSpace struct {
 	// ackElicited indicates received packets need to be acknowledged.
 	ackElicited      bool
 	firstPacketAcked bool
+	// recvECN is the number of received packets with each ECN codepoint.
+	recvECN ecnCounts
 
 	opener packetProtection
 	sealer packetProtection
 
+	// Key update is only used in application space.
+	// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-key-update
+	keyPhase bool
+	// prevOpener is the read keys of the previous key phase, retained until prevOpenerTimer.
+	prevOpener      packetProtection
+	prevOpenerTimer time.Time
+	// nextOpener is the read keys of the next key phase, derived when peer may have updated keys.
+	nextOpener packetProtection
+	// keyPhaseRecvStart is the smallest packet number received in current key phase.
+	keyPhaseRecvStart uint64
+	// keyPhaseSendStart is the first packet number sent in current key phase.
+	keyPhaseSendStart uint64
+	// keyPhaseAcked is whether a packet sent in current key phase has been acknowledged.
+	keyPhaseAcked bool
+	// encryptedPackets is the number of packets encrypted with current keys.
+	encryptedPackets uint64
+
+	// originalOpener is the Initial read keys of the original version, which server keeps
+	// after switching to a compatible version.
+	// https://www.rfc-editor.org/rfc/rfc9368.html#name-compatible-versions
+	originalOpener packetProtection
+
+	// 0-RTT keys are only used in application space.
+	// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-0-rtt
+	zeroRTTOpener packetProtection
+	zeroRTTSealer packetProtection
+	// zeroRTTOpenerTimer is the time server discards 0-RTT keys after receiving 1-RTT packets.
+	zeroRTTOpenerTimer time.Time
+
 	cryptoStream Stream
 }
 
@@ -830,22 +935,42 @@ func (s *packetNumberSpace) drop() {
 	*s = packetNumberSpace{}
 }
 
-func (s *packetNumberSpace) canEncrypt() bool {
-	return s.sealer.aead != nil
+// sealerFor returns the write keys for packet type typ.
+func (s *packetNumberSpace) sealerFor(typ packetType) *packetProtection {
+	if typ == packetTypeZeroRTT {
+		return &s.zeroRTTSealer
+	}
+	return &s.sealer
+}
+
+// openerFor returns the read keys for packet type typ.
+func (s *packetNumberSpace) openerFor(typ packetType) *packetProtection {
+	if typ == packetTypeZeroRTT {
+		return &s.zeroRTTOpener
+	}
+	return &s.opener
+}
+
+func (s *packetNumberSpace) canEncrypt(typ packetType) bool {
+	return s.sealerFor(typ).aead != nil
 }
 
 // length of b and payloadLen must include overhead.
 func (s *packetNumberSpace) encryptPacket(b []byte, p *packet) {
-	payload := s.sealer.encryptPayload(b, p.packetNumber, p.payloadLen)
+	sealer := s.sealerFor(p.typ)
+	payload := sealer.encryptPayload(b, p.packetNumber, p.payloadLen)
 	if len(payload) != p.payloadLen {
 		panic("encrypted payload length not expected")
 	}
 	pnOffset := len(b) - p.payloadLen - packetNumberLen(p.packetNumber)
-	s.sealer.encryptHeader(b, pnOffset)
+	sealer.encryptHeader(b, pnOffset)
+	if sealer == &s.sealer {
+		s.encryptedPackets++
+	}
 }
 
-func (s *packetNumberSpace) canDecrypt() bool {
-	return s.opener.aead != nil
+func (s *packetNumberSpace) canDecrypt(typ packetType) bool {
+	return s.openerFor(typ).aead != nil
 }
 
 func (s *packetNumberSpace) decryptPacket(b []byte, p *packet) ([]byte, int, error) {
@@ -853,7 +978,12 @@ func (s *packetNumberSpace) decryptPacket(b []byte, p *packet) ([]byte, int, err
 	if err != nil {
 		return nil, 0, err
 	}
-	err = s.opener.decryptHeader(b, pnOffset)
+	opener := s.openerFor(p.typ)
+	if p.typ == packetTypeInitial && p.header.version != opener.version &&
+		s.originalOpener.aead != nil && p.header.version == s.originalOpener.version {
+		opener = &s.originalOpener
+	}
+	err = opener.decryptHeader(b, pnOffset)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -865,13 +995,90 @@ func (s *packetNumberSpace) decryptPacket(b []byte, p *packet) ([]byte, int, err
 	pnLen := packetNumberLenFromHeader(p.header.flags)
 	p.packetNumber = decodePacketNumber(s.largestRecvPacketNumber, p.packetNumber, pnLen)
 	length := p.headerLen + n + p.payloadLen
-	payload, err := s.opener.decryptPayload(b[:length], p.packetNumber, p.payloadLen)
+	if p.typ == packetTypeShort {
+		p.keyPhase = p.header.flags&keyPhaseBit != 0
+		opener = s.selectOpener(p)
+	}
+	payload, err := opener.decryptPayload(b[:length], p.packetNumber, p.payloadLen)
 	if err != nil {
 		return nil, 0, err
 	}
+	if opener == &s.nextOpener {
+		// Peer has initiated a key update.
+		s.updateKey()
+		s.keyPhaseRecvStart = p.packetNumber
+	} else if opener == &s.opener && p.packetNumber < s.keyPhaseRecvStart {
+		s.keyPhaseRecvStart = p.packetNumber
+	}
 	return payload, length, nil
 }
 
+// selectOpener returns the read keys for the key phase of short header packet p.
+// https://quicwg.org/base-drafts/draft-ietf-quic-tls.html#name-receiving-with-different-k
+func (s *packetNumberSpace) selectOpener(p *packet) *packetProtection {
+	if p.keyPhase == s.keyPhase {
+		return &s.opener
+	}
+	// Packets sent before those in current key phase use the previous keys.
+	if s.prevOpener.aead != nil && p.packetNumber < s.keyPhaseRecvStart {
+		return &s.prevOpener
+	}
+	if s.nextOpener.aead == nil {
+		s.nextOpener = s.opener.next()
+	}
+	return &s.nextOpener
+}
+
+// canUpdateKey returns true when a key update can be initiated.
+// An update is only allowed after a packet sent in current key phase has been acknowledged
+// and previous keys have been discarded.
+func (s *packetNumberSpace) canUpdateKey() bool {
+	return s.sealer.aead != nil && s.keyPhaseAcked && s.prevOpener.aead == nil
+}
+
+// needUpdateKey returns true when current keys are close to their confidentiality limit.
+func (s *packetNumberSpace) needUpdateKey() bool {
+	return s.encryptedPackets+keyUpdateMargin >= s.sealer.confidentialityLimit()
+}
+
+// updateKey switches both read and write keys to the next key phase.
+// Current read keys are retained to decrypt delayed packets.
+func (s *packetNumberSpace) updateKey() {
+	if s.nextOpener.aead == nil {
+		s.nextOpener = s.opener.next()
+	}
+	s.prevOpener = s.opener
+	s.prevOpenerTimer = time.Time{}
+	s.opener = s.nextOpener
+	s.nextOpener = packetProtection{}
+	s.sealer = s.sealer.next()
+	s.keyPhase = !s.keyPhase
+	s.keyPhaseRecvStart = maxPacketNumber
+	s.keyPhaseSendStart = s.nextPacketNumber
+	s.keyPhaseAcked = false
+	s.encryptedPackets = 0
+}
+
+// onPacketAcked is called when a packet with number pn is acknowledged by peer.
+func (s *packetNumberSpace) onPacketAcked(pn uint64) {
+	if !s.keyPhaseAcked && pn >= s.keyPhaseSendStart {
+		s.keyPhaseAcked = true
+	}
+}
+
+// dropPrevKeys discards read keys of previous key phase.
+func (s *packetNumberSpace) dropPrevKeys() {
+	s.prevOpener = packetProtection{}
+	s.prevOpenerTimer = time.Time{}
+}
+
+// dropZeroRTTKeys discards 0-RTT keys.
+func (s *packetNumberSpace) dropZeroRTTKeys() {
+	s.zeroRTTOpener = packetProtection{}
+	s.zeroRTTSealer = packetProtection{}
+	s.zeroRTTOpenerTimer = time.Time{}
+}
+
 func (s *packetNumberSpace) isPacketReceived(pn uint64) bool {
 	return s.recvPacketNumbers.contains(pn)
 }
@@ -3,6 +3,7 @@ package transport
 import (
 	"bytes"
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -47,12 +48,40 @@ func TestPacketInitial(t *testing.T) {
 	}
 }
 
+func TestPacketLongHeaderType(t *testing.T) {
+	data := []struct {
+		version uint32
+		typ     packetType
+		flags   uint8
+	}{
+		{Version1, packetTypeInitial, 0xc0},
+		{Version1, packetTypeZeroRTT, 0xd0},
+		{Version1, packetTypeHandshake, 0xe0},
+		{Version1, packetTypeRetry, 0xf0},
+		{Version2, packetTypeInitial, 0xd0},
+		{Version2, packetTypeZeroRTT, 0xe0},
+		{Version2, packetTypeHandshake, 0xf0},
+		{Version2, packetTypeRetry, 0xc0},
+	}
+	for _, d := range data {
+		flags := longHeaderFlags(d.version, d.typ)
+		if flags != d.flags {
+			t.Errorf("expect flags %x, actual %x", d.flags, flags)
+		}
+		typ := packetTypeFromLongHeader(d.version, flags)
+		if typ != d.typ {
+			t.Errorf("expect type %v, actual %v", d.typ, typ)
+		}
+	}
+}
+
 func TestPacketVersionNegotiation(t *testing.T) {
 	b := make([]byte, 128)
 	dcid := randomBytes(MaxCIDLength)
 	scid := randomBytes(MaxCIDLength)
 
-	n, err := NegotiateVersion(b, dcid, scid)
+	versions := []uint32{Version1, VersionDraft29}
+	n, err := NegotiateVersion(b, dcid, scid, versions)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,8 +103,8 @@ func TestPacketVersionNegotiation(t *testing.T) {
 	if !bytes.Equal(scid, p.header.scid) {
 		t.Errorf("expect scid %x, actual %x", scid, p.header.scid)
 	}
-	if len(p.supportedVersions) != 1 || p.supportedVersions[0] != ProtocolVersion {
-		t.Errorf("expect supported versions: [%d], actual: %v", ProtocolVersion, p.supportedVersions)
+	if !reflect.DeepEqual(versions, p.supportedVersions) {
+		t.Errorf("expect supported versions: %v, actual: %v", versions, p.supportedVersions)
 	}
 
 	h := Header{}
@@ -107,7 +136,7 @@ func TestPacketRetry(t *testing.T) {
 	odcid := randomBytes(MaxCIDLength)
 	token := randomBytes(100)
 
-	n, err := Retry(b, dcid, scid, odcid, token)
+	n, err := Retry(b, dcid, scid, odcid, token, ProtocolVersion)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -158,6 +187,72 @@ func TestPacketRetry(t *testing.T) {
 	}
 }
 
+func TestPacketFixedBit(t *testing.T) {
+	b := make([]byte, 64)
+	p := packet{
+		typ: packetTypeShort,
+		header: packetHeader{
+			dcid: randomBytes(8),
+		},
+		payloadLen: minPayloadLength,
+	}
+	if _, err := p.encode(b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0]&0xc0 != 0x40 {
+		t.Fatalf("expect short header with fixed bit, actual 0x%x", b[0])
+	}
+	p.typ = packetTypeHandshake
+	p.header.version = ProtocolVersion
+	p.clearFixedBit = true
+	if _, err := p.encode(b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0]&0xc0 != 0x80 {
+		t.Fatalf("expect long header without fixed bit, actual 0x%x", b[0])
+	}
+	h := Header{}
+	if _, err := h.Decode(b, 0); err != nil || h.Type != "handshake" {
+		t.Fatalf("expect handshake packet, actual %s %v", h.Type, err)
+	}
+}
+
+func TestPacketStatelessReset(t *testing.T) {
+	token := StatelessResetToken([]byte("key"), []byte("cid"))
+	if len(token) != statelessResetTokenLen {
+		t.Fatalf("expect token length %d, actual %d", statelessResetTokenLen, len(token))
+	}
+	if !bytes.Equal(token, StatelessResetToken([]byte("key"), []byte("cid"))) {
+		t.Fatalf("expect same token for same key and cid")
+	}
+	if bytes.Equal(token, StatelessResetToken([]byte("key"), []byte("cid2"))) ||
+		bytes.Equal(token, StatelessResetToken([]byte("key2"), []byte("cid"))) {
+		t.Fatalf("expect different token for different key or cid")
+	}
+	_, err := StatelessReset(make([]byte, MinStatelessResetLength-1), token)
+	if err != errShortBuffer {
+		t.Fatalf("expect error %v, actual %v", errShortBuffer, err)
+	}
+	b := make([]byte, 50)
+	n, err := StatelessReset(b, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) {
+		t.Fatalf("expect length %d, actual %d", len(b), n)
+	}
+	if b[0]&0xc0 != 0x40 {
+		t.Fatalf("expect short header with fixed bit, actual 0x%x", b[0])
+	}
+	tokens := []connectionID{{resetToken: token}}
+	if !isStatelessReset(b, tokens) {
+		t.Fatalf("expect stateless reset: %x", b)
+	}
+	if isStatelessReset(b[:n-1], tokens) || isStatelessReset(b[n-MinStatelessResetLength+1:], tokens) {
+		t.Fatalf("expect not stateless reset: %x", b)
+	}
+}
+
 func randomBytes(maxLength int) []byte {
 	n := rand.Intn(maxLength + 1)
 	b := make([]byte, n)
@@ -0,0 +1,214 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	pathChallengeLen = 8
+	// maxPathChallenges limits the number of outstanding PATH_CHALLENGE data.
+	maxPathChallenges = 4
+	// amplificationFactor limits data sent to an unvalidated address.
+	amplificationFactor = 3
+)
+
+// Path is a network path identified by local and peer addresses.
+// Zero Path refers to the path currently in use.
+type Path struct {
+	Local net.Addr
+	Peer  net.Addr
+}
+
+func (s Path) isZero() bool {
+	return s.Local == nil && s.Peer == nil
+}
+
+func (s Path) equal(p Path) bool {
+	return addrEqual(s.Local, p.Local) && addrEqual(s.Peer, p.Peer)
+}
+
+func (s Path) String() string {
+	return fmt.Sprintf("local=%v peer=%v", s.Local, s.Peer)
+}
+
+func addrEqual(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+// addrSameHost returns true when only port numbers of the addresses are different.
+func addrSameHost(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ua, ok := a.(*net.UDPAddr)
+	if !ok {
+		return addrEqual(a, b)
+	}
+	ub, ok := b.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	return ua.IP.Equal(ub.IP)
+}
+
+// networkPath keeps track of validation and anti-amplification state of a path.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-path-validation
+type networkPath struct {
+	addr Path
+	// dcid is the destination connection ID reserved for this path when probing.
+	// Connection ID of the connection is used when it is nil.
+	dcid    []byte
+	dcidSeq uint64
+
+	validated  bool
+	validating bool
+	// limited is true when anti-amplification limit applies until peer address is validated.
+	limited bool
+	// validationTimer is the time path validation is abandoned.
+	validationTimer time.Time
+	// challenge is the PATH_CHALLENGE data to be sent.
+	challenge []byte
+	// challenges contains data of all PATH_CHALLENGE frames sent on this path.
+	challenges [][]byte
+	// response is the PATH_CHALLENGE data received on this path to be echoed.
+	response []byte
+
+	// Bytes received from and sent to this path for the anti-amplification limit.
+	recvBytes uint64
+	sentBytes uint64
+}
+
+func newNetworkPath(addr Path, validated bool) *networkPath {
+	return &networkPath{
+		addr:      addr,
+		validated: validated,
+	}
+}
+
+// startValidation sends PATH_CHALLENGE with given data and waits for the response until deadline.
+func (s *networkPath) startValidation(data []byte, deadline time.Time) {
+	s.validated = false
+	s.validating = true
+	s.validationTimer = deadline
+	s.challenge = data
+	s.challenges = s.challenges[:0]
+}
+
+// onChallengeSent records data of a sent PATH_CHALLENGE frame.
+func (s *networkPath) onChallengeSent() {
+	if len(s.challenges) >= maxPathChallenges {
+		copy(s.challenges, s.challenges[1:])
+		s.challenges = s.challenges[:len(s.challenges)-1]
+	}
+	s.challenges = append(s.challenges, s.challenge)
+	s.challenge = nil
+}
+
+// hasChallenge returns true if data was sent in a PATH_CHALLENGE frame on this path.
+func (s *networkPath) hasChallenge(data []byte) bool {
+	for _, c := range s.challenges {
+		if bytes.Equal(c, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// onValidated is called when a PATH_RESPONSE frame matches the challenge.
+func (s *networkPath) onValidated() {
+	s.validated = true
+	s.validating = false
+	s.validationTimer = time.Time{}
+	s.challenge = nil
+	s.challenges = nil
+}
+
+// isValidationExpired returns true if path validation has not succeeded before its deadline.
+func (s *networkPath) isValidationExpired(now time.Time) bool {
+	return s.validating && !now.Before(s.validationTimer)
+}
+
+// needSend returns true when there are path validation frames to send.
+func (s *networkPath) needSend() bool {
+	return s.challenge != nil || s.response != nil
+}
+
+// sendLimit returns maximum bytes can be sent, bounded by n, to an unvalidated path.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-address-validation
+func (s *networkPath) sendLimit(n int) int {
+	if s.validated || !s.limited {
+		return n
+	}
+	limit := s.recvBytes * amplificationFactor
+	if limit <= s.sentBytes {
+		return 0
+	}
+	if limit-s.sentBytes < uint64(n) {
+		return int(limit - s.sentBytes)
+	}
+	return n
+}
+
+// isAmplificationLimited returns true when nothing can be sent to the unvalidated path
+// until more data is received from it.
+func (s *networkPath) isAmplificationLimited() bool {
+	return s.sendLimit(1) == 0
+}
+
+func (s *networkPath) String() string {
+	return fmt.Sprintf("%v validated=%v recv=%d sent=%d", s.addr, s.validated, s.recvBytes, s.sentBytes)
+}
+
+// pathManager keeps the active path and other paths known to the connection.
+type pathManager struct {
+	// active is the path currently used for sending.
+	active *networkPath
+	// previous is the last validated path when migrating to an unvalidated one.
+	previous *networkPath
+	// probe is a non-active path which path validation frames are sent on.
+	probe *networkPath
+	// recv is the path of the datagram being processed.
+	recv *networkPath
+}
+
+func (s *pathManager) init() {
+	s.active = newNetworkPath(Path{}, true)
+}
+
+// get returns the known path matching addr or nil.
+// Zero address or the first address given is treated as the active path.
+func (s *pathManager) get(addr Path) *networkPath {
+	if addr.isZero() {
+		return s.active
+	}
+	for _, p := range [...]*networkPath{s.active, s.probe, s.previous} {
+		if p != nil && p.addr.equal(addr) {
+			return p
+		}
+	}
+	if s.active.addr.isZero() {
+		s.active.addr = addr
+		return s.active
+	}
+	return nil
+}
+
+// findChallenge returns the path that a PATH_CHALLENGE with given data was sent on.
+func (s *pathManager) findChallenge(data []byte) *networkPath {
+	for _, p := range [...]*networkPath{s.active, s.probe} {
+		if p != nil && p.hasChallenge(data) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *pathManager) String() string {
+	return fmt.Sprintf("active={%v} probe={%v}", s.active, s.probe)
+}
@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPathSendLimit(t *testing.T) {
+	p := newNetworkPath(Path{}, false)
+	p.limited = true
+	if n := p.sendLimit(100); n != 0 {
+		t.Fatalf("expect send limit %d, actual %d", 0, n)
+	}
+	p.recvBytes = 50
+	p.sentBytes = 20
+	if n := p.sendLimit(200); n != 130 {
+		t.Fatalf("expect send limit %d, actual %d", 130, n)
+	}
+	if n := p.sendLimit(100); n != 100 {
+		t.Fatalf("expect send limit %d, actual %d", 100, n)
+	}
+	p.onValidated()
+	if n := p.sendLimit(1000); n != 1000 {
+		t.Fatalf("expect send limit %d, actual %d", 1000, n)
+	}
+}
+
+func TestPathValidation(t *testing.T) {
+	p := newNetworkPath(Path{}, true)
+	now := time.Now()
+	p.startValidation([]byte{1, 2, 3, 4, 5, 6, 7, 8}, now.Add(time.Second))
+	if p.validated || !p.needSend() {
+		t.Fatalf("expect path validating, actual %v", p)
+	}
+	p.onChallengeSent()
+	if p.needSend() || !p.hasChallenge([]byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("expect challenge sent, actual %v %x", p, p.challenges)
+	}
+	if p.isValidationExpired(now) || !p.isValidationExpired(now.Add(time.Second)) {
+		t.Fatalf("expect validation expired at %v, actual %v", now.Add(time.Second), p.validationTimer)
+	}
+}
+
+func TestPathManager(t *testing.T) {
+	var m pathManager
+	m.init()
+	addr1 := Path{Peer: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}}
+	addr2 := Path{Peer: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}}
+	if p := m.get(addr1); p != m.active || !p.addr.equal(addr1) {
+		t.Fatalf("expect active path %v, actual %v", addr1, p)
+	}
+	if p := m.get(Path{}); p != m.active {
+		t.Fatalf("expect active path, actual %v", p)
+	}
+	if p := m.get(addr2); p != nil {
+		t.Fatalf("expect no path, actual %v", p)
+	}
+	if !addrSameHost(addr1.Peer, addr2.Peer) {
+		t.Fatalf("expect same host %v %v", addr1.Peer, addr2.Peer)
+	}
+}
@@ -0,0 +1,198 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// pmtuBase is the size which all paths are assumed to support (BASE_PLPMTU).
+	pmtuBase = MinInitialPacketSize
+	// pmtuMaxProbes is the number of lost probes of the same size before the size is
+	// considered not supported by the path.
+	pmtuMaxProbes = 3
+	// pmtuSearchGranularity stops searching when the range is smaller than this size.
+	pmtuSearchGranularity = 20
+	// pmtuRaiseTimeout is the period to search for a larger PMTU again after the search completed.
+	pmtuRaiseTimeout = 600 * time.Second
+	// pmtuBlackHoleThreshold is the number of consecutive lost packets larger than pmtuBase
+	// to consider the current PMTU is no longer supported.
+	pmtuBlackHoleThreshold = 3
+)
+
+type pmtuState uint8
+
+const (
+	pmtuDisabled pmtuState = iota
+	pmtuSearching
+	pmtuSearchComplete
+)
+
+func (s pmtuState) String() string {
+	switch s {
+	case pmtuDisabled:
+		return "disabled"
+	case pmtuSearching:
+		return "searching"
+	case pmtuSearchComplete:
+		return "search_complete"
+	default:
+		return fmt.Sprintf("pmtu_state_%d", uint8(s))
+	}
+}
+
+// pmtuDiscovery searches for the largest datagram size supported by the path by
+// sending probe packets padded to the candidate size. Loss of probes does not
+// indicate congestion.
+// https://www.rfc-editor.org/rfc/rfc8899.html
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-datagram-packetization-laye
+type pmtuDiscovery struct {
+	state pmtuState
+	// current is the validated maximum datagram size (PLPMTU).
+	current int
+	// maxSize is the upper limit of the search, e.g. peer max_udp_payload_size.
+	maxSize int
+	// Search range: low has been validated and high is the largest size not known to fail.
+	low  int
+	high int
+	// candidate is the size being probed, zero if a new size needs to be chosen.
+	candidate  int
+	probeCount int
+	// probing is true when a probe packet is in flight.
+	probing    bool
+	raiseTimer time.Time
+	// blackHoleLost is the number of consecutive lost packets larger than pmtuBase.
+	blackHoleLost int
+}
+
+func (s *pmtuDiscovery) init() {
+	*s = pmtuDiscovery{
+		current: pmtuBase,
+	}
+}
+
+// start begins searching up to maxSize.
+func (s *pmtuDiscovery) start(maxSize int) {
+	s.maxSize = maxSize
+	s.restart()
+}
+
+// restart searches from pmtuBase, e.g. when the path has changed.
+func (s *pmtuDiscovery) restart() {
+	s.current = pmtuBase
+	s.blackHoleLost = 0
+	if s.maxSize == 0 {
+		s.state = pmtuDisabled
+		return
+	}
+	s.search(s.maxSize)
+}
+
+// search starts probing sizes in (current, high], the largest one first as it is
+// usually supported, then binary searching.
+func (s *pmtuDiscovery) search(high int) {
+	s.state = pmtuSearching
+	s.low = s.current
+	s.high = high
+	s.candidate = high
+	s.probeCount = 0
+	s.probing = false
+	s.checkComplete()
+}
+
+func (s *pmtuDiscovery) checkComplete() {
+	if s.high-s.low < pmtuSearchGranularity {
+		s.state = pmtuSearchComplete
+		s.candidate = 0
+		// Raise timer is started in nextProbe.
+		s.raiseTimer = time.Time{}
+	}
+}
+
+// nextProbe returns the size of the probe packet to be sent or zero if no probe is needed.
+// limit is the size of the buffer to send the probe which is limited by the local MTU.
+func (s *pmtuDiscovery) nextProbe(limit int, now time.Time) int {
+	if s.state == pmtuSearchComplete && s.current < s.maxSize {
+		if s.raiseTimer.IsZero() {
+			s.raiseTimer = now.Add(pmtuRaiseTimeout)
+		} else if !now.Before(s.raiseTimer) {
+			// Path may support a larger size now.
+			s.search(s.maxSize)
+		}
+	}
+	if s.state != pmtuSearching || s.probing {
+		return 0
+	}
+	if s.high > limit {
+		s.high = limit
+		s.checkComplete()
+		if s.state != pmtuSearching {
+			return 0
+		}
+	}
+	if s.candidate > s.high {
+		s.candidate = s.high
+		s.probeCount = 0
+	} else if s.candidate == 0 {
+		s.candidate = (s.low + s.high + 1) / 2
+		s.probeCount = 0
+	}
+	return s.candidate
+}
+
+func (s *pmtuDiscovery) onProbeSent() {
+	s.probing = true
+}
+
+// onProbeAcked returns true when PLPMTU has increased.
+func (s *pmtuDiscovery) onProbeAcked(size int) bool {
+	s.probing = false
+	if s.state != pmtuSearching || size != s.candidate {
+		return false
+	}
+	s.current = size
+	s.low = size
+	s.candidate = 0
+	s.checkComplete()
+	return true
+}
+
+func (s *pmtuDiscovery) onProbeLost(size int) {
+	s.probing = false
+	if s.state != pmtuSearching || size != s.candidate {
+		return
+	}
+	s.probeCount++
+	if s.probeCount >= pmtuMaxProbes {
+		s.high = size - 1
+		s.candidate = 0
+		s.checkComplete()
+	}
+}
+
+func (s *pmtuDiscovery) onPacketAcked(size int) {
+	if size > pmtuBase {
+		s.blackHoleLost = 0
+	}
+}
+
+// onPacketLost returns true when a black hole is detected and PLPMTU is reset to pmtuBase.
+func (s *pmtuDiscovery) onPacketLost(size int) bool {
+	if size <= pmtuBase || s.current <= pmtuBase {
+		return false
+	}
+	s.blackHoleLost++
+	if s.blackHoleLost < pmtuBlackHoleThreshold {
+		return false
+	}
+	// Search again below the size which is no longer working.
+	high := s.current - 1
+	s.current = pmtuBase
+	s.blackHoleLost = 0
+	s.search(high)
+	return true
+}
+
+func (s *pmtuDiscovery) String() string {
+	return fmt.Sprintf("state=%v current=%d search=[%d,%d]", s.state, s.current, s.low, s.high)
+}
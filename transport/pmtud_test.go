@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPMTUDiscovery(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var s pmtuDiscovery
+	s.init()
+	if s.nextProbe(1500, now) != 0 || s.current != pmtuBase {
+		t.Fatalf("expect no probe before started: %v", &s)
+	}
+	s.start(1500)
+	// Largest size is limited by the local buffer and probed first.
+	size := s.nextProbe(1400, now)
+	if size != 1400 {
+		t.Fatalf("expect probe size %v, actual %v", 1400, size)
+	}
+	s.onProbeSent()
+	if s.nextProbe(1400, now) != 0 {
+		t.Fatalf("expect only one probe in flight: %v", &s)
+	}
+	for i := 0; i < pmtuMaxProbes; i++ {
+		if i > 0 {
+			if s.nextProbe(1400, now) != size {
+				t.Fatalf("expect probe size %v retried: %v", size, &s)
+			}
+			s.onProbeSent()
+		}
+		s.onProbeLost(size)
+	}
+	// Binary search after the largest size failed.
+	size = s.nextProbe(1400, now)
+	if size != (pmtuBase+1399+1)/2 {
+		t.Fatalf("expect probe size %v, actual %v", (pmtuBase+1399+1)/2, size)
+	}
+	s.onProbeSent()
+	if !s.onProbeAcked(size) || s.current != size {
+		t.Fatalf("expect current size %v: %v", size, &s)
+	}
+	for s.state == pmtuSearching {
+		size = s.nextProbe(1400, now)
+		s.onProbeSent()
+		s.onProbeAcked(size)
+	}
+	if s.current < 1399-pmtuSearchGranularity || s.current > 1399 {
+		t.Fatalf("expect search complete: %v", &s)
+	}
+	// Search again after raise timer.
+	if s.nextProbe(1500, now) != 0 {
+		t.Fatalf("expect no probe when search completed: %v", &s)
+	}
+	if s.nextProbe(1500, now.Add(pmtuRaiseTimeout)) != 1500 {
+		t.Fatalf("expect probe size %v: %v", 1500, &s)
+	}
+	s.onProbeSent()
+	s.onProbeAcked(1500)
+	if s.current != 1500 || s.state != pmtuSearchComplete {
+		t.Fatalf("expect current size %v: %v", 1500, &s)
+	}
+	// Black hole detection.
+	s.onPacketLost(1500)
+	s.onPacketAcked(1500)
+	for i := 0; i < pmtuBlackHoleThreshold-1; i++ {
+		if s.onPacketLost(1500) {
+			t.Fatalf("unexpected black hole: %v", &s)
+		}
+	}
+	if !s.onPacketLost(1500) || s.current != pmtuBase || s.state != pmtuSearching || s.high != 1499 {
+		t.Fatalf("expect black hole detected: %v", &s)
+	}
+	s.restart()
+	if s.current != pmtuBase || s.high != 1500 {
+		t.Fatalf("expect search restarted: %v", &s)
+	}
+}
@@ -38,6 +38,27 @@ func (s rangeSet) contains(n uint64) bool {
 	return false
 }
 
+// overlaps returns true if any number in [start, end] is in the set.
+func (s rangeSet) overlaps(start, end uint64) bool {
+	if end < start {
+		return false
+	}
+	left := 0
+	right := len(s)
+	for left < right {
+		mid := left + (right-left)/2
+		r := s[mid]
+		if end < r.start {
+			right = mid
+		} else if start <= r.end {
+			return true
+		} else {
+			left = mid + 1
+		}
+	}
+	return false
+}
+
 // equals returns true only when range is continuous from start to end.
 func (s rangeSet) equals(start, end uint64) bool {
 	return len(s) == 1 && s[0].start == start && s[0].end == end
@@ -55,6 +55,30 @@ func TestRangeSetRemoveUntil(t *testing.T) {
 	}
 }
 
+func TestRangeSetOverlaps(t *testing.T) {
+	var ls rangeSet
+	ls.push(2, 4)
+	ls.push(8, 10)
+	data := []struct {
+		start, end uint64
+		overlaps   bool
+	}{
+		{0, 1, false},
+		{0, 2, true},
+		{4, 7, true},
+		{5, 7, false},
+		{5, 8, true},
+		{9, 9, true},
+		{11, 20, false},
+		{6, 5, false},
+	}
+	for _, d := range data {
+		if ls.overlaps(d.start, d.end) != d.overlaps {
+			t.Errorf("expect overlaps [%d,%d]: %v, actual: %v", d.start, d.end, d.overlaps, !d.overlaps)
+		}
+	}
+}
+
 func TestRangeSetRandom(t *testing.T) {
 	x := rangeSetTest{t: t}
 	n := rand.Intn(1000)
@@ -3,6 +3,7 @@ package transport
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -11,11 +12,16 @@ const (
 	granularity     = 1 * time.Millisecond
 	initialRTT      = 500 * time.Millisecond
 
-	initialWindowPackets = 10
-	maxDatagramSize      = 1452
+	// initialMaxDatagramSize is the maximum datagram size before the path MTU is discovered.
+	initialMaxDatagramSize = MinInitialPacketSize
 
-	initialWindow = initialWindowPackets * maxDatagramSize
-	minimumWindow = 2 * maxDatagramSize
+	// initialWindow is min(10 * max_datagram_size, max(14720, 2 * max_datagram_size)),
+	// which is 14720 for datagram sizes from 1472 to 7360 bytes. It is not computed from
+	// initialMaxDatagramSize so the window is not reduced because DPLPMTUD starts from
+	// the minimum datagram size.
+	// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-initial-and-minimum-congest
+	initialWindow = 14720
+	minimumWindow = 2 * initialMaxDatagramSize
 
 	persistentCongestionThreshold = 3
 
@@ -30,6 +36,16 @@ type outgoingPacket struct {
 
 	ackEliciting bool
 	inFlight     bool
+	ecn          bool // Whether the packet was sent with ECT(0) codepoint.
+	pmtuProbe    bool // Whether the packet is a PMTU probe, which loss is not a congestion signal.
+	// Whether frames have been queued for retransmission in a probe packet.
+	retransmitted bool
+
+	// Connection delivery state when the packet was sent, for delivery rate estimation.
+	delivered     uint64
+	deliveredTime time.Time
+	firstSentTime time.Time
+	appLimited    bool
 }
 
 func newOutgoingPacket(pn uint64, tm time.Time) *outgoingPacket {
@@ -70,6 +86,10 @@ type lossRecovery struct {
 	lossDetectionTimer time.Time // Multi-modal timer used for loss detection.
 
 	timeLastSentAckElicitingPacket time.Time // The time the most recent ack-eliciting packet was sent.
+	// timeLastAckEliciting is the time the most recent ack-eliciting packet was sent in each space.
+	timeLastAckEliciting [packetSpaceCount]time.Time
+	// ackElicitingInFlight is the number of ack-eliciting packets in flight in each space.
+	ackElicitingInFlight [packetSpaceCount]int
 
 	largestAckedPacket [packetSpaceCount]uint64 // The largest packet number acknowledged in the packet number space so far.
 
@@ -77,6 +97,8 @@ type lossRecovery struct {
 	smoothedRTT time.Duration // The smoothed RTT of the connection.
 	rttVariance time.Duration // The RTT variance.
 	minRTT      time.Duration // The minimum RTT seen in the connection, ignoring ack delay.
+	// firstRTTSample is the time the first RTT sample was obtained.
+	firstRTTSample time.Time
 	// maxAckDelay is The maximum amount of time by which the receiver intends
 	// to delay acknowledgments for packets in the ApplicationData packet number space.
 	// The actual ack_delay in a received ACK frame may be larger due to late timers,
@@ -90,15 +112,46 @@ type lossRecovery struct {
 	sent  [packetSpaceCount]map[uint64]*outgoingPacket
 	lost  [packetSpaceCount][]frame
 	acked [packetSpaceCount][]frame
-
-	lostCount          uint64
-	bytesInFlight      uint64
-	congestionWindow   uint64
-	recoveryStartTime  time.Time
-	slowStartThreshold uint64
+	// ackedPackets are packet numbers acknowledged, which end persistent congestion periods.
+	ackedPackets [packetSpaceCount]rangeSet
+
+	lostCount     uint64
+	bytesInFlight uint64
+	// cc is the congestion controller, NewReno by default.
+	cc    CongestionController
+	pacer pacer
+	ecn   ecnValidator
+	pmtud pmtuDiscovery
+
+	// Delivery rate estimation.
+	// https://datatracker.ietf.org/doc/html/draft-cheng-iccrg-delivery-rate-estimation
+	delivered     uint64    // Total data acknowledged.
+	deliveredTime time.Time // The time delivered was last updated.
+	firstSentTime time.Time // The send time of the packet that was most recently marked as delivered.
+	// appLimited is the delivered mark when the application-limited period ends,
+	// or zero if the connection is not application-limited.
+	appLimited uint64
+	// rs is the rate sample being generated while processing an ACK frame.
+	rs            RateSample
+	rsPriorTime   time.Time
+	rsSendElapsed time.Duration
+	rsAckElapsed  time.Duration
 
 	ptoCount uint // The number of times a PTO has been sent without receiving an ack.
-	probes   int
+	// probes is the number of ack-eliciting packets to be sent in probeSpace when PTO expires.
+	probes     int
+	probeSpace packetSpace
+
+	// amplificationLimited is true when server can not send more data to the unvalidated
+	// client address, so loss detection timer is not armed.
+	amplificationLimited bool
+	// peerCompletedAddressValidation is false when client does not know whether server has
+	// validated its address, so it keeps the timer armed to avoid a deadlock.
+	// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-handling-anti-amplificatio
+	peerCompletedAddressValidation bool
+	// Handshake states provided by the connection for selecting probe space.
+	hasHandshakeKeys   bool
+	handshakeConfirmed bool
 }
 
 func (s *lossRecovery) init(now time.Time) {
@@ -108,53 +161,111 @@ func (s *lossRecovery) init(now time.Time) {
 		s.sent[i] = make(map[uint64]*outgoingPacket)
 	}
 	s.maxAckDelay = 25 * time.Millisecond
-	s.congestionWindow = initialWindow
-	s.slowStartThreshold = maxUint64
+	if s.cc == nil {
+		s.cc = NewReno()
+	}
+	s.pmtud.init()
 }
 
 // After a packet is sent, information about the packet is stored.
 // https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-on-sending-a-packet
 func (s *lossRecovery) onPacketSent(p *outgoingPacket, space packetSpace) {
 	s.sent[space][p.packetNumber] = p
+	s.ecn.onPacketSent(p)
+	if p.pmtuProbe {
+		s.pmtud.onProbeSent()
+	}
 	if p.inFlight {
+		if s.bytesInFlight == 0 {
+			s.firstSentTime = p.timeSent
+			s.deliveredTime = p.timeSent
+		}
+		p.delivered = s.delivered
+		p.deliveredTime = s.deliveredTime
+		p.firstSentTime = s.firstSentTime
+		p.appLimited = s.appLimited != 0
 		if p.ackEliciting {
 			s.timeLastSentAckElicitingPacket = p.timeSent
+			s.timeLastAckEliciting[space] = p.timeSent
+			s.ackElicitingInFlight[space]++
 		}
 		s.bytesInFlight += p.size
-		s.setLossDetectionTimer()
+		s.cc.OnPacketSent(p.size, p.timeSent)
+		s.pacer.onPacketSent(p.size, s.pacingRate(), p.timeSent)
+		s.setLossDetectionTimer(p.timeSent)
 	}
 }
 
 // When an ACK frame is received, it may newly acknowledge any number of packets.
+// ecn is the ECN counts in the frame or nil if it is not an ACK_ECN frame.
 // https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-on-receiving-an-acknowledgm
-func (s *lossRecovery) onAckReceived(ranges rangeSet, ackDelay time.Duration, space packetSpace, now time.Time) {
+func (s *lossRecovery) onAckReceived(ranges rangeSet, ackDelay time.Duration, ecn *ecnCounts, space packetSpace, now time.Time) {
 	largestAcked := ranges.largest()
+	largestAdvanced := false
 	if s.largestAckedPacket[space] == maxUint64 || s.largestAckedPacket[space] < largestAcked {
 		s.largestAckedPacket[space] = largestAcked
+		largestAdvanced = true
 	} else {
 		largestAcked = s.largestAckedPacket[space]
 	}
+	var largestSentTime time.Time
 	if p, ok := s.sent[space][largestAcked]; ok {
+		largestSentTime = p.timeSent
 		if p.ackEliciting {
 			latestRTT := now.Sub(p.timeSent)
 			if space != packetSpaceApplication {
 				ackDelay = 0
 			}
+			if s.firstRTTSample.IsZero() {
+				s.firstRTTSample = now
+			}
 			s.updateRTT(latestRTT, ackDelay)
 		}
 	}
+	s.rs = RateSample{}
+	s.rsPriorTime = time.Time{}
 	hasNewlyAcked := false
 	for _, r := range ranges {
 		for pn := r.start; pn <= r.end; pn++ {
-			if s.onPacketAcked(pn, space) {
+			if s.onPacketAcked(pn, space, now) {
 				hasNewlyAcked = true
 			}
 		}
 	}
+	if largestAdvanced {
+		s.onECNCounts(ecn, space, largestSentTime, now)
+	} else {
+		s.ecn.newlyAcked = 0
+	}
 	if hasNewlyAcked {
 		s.detectLostPackets(space, now)
-		s.ptoCount = 0
-		s.setLossDetectionTimer()
+		s.generateRateSample(now)
+		// Client does not reset PTO backoff until it is sure that server has validated its address.
+		if s.peerCompletedAddressValidation {
+			s.ptoCount = 0
+		}
+		s.setLossDetectionTimer(now)
+	}
+}
+
+// onECNCounts validates ECN counts reported by peer. An increase in ECN-CE count
+// is a signal of congestion, using the send time of the largest acknowledged packet.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-on-receiving-an-acknowledgm
+func (s *lossRecovery) onECNCounts(ecn *ecnCounts, space packetSpace, sentTime time.Time, now time.Time) {
+	state := s.ecn.state
+	ce := s.ecn.onAckReceived(ecn, space)
+	if s.ecn.state != state {
+		debug("ecn validation %v space=%v", s.ecn.state, space)
+	}
+	if ce > 0 && !sentTime.IsZero() {
+		debug("ecn congestion experienced space=%v ce=%d", space, ce)
+		if cc, ok := s.cc.(interface {
+			onCongestionExperienced(sentTime time.Time, now time.Time)
+		}); ok {
+			cc.onCongestionExperienced(sentTime, now)
+		} else {
+			s.cc.OnCongestionEvent(sentTime, now)
+		}
 	}
 }
 
@@ -198,50 +309,112 @@ func (s *lossRecovery) updateRTT(latestRTT time.Duration, ackDelay time.Duration
 // https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-on-packet-acknowledgment
 //
 // onPacketAcked removes frames from s.sent.
-func (s *lossRecovery) onPacketAcked(packetNumber uint64, space packetSpace) bool {
+func (s *lossRecovery) onPacketAcked(packetNumber uint64, space packetSpace, now time.Time) bool {
 	p, ok := s.sent[space][packetNumber]
 	if !ok {
 		return false
 	}
 	delete(s.sent[space], packetNumber)
 	s.acked[space] = append(s.acked[space], p.frames...)
+	s.ackedPackets[space].push(packetNumber, packetNumber)
+	if p.ecn {
+		s.ecn.newlyAcked++
+	}
 	if p.inFlight {
 		s.bytesInFlight -= p.size
-		if s.inRecovery(p.timeSent) {
-			return true
+		if p.ackEliciting {
+			s.ackElicitingInFlight[space]--
 		}
-		if s.congestionWindow < s.slowStartThreshold {
-			// Slow start.
-			s.congestionWindow += p.size
-		} else {
-			// Congestion avoidance.
-			s.congestionWindow += (maxDatagramSize * p.size) / s.congestionWindow
+		s.delivered += p.size
+		s.deliveredTime = now
+		s.updateRateSample(p, now)
+		s.cc.OnAck(p.size, p.timeSent, s.roundTripTime(), now)
+	}
+	if p.pmtuProbe {
+		if s.pmtud.onProbeAcked(int(p.size)) {
+			debug("pmtu increased %v", &s.pmtud)
+			s.cc.SetMaxDatagramSize(uint64(s.pmtud.current))
 		}
+	} else {
+		s.pmtud.onPacketAcked(int(p.size))
 	}
 	return true
 }
 
 // https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-setting-the-loss-detection-
-func (s *lossRecovery) setLossDetectionTimer() {
+func (s *lossRecovery) setLossDetectionTimer(now time.Time) {
 	lossTime, _ := s.earliestLossTime()
 	if !lossTime.IsZero() {
 		// Time threshold loss detection.
 		s.lossDetectionTimer = lossTime
 		return
 	}
-	if s.bytesInFlight == 0 {
+	if s.amplificationLimited {
+		// Server's timer is not set if nothing can be sent.
+		s.lossDetectionTimer = time.Time{}
+		return
+	}
+	if !s.hasAckElicitingInFlight() && s.peerCompletedAddressValidation {
 		s.lossDetectionTimer = time.Time{}
 		return
 	}
-	// PTO timer
-	var timeout time.Duration
+	s.lossDetectionTimer, _ = s.ptoTimeAndSpace(now)
+}
+
+// ptoTimeAndSpace returns the time when PTO expires and the packet number space
+// which probe packets are sent in.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-setting-the-loss-detection-
+func (s *lossRecovery) ptoTimeAndSpace(now time.Time) (time.Time, packetSpace) {
+	var duration time.Duration
 	if s.smoothedRTT > 0 {
-		// When a PTO timer expires, the PTO period MUST be set to twice its current value.
-		timeout = s.probeTimeout() * (1 << s.ptoCount)
+		duration = s.smoothedRTT
+		if s.rttVariance*4 > granularity {
+			duration += s.rttVariance * 4
+		} else {
+			duration += granularity
+		}
 	} else {
-		timeout = initialRTT * 2
+		duration = initialRTT * 2
+	}
+	// When a PTO timer expires, the PTO period MUST be set to twice its current value.
+	duration *= 1 << s.ptoCount
+	if !s.hasAckElicitingInFlight() {
+		// Anti-deadlock PTO starts from the current time.
+		if s.hasHandshakeKeys {
+			return now.Add(duration), packetSpaceHandshake
+		}
+		return now.Add(duration), packetSpaceInitial
 	}
-	s.lossDetectionTimer = s.timeLastSentAckElicitingPacket.Add(timeout)
+	var ptoTime time.Time
+	ptoSpace := packetSpaceInitial
+	for space := packetSpaceInitial; space < packetSpaceCount; space++ {
+		if s.ackElicitingInFlight[space] == 0 {
+			continue
+		}
+		if space == packetSpaceApplication {
+			// Skip Application Data until handshake confirmed.
+			if !s.handshakeConfirmed {
+				break
+			}
+			// Include max_ack_delay and backoff for Application Data.
+			duration += s.maxAckDelay * (1 << s.ptoCount)
+		}
+		tm := s.timeLastAckEliciting[space].Add(duration)
+		if ptoTime.IsZero() || tm.Before(ptoTime) {
+			ptoTime = tm
+			ptoSpace = space
+		}
+	}
+	return ptoTime, ptoSpace
+}
+
+func (s *lossRecovery) hasAckElicitingInFlight() bool {
+	for _, n := range s.ackElicitingInFlight {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // onLossDetectionTimeout checks lossDetectionTimer to detect whether a packet was lost.
@@ -253,32 +426,44 @@ func (s *lossRecovery) onLossDetectionTimeout(now time.Time) {
 	lossTime, space := s.earliestLossTime()
 	if !lossTime.IsZero() {
 		s.detectLostPackets(space, now)
-		s.setLossDetectionTimer()
+		s.setLossDetectionTimer(now)
 		return
 	}
-	// TODO:
-	//   if (endpoint is client without 1-RTT keys):
-	//     // Client sends an anti-deadlock packet: Initial is padded
-	//     // to earn more anti-amplification credit,
-	//     // a Handshake packet proves address ownership.
-	//     if (has Handshake keys):
-	//       SendOneAckElicitingHandshakePacket()
-	//     else:
-	//       SendOneAckElicitingPaddedInitialPacket()
-	//   else:
-	//     // PTO. Send new data if available, else retransmit old data.
-	//     // If neither is available, send a single PING frame.
-	//     _, pn_space = GetEarliestTimeAndSpace(
-	//       time_of_last_sent_ack_eliciting_packet)
-	//     SendOneOrTwoAckElicitingPackets(pn_space)
-
-	// probeTimeout triggers sending one or two probe datagrams when ack-eliciting
-	// packets are not acknowledged within the expected period of time or the
-	// handshake has not been completed.
-	s.probes = 2
-
+	if !s.hasAckElicitingInFlight() {
+		// Client sends an anti-deadlock packet: Initial is padded to earn more
+		// anti-amplification credit, a Handshake packet proves address ownership.
+		_, s.probeSpace = s.ptoTimeAndSpace(now)
+		s.probes = 1
+	} else {
+		// PTO. Send new data if available, else retransmit old data.
+		// If neither is available, send a single PING frame.
+		_, s.probeSpace = s.ptoTimeAndSpace(now)
+		s.probes = 2
+		s.retransmitOldest(s.probeSpace)
+		if s.probeSpace == packetSpaceInitial {
+			// Handshake data is likely lost too, send it along with the Initial probe.
+			s.retransmitOldest(packetSpaceHandshake)
+		}
+	}
 	s.ptoCount++
-	s.setLossDetectionTimer()
+	s.setLossDetectionTimer(now)
+}
+
+// retransmitOldest queues frames of the oldest unacknowledged ack-eliciting packet,
+// which has not been retransmitted, in the space to be sent in probe packets.
+// The packet is still considered in flight but its frames are not queued again when lost.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-sending-probe-packets
+func (s *lossRecovery) retransmitOldest(space packetSpace) {
+	var oldest *outgoingPacket
+	for _, p := range s.sent[space] {
+		if p.ackEliciting && !p.retransmitted && (oldest == nil || p.packetNumber < oldest.packetNumber) {
+			oldest = p
+		}
+	}
+	if oldest != nil {
+		oldest.retransmitted = true
+		s.lost[space] = append(s.lost[space], oldest.frames...)
+	}
 }
 
 // detectLostPackets is called every time an ACK is received and operates on the sent_packets for that packet number space.
@@ -304,9 +489,6 @@ func (s *lossRecovery) detectLostPackets(space packetSpace, now time.Time) {
 		}
 		// Mark packet as lost, or set time when it should be marked.
 		if !unacked.timeSent.After(lostSendTime) || largestAcked >= unacked.packetNumber+packetThreshold {
-			if unacked.inFlight {
-				// TODO: packet lost
-			}
 			// Keep track of the packet number to remove later
 			lostPkt = append(lostPkt, unacked.packetNumber)
 		} else {
@@ -330,6 +512,7 @@ func (s *lossRecovery) dropUnackedData(space packetSpace) {
 		}
 	}
 	s.bytesInFlight -= unackedBytes
+	s.ackElicitingInFlight[space] = 0
 	// Remove saved frames
 	m := s.sent[space]
 	for i := range m {
@@ -337,6 +520,35 @@ func (s *lossRecovery) dropUnackedData(space packetSpace) {
 	}
 	s.lost[space] = nil
 	s.acked[space] = nil
+	s.lossTime[space] = time.Time{}
+	s.timeLastAckEliciting[space] = time.Time{}
+}
+
+// onSpaceDiscarded drops all data of the packet number space when its keys are discarded.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-discarding-keys-and-packet-
+func (s *lossRecovery) onSpaceDiscarded(space packetSpace, now time.Time) {
+	s.dropUnackedData(space)
+	s.ackedPackets[space] = nil
+	s.ptoCount = 0
+	s.setLossDetectionTimer(now)
+}
+
+// requeueUnackedData moves frames of all unacknowledged packets in the space to lost
+// frames so they are retransmitted, without signalling congestion.
+// It is used when 0-RTT data is rejected by server.
+func (s *lossRecovery) requeueUnackedData(space packetSpace) {
+	m := s.sent[space]
+	for pn, p := range m {
+		if p.inFlight {
+			s.bytesInFlight -= p.size
+			if !p.retransmitted {
+				s.lost[space] = append(s.lost[space], p.frames...)
+			}
+		}
+		delete(m, pn)
+	}
+	s.ackElicitingInFlight[space] = 0
+	s.lossTime[space] = time.Time{}
 }
 
 // roundTripTime retruns smoothed RTT when available.
@@ -379,50 +591,110 @@ func (s *lossRecovery) earliestLossTime() (time.Time, packetSpace) {
 	return lossTime, space
 }
 
-func (s *lossRecovery) inRecovery(sentTime time.Time) bool {
-	if s.recoveryStartTime.IsZero() {
+// inPersistentCongestion returns true when the lost packets, which are sorted by packet number,
+// contain two ack-eliciting packets sent after the first RTT sample, with no packets
+// sent between them acknowledged, spanning longer than the persistent congestion duration.
+// https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-persistent-congestion
+func (s *lossRecovery) inPersistentCongestion(lostPkt []*outgoingPacket, space packetSpace) bool {
+	if s.firstRTTSample.IsZero() {
 		return false
 	}
-	return s.recoveryStartTime.After(sentTime)
+	duration := s.probeTimeout() * persistentCongestionThreshold
+	var start *outgoingPacket
+	for _, p := range lostPkt {
+		if !p.ackEliciting || p.pmtuProbe || p.timeSent.Before(s.firstRTTSample) {
+			continue
+		}
+		if start == nil || s.ackedPackets[space].overlaps(start.packetNumber+1, p.packetNumber-1) {
+			// A packet in between was acknowledged.
+			start = p
+		} else if p.timeSent.Sub(start.timeSent) > duration {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *lossRecovery) inPersistentCongestion(largestLostPkt *outgoingPacket) bool {
-	// TODO
-	return false
+// pruneAckedPackets removes acknowledged packet numbers older than all packets in flight
+// as they are no longer needed for detecting persistent congestion.
+func (s *lossRecovery) pruneAckedPackets(space packetSpace) {
+	if len(s.ackedPackets[space]) == 0 {
+		return
+	}
+	smallest := uint64(maxUint64)
+	for pn := range s.sent[space] {
+		if pn < smallest {
+			smallest = pn
+		}
+	}
+	if smallest == maxUint64 {
+		s.ackedPackets[space] = nil
+	} else if smallest > 0 {
+		s.ackedPackets[space].removeUntil(smallest - 1)
+	}
 }
 
 // onPacketsLost moves frames from s.sent to s.lost.
 // https://quicwg.org/base-drafts/draft-ietf-quic-recovery.html#name-on-packets-lost
 func (s *lossRecovery) onPacketsLost(lostPkt []uint64, space packetSpace, now time.Time) {
+	sort.Slice(lostPkt, func(i, j int) bool { return lostPkt[i] < lostPkt[j] })
+	lost := make([]*outgoingPacket, 0, len(lostPkt))
 	var largestLostPkt *outgoingPacket
-	for _, lost := range lostPkt {
-		p, ok := s.sent[space][lost]
+	for _, pn := range lostPkt {
+		p, ok := s.sent[space][pn]
 		if !ok {
 			continue
 		}
-		delete(s.sent[space], lost)
+		delete(s.sent[space], pn)
+		lost = append(lost, p)
 		s.lostCount++
+		s.ecn.onPacketLost(p)
 		if !p.inFlight {
 			continue
 		}
 		s.bytesInFlight -= p.size
-		s.lost[space] = append(s.lost[space], p.frames...)
+		if p.ackEliciting {
+			s.ackElicitingInFlight[space]--
+		}
+		if p.pmtuProbe {
+			// Probe only contains PING and PADDING, its loss does not indicate congestion.
+			s.pmtud.onProbeLost(int(p.size))
+			continue
+		}
+		if s.pmtud.onPacketLost(int(p.size)) {
+			debug("pmtu black hole detected %v", &s.pmtud)
+			s.cc.SetMaxDatagramSize(uint64(s.pmtud.current))
+		}
+		if !p.retransmitted {
+			s.lost[space] = append(s.lost[space], p.frames...)
+		}
+		s.rs.Lost += p.size
 		largestLostPkt = p // last
 	}
 	if largestLostPkt != nil {
-		// CongestionEvent
-		if !s.inRecovery(largestLostPkt.timeSent) {
-			s.recoveryStartTime = now
-			s.congestionWindow /= 2
-			if s.congestionWindow < minimumWindow {
-				s.congestionWindow = minimumWindow
-			}
-			s.slowStartThreshold = s.congestionWindow
+		s.cc.OnCongestionEvent(largestLostPkt.timeSent, now)
+		if s.inPersistentCongestion(lost, space) {
+			debug("persistent congestion space=%v lost=%d", space, len(lost))
+			s.cc.OnPersistentCongestion(now)
 		}
-		if s.inPersistentCongestion(largestLostPkt) {
-			s.congestionWindow = minimumWindow
+	}
+	s.pruneAckedPackets(space)
+}
+
+// onPMTUProbeFailed declares the PMTU probe of the size lost when it could not be sent
+// because it exceeds the local MTU, so the next probe does not wait for loss detection.
+func (s *lossRecovery) onPMTUProbeFailed(size int, now time.Time) bool {
+	if !s.pmtud.probing {
+		return false
+	}
+	for pn, p := range s.sent[packetSpaceApplication] {
+		if p.pmtuProbe && int(p.size) == size {
+			s.onPacketsLost([]uint64{pn}, packetSpaceApplication, now)
+			s.setLossDetectionTimer(now)
+			return true
 		}
 	}
+	return false
 }
 
 func (s *lossRecovery) drainLost(space packetSpace, fn func(frame)) {
@@ -443,6 +715,106 @@ func (s *lossRecovery) drainAcked(space packetSpace, fn func(frame)) {
 	s.acked[space] = frames[:0]
 }
 
+// resetCongestion resets congestion controller and round-trip time estimator
+// to initial values when the path has changed.
+func (s *lossRecovery) resetCongestion() {
+	s.latestRTT = 0
+	s.smoothedRTT = 0
+	s.rttVariance = 0
+	s.minRTT = 0
+	s.firstRTTSample = time.Time{}
+	s.appLimited = 0
+	s.cc.Reset()
+	s.pacer.reset()
+	s.ecn.reset()
+	s.pmtud.restart()
+}
+
+// setAmplificationLimited updates anti-amplification state and rearms loss detection timer
+// when it has changed.
+func (s *lossRecovery) setAmplificationLimited(limited bool, now time.Time) {
+	if s.amplificationLimited != limited {
+		s.amplificationLimited = limited
+		s.setLossDetectionTimer(now)
+	}
+}
+
+// updateRateSample updates the rate sample with the packet being acknowledged.
+// The sample is based on the most recently sent packet.
+func (s *lossRecovery) updateRateSample(p *outgoingPacket, now time.Time) {
+	if !s.rsPriorTime.IsZero() && p.delivered < s.rs.PriorDelivered {
+		return
+	}
+	s.rs.PriorDelivered = p.delivered
+	s.rs.AppLimited = p.appLimited
+	s.rs.RTT = now.Sub(p.timeSent)
+	s.rsPriorTime = p.deliveredTime
+	s.rsSendElapsed = p.timeSent.Sub(p.firstSentTime)
+	s.rsAckElapsed = s.deliveredTime.Sub(p.deliveredTime)
+	s.firstSentTime = p.timeSent
+}
+
+// generateRateSample finishes the rate sample after all packets in an ACK frame
+// have been processed and passes it to the congestion controller.
+// https://datatracker.ietf.org/doc/html/draft-cheng-iccrg-delivery-rate-estimation#section-3.3
+func (s *lossRecovery) generateRateSample(now time.Time) {
+	if s.appLimited != 0 && s.delivered > s.appLimited {
+		s.appLimited = 0
+	}
+	if s.rsPriorTime.IsZero() {
+		// Only non in-flight packets were acknowledged.
+		return
+	}
+	s.rs.TotalDelivered = s.delivered
+	s.rs.Delivered = s.delivered - s.rs.PriorDelivered
+	s.rs.BytesInFlight = s.bytesInFlight
+	// Use the longer of the send and ACK phases to avoid overestimating the rate
+	// because of ACK compression.
+	s.rs.Interval = s.rsSendElapsed
+	if s.rs.Interval < s.rsAckElapsed {
+		s.rs.Interval = s.rsAckElapsed
+	}
+	// Intervals shorter than min RTT are not reliable.
+	if s.rs.Interval > 0 && s.rs.Interval >= s.minRTT {
+		s.rs.DeliveryRate = uint64(float64(s.rs.Delivered) / s.rs.Interval.Seconds())
+	}
+	s.cc.OnRateSample(&s.rs, now)
+}
+
+// onAppLimited marks the connection application-limited when there is no data
+// to send while congestion window is not fully utilized.
+// https://datatracker.ietf.org/doc/html/draft-cheng-iccrg-delivery-rate-estimation#section-3.4
+func (s *lossRecovery) onAppLimited() {
+	if !s.cc.CanSend(s.bytesInFlight) {
+		return
+	}
+	s.appLimited = s.delivered + s.bytesInFlight
+	if s.appLimited == 0 {
+		s.appLimited = 1
+	}
+}
+
+// canSend returns true when congestion window and pacer allow sending new data.
+func (s *lossRecovery) canSend(now time.Time) bool {
+	if s.probes > 0 {
+		return true
+	}
+	return s.cc.CanSend(s.bytesInFlight) && s.pacer.canSend(s.pacingRate(), now)
+}
+
+// pacingRate returns the pacing rate in bytes per second provided by the congestion
+// controller, or derived from congestion window and smoothed RTT.
+// Zero means there is no RTT sample to pace packets yet.
+func (s *lossRecovery) pacingRate() uint64 {
+	if cc, ok := s.cc.(interface{ PacingRate() uint64 }); ok {
+		return cc.PacingRate()
+	}
+	if s.smoothedRTT <= 0 {
+		return 0
+	}
+	return uint64(pacingGain * float64(s.cc.CongestionWindow()) / s.smoothedRTT.Seconds())
+}
+
 func (s *lossRecovery) String() string {
-	return fmt.Sprintf("lossTimer=%v bytes=%d probes=%d", s.lossDetectionTimer, s.bytesInFlight, s.probes)
+	return fmt.Sprintf("lossTimer=%v bytes=%d cwnd=%d probes=%d", s.lossDetectionTimer, s.bytesInFlight, s.cc.CongestionWindow(), s.probes)
 }
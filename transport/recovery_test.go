@@ -37,3 +37,324 @@ func TestRecoverySetTimer(t *testing.T) {
 		t.Fatalf("expect probes > 0, actual: %v", x.probes)
 	}
 }
+
+func TestRecoveryProbeSpace(t *testing.T) {
+	x := lossRecovery{}
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	x.init(now)
+	x.peerCompletedAddressValidation = true
+
+	initial := &outgoingPacket{
+		packetNumber: 0,
+		frames:       []frame{newCryptoFrame([]byte("initial"), 0)},
+		timeSent:     now,
+		size:         100,
+		ackEliciting: true,
+		inFlight:     true,
+	}
+	x.onPacketSent(initial, packetSpaceInitial)
+	now = now.Add(10 * time.Millisecond)
+	handshake := &outgoingPacket{
+		packetNumber: 0,
+		frames:       []frame{newCryptoFrame([]byte("handshake"), 0)},
+		timeSent:     now,
+		size:         100,
+		ackEliciting: true,
+		inFlight:     true,
+	}
+	x.onPacketSent(handshake, packetSpaceHandshake)
+	// Application data is not considered until handshake confirmed.
+	app := &outgoingPacket{
+		packetNumber: 0,
+		frames:       []frame{&pingFrame{}},
+		timeSent:     now.Add(-time.Second),
+		size:         100,
+		ackEliciting: true,
+		inFlight:     true,
+	}
+	x.onPacketSent(app, packetSpaceApplication)
+	ptoTime, space := x.ptoTimeAndSpace(now)
+	if space != packetSpaceInitial || ptoTime != initial.timeSent.Add(initialRTT*2) {
+		t.Fatalf("expect pto space initial at %v, actual: %v %v", initial.timeSent.Add(initialRTT*2), space, ptoTime)
+	}
+	x.onLossDetectionTimeout(ptoTime)
+	if x.probes != 2 || x.probeSpace != packetSpaceInitial || x.ptoCount != 1 {
+		t.Fatalf("expect 2 probes in initial space, actual: %v %v %v", x.probes, x.probeSpace, x.ptoCount)
+	}
+	// Unacked data is sent in probe packets.
+	if len(x.lost[packetSpaceInitial]) != 1 || len(x.lost[packetSpaceHandshake]) != 1 {
+		t.Fatalf("expect data retransmitted, actual: %v", x.lost)
+	}
+	if x.bytesInFlight != 300 {
+		t.Fatalf("expect bytesInFlight: %v, actual: %v", 300, x.bytesInFlight)
+	}
+	// Discarding initial keys resets PTO backoff.
+	x.onSpaceDiscarded(packetSpaceInitial, ptoTime)
+	if x.ptoCount != 0 || x.ackElicitingInFlight[packetSpaceInitial] != 0 {
+		t.Fatalf("expect initial space discarded, actual: %v %v", x.ptoCount, x.ackElicitingInFlight)
+	}
+	_, space = x.ptoTimeAndSpace(ptoTime)
+	if space != packetSpaceHandshake {
+		t.Fatalf("expect pto space handshake, actual: %v", space)
+	}
+	x.handshakeConfirmed = true
+	_, space = x.ptoTimeAndSpace(ptoTime)
+	if space != packetSpaceApplication {
+		t.Fatalf("expect pto space application, actual: %v", space)
+	}
+}
+
+func TestRecoveryRetransmitOldest(t *testing.T) {
+	x := lossRecovery{}
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	x.init(now)
+	x.peerCompletedAddressValidation = true
+	x.handshakeConfirmed = true
+	var frames [3]frame
+	for i := range frames {
+		frames[i] = &pingFrame{}
+		x.onPacketSent(&outgoingPacket{
+			packetNumber: uint64(i),
+			frames:       []frame{frames[i]},
+			timeSent:     now,
+			size:         100,
+			ackEliciting: true,
+			inFlight:     true,
+		}, packetSpaceApplication)
+	}
+	// Repeated probes retransmit different packets.
+	for i := 0; i < 2; i++ {
+		x.retransmitOldest(packetSpaceApplication)
+		lost := x.lost[packetSpaceApplication]
+		if len(lost) != 1 || lost[0] != frames[i] {
+			t.Fatalf("expect frames of packet %d retransmitted, actual: %v", i, lost)
+		}
+		x.lost[packetSpaceApplication] = nil
+	}
+	// Retransmitted frames are not queued again when the packets are lost.
+	x.onPacketsLost([]uint64{0, 1, 2}, packetSpaceApplication, now)
+	lost := x.lost[packetSpaceApplication]
+	if len(lost) != 1 || lost[0] != frames[2] {
+		t.Fatalf("expect only frames of packet 2 lost, actual: %v", lost)
+	}
+	if x.bytesInFlight != 0 || x.ackElicitingInFlight[packetSpaceApplication] != 0 {
+		t.Fatalf("expect no packets in flight, actual: %v %v", x.bytesInFlight, x.ackElicitingInFlight)
+	}
+}
+
+func TestRecoveryAntiDeadlock(t *testing.T) {
+	x := lossRecovery{}
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	x.init(now)
+	// Client has not known whether server validated its address.
+	x.setLossDetectionTimer(now)
+	if x.lossDetectionTimer != now.Add(initialRTT*2) {
+		t.Fatalf("expect lossDetectionTimer: %v, actual: %v", now.Add(initialRTT*2), x.lossDetectionTimer)
+	}
+	x.onLossDetectionTimeout(x.lossDetectionTimer)
+	if x.probes != 1 || x.probeSpace != packetSpaceInitial {
+		t.Fatalf("expect 1 probe in initial space, actual: %v %v", x.probes, x.probeSpace)
+	}
+	x.hasHandshakeKeys = true
+	now = x.lossDetectionTimer
+	x.onLossDetectionTimeout(now)
+	if x.probes != 1 || x.probeSpace != packetSpaceHandshake {
+		t.Fatalf("expect 1 probe in handshake space, actual: %v %v", x.probes, x.probeSpace)
+	}
+	// Backoff is doubled every time.
+	if x.lossDetectionTimer != now.Add(initialRTT*8) {
+		t.Fatalf("expect lossDetectionTimer: %v, actual: %v", now.Add(initialRTT*8), x.lossDetectionTimer)
+	}
+	// Timer is not armed when server has validated client address.
+	x.peerCompletedAddressValidation = true
+	x.setLossDetectionTimer(now)
+	if !x.lossDetectionTimer.IsZero() {
+		t.Fatalf("expect lossDetectionTimer disarmed, actual: %v", x.lossDetectionTimer)
+	}
+}
+
+func TestRecoveryPersistentCongestion(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	newRecovery := func(rttSample bool) *lossRecovery {
+		x := &lossRecovery{}
+		x.init(now)
+		x.peerCompletedAddressValidation = true
+		x.handshakeConfirmed = true
+		x.onPacketSent(&outgoingPacket{
+			packetNumber: 0,
+			frames:       []frame{&pingFrame{}},
+			timeSent:     now,
+			size:         100,
+			ackEliciting: true,
+			inFlight:     true,
+		}, packetSpaceApplication)
+		if rttSample {
+			var ranges rangeSet
+			ranges.push(0, 0)
+			x.onAckReceived(ranges, 0, nil, packetSpaceApplication, now.Add(100*time.Millisecond))
+		}
+		// Persistent congestion duration is (100 + 4*50 + 25) * 3 = 975ms.
+		for i := 1; i <= 6; i++ {
+			x.onPacketSent(&outgoingPacket{
+				packetNumber: uint64(i),
+				frames:       []frame{&pingFrame{}},
+				timeSent:     now.Add(time.Duration(i) * 300 * time.Millisecond),
+				size:         100,
+				ackEliciting: true,
+				inFlight:     true,
+			}, packetSpaceApplication)
+		}
+		return x
+	}
+	ackTime := now.Add(2 * time.Second)
+
+	x := newRecovery(true)
+	var ranges rangeSet
+	ranges.push(6, 6)
+	x.onAckReceived(ranges, 0, nil, packetSpaceApplication, ackTime)
+	if x.cc.CongestionWindow() != minimumWindow {
+		t.Fatalf("expect congestionWindow: %v, actual: %v", minimumWindow, x.cc.CongestionWindow())
+	}
+	// An acknowledged packet in between ends the congestion period.
+	x = newRecovery(true)
+	ranges = ranges[:0]
+	ranges.push(3, 3)
+	ranges.push(6, 6)
+	x.onAckReceived(ranges, 0, nil, packetSpaceApplication, ackTime)
+	if cwnd := x.cc.CongestionWindow(); cwnd == minimumWindow || cwnd >= initialWindow {
+		t.Fatalf("expect congestionWindow reduced, actual: %v", cwnd)
+	}
+	// A packet declared lost earlier does not end the congestion period.
+	x = newRecovery(true)
+	x.onPacketsLost([]uint64{3}, packetSpaceApplication, now.Add(time.Second))
+	ranges = ranges[:0]
+	ranges.push(6, 6)
+	x.onAckReceived(ranges, 0, nil, packetSpaceApplication, ackTime)
+	if x.cc.CongestionWindow() != minimumWindow {
+		t.Fatalf("expect congestionWindow: %v, actual: %v", minimumWindow, x.cc.CongestionWindow())
+	}
+	// Packets sent before the first RTT sample are not considered.
+	x = newRecovery(false)
+	ranges = ranges[:0]
+	ranges.push(6, 6)
+	x.onAckReceived(ranges, 0, nil, packetSpaceApplication, ackTime)
+	if cwnd := x.cc.CongestionWindow(); cwnd == minimumWindow || cwnd >= initialWindow {
+		t.Fatalf("expect congestionWindow reduced, actual: %v", cwnd)
+	}
+}
+
+type testRateSampler struct {
+	newReno
+	samples []RateSample
+}
+
+func (s *testRateSampler) OnRateSample(rs *RateSample, now time.Time) {
+	s.samples = append(s.samples, *rs)
+}
+
+func TestRecoveryRateSample(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	cc := &testRateSampler{}
+	cc.Reset()
+	x := lossRecovery{cc: cc}
+	x.init(now)
+	x.peerCompletedAddressValidation = true
+	send := func(pn uint64, tm time.Time) {
+		x.onPacketSent(&outgoingPacket{
+			packetNumber: pn,
+			frames:       []frame{&pingFrame{}},
+			timeSent:     tm,
+			size:         1000,
+			ackEliciting: true,
+			inFlight:     true,
+		}, packetSpaceApplication)
+	}
+	for i := uint64(0); i < 10; i++ {
+		send(i, now)
+	}
+	now = now.Add(100 * time.Millisecond)
+	var ranges rangeSet
+	ranges.push(0, 9)
+	x.onAckReceived(ranges, 0, nil, packetSpaceApplication, now)
+	if len(cc.samples) != 1 {
+		t.Fatalf("expect 1 rate sample, actual: %v", cc.samples)
+	}
+	rs := cc.samples[0]
+	if rs.Delivered != 10000 || rs.Interval != 100*time.Millisecond || rs.DeliveryRate != 100000 ||
+		rs.RTT != 100*time.Millisecond || rs.AppLimited || rs.TotalDelivered != 10000 {
+		t.Fatalf("unexpected rate sample: %+v", rs)
+	}
+	// Application-limited samples are marked.
+	x.onAppLimited()
+	send(10, now)
+	now = now.Add(100 * time.Millisecond)
+	ranges = ranges[:0]
+	ranges.push(10, 10)
+	x.onAckReceived(ranges, 0, nil, packetSpaceApplication, now)
+	rs = cc.samples[1]
+	if !rs.AppLimited || rs.Delivered != 1000 || rs.PriorDelivered != 10000 {
+		t.Fatalf("unexpected rate sample: %+v", rs)
+	}
+	if x.appLimited != 0 {
+		t.Fatalf("expect app limited period ended: %v", x.appLimited)
+	}
+}
+
+func TestRecoveryECN(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	x := lossRecovery{}
+	x.init(now)
+	x.peerCompletedAddressValidation = true
+	var pn uint64
+	send := func() {
+		x.onPacketSent(&outgoingPacket{
+			packetNumber: pn,
+			frames:       []frame{&pingFrame{}},
+			timeSent:     now,
+			size:         1000,
+			ackEliciting: true,
+			inFlight:     true,
+			ecn:          x.ecn.canMark(),
+		}, packetSpaceApplication)
+		pn++
+	}
+	ack := func(counts *ecnCounts) {
+		now = now.Add(100 * time.Millisecond)
+		var ranges rangeSet
+		ranges.push(0, pn-1)
+		x.onAckReceived(ranges, 0, counts, packetSpaceApplication, now)
+	}
+	for i := 0; i < ecnTestingPackets; i++ {
+		send()
+	}
+	if x.ecn.state != ecnUnknown || x.ecn.canMark() {
+		t.Fatalf("expect ecn unknown after testing: %v", x.ecn.state)
+	}
+	ack(&ecnCounts{ect0: ecnTestingPackets})
+	if x.ecn.state != ecnCapable || !x.ecn.canMark() {
+		t.Fatalf("expect ecn capable: %v", x.ecn.state)
+	}
+	// CE mark is a congestion signal.
+	send()
+	cwnd := x.cc.CongestionWindow()
+	ack(&ecnCounts{ect0: ecnTestingPackets, ce: 1})
+	if x.cc.CongestionWindow() >= cwnd {
+		t.Fatalf("expect congestion window reduced from %v: %v", cwnd, x.cc.CongestionWindow())
+	}
+	// Counts must cover newly acknowledged marked packets.
+	send()
+	ack(&ecnCounts{ect0: ecnTestingPackets, ce: 1})
+	if x.ecn.state != ecnFailed || x.ecn.canMark() {
+		t.Fatalf("expect ecn failed: %v", x.ecn.state)
+	}
+	// Validation restarts on a new path.
+	x.resetCongestion()
+	if x.ecn.state != ecnTesting {
+		t.Fatalf("expect ecn testing: %v", x.ecn.state)
+	}
+	send()
+	ack(nil)
+	if x.ecn.state != ecnFailed {
+		t.Fatalf("expect ecn failed without counts: %v", x.ecn.state)
+	}
+}
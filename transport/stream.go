@@ -3,6 +3,14 @@ package transport
 import (
 	"fmt"
 	"io"
+	"sort"
+)
+
+// Stream priority urgency levels.
+// https://www.rfc-editor.org/rfc/rfc9218.html#name-urgency
+const (
+	maxStreamUrgency     = 7
+	defaultStreamUrgency = 3
 )
 
 // Stream is a data stream.
@@ -18,14 +26,37 @@ type Stream struct {
 	connFlow *flowControl
 	// Whether this stream needs to send MAX_STREAM_DATA
 	updateMaxData bool
+	// Whether this stream needs to send RESET_STREAM or STOP_SENDING
+	updateReset       bool
+	updateStopSending bool
 
 	local bool
 	bidi  bool
+
+	// Sending priority. Streams with lower urgency are sent first.
+	urgency     uint8
+	incremental bool
+	// sendSeq orders incremental streams of the same urgency in round-robin.
+	sendSeq uint64
 }
 
 func (s *Stream) init(local, bidi bool) {
 	s.local = local
 	s.bidi = bidi
+	s.urgency = defaultStreamUrgency
+}
+
+// SetPriority sets urgency from 0 (highest) to 7 (lowest) and whether data can be sent
+// incrementally, interleaving with other incremental streams of the same urgency.
+// Non-incremental streams are sent one by one in order of stream ID.
+// https://www.rfc-editor.org/rfc/rfc9218.html#name-priority-parameters
+func (s *Stream) SetPriority(urgency uint8, incremental bool) error {
+	if urgency > maxStreamUrgency {
+		return newError(InternalError, sprint("invalid urgency ", urgency))
+	}
+	s.urgency = urgency
+	s.incremental = incremental
+	return nil
 }
 
 // pushRecv checks for maximum data can be received and pushes data to recv stream.
@@ -37,6 +68,9 @@ func (s *Stream) pushRecv(data []byte, offset uint64, fin bool) error {
 	if err == nil {
 		// Keep flow received bytes in sync with maximum absolute offset of the stream.
 		s.flow.setRecv(s.recv.length)
+		if s.recv.stopped {
+			s.discardRecv()
+		}
 	}
 	return err
 }
@@ -45,26 +79,45 @@ func (s *Stream) pushRecv(data []byte, offset uint64, fin bool) error {
 func (s *Stream) Read(b []byte) (int, error) {
 	n, err := s.recv.Read(b)
 	if n > 0 {
-		// A receiver could use the current offset of data consumed to determine the
-		// flow control offset to be advertised.
-		s.flow.addMaxRecvNext(uint64(n))
-		if s.connFlow != nil {
-			s.connFlow.addMaxRecvNext(uint64(n))
-		}
-		// Only tell peer to update max data when the stream is consumed.
-		if !s.recv.fin && s.flow.shouldUpdateMaxRecv() {
-			s.updateMaxData = true
-		}
+		s.consumeRecv(uint64(n))
 	}
 	return n, err
 }
 
+// consumeRecv gives back flow control credit of n bytes consumed from recv stream.
+func (s *Stream) consumeRecv(n uint64) {
+	// A receiver could use the current offset of data consumed to determine the
+	// flow control offset to be advertised.
+	s.flow.addMaxRecvNext(n)
+	if s.connFlow != nil {
+		s.connFlow.addMaxRecvNext(n)
+	}
+	// Only tell peer to update max data when the stream is consumed.
+	if !s.recv.fin && s.flow.shouldUpdateMaxRecv() {
+		s.updateMaxData = true
+	}
+}
+
+// discardRecv drops data which has not been read as if it was consumed.
+func (s *Stream) discardRecv() {
+	if n := s.recv.discard(); n > 0 {
+		s.consumeRecv(n)
+	}
+}
+
 // Write writes data to send stream.
 func (s *Stream) Write(b []byte) (int, error) {
 	if !s.bidi && !s.local {
 		return 0, newError(StreamStateError, "cannot write to uni stream")
 	}
-	if s.flow.canSend() < uint64(len(b)) {
+	if s.send.reset {
+		return 0, newError(StreamStateError, "stream reset")
+	}
+	if n := s.flow.canSend(); n < uint64(len(b)) {
+		if n == 0 {
+			// Peer is notified with STREAM_DATA_BLOCKED only when the limit is reached.
+			s.flow.setBlocked()
+		}
 		return 0, errFlowControl
 	}
 	n, err := s.send.Write(b)
@@ -104,6 +157,54 @@ func (s *Stream) Close() error {
 	return nil
 }
 
+// Reset abruptly terminates the sending part of the stream. Data which has not been sent
+// is discarded and peer is notified with RESET_STREAM carrying the error code.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-operations-on-streams
+func (s *Stream) Reset(code uint64) error {
+	if !s.bidi && !s.local {
+		return newError(StreamStateError, "cannot reset uni stream")
+	}
+	s.resetSend(code)
+	return nil
+}
+
+// resetSend resets the sending part unless it has been reset or all data has been acknowledged.
+func (s *Stream) resetSend(code uint64) {
+	if s.send.reset || s.send.complete() {
+		return
+	}
+	s.send.abort(code)
+	s.flow.setSend(s.send.length)
+	s.updateReset = true
+}
+
+// StopSending requests peer to stop sending data on the stream. Data which has not been read
+// is discarded, as well as data received later.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-operations-on-streams
+func (s *Stream) StopSending(code uint64) error {
+	if !s.bidi && s.local {
+		return newError(StreamStateError, "cannot stop sending uni stream")
+	}
+	if s.recv.stopped {
+		return nil
+	}
+	s.recv.stopped = true
+	s.recv.stopCode = code
+	// Not needed when all data has been read or the stream has been reset by peer.
+	s.updateStopSending = !s.recv.isFin()
+	s.discardRecv()
+	return nil
+}
+
+// isClosed returns true when both receiving and sending parts have reached a terminal state,
+// i.e. all data has been read by application and all sent data has been acknowledged.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-stream-states
+func (s *Stream) isClosed() bool {
+	recvClosed := (s.local && !s.bidi) || s.recv.isFin()
+	sendClosed := (!s.local && !s.bidi) || s.send.complete() || s.send.resetAcked
+	return recvClosed && sendClosed
+}
+
 func (s *Stream) String() string {
 	return fmt.Sprintf("recv{%s} send{%s}", &s.recv, &s.send)
 }
@@ -116,6 +217,9 @@ type recvStream struct {
 	length uint64 // total length
 
 	fin bool
+	// Application has requested peer to stop sending.
+	stopped  bool
+	stopCode uint64
 }
 
 func (s *recvStream) push(data []byte, offset uint64, fin bool) error {
@@ -170,6 +274,14 @@ func (s *recvStream) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// discard drops all data buffered and returns number of bytes skipped.
+func (s *recvStream) discard() uint64 {
+	s.buf.shift(len(s.buf))
+	n := s.length - s.offset
+	s.offset = s.length
+	return n
+}
+
 func (s *recvStream) isFin() bool {
 	return s.fin && s.offset >= s.length
 }
@@ -187,6 +299,10 @@ type sendStream struct {
 	length uint64 // total length
 
 	fin bool
+	// Stream has been reset with the error code, and peer has acknowledged it.
+	reset      bool
+	resetCode  uint64
+	resetAcked bool
 }
 
 // push would only be called directly when it needs to bypass flow control.
@@ -250,13 +366,41 @@ func (s *sendStream) ack(offset, length uint64) {
 
 // complete returns true if all data in the stream has been sent.
 func (s *sendStream) complete() bool {
-	return s.fin && s.offset >= s.length && s.acked.equals(0, s.length)
+	return !s.reset && s.fin && s.offset >= s.length && s.acked.equals(0, s.length)
 }
 
+// abort discards data not yet sent. The final size of the stream is the offset sent.
+func (s *sendStream) abort(code uint64) {
+	s.buf.shift(len(s.buf))
+	s.length = s.offset
+	s.fin = true
+	s.reset = true
+	s.resetCode = code
+}
+
+// MaxStreamsPolicy decides when peer is given credit to open more streams with
+// MAX_STREAMS frames as its streams are closed.
+// https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#name-controlling-concurrency
+type MaxStreamsPolicy uint8
+
+// Supported MaxStreamsPolicy.
+const (
+	// MaxStreamsWindow keeps the number of concurrent peer streams at the initial limit.
+	// MAX_STREAMS is sent when peer has less than half of the initial limit left.
+	MaxStreamsWindow MaxStreamsPolicy = iota
+	// MaxStreamsEach sends MAX_STREAMS every time a peer stream is closed.
+	MaxStreamsEach
+	// MaxStreamsFixed never sends MAX_STREAMS so peer can only open the initial number of streams.
+	MaxStreamsFixed
+)
+
 /// streamMap keeps track of QUIC streams and enforces stream limits.
 type streamMap struct {
 	// Streams indexed by stream ID
 	streams map[uint64]*Stream
+	// closed contains stream numbers (ID >> 2) of removed streams indexed by stream type (ID & 0x3),
+	// so that frames received late for these streams are ignored.
+	closed [4]rangeSet
 
 	openedStreams struct {
 		peerBidi  uint64
@@ -272,12 +416,29 @@ type streamMap struct {
 		localBidi uint64
 		localUni  uint64
 	}
+
+	// Number of removed peer streams, which are given back to peer as credit.
+	closedPeerBidi uint64
+	closedPeerUni  uint64
+	// Initial limits of peer streams.
+	initialMaxBidi uint64
+	initialMaxUni  uint64
+	// Whether MAX_STREAMS needs to be sent again because it was lost.
+	updateMaxStreamsBidi bool
+	updateMaxStreamsUni  bool
+	policy               MaxStreamsPolicy
+
+	// sendQueue is reused to order flushable streams by priority.
+	sendQueue []uint64
+	sendSeq   uint64
 }
 
 func (s *streamMap) init(maxBidi, maxUni uint64) {
 	s.streams = make(map[uint64]*Stream)
 	s.maxStreams.localBidi = maxBidi
 	s.maxStreams.localUni = maxUni
+	s.initialMaxBidi = maxBidi
+	s.initialMaxUni = maxUni
 }
 
 func (s *streamMap) get(id uint64) *Stream {
@@ -350,6 +511,127 @@ func (s *streamMap) hasFlushable() bool {
 	return false
 }
 
+// hasUpdate returns true if any stream needs to send RESET_STREAM, STOP_SENDING
+// or STREAM_DATA_BLOCKED.
+func (s *streamMap) hasUpdate() bool {
+	for _, st := range s.streams {
+		if st.updateReset || st.updateStopSending || st.flow.blocked {
+			return true
+		}
+	}
+	return false
+}
+
+// isClosed returns true if the stream has been removed.
+func (s *streamMap) isClosed(id uint64) bool {
+	return s.closed[id&0x3].contains(id >> 2)
+}
+
+// remove deletes the stream and remembers it as closed.
+func (s *streamMap) remove(id uint64) {
+	st := s.streams[id]
+	if st == nil {
+		return
+	}
+	delete(s.streams, id)
+	s.closed[id&0x3].push(id>>2, id>>2)
+	if !st.local {
+		if st.bidi {
+			s.closedPeerBidi++
+		} else {
+			s.closedPeerUni++
+		}
+	}
+}
+
+// localMaxStreamsNext returns the new limit of peer streams to be sent in MAX_STREAMS
+// or zero if it does not need to be updated.
+func (s *streamMap) localMaxStreamsNext(bidi bool) uint64 {
+	max, opened, next, initial := s.maxStreams.localUni, s.openedStreams.peerUni,
+		s.initialMaxUni+s.closedPeerUni, s.initialMaxUni
+	update := s.updateMaxStreamsUni
+	if bidi {
+		max, opened, next, initial = s.maxStreams.localBidi, s.openedStreams.peerBidi,
+			s.initialMaxBidi+s.closedPeerBidi, s.initialMaxBidi
+		update = s.updateMaxStreamsBidi
+	}
+	if next > max {
+		switch s.policy {
+		case MaxStreamsWindow:
+			if (max-opened)*2 < initial {
+				return next
+			}
+		case MaxStreamsEach:
+			return next
+		}
+	}
+	if update {
+		return max
+	}
+	return 0
+}
+
+func (s *streamMap) localMaxStreams(bidi bool) uint64 {
+	if bidi {
+		return s.maxStreams.localBidi
+	}
+	return s.maxStreams.localUni
+}
+
+func (s *streamMap) setUpdateMaxStreams(bidi bool) {
+	if bidi {
+		s.updateMaxStreamsBidi = true
+	} else {
+		s.updateMaxStreamsUni = true
+	}
+}
+
+// commitMaxStreams sets the limit of peer streams after sending MAX_STREAMS.
+func (s *streamMap) commitMaxStreams(v uint64, bidi bool) {
+	if bidi {
+		s.setLocalMaxStreamsBidi(v)
+		s.updateMaxStreamsBidi = false
+	} else {
+		s.setLocalMaxStreamsUni(v)
+		s.updateMaxStreamsUni = false
+	}
+}
+
+// flushable returns IDs of streams having data to send in priority order.
+// Within the same urgency, non-incremental streams come first in order of stream ID,
+// then incremental streams in round-robin.
+// https://www.rfc-editor.org/rfc/rfc9218.html#name-server-scheduling
+func (s *streamMap) flushable() []uint64 {
+	s.sendQueue = s.sendQueue[:0]
+	for id, st := range s.streams {
+		if st.isFlushable() {
+			s.sendQueue = append(s.sendQueue, id)
+		}
+	}
+	sort.Slice(s.sendQueue, func(i, j int) bool {
+		a, b := s.streams[s.sendQueue[i]], s.streams[s.sendQueue[j]]
+		if a.urgency != b.urgency {
+			return a.urgency < b.urgency
+		}
+		if a.incremental != b.incremental {
+			return !a.incremental
+		}
+		if a.incremental && a.sendSeq != b.sendSeq {
+			return a.sendSeq < b.sendSeq
+		}
+		return s.sendQueue[i] < s.sendQueue[j]
+	})
+	return s.sendQueue
+}
+
+// onSent moves an incremental stream to the end of its urgency level after sending data.
+func (s *streamMap) onSent(st *Stream) {
+	if st.incremental {
+		s.sendSeq++
+		st.sendSeq = s.sendSeq
+	}
+}
+
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#stream-id
 // Client-initiated streams have even-numbered stream IDs (with the bit set to 0),
 // and server-initiated streams have odd-numbered stream IDs (with the bit set to 1).
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"io"
+	"reflect"
 	"testing"
 )
 
@@ -76,6 +77,73 @@ func TestStreamSend(t *testing.T) {
 	}
 }
 
+func TestStreamReset(t *testing.T) {
+	s := Stream{}
+	s.init(true, true)
+	s.flow.init(10, 10)
+	if _, err := s.Write([]byte("sendstream")); err != nil {
+		t.Fatal(err)
+	}
+	s.popSend(4)
+	if err := s.Reset(5); err != nil {
+		t.Fatal(err)
+	}
+	if s.isFlushable() || !s.updateReset || s.send.length != 4 || s.send.resetCode != 5 {
+		t.Fatalf("expect stream reset with final size 4: %+v", s.send)
+	}
+	if s.send.complete() {
+		t.Fatalf("expect reset stream not complete")
+	}
+	n, err := s.Write([]byte("more"))
+	if n != 0 || err == nil || err.Error() != "stream_state_error stream reset" {
+		t.Fatalf("expect write error, actual %v %v", n, err)
+	}
+	// Reset only once
+	s.updateReset = false
+	s.Reset(6)
+	if s.updateReset || s.send.resetCode != 5 {
+		t.Fatalf("expect stream not reset again: %+v", s.send)
+	}
+	s.send.resetAcked = true
+	s.recv.fin = true
+	if !s.isClosed() {
+		t.Fatalf("expect stream closed: %v", &s)
+	}
+}
+
+func TestStreamStopSending(t *testing.T) {
+	s := Stream{}
+	s.init(false, true)
+	s.flow.init(10, 10)
+	if err := s.pushRecv([]byte("recv"), 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StopSending(7); err != nil {
+		t.Fatal(err)
+	}
+	if !s.updateStopSending || s.recv.stopCode != 7 || len(s.recv.buf) != 0 || s.recv.offset != 4 {
+		t.Fatalf("expect recv data discarded: %+v", s.recv)
+	}
+	// Data received later is also discarded and flow control credit is given back.
+	if err := s.pushRecv([]byte("stream"), 4, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.recv.buf) != 0 || !s.recv.isFin() || s.flow.maxRecvNext != 20 {
+		t.Fatalf("expect recv data discarded: %+v %+v", s.recv, s.flow)
+	}
+	b := make([]byte, 10)
+	n, err := s.Read(b)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("expect read %v %v, actual %v %v", 0, io.EOF, n, err)
+	}
+	// Not for our send-only stream
+	s = Stream{}
+	s.init(true, false)
+	if err := s.StopSending(0); err == nil || err.Error() != "stream_state_error cannot stop sending uni stream" {
+		t.Fatalf("expect error, actual %v", err)
+	}
+}
+
 func TestStreamType(t *testing.T) {
 	data := []struct {
 		id     uint64
@@ -195,3 +263,95 @@ func TestStreamRemoteUni(t *testing.T) {
 		t.Fatalf("expect error %v, actual %v", errFinalSize, err)
 	}
 }
+
+func TestStreamPriority(t *testing.T) {
+	s := streamMap{}
+	s.init(10, 10)
+	s.setPeerMaxStreamsBidi(10)
+	s.setPeerMaxStreamsUni(10)
+	priorities := []struct {
+		id          uint64
+		urgency     uint8
+		incremental bool
+	}{
+		{0, 3, false},
+		{4, 3, true},
+		{8, 1, false},
+		{12, 3, true},
+		{16, 3, false},
+		{20, 7, true},
+	}
+	for _, p := range priorities {
+		st, err := s.create(p.id, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = st.SetPriority(p.urgency, p.incremental); err != nil {
+			t.Fatal(err)
+		}
+		st.flow.init(0, 100)
+		if _, err = st.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []uint64{8, 0, 16, 4, 12, 20}
+	if actual := s.flushable(); !reflect.DeepEqual(expect, actual) {
+		t.Fatalf("expect order %v, actual %v", expect, actual)
+	}
+	// Incremental stream goes to the end of its urgency after sending.
+	s.onSent(s.get(4))
+	s.onSent(s.get(0))
+	expect = []uint64{8, 0, 16, 12, 4, 20}
+	if actual := s.flushable(); !reflect.DeepEqual(expect, actual) {
+		t.Fatalf("expect order %v, actual %v", expect, actual)
+	}
+	if err := s.get(0).SetPriority(maxStreamUrgency+1, false); err == nil {
+		t.Fatal("expect error setting invalid urgency")
+	}
+}
+
+func TestStreamMapMaxStreams(t *testing.T) {
+	policies := []struct {
+		policy MaxStreamsPolicy
+		next   []uint64 // After each stream is closed
+	}{
+		{MaxStreamsWindow, []uint64{5, 6, 0, 0}},
+		{MaxStreamsEach, []uint64{5, 6, 7, 8}},
+		{MaxStreamsFixed, []uint64{0, 0, 0, 0}},
+	}
+	for _, p := range policies {
+		s := streamMap{}
+		s.init(4, 4)
+		s.policy = p.policy
+		for i := uint64(0); i < 4; i++ {
+			id := i*4 + 1 // Client-initiated bidi
+			if _, err := s.create(id, false, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := uint64(0); i < 4; i++ {
+			id := i*4 + 1
+			s.remove(id)
+			if s.get(id) != nil || !s.isClosed(id) {
+				t.Fatalf("expect stream %d closed", id)
+			}
+			if next := s.localMaxStreamsNext(true); next != p.next[i] {
+				t.Fatalf("policy %d: expect next max streams %d, actual %d", p.policy, p.next[i], next)
+			}
+			if p.next[i] > 0 {
+				s.commitMaxStreams(p.next[i], true)
+			}
+		}
+		if s.isClosed(17) || s.localMaxStreamsNext(false) != 0 {
+			t.Fatalf("expect stream 17 open and no uni max streams update")
+		}
+		s.setUpdateMaxStreams(false)
+		if next := s.localMaxStreamsNext(false); next != 4 {
+			t.Fatalf("expect max streams uni 4, actual %d", next)
+		}
+		s.commitMaxStreams(4, false)
+		if next := s.localMaxStreamsNext(false); next != 0 {
+			t.Fatalf("expect no max streams uni update, actual %d", next)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"time"
 
@@ -22,10 +23,19 @@ const (
 	paramInitialMaxStreamsUni           = 0x09
 	paramAckDelayExponent               = 0x0a
 	paramMaxAckDelay                    = 0x0b
+	paramDisableActiveMigration         = 0x0c
+	paramActiveConnectionIDLimit        = 0x0e
 	paramInitialSourceCID               = 0x0f
 	paramRetrySourceCID                 = 0x10
+	paramVersionInformation             = 0x11
+	paramMaxDatagramFrameSize           = 0x20
+	paramGreaseQUICBit                  = 0x2ab2
 )
 
+// reservedParamRandLen is the number of random bytes for a reserved transport parameter:
+// 4 for identifier, 1 for value length and up to 15 for value.
+const reservedParamRandLen = 20
+
 // Parameters is QUIC transport parameters.
 // See https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#transport-parameters
 type Parameters struct {
@@ -50,6 +60,31 @@ type Parameters struct {
 
 	AckDelayExponent uint64
 	MaxAckDelay      time.Duration
+
+	// DisableActiveMigration indicates the endpoint does not support active connection migration.
+	DisableActiveMigration bool
+
+	// ActiveConnectionIDLimit is the maximum number of connection IDs from the peer
+	// that an endpoint is willing to store.
+	ActiveConnectionIDLimit uint64
+
+	// MaxDatagramFrameSize is the maximum size of a DATAGRAM frame the endpoint is willing
+	// to receive. Zero means DATAGRAM frames are not supported.
+	// https://www.rfc-editor.org/rfc/rfc9221.html#name-transport-parameter
+	MaxDatagramFrameSize uint64
+
+	// ChosenVersion is the version used by the endpoint when sending transport parameters
+	// and AvailableVersions are the versions it supports, for compatible version negotiation.
+	// https://www.rfc-editor.org/rfc/rfc9368.html#name-version-information
+	ChosenVersion     uint32
+	AvailableVersions []uint32
+
+	// GreaseQUICBit indicates the endpoint accepts packets with the QUIC Bit cleared.
+	// https://www.rfc-editor.org/rfc/rfc9287.html
+	GreaseQUICBit bool
+
+	// grease is random bytes to add a reserved transport parameter when marshaling.
+	grease []byte
 }
 
 // https://quicwg.org/base-drafts/draft-ietf-quic-transport.html#transport-parameter-encoding
@@ -112,6 +147,14 @@ func (s *Parameters) marshal() []byte {
 		b.writeVarint(paramMaxAckDelay)
 		b.writeUint(uint64(s.MaxAckDelay / time.Millisecond))
 	}
+	if s.DisableActiveMigration {
+		b.writeVarint(paramDisableActiveMigration)
+		b.writeVarint(0) // Zero-length value
+	}
+	if s.ActiveConnectionIDLimit > 0 {
+		b.writeVarint(paramActiveConnectionIDLimit)
+		b.writeUint(s.ActiveConnectionIDLimit)
+	}
 	if len(s.InitialSourceCID) > 0 {
 		b.writeVarint(paramInitialSourceCID)
 		b.writeBytes(s.InitialSourceCID)
@@ -120,6 +163,21 @@ func (s *Parameters) marshal() []byte {
 		b.writeVarint(paramRetrySourceCID)
 		b.writeBytes(s.RetrySourceCID)
 	}
+	if s.MaxDatagramFrameSize > 0 {
+		b.writeVarint(paramMaxDatagramFrameSize)
+		b.writeUint(s.MaxDatagramFrameSize)
+	}
+	if s.ChosenVersion > 0 {
+		b.writeVarint(paramVersionInformation)
+		b.writeVersions(s.ChosenVersion, s.AvailableVersions)
+	}
+	if s.GreaseQUICBit {
+		b.writeVarint(paramGreaseQUICBit)
+		b.writeVarint(0) // Zero-length value
+	}
+	if len(s.grease) >= reservedParamRandLen {
+		b.writeReserved(s.grease)
+	}
 	return b
 }
 
@@ -183,6 +241,16 @@ func (s *Parameters) unmarshal(data []byte) bool {
 				return false
 			}
 			s.MaxAckDelay = time.Duration(v) * time.Millisecond
+		case paramDisableActiveMigration:
+			var v []byte
+			if !b.readBytes(&v) || len(v) > 0 {
+				return false
+			}
+			s.DisableActiveMigration = true
+		case paramActiveConnectionIDLimit:
+			if !b.readUint(&s.ActiveConnectionIDLimit) {
+				return false
+			}
 		case paramInitialSourceCID:
 			if !b.readBytes(&s.InitialSourceCID) {
 				return false
@@ -191,9 +259,25 @@ func (s *Parameters) unmarshal(data []byte) bool {
 			if !b.readBytes(&s.RetrySourceCID) {
 				return false
 			}
+		case paramMaxDatagramFrameSize:
+			if !b.readUint(&s.MaxDatagramFrameSize) {
+				return false
+			}
+		case paramVersionInformation:
+			if !b.readVersions(&s.ChosenVersion, &s.AvailableVersions) {
+				return false
+			}
+		case paramGreaseQUICBit:
+			var v []byte
+			if !b.readBytes(&v) || len(v) > 0 {
+				return false
+			}
+			s.GreaseQUICBit = true
 		default:
-			// Unsupported parameter
-			debug("skip unsupported transport parameter 0x%x", param)
+			// Unsupported or reserved parameter
+			if !isParamReserved(param) {
+				debug("skip unsupported transport parameter 0x%x", param)
+			}
 			var v uint64
 			if !b.readVarint(&v) || !b.skip(int(v)) {
 				return false
@@ -203,6 +287,11 @@ func (s *Parameters) unmarshal(data []byte) bool {
 	return true
 }
 
+// isParamReserved returns true for transport parameter identifiers of the form 31 * N + 27.
+func isParamReserved(param uint64) bool {
+	return param%31 == 27
+}
+
 // Each transport parameter is encoded as an (identifier, length, value) tuple.
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 // |                 Transport Parameter ID (i)                  ...
@@ -261,6 +350,28 @@ func (s *tlsExtension) readBytes(v *[]byte) bool {
 	return true
 }
 
+// readVersions reads Version Information which is a list of 32-bit versions.
+// Zero versions are invalid.
+func (s *tlsExtension) readVersions(chosen *uint32, available *[]uint32) bool {
+	var v []byte
+	if !s.readBytes(&v) || len(v) < 4 || len(v)%4 != 0 {
+		return false
+	}
+	*chosen = binary.BigEndian.Uint32(v)
+	if *chosen == 0 {
+		return false
+	}
+	*available = (*available)[:0]
+	for v = v[4:]; len(v) > 0; v = v[4:] {
+		version := binary.BigEndian.Uint32(v)
+		if version == 0 {
+			return false
+		}
+		*available = append(*available, version)
+	}
+	return true
+}
+
 // writeVarint appends integer.
 func (s *tlsExtension) writeVarint(v uint64) {
 	n := varintLen(v)
@@ -280,6 +391,27 @@ func (s *tlsExtension) writeBytes(v []byte) {
 	*s = append(*s, v...)
 }
 
+// writeVersions appends Version Information with length prefix.
+func (s *tlsExtension) writeVersions(chosen uint32, available []uint32) {
+	s.writeVarint(uint64(4 * (1 + len(available))))
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], chosen)
+	*s = append(*s, v[:]...)
+	for _, version := range available {
+		binary.BigEndian.PutUint32(v[:], version)
+		*s = append(*s, v[:]...)
+	}
+}
+
+// writeReserved appends a reserved transport parameter with identifier and value
+// taken from random bytes v, which length is at least reservedParamRandLen.
+// https://www.rfc-editor.org/rfc/rfc9000.html#name-reserved-transport-paramete
+func (s *tlsExtension) writeReserved(v []byte) {
+	n := uint64(binary.BigEndian.Uint32(v))
+	s.writeVarint(31*n + 27)
+	s.writeBytes(v[5 : 5+v[4]%16])
+}
+
 func (s *tlsExtension) skip(n int) bool {
 	b := *s
 	if len(b) < n {
@@ -297,16 +429,37 @@ type tlsHandshake struct {
 	conn      *Conn
 	tlsConfig *tls.Config
 	tlsConn   *tls13.Conn
+
+	earlyData        bool
+	earlyDataContext []byte
 }
 
 func (s *tlsHandshake) init(conn *Conn, config *tls.Config) {
 	s.conn = conn
 	s.tlsConfig = config
 	s.tlsConn = tls13.NewConn(s, s.tlsConfig, conn.isClient)
+	if !conn.isClient {
+		s.tlsConn.SetQUICTransportParamsHandler(s.handlePeerTransportParams)
+	}
+}
+
+// setEarlyData enables 0-RTT. For server, context is the transport parameters
+// remembered in session tickets, early data is rejected when they have changed.
+func (s *tlsHandshake) setEarlyData(enable bool, context []byte) {
+	s.earlyData = enable
+	s.earlyDataContext = context
+	s.tlsConn.SetEarlyData(enable, context)
+}
+
+func (s *tlsHandshake) earlyDataAccepted() bool {
+	return s.tlsConn.EarlyDataAccepted()
 }
 
 func (s *tlsHandshake) doHandshake() error {
 	err := s.tlsConn.Handshake()
+	if err, ok := err.(*Error); ok {
+		return err
+	}
 	if err != nil && err != tls13.ErrWantRead {
 		alert := uint64(s.tlsConn.Alert())
 		return newError(CryptoError+alert, err.Error())
@@ -314,10 +467,28 @@ func (s *tlsHandshake) doHandshake() error {
 	return nil
 }
 
+// doPostHandshake processes TLS messages received after the handshake has completed.
+func (s *tlsHandshake) doPostHandshake() error {
+	for {
+		err := s.tlsConn.HandlePostHandshakeMessage()
+		if err != nil {
+			if err == tls13.ErrWantRead {
+				return nil
+			}
+			alert := uint64(s.tlsConn.Alert())
+			return newError(CryptoError+alert, err.Error())
+		}
+	}
+}
+
 func (s *tlsHandshake) HandshakeComplete() bool {
 	return s.tlsConn.ConnectionState().HandshakeComplete
 }
 
+func (s *tlsHandshake) connectionState() tls.ConnectionState {
+	return s.tlsConn.ConnectionState()
+}
+
 func (s *tlsHandshake) writeSpace() packetSpace {
 	level := s.tlsConn.WriteLevel()
 	switch level {
@@ -333,6 +504,7 @@ func (s *tlsHandshake) writeSpace() packetSpace {
 
 func (s *tlsHandshake) reset() {
 	s.tlsConn = tls13.NewConn(s, s.tlsConfig, s.conn.isClient)
+	s.tlsConn.SetEarlyData(s.earlyData, s.earlyDataContext)
 }
 
 func (s *tlsHandshake) ReadRecord(level tls13.EncryptionLevel, b []byte) (int, error) {
@@ -353,7 +525,11 @@ func (s *tlsHandshake) SetReadSecret(level tls13.EncryptionLevel, readSecret []b
 	if cipher == nil {
 		return fmt.Errorf("connection not yet handshaked")
 	}
-	space.opener.init(cipher, readSecret)
+	if level == tls13.EncryptionLevelEarly {
+		space.zeroRTTOpener.init(s.conn.version, cipher, readSecret)
+	} else {
+		space.opener.init(s.conn.version, cipher, readSecret)
+	}
 	return nil
 }
 
@@ -365,15 +541,30 @@ func (s *tlsHandshake) SetWriteSecret(level tls13.EncryptionLevel, writeSecret [
 	if cipher == nil {
 		return fmt.Errorf("connection not yet handshaked")
 	}
-	space.sealer.init(cipher, writeSecret)
+	if level == tls13.EncryptionLevelEarly {
+		space.zeroRTTSealer.init(s.conn.version, cipher, writeSecret)
+	} else {
+		space.sealer.init(s.conn.version, cipher, writeSecret)
+	}
 	return nil
 }
 
 func (s *tlsHandshake) setTransportParams(params *Parameters) {
 	debug("transport params: %+v", params)
+	s.tlsConn.SetQUICTransportParamsExtension(getVersionParams(s.conn.version).paramsExtension)
 	s.tlsConn.SetQUICTransportParams(params.marshal())
 }
 
+// handlePeerTransportParams is called on server when client transport parameters are received.
+// Invalid parameters are rejected after the handshake has completed.
+func (s *tlsHandshake) handlePeerTransportParams(b []byte) error {
+	params := &Parameters{}
+	if len(b) == 0 || !params.unmarshal(b) {
+		return nil
+	}
+	return s.conn.negotiateCompatibleVersion(params)
+}
+
 func (s *tlsHandshake) peerTransportParams() *Parameters {
 	b := s.tlsConn.PeerQUICTransportParams()
 	if len(b) == 0 {
@@ -386,6 +577,20 @@ func (s *tlsHandshake) peerTransportParams() *Parameters {
 	return params
 }
 
+// sessionTransportParams returns server transport parameters remembered from
+// the resumed session, or nil when client is not sending early data.
+func (s *tlsHandshake) sessionTransportParams() *Parameters {
+	b := s.tlsConn.SessionQUICTransportParams()
+	if len(b) == 0 {
+		return nil
+	}
+	params := &Parameters{}
+	if !params.unmarshal(b) {
+		return nil
+	}
+	return params
+}
+
 func (s *tlsHandshake) packetNumberSpace(level tls13.EncryptionLevel) *packetNumberSpace {
 	space := packetSpaceFromEncryptionLevel(level)
 	return &s.conn.packetNumberSpaces[space]
@@ -397,7 +602,7 @@ func packetSpaceFromEncryptionLevel(level tls13.EncryptionLevel) packetSpace {
 		return packetSpaceInitial
 	case tls13.EncryptionLevelHandshake:
 		return packetSpaceHandshake
-	case tls13.EncryptionLevelApplication:
+	case tls13.EncryptionLevelEarly, tls13.EncryptionLevelApplication:
 		return packetSpaceApplication
 	default:
 		panic(fmt.Sprintf("unsupported encryption level: %v", level))
@@ -25,6 +25,16 @@ func TestTransportParams(t *testing.T) {
 		InitialMaxStreamDataUni:        262144,
 		InitialMaxStreamsBidi:          8,
 		InitialMaxStreamsUni:           8,
+
+		DisableActiveMigration:  true,
+		ActiveConnectionIDLimit: 4,
+
+		MaxDatagramFrameSize: 65535,
+
+		ChosenVersion:     Version1,
+		AvailableVersions: []uint32{Version1, Version2},
+
+		GreaseQUICBit: true,
 	}
 	b := testdata.DecodeHex(`
 	00050102030405
@@ -37,8 +47,13 @@ func TestTransportParams(t *testing.T) {
 	070480040000
 	080108
 	090108
+	0c00
+	0e0104
 	0f020204
-	1003030507`)
+	1003030507
+	20048000ffff
+	110c00000001000000016b3343cf
+	6ab200`)
 	encoded := tp.marshal()
 	if !bytes.Equal(b, encoded) {
 		t.Fatalf("marshal transport parameters\nexpect=%x\nactual=%x", b, encoded)
@@ -51,3 +66,40 @@ func TestTransportParams(t *testing.T) {
 		t.Fatalf("unmarshal transport parameters:\nexpect=%#v\nactual=%#v", &tp, &tp2)
 	}
 }
+
+func TestTransportParamsVersionInformation(t *testing.T) {
+	data := []string{
+		"1100",                 // Empty
+		"110200000001",         // Short
+		"110400000000",         // Zero chosen version
+		"110700000001000000",   // Incomplete available version
+		"11080000000100000000", // Zero available version
+	}
+	for _, d := range data {
+		tp := Parameters{}
+		if tp.unmarshal(testdata.DecodeHex(d)) {
+			t.Errorf("expect error unmarshal %s, actual %+v", d, &tp)
+		}
+	}
+}
+
+func TestTransportParamsGrease(t *testing.T) {
+	tp := Parameters{
+		InitialMaxData: 1024,
+		grease:         make([]byte, reservedParamRandLen),
+	}
+	b := tp.marshal()
+	// Reserved parameter 27 with empty value is derived from zero random bytes.
+	if !bytes.Equal(b, testdata.DecodeHex("04024400 1b00")) {
+		t.Fatalf("expect reserved parameter, actual %x", b)
+	}
+	tp2 := Parameters{}
+	if !tp2.unmarshal(b) || tp2.InitialMaxData != tp.InitialMaxData {
+		t.Fatalf("expect reserved parameter skipped, actual %+v", &tp2)
+	}
+	// Reserved parameters 27 and 31 * 2 + 27
+	tp2 = Parameters{}
+	if !tp2.unmarshal(testdata.DecodeHex("1b0101 04024400 4059020102")) || tp2.InitialMaxData != 1024 {
+		t.Fatalf("expect reserved parameter skipped, actual %+v", &tp2)
+	}
+}
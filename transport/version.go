@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// Supported QUIC versions.
+const (
+	// Version1 is QUIC version 1.
+	// https://www.rfc-editor.org/rfc/rfc9000.html
+	Version1 uint32 = 0x00000001
+	// VersionDraft29 is QUIC draft-29.
+	// https://tools.ietf.org/html/draft-ietf-quic-transport-29
+	VersionDraft29 uint32 = 0xff000000 + 29
+	// Version2 is QUIC version 2.
+	// https://www.rfc-editor.org/rfc/rfc9369.html
+	Version2 uint32 = 0x6b3343cf
+)
+
+// Transport parameters TLS extension codepoints.
+const (
+	tlsExtensionTransportParams      = 0x39
+	tlsExtensionTransportParamsDraft = 0xffa5
+)
+
+// versionParams contains constants which are specific to a QUIC version.
+type versionParams struct {
+	initialSalt []byte
+	// retryAEAD is AES-128-GCM with the Retry integrity key.
+	retryAEAD  cipher.AEAD
+	retryNonce []byte
+	// paramsExtension is the TLS extension codepoint for transport parameters.
+	paramsExtension uint16
+	// HKDF labels to derive packet protection keys.
+	keyLabel string
+	ivLabel  string
+	hpLabel  string
+	kuLabel  string
+	// longHeaderTypes is the Long Packet Type bits indexed by packetType
+	// (Initial, 0-RTT, Handshake and Retry).
+	longHeaderTypes [4]uint8
+}
+
+// https://www.rfc-editor.org/rfc/rfc9001.html#name-initial-secrets
+// https://www.rfc-editor.org/rfc/rfc9001.html#name-retry-packet-integrity
+var version1Params = versionParams{
+	initialSalt: []byte{
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	},
+	retryAEAD: newRetryIntegrityAEAD([]byte{
+		0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a,
+		0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e,
+	}),
+	retryNonce: []byte{
+		0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2,
+		0x23, 0x98, 0x25, 0xbb,
+	},
+	paramsExtension: tlsExtensionTransportParams,
+	keyLabel:        "quic key",
+	ivLabel:         "quic iv",
+	hpLabel:         "quic hp",
+	kuLabel:         "quic ku",
+	longHeaderTypes: [4]uint8{0, 1, 2, 3},
+}
+
+// https://www.rfc-editor.org/rfc/rfc9369.html#name-version-specific-constants
+var version2Params = versionParams{
+	initialSalt: []byte{
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	},
+	retryAEAD: newRetryIntegrityAEAD([]byte{
+		0x8f, 0xb4, 0xb0, 0x1b, 0x56, 0xac, 0x48, 0xe2,
+		0x60, 0xfb, 0xcb, 0xce, 0xad, 0x7c, 0xcc, 0x92,
+	}),
+	retryNonce: []byte{
+		0xd8, 0x69, 0x69, 0xbc, 0x2d, 0x7c, 0x6d, 0x99,
+		0x90, 0xef, 0xb0, 0x4a,
+	},
+	paramsExtension: tlsExtensionTransportParams,
+	keyLabel:        "quicv2 key",
+	ivLabel:         "quicv2 iv",
+	hpLabel:         "quicv2 hp",
+	kuLabel:         "quicv2 ku",
+	longHeaderTypes: [4]uint8{1, 2, 3, 0},
+}
+
+// https://tools.ietf.org/html/draft-ietf-quic-tls-29#section-5.2
+// https://tools.ietf.org/html/draft-ietf-quic-tls-29#section-5.8
+var versionDraft29Params = versionParams{
+	initialSalt: []byte{
+		0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97,
+		0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99,
+	},
+	retryAEAD: newRetryIntegrityAEAD([]byte{
+		0xcc, 0xce, 0x18, 0x7e, 0xd0, 0x9a, 0x09, 0xd0,
+		0x57, 0x28, 0x15, 0x5a, 0x6c, 0xb9, 0x6b, 0xe1,
+	}),
+	retryNonce: []byte{
+		0xe5, 0x49, 0x30, 0xf9, 0x7f, 0x21, 0x36, 0xf0,
+		0x53, 0x0a, 0x8c, 0x1c,
+	},
+	paramsExtension: tlsExtensionTransportParamsDraft,
+	keyLabel:        "quic key",
+	ivLabel:         "quic iv",
+	hpLabel:         "quic hp",
+	kuLabel:         "quic ku",
+	longHeaderTypes: [4]uint8{0, 1, 2, 3},
+}
+
+// getVersionParams returns constants of the given version.
+// Unknown versions, e.g. those used to force version negotiation, use QUIC version 1 constants.
+func getVersionParams(version uint32) *versionParams {
+	switch version {
+	case VersionDraft29:
+		return &versionDraft29Params
+	case Version2:
+		return &version2Params
+	default:
+		return &version1Params
+	}
+}
+
+// isVersionKnown returns true when the version is implemented.
+func isVersionKnown(version uint32) bool {
+	switch version {
+	case Version1, Version2, VersionDraft29:
+		return true
+	default:
+		return false
+	}
+}
+
+// versionSupported returns true when the version is in the list of supported versions.
+func versionSupported(versions []uint32, version uint32) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// versionCompatible returns true when a connection started with version from can be
+// switched to version to during the handshake.
+// https://www.rfc-editor.org/rfc/rfc9369.html#name-compatibility-with-quic-ver
+func versionCompatible(from, to uint32) bool {
+	switch from {
+	case Version1:
+		return to == Version2
+	case Version2:
+		return to == Version1
+	default:
+		return false
+	}
+}
+
+func newRetryIntegrityAEAD(key []byte) cipher.AEAD {
+	aes, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(aes)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}